@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The admin console is a simple line-oriented text protocol intended to be
+// used by an operator with netcat or telnet.  Each line received is a
+// command; the response is zero or more lines of output followed by a line
+// containing either "OK" or "ERROR: <reason>".
+
+var unknownAdminCommand = errors.New("unknown command; try HELP")
+var invalidAdminArguments = errors.New("invalid arguments")
+
+type adminCommand struct {
+	name    string
+	usage   string
+	handler func(args []string, out io.Writer) error
+}
+
+var adminCommands = []adminCommand{
+	{"SIMULATE FAILOVER", "<seconds> -- treat the master as down for a period; 0 ends the simulation", adminSimulateFailover},
+	{"SHOW SESSIONS", "-- list proxied sessions", adminShowSessions},
+	{"SHOW CAPTURES", "-- list wire capture rules and running captures", adminShowCaptures},
+	{"CAPTURE", "USER <name> | IP <address> | SESSION <id> | STOP -- record session wire traffic to a file", adminCapture},
+	{"SHOW METRICS", "-- show all metrics, in the Prometheus text format", adminShowMetrics},
+	{"SHOW PARAMETERS", "-- show the ParameterStatus values last reported by each backend", adminShowParameters},
+	{"SHOW BALANCER", "-- show the master, the replica policy, ring order and next candidate, weights, and selection counts", adminShowBalancer},
+	{"SHOW CAPACITY", "-- show database connection slots, queues, and wait times (databases without a [database] section under \"other\")", adminShowCapacity},
+	{"SHOW DEBUG", "-- list protocol debugging rules and debugged sessions", adminShowDebug},
+	{"SHOW STATS", "-- show per-database traffic totals since the last reset, and averages over the last stats period", adminShowStats},
+	{"RESET STATS", "-- reset the totals shown by SHOW STATS", adminResetStats},
+	{"SHOW TARPIT", "-- list client IPs with recent authentication failures, and bans", adminShowTarpit},
+	{"DRAIN", "<database> [<seconds> [<message>]] -- refuse new sessions to a database, and close its sessions after seconds if given", adminDrain},
+	{"UNDRAIN", "<database> -- accept new sessions to a drained database again", adminUndrain},
+	{"SHOW DRAINS", "-- list drained databases and their remaining sessions", adminShowDrains},
+	{"DEBUG", "USER <name> | IP <address> | SESSION <id> | STOP -- log decoded protocol messages of sessions", adminDebug},
+	{"CUTOVER", "<database> <cluster> [<seconds> [<slot>]] -- move a database to another backend cluster once its sessions are idle, optionally after a replication slot catches up", adminCutover},
+	{"CONNINFO", "<user> <database> -- show the connection strings to use through the proxy for a user and database", adminConninfo},
+}
+
+func listenAdmin(listen string) {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go handleAdminConnection(conn)
+	}
+}
+
+func handleAdminConnection(conn net.Conn) {
+	defer conn.Close()
+
+	log.Printf("admin connection from %v", conn.RemoteAddr())
+
+	scanner := bufio.NewScanner(conn)
+	out := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.EqualFold(line, "QUIT") {
+			return
+		}
+
+		log.Printf("admin command from %v: %v", conn.RemoteAddr(), line)
+		err := runAdminCommand(line, out)
+		if err != nil {
+			fmt.Fprintf(out, "ERROR: %v\n", err)
+		} else {
+			fmt.Fprintln(out, "OK")
+		}
+		if out.Flush() != nil {
+			return
+		}
+	}
+}
+
+func runAdminCommand(line string, out io.Writer) error {
+	words := strings.Fields(line)
+
+	if strings.EqualFold(words[0], "HELP") {
+		for _, cmd := range adminCommands {
+			fmt.Fprintf(out, "%v %v\n", cmd.name, cmd.usage)
+		}
+		fmt.Fprintln(out, "HELP")
+		fmt.Fprintln(out, "QUIT")
+		return nil
+	}
+
+	for _, cmd := range adminCommands {
+		nameWords := strings.Fields(cmd.name)
+		if len(words) < len(nameWords) {
+			continue
+		}
+		matched := true
+		for i, nameWord := range nameWords {
+			if !strings.EqualFold(words[i], nameWord) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return cmd.handler(words[len(nameWords):], out)
+		}
+	}
+
+	return unknownAdminCommand
+}
+
+func adminSimulateFailover(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return invalidAdminArguments
+	}
+	seconds, err := strconv.Atoi(args[0])
+	if err != nil || seconds < 0 {
+		return invalidAdminArguments
+	}
+
+	select {
+	case simulateFailoverChannel <- time.Duration(seconds) * time.Second:
+	case <-time.After(oracleRequestTimeout):
+		return oracleTimeout
+	}
+	if seconds == 0 {
+		fmt.Fprintln(out, "simulated master failure ended")
+	} else {
+		fmt.Fprintf(out, "master will be treated as down for %v seconds\n", seconds)
+	}
+	return nil
+}
+
+func adminShowSessions(args []string, out io.Writer) error {
+	for _, s := range listSessions() {
+		_, backendAddress := network(s.backend)
+		fmt.Fprintf(out, "%v client=%v listener=%v user=%v database=%v backend=%v age=%v",
+			s.id, s.clientAddr, s.frontend, s.user, s.database, backendAddress, time.Since(s.started)/time.Second*time.Second)
+		if atomic.LoadInt32(&s.twoPhase) == 1 {
+			fmt.Fprint(out, " two-phase=true")
+		}
+		fmt.Fprintln(out)
+	}
+	return nil
+}
+
+func adminCapture(args []string, out io.Writer) error {
+	return adminSessionRuleCommand(args, out, &captureRules, "wire capture",
+		(*session).startCapture, (*session).stopCapture)
+}
+
+func adminShowCaptures(args []string, out io.Writer) error {
+	for _, rule := range captureRules.list() {
+		fmt.Fprintf(out, "rule %v %v\n", strings.ToLower(rule.kind), rule.value)
+	}
+
+	for _, s := range listSessions() {
+		s.mutex.Lock()
+		if s.capture != nil {
+			fmt.Fprintf(out, "session %v -> %v\n", s.id, s.capture.file.Name())
+		}
+		s.mutex.Unlock()
+	}
+	return nil
+}
+
+func adminDebug(args []string, out io.Writer) error {
+	return adminSessionRuleCommand(args, out, &debugRules, "protocol debugging",
+		(*session).startDebug, (*session).stopDebug)
+}
+
+func adminShowDebug(args []string, out io.Writer) error {
+	for _, rule := range debugRules.list() {
+		fmt.Fprintf(out, "rule %v %v\n", strings.ToLower(rule.kind), rule.value)
+	}
+
+	for _, s := range listSessions() {
+		s.mutex.Lock()
+		if s.debug {
+			fmt.Fprintf(out, "session %v\n", s.id)
+		}
+		s.mutex.Unlock()
+	}
+	return nil
+}
+
+// Implements the USER <name> | IP <address> | SESSION <id> | STOP arguments
+// shared by the commands that enable a feature for selected sessions.
+func adminSessionRuleCommand(args []string, out io.Writer, rules *sessionRuleSet, feature string, start, stop func(*session)) error {
+	if len(args) == 1 && strings.EqualFold(args[0], "STOP") {
+		rules.clear()
+		for _, s := range listSessions() {
+			stop(s)
+		}
+		fmt.Fprintf(out, "all %v stopped\n", feature)
+		return nil
+	}
+	if len(args) != 2 {
+		return invalidAdminArguments
+	}
+
+	rule := sessionRule{strings.ToUpper(args[0]), args[1]}
+	switch rule.kind {
+	case "USER", "IP":
+	case "SESSION":
+		id, err := strconv.ParseUint(rule.value, 10, 64)
+		if err != nil {
+			return invalidAdminArguments
+		}
+		s := findSession(id)
+		if s == nil {
+			return errors.New("no such session")
+		}
+		start(s)
+		return nil
+	default:
+		return invalidAdminArguments
+	}
+
+	rules.add(rule)
+	for _, s := range listSessions() {
+		if rule.matches(s) {
+			start(s)
+		}
+	}
+	fmt.Fprintf(out, "%v enabled for sessions with %v %v\n", feature, strings.ToLower(rule.kind), rule.value)
+	return nil
+}
+
+func adminShowMetrics(args []string, out io.Writer) error {
+	writeMetrics(out)
+	return nil
+}
+
+// Lists the capacity metrics of each database.  Those of the databases
+// without a [database] section are added up under "other", whose max is the
+// limit of each of them rather than of them all.
+func adminShowCapacity(args []string, out io.Writer) error {
+	metrics.Lock()
+	var databases []string
+	for _, series := range metrics.families[databaseConnectionsMetric].series {
+		databases = append(databases, series.labelValues[0])
+	}
+	metrics.Unlock()
+	sort.Strings(databases)
+
+	for _, database := range databases {
+		fmt.Fprintf(out, "%v max=%v active=%v waiting=%v wait_p50=%.3fs wait_p95=%.3fs wait_p99=%.3fs\n",
+			database, databaseMaxConnections(database),
+			metricValue(databaseConnectionsMetric, database), metricValue(databaseQueueDepthMetric, database),
+			metricQuantile(databaseQueueWaitMetric, 0.5, database),
+			metricQuantile(databaseQueueWaitMetric, 0.95, database),
+			metricQuantile(databaseQueueWaitMetric, 0.99, database))
+	}
+	return nil
+}
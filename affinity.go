@@ -0,0 +1,63 @@
+package main
+
+import (
+	"container/ring"
+	"hash/fnv"
+	"log"
+	"math"
+	"net"
+)
+
+// With replica-affinity, replica sessions are assigned to replicas by
+// rendezvous hashing rather than in rotation, keyed on the client's address
+// (client-ip) or on the user and database (user-database), so that repeated
+// connections from the same client land on the same replica and find its
+// caches warm.  When that replica goes away, only its clients move, and they
+// come back once it returns.  Replica groups, zones and weights still apply:
+// the replica is chosen among the same candidates, and weights scale each
+// replica's share of the keys.
+
+func validateReplicaAffinity() {
+	switch cfg.Pgreplicaproxy.Replica_Affinity {
+	case "", "none", "client-ip", "user-database":
+	default:
+		log.Fatalf("replica-affinity must be none, client-ip or user-database")
+	}
+}
+
+// Returns the affinity key of a session, or "" without replica-affinity.
+func replicaAffinityKey(user, database string, addr net.Addr) string {
+	switch cfg.Pgreplicaproxy.Replica_Affinity {
+	case "client-ip":
+		return clientIP(addr)
+	case "user-database":
+		return user + "\x00" + database
+	}
+	return ""
+}
+
+// Picks the replica with the highest weighted rendezvous score for key, among
+// those in allowed unless it's nil.  Returns the ring positioned at it, or
+// nil if none is allowed.
+func stickyMember(replicas *ring.Ring, allowed map[string]bool, key string) *ring.Ring {
+	var best *ring.Ring
+	bestScore := 0.0
+	for i, r := 0, replicas; i < replicas.Len(); i, r = i+1, r.Next() {
+		backend := r.Value.(string)
+		label := backendLabel(backend)
+		if allowed != nil && !allowed[label] {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(label))
+		// A uniform value in (0, 1), so that the score is positive and finite
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -float64(backendWeight(backend)) / math.Log(u)
+		if best == nil || score > bestScore {
+			best, bestScore = r, score
+		}
+	}
+	return best
+}
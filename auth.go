@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// With proxy-terminated auth (auth-type=md5 or scram-sha-256), the proxy
+// authenticates clients against the auth-file itself, and then authenticates
+// to the backend on the client's behalf using what the exchange with the
+// client revealed: the md5 hash of the password, or the SCRAM client key.
+// Authenticating to the backend with a SCRAM client key only works when the
+// auth-file's verifier is the one stored on the backend.
+//
+// With auth-type=md5, users whose auth-file entry is a SCRAM verifier are
+// authenticated with SCRAM, as PostgreSQL does.  auth-type=ldap and jwt are
+// handled in ldap.go and jwt.go.
+
+const (
+	authenticationOk                = 0
+	authenticationCleartextPassword = 3
+	authenticationMD5Password       = 5
+	authenticationSASL              = 10
+	authenticationSASLContinue      = 11
+	authenticationSASLFinal         = 12
+)
+
+const maxAuthMessageSize = 8192
+
+var authenticationFailed = errors.New("Password authentication failed")
+var unexpectedAuthMessage = errors.New("Unexpected message during authentication")
+var backendCredentialsUnavailable = errors.New("Backend requested an authentication method that the auth-file entry can't satisfy")
+var backendCredentialsRefused = errors.New("Backend refused the credentials")
+
+// What the proxy knows about a client's password after authenticating them.
+type authCredentials struct {
+	user     string
+	password string // only if the auth-file holds the plaintext password
+	md5Hash  string // "md5" followed by the hex md5 of password and user
+	scram    *scramKeys
+
+	// The role to connect to the backend as, with the role's own
+	// credentials, when the client's credentials can't be used there
+	backendRole string
+}
+
+// Authenticates a client against the auth-file, or auth-query.  On success,
+// the client is waiting for the backend's AuthenticationOk.  channelBinding
+// is the client connection's channel binding data, if it's over TLS.
+func authenticateClient(conn io.ReadWriter, user, database string, channelBinding []byte) (*authCredentials, error) {
+	switch cfg.Pgreplicaproxy.Auth_Type {
+	case "ldap":
+		return authenticateLDAP(conn, user)
+	case "jwt":
+		return authenticateJWT(conn, user)
+	}
+	secret := authSecret(user)
+	if secret == "" && cfg.Pgreplicaproxy.Auth_Query != "" {
+		var err error
+		secret, err = queryAuthSecret(database, user)
+		if err != nil {
+			logLimited("auth-query", "auth-query for user %v: %v", user, err)
+		}
+	}
+	credentials := &authCredentials{user: user}
+
+	useSCRAM := cfg.Pgreplicaproxy.Auth_Type == "scram-sha-256" || strings.HasPrefix(secret, scramMechanism+"$")
+	switch {
+	case strings.HasPrefix(secret, scramMechanism+"$"):
+		keys, err := parseSCRAMVerifier(secret)
+		if err != nil {
+			return nil, fmt.Errorf("auth-file entry for %v: %v", user, err)
+		}
+		credentials.scram = keys
+	case strings.HasPrefix(secret, "md5") && len(secret) == 35:
+		credentials.md5Hash = secret
+	case secret != "":
+		credentials.password = secret
+		credentials.md5Hash = md5Password(secret, user)
+		if useSCRAM {
+			salt := make([]byte, 16)
+			rand.Read(salt)
+			credentials.scram = scramKeysFromPassword(secret, salt, scramIterations)
+		}
+	}
+
+	if !useSCRAM {
+		// Unknown users get a challenge too, so that they can't be told
+		// apart from wrong passwords
+		salt := make([]byte, 4)
+		rand.Read(salt)
+		writeAuthRequest(conn, authenticationMD5Password, salt)
+		response, err := readPasswordMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		password, _ := readCString(response)
+		if credentials.md5Hash == "" || password != md5Salted(credentials.md5Hash, salt) {
+			return nil, authenticationFailed
+		}
+		return credentials, nil
+	}
+
+	if credentials.scram == nil {
+		if secret != "" {
+			// An md5 hash can't be used for SCRAM
+			return nil, fmt.Errorf("auth-file entry for %v can't be used with scram-sha-256", user)
+		}
+		// A verifier that no proof matches
+		salt := make([]byte, 16)
+		rand.Read(salt)
+		credentials.scram = &scramKeys{salt: salt, iterations: scramIterations, storedKey: make([]byte, 32), serverKey: make([]byte, 32)}
+	}
+	err := scramServerExchange(conn, credentials.scram, channelBinding)
+	if err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+func scramServerExchange(conn io.ReadWriter, keys *scramKeys, channelBinding []byte) error {
+	mechanisms := scramMechanism + "\x00\x00"
+	if channelBinding != nil {
+		mechanisms = scramPlusMechanism + "\x00" + mechanisms
+	}
+	writeAuthRequest(conn, authenticationSASL, []byte(mechanisms))
+
+	response, err := readPasswordMessage(conn)
+	if err != nil {
+		return err
+	}
+	mechanism, rest := readCString(response)
+	if len(rest) < 4 {
+		return malformedSCRAMMessage
+	}
+	clientFirst := string(rest[4:])
+	var gs2Header string
+	var cbindData []byte
+	switch {
+	case mechanism == scramPlusMechanism && channelBinding != nil && strings.HasPrefix(clientFirst, tlsServerEndPointGS2Header):
+		gs2Header = tlsServerEndPointGS2Header
+		cbindData = channelBinding
+	case mechanism == scramMechanism && strings.HasPrefix(clientFirst, "n,,"):
+		gs2Header = "n,,"
+	case mechanism == scramMechanism && strings.HasPrefix(clientFirst, "y,,"):
+		if channelBinding != nil {
+			// The client supports channel binding, but didn't see it
+			// offered: the mechanism list was tampered with
+			return fmt.Errorf("SCRAM channel binding negotiation error")
+		}
+		gs2Header = "y,,"
+	default:
+		return malformedSCRAMMessage
+	}
+	clientFirstBare := clientFirst[len(gs2Header):]
+	clientNonce := scramAttributes(clientFirstBare)['r']
+	if clientNonce == "" {
+		return malformedSCRAMMessage
+	}
+
+	nonce := clientNonce + scramNonce()
+	serverFirst := fmt.Sprintf("r=%v,s=%v,i=%v", nonce, base64.StdEncoding.EncodeToString(keys.salt), keys.iterations)
+	writeAuthRequest(conn, authenticationSASLContinue, []byte(serverFirst))
+
+	response, err = readPasswordMessage(conn)
+	if err != nil {
+		return err
+	}
+	clientFinal := string(response)
+	proofIndex := strings.LastIndex(clientFinal, ",p=")
+	if proofIndex == -1 {
+		return malformedSCRAMMessage
+	}
+	clientFinalWithoutProof := clientFinal[:proofIndex]
+	attributes := scramAttributes(clientFinalWithoutProof)
+	if attributes['r'] != nonce {
+		return malformedSCRAMMessage
+	}
+	if attributes['c'] != base64.StdEncoding.EncodeToString(append([]byte(gs2Header), cbindData...)) {
+		return fmt.Errorf("SCRAM channel binding check failed")
+	}
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[proofIndex+3:])
+	if err != nil {
+		return malformedSCRAMMessage
+	}
+
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	if !keys.verifyClientProof(authMessage, proof) {
+		return authenticationFailed
+	}
+	serverFinal := "v=" + base64.StdEncoding.EncodeToString(keys.serverSignature(authMessage))
+	writeAuthRequest(conn, authenticationSASLFinal, []byte(serverFinal))
+	return nil
+}
+
+// Answers the backend's authentication requests with a client's credentials,
+// until the backend accepts them.  The backend's AuthenticationOk, or its
+// ErrorResponse, is passed on to the client.  SCRAM is bound to the backend's
+// TLS connection when the backend offers SCRAM-SHA-256-PLUS.
+func authenticateBackend(backend io.ReadWriter, client io.Writer, credentials *authCredentials) error {
+	var scramClientFirstBare, scramAuthMessage, scramNonceSent string
+	var scramCbind []byte
+	var scram *scramKeys
+	channelBinding := backendChannelBinding(backend)
+
+	for {
+		msgType, body, err := readMessage(backend)
+		if err != nil {
+			return err
+		}
+		if msgType == 'E' {
+			writeMessage(client, msgType, body)
+			return backendCredentialsRefused
+		}
+		if msgType != 'R' || len(body) < 4 {
+			return unexpectedAuthMessage
+		}
+
+		request := binary.BigEndian.Uint32(body)
+		data := body[4:]
+		switch request {
+		case authenticationOk:
+			return writeMessage(client, msgType, body)
+
+		case authenticationCleartextPassword:
+			if credentials.password == "" {
+				return backendCredentialsUnavailable
+			}
+			err = writeMessage(backend, 'p', append([]byte(credentials.password), 0))
+
+		case authenticationMD5Password:
+			if credentials.md5Hash == "" || len(data) < 4 {
+				return backendCredentialsUnavailable
+			}
+			err = writeMessage(backend, 'p', append([]byte(md5Salted(credentials.md5Hash, data[:4])), 0))
+
+		case authenticationSASL:
+			mechanism, gs2Header := scramMechanism, "n,,"
+			if channelBinding != nil && bytes.Contains(data, []byte(scramPlusMechanism+"\x00")) {
+				mechanism, gs2Header = scramPlusMechanism, tlsServerEndPointGS2Header
+			} else if !bytes.Contains(data, []byte(scramMechanism+"\x00")) {
+				return backendCredentialsUnavailable
+			} else if channelBinding != nil {
+				// Over TLS, but channel binding wasn't offered
+				gs2Header = "y,,"
+			}
+			scramCbind = []byte(gs2Header)
+			if mechanism == scramPlusMechanism {
+				scramCbind = append(scramCbind, channelBinding...)
+			}
+			if credentials.password == "" && (credentials.scram == nil || credentials.scram.clientKey == nil) {
+				return backendCredentialsUnavailable
+			}
+			scramNonceSent = scramNonce()
+			scramClientFirstBare = "n=,r=" + scramNonceSent
+			clientFirst := gs2Header + scramClientFirstBare
+			message := &bytes.Buffer{}
+			message.WriteString(mechanism)
+			message.WriteByte(0)
+			binary.Write(message, binary.BigEndian, int32(len(clientFirst)))
+			message.WriteString(clientFirst)
+			err = writeMessage(backend, 'p', message.Bytes())
+
+		case authenticationSASLContinue:
+			serverFirst := string(data)
+			attributes := scramAttributes(serverFirst)
+			salt, saltErr := base64.StdEncoding.DecodeString(attributes['s'])
+			iterations, iterationsErr := strconv.Atoi(attributes['i'])
+			if scramNonceSent == "" || !strings.HasPrefix(attributes['r'], scramNonceSent) || saltErr != nil || iterationsErr != nil || iterations < 1 {
+				return malformedSCRAMMessage
+			}
+			if credentials.password != "" {
+				scram = scramKeysFromPassword(credentials.password, salt, iterations)
+			} else if bytes.Equal(salt, credentials.scram.salt) && iterations == credentials.scram.iterations {
+				scram = credentials.scram
+			} else {
+				return fmt.Errorf("auth-file SCRAM verifier for %v doesn't match the backend's", credentials.user)
+			}
+			clientFinalWithoutProof := "c=" + base64.StdEncoding.EncodeToString(scramCbind) + ",r=" + attributes['r']
+			scramAuthMessage = scramClientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+			clientFinal := clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(scram.clientProof(scramAuthMessage))
+			err = writeMessage(backend, 'p', []byte(clientFinal))
+
+		case authenticationSASLFinal:
+			if scram == nil {
+				return malformedSCRAMMessage
+			}
+			expected := "v=" + base64.StdEncoding.EncodeToString(scram.serverSignature(scramAuthMessage))
+			if string(data) != expected {
+				return fmt.Errorf("backend's SCRAM server signature is invalid")
+			}
+
+		default:
+			return backendCredentialsUnavailable
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func md5Password(password, user string) string {
+	sum := md5.Sum([]byte(password + user))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+// The response to an AuthenticationMD5Password request, given the md5 hash of
+// the password and the request's salt.
+func md5Salted(md5Hash string, salt []byte) string {
+	sum := md5.Sum(append([]byte(md5Hash[3:]), salt...))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+func writeAuthRequest(w io.Writer, request uint32, data []byte) error {
+	body := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(body, request)
+	return writeMessage(w, 'R', append(body, data...))
+}
+
+func readPasswordMessage(r io.Reader) ([]byte, error) {
+	msgType, body, err := readMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != 'p' {
+		return nil, unexpectedAuthMessage
+	}
+	return body, nil
+}
+
+func readMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int32(binary.BigEndian.Uint32(header[1:]))
+	if length < 4 || length > maxAuthMessageSize {
+		return 0, nil, incorrectlyFormattedPacket
+	}
+	body := make([]byte, length-4)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+func writeMessage(w io.Writer, msgType byte, body []byte) error {
+	message := make([]byte, 5, 5+len(body))
+	message[0] = msgType
+	binary.BigEndian.PutUint32(message[1:], uint32(len(body)+4))
+	_, err := w.Write(append(message, body...))
+	return err
+}
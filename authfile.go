@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// The auth-file lists the users that may connect when the proxy authenticates
+// clients itself, in the same format as pgbouncer's userlist.txt: one user per
+// line, as a quoted user name followed by a quoted password.  The password
+// may be given in plaintext, as an md5 hash ("md5" followed by the hex md5 of
+// the password and user name, as in pg_authid), or as a SCRAM-SHA-256
+// verifier copied from pg_authid.  Double quotes within a quoted value are
+// written twice.  The file is reloaded whenever SIGHUP is received.
+
+var authUsers = struct {
+	sync.Mutex
+	secrets map[string]string
+}{secrets: make(map[string]string)}
+
+func setupAuthFile() {
+	switch cfg.Pgreplicaproxy.Auth_Type {
+	case "", "passthrough":
+		return
+	case "md5", "scram-sha-256":
+	case "ldap":
+		setupLDAP()
+		return
+	case "jwt":
+		setupJWT()
+		return
+	default:
+		log.Fatalf("auth-type must be passthrough, md5, scram-sha-256, ldap, or jwt")
+	}
+	if cfg.Pgreplicaproxy.Auth_File == "" {
+		if cfg.Pgreplicaproxy.Auth_Query != "" {
+			return
+		}
+		log.Fatalf("auth-type %v requires an auth-file or auth-query", cfg.Pgreplicaproxy.Auth_Type)
+	}
+
+	err := loadAuthFile(cfg.Pgreplicaproxy.Auth_File)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			err := loadAuthFile(cfg.Pgreplicaproxy.Auth_File)
+			if err != nil {
+				log.Printf("auth-file reload failed, keeping the previous users: %v", err)
+			}
+		}
+	}()
+}
+
+func loadAuthFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	secrets := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		user, rest, ok := readQuotedField(line)
+		if ok {
+			var secret string
+			secret, rest, ok = readQuotedField(strings.TrimLeft(rest, " \t"))
+			if ok && strings.TrimSpace(rest) == "" {
+				secrets[user] = secret
+				continue
+			}
+		}
+		return fmt.Errorf("%v:%v: expected \"user\" \"password\"", name, lineNumber)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	authUsers.Lock()
+	authUsers.secrets = secrets
+	authUsers.Unlock()
+	log.Printf("Loaded %v users from %v", len(secrets), name)
+	return nil
+}
+
+// Splits a double-quoted value off the front of text.
+func readQuotedField(text string) (string, string, bool) {
+	if len(text) == 0 || text[0] != '"' {
+		return "", text, false
+	}
+	var value []byte
+	for i := 1; i < len(text); i++ {
+		if text[i] != '"' {
+			value = append(value, text[i])
+		} else if i+1 < len(text) && text[i+1] == '"' {
+			value = append(value, '"')
+			i++
+		} else {
+			return string(value), text[i+1:], true
+		}
+	}
+	return "", text, false
+}
+
+// Returns the password, md5 hash, or SCRAM verifier for a user, or "" if the
+// user isn't listed in the auth-file.
+func authSecret(user string) string {
+	authUsers.Lock()
+	defer authUsers.Unlock()
+	return authUsers.secrets[user]
+}
+
+func proxyTerminatedAuth() bool {
+	authType := cfg.Pgreplicaproxy.Auth_Type
+	return authType != "" && authType != "passthrough"
+}
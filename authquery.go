@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With proxy-terminated auth, users that aren't in the auth-file can have
+// their password looked up on the master of their database instead, with
+// auth-query, as pgbouncer does: a query such as
+//
+//   SELECT usename, passwd FROM pg_shadow WHERE usename=$1
+//
+// which is given the user name and returns it with its md5 hash or SCRAM
+// verifier.  The query is run in auth-database, or else in the client's
+// database if it has a [database "name"] section, or else in the monitoring
+// database, so that clients can't have the proxy connect to databases of
+// their choosing before they've authenticated.  Each of those databases has
+// a dedicated connection on each master, as auth-user (default
+// monitor-user), whose password is auth-password, or its auth-file entry,
+// or is found in the monitoring passfile; it's closed after
+// authQueryIdleTime without use.  Users the query doesn't return, or returns
+// without a password, can't log in.
+
+var authQueryMetric = defineMetric("pgreplicaproxy_auth_queries_total", counterMetric,
+	"Password lookups made with auth-query, by result.", nil, "result")
+
+const authQueryIdleTime = 5 * time.Minute
+
+// The auth connections, by database and master.  There's at most one per
+// configured database (and auth-database, and the monitoring database) on
+// each backend.
+var authQueryConnections = struct {
+	sync.Mutex
+	dbs map[authQueryKey]*sql.DB
+}{dbs: make(map[authQueryKey]*sql.DB)}
+
+type authQueryKey struct {
+	database string
+	master   string
+}
+
+func validateAuthQuery() {
+	if cfg.Pgreplicaproxy.Auth_Query != "" && !proxyTerminatedAuth() {
+		log.Fatal("auth-query requires auth-type md5 or scram-sha-256")
+	} else if cfg.Pgreplicaproxy.Auth_Query != "" && (cfg.Pgreplicaproxy.Auth_Type == "ldap" || cfg.Pgreplicaproxy.Auth_Type == "jwt") {
+		log.Fatalf("auth-query can't be used with auth-type %v", cfg.Pgreplicaproxy.Auth_Type)
+	}
+}
+
+// Returns the md5 hash or SCRAM verifier of a user, from the master of the
+// given database, or "" if the user can't be found.
+func queryAuthSecret(database, user string) (string, error) {
+	db, err := authQueryConnectionFor(database)
+	if err != nil {
+		incMetric(authQueryMetric, "error")
+		return "", err
+	}
+
+	var name, secret sql.NullString
+	err = db.QueryRow(cfg.Pgreplicaproxy.Auth_Query, user).Scan(&name, &secret)
+	if err == sql.ErrNoRows {
+		incMetric(authQueryMetric, "not_found")
+		return "", nil
+	} else if err != nil {
+		incMetric(authQueryMetric, "error")
+		return "", fmt.Errorf("auth-query: %v", err)
+	}
+	incMetric(authQueryMetric, "found")
+	return secret.String, nil
+}
+
+// Returns the database that auth-query runs in for a client's database.
+func authQueryDatabase(database string) string {
+	if cfg.Pgreplicaproxy.Auth_Database != "" {
+		return cfg.Pgreplicaproxy.Auth_Database
+	}
+	if _, ok := cfg.Database[database]; ok {
+		return database
+	}
+	return cfg.Pgreplicaproxy.Monitor_Database
+}
+
+// Returns the auth connection for a client's database, on its current
+// master.
+func authQueryConnectionFor(database string) (*sql.DB, error) {
+	master, err := requestBackend(masterRequestChannel, databaseCluster(database), nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if master == nil {
+		return nil, fmt.Errorf("no master is available for auth-query in database %v", database)
+	}
+
+	key := authQueryKey{authQueryDatabase(database), *master}
+	authQueryConnections.Lock()
+	defer authQueryConnections.Unlock()
+	if db := authQueryConnections.dbs[key]; db != nil {
+		return db, nil
+	}
+
+	db, err := sql.Open(monitorDriver(*master), authQueryConnectionString(*master, key.database))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxIdleTime(authQueryIdleTime)
+	authQueryConnections.dbs[key] = db
+	return db, nil
+}
+
+// The monitoring connection string of a backend, as auth-user in the given
+// database (or the monitoring database, if it's ""); later keywords override
+// earlier ones.  auth-user's password is looked up like a mapped role's (see
+// usermap.go).
+func authQueryConnectionString(backend, database string) string {
+	conninfo := monitorConnectionString(backend)
+	if database != "" {
+		conninfo += " dbname=" + quoteConnectionValue(database)
+	}
+	user := cfg.Pgreplicaproxy.Auth_User
+	if user == "" {
+		// The monitor credentials
+		return conninfo
+	}
+	password := cfg.Pgreplicaproxy.Auth_Password
+	if vaultUser, vaultPassword, ok := vaultRoleCredentials(user); ok && password == "" {
+		user, password = vaultUser, vaultPassword
+	}
+	conninfo += " user=" + quoteConnectionValue(user)
+
+	if secret := authSecret(user); password == "" && !isPasswordHash(secret) {
+		password = secret
+	}
+	if password == "" {
+		o := connectionOptions(backend)
+		o.Set("user", user)
+		o.Set("dbname", database)
+		password = lookupBackendPassword(o)
+	}
+	if password != "" {
+		conninfo += " password=" + quoteConnectionValue(password)
+	}
+	return conninfo
+}
+
+// Returns whether an auth-file secret is an md5 hash or a SCRAM verifier,
+// rather than a password.
+func isPasswordHash(secret string) bool {
+	return (strings.HasPrefix(secret, "md5") && len(secret) == 35) || strings.HasPrefix(secret, scramMechanism+"$")
+}
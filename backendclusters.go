@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each [backend-cluster "name"] section puts the databases it lists on a set
+// of backends of their own, so that one proxy can front several independent
+// PostgreSQL clusters, each with its own master and replicas.  The backends
+// in [pgreplicaproxy] serve all the other databases.  Every backend belongs
+// to one cluster only.  Clusters can have their own replica-suffix, for
+// their databases, and health-check-interval, and are typically kept in
+// include files of their own.
+
+type backendCluster struct {
+	name      string
+	databases []string
+	backends  []string
+
+	// The network addresses of the backends
+	members map[string]bool
+
+	replicaSuffix       string
+	healthCheckInterval time.Duration
+}
+
+type backendClusterMap struct {
+	clusters   []*backendCluster
+	byDatabase map[string]*backendCluster
+
+	// The network addresses of the [pgreplicaproxy] backends
+	defaultMembers map[string]bool
+}
+
+var backendClusters = struct {
+	sync.Mutex
+	clusters *backendClusterMap
+}{clusters: &backendClusterMap{}}
+
+func setupBackendClusters() {
+	clusters, err := compileBackendClusters(&cfg, cfg.Pgreplicaproxy.Backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setBackendClusters(clusters)
+}
+
+func setBackendClusters(clusters *backendClusterMap) {
+	backendClusters.Lock()
+	backendClusters.clusters = clusters
+	backendClusters.Unlock()
+}
+
+func currentBackendClusters() *backendClusterMap {
+	backendClusters.Lock()
+	defer backendClusters.Unlock()
+	return backendClusters.clusters
+}
+
+// Returns the backends of [pgreplicaproxy] and of all the clusters.
+func configuredBackends() []string {
+	backends := append([]string(nil), cfg.Pgreplicaproxy.Backend...)
+	return append(backends, currentBackendClusters().backends()...)
+}
+
+// Builds the clusters of a config, given its [pgreplicaproxy] backends with
+// services and multi-host connection strings already expanded.
+func compileBackendClusters(c *config, defaultBackends []string) (*backendClusterMap, error) {
+	names := make([]string, 0, len(c.Backend_Cluster))
+	for name := range c.Backend_Cluster {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	clusters := &backendClusterMap{byDatabase: make(map[string]*backendCluster)}
+	if len(names) == 0 {
+		return clusters, nil
+	}
+
+	owners := make(map[string]string)
+	clusters.defaultMembers = make(map[string]bool)
+	for _, backend := range defaultBackends {
+		clusters.defaultMembers[backendLabel(backend)] = true
+		owners[backendLabel(backend)] = "[pgreplicaproxy]"
+	}
+
+	for _, name := range names {
+		bc := c.Backend_Cluster[name]
+		cluster := &backendCluster{name: name, databases: bc.Database, members: make(map[string]bool),
+			replicaSuffix: bc.Replica_Suffix, healthCheckInterval: bc.Health_Check_Interval.Duration}
+
+		backends, err := expandBackendServices(bc.Backend)
+		if err != nil {
+			return nil, fmt.Errorf("backend-cluster %v: %v", name, err)
+		}
+		cluster.backends, err = expandMultiHostBackends(backends)
+		if err != nil {
+			return nil, fmt.Errorf("backend-cluster %v: %v", name, err)
+		}
+		if len(cluster.backends) == 0 {
+			return nil, fmt.Errorf("backend-cluster %v: no backends", name)
+		}
+		for _, backend := range cluster.backends {
+			label := backendLabel(backend)
+			if owner, ok := owners[label]; ok {
+				return nil, fmt.Errorf("backend-cluster %v: %v is already a backend of %v", name, label, owner)
+			}
+			owners[label] = "backend-cluster " + name
+			cluster.members[label] = true
+		}
+
+		if len(cluster.databases) == 0 {
+			return nil, fmt.Errorf("backend-cluster %v: no databases", name)
+		}
+		for _, database := range cluster.databases {
+			if other, ok := clusters.byDatabase[database]; ok {
+				return nil, fmt.Errorf("backend-cluster %v: database %v is already in backend-cluster %v", name, database, other.name)
+			}
+			clusters.byDatabase[database] = cluster
+		}
+		clusters.clusters = append(clusters.clusters, cluster)
+	}
+	return clusters, nil
+}
+
+// Returns the backends of all the clusters, in config order.
+func (m *backendClusterMap) backends() []string {
+	var backends []string
+	for _, cluster := range m.clusters {
+		backends = append(backends, cluster.backends...)
+	}
+	return backends
+}
+
+// Returns the name of the cluster a backend belongs to, or "" for the
+// [pgreplicaproxy] backends.
+func (m *backendClusterMap) clusterOf(backend string) string {
+	if cluster := m.backendCluster(backend); cluster != nil {
+		return cluster.name
+	}
+	return ""
+}
+
+// Returns the cluster a backend belongs to, or nil for the [pgreplicaproxy]
+// backends.
+func (m *backendClusterMap) backendCluster(backend string) *backendCluster {
+	label := backendLabel(backend)
+	for _, cluster := range m.clusters {
+		if cluster.members[label] {
+			return cluster
+		}
+	}
+	return nil
+}
+
+// If a database name is one of a cluster's databases with the cluster's
+// replica-suffix appended, returns the database name without it.
+func clusterReplicaDatabase(dbName string) (string, bool) {
+	clusters := currentBackendClusters()
+	for _, cluster := range clusters.clusters {
+		if cluster.replicaSuffix == "" || !strings.HasSuffix(dbName, cluster.replicaSuffix) {
+			continue
+		}
+		database := dbName[:len(dbName)-len(cluster.replicaSuffix)]
+		if clusters.byDatabase[database] == cluster {
+			return database, true
+		}
+	}
+	return "", false
+}
+
+// Returns the network addresses of the backends that serve a database, or
+// nil if there are no clusters and every backend does.  A database moved by
+// CUTOVER is served by the cluster it was moved to.
+func databaseCluster(database string) map[string]bool {
+	clusters := currentBackendClusters()
+	if name, ok := cutoverCluster(database); ok {
+		if members, ok := clusters.namedClusterMembers(name); ok {
+			return members
+		}
+	}
+	if cluster, ok := clusters.byDatabase[database]; ok {
+		return cluster.members
+	}
+	return clusters.defaultMembers
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Backends can also be listed in a separate file (backend-file), one
+// connection string per line, with blank lines and lines starting with # or
+// ; ignored.  They're added to those given by backend.  The file is watched
+// for changes (see filewatch.go), and when it changes the config is reloaded
+// as on SIGHUP: new backends are monitored, and removed ones are taken out of
+// the rotation while their existing sessions carry on.
+
+func readBackendFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var backends []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		backends = append(backends, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return backends, nil
+}
+
+// Appends the backends listed in the config's backend file, if any, to the
+// given backends.
+func appendBackendFile(c *config, backends []string) ([]string, error) {
+	if c.Pgreplicaproxy.Backend_File == "" {
+		return backends, nil
+	}
+	listed, err := readBackendFile(c.Pgreplicaproxy.Backend_File)
+	if err != nil {
+		return nil, fmt.Errorf("backend-file: %v", err)
+	}
+	return append(append([]string(nil), backends...), listed...), nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// When a backend restarts or crashes, it may close its sessions' connections
+// without telling the clients why.  A session whose backend connection is
+// closed unexpectedly (not after the client's Terminate, not after an
+// ErrorResponse, and not by the proxy) has its client sent a FATAL
+// ErrorResponse with SQLSTATE 57P01 (admin_shutdown), which client libraries
+// handle as a lost connection, rather than a bare close.  The backend is also
+// marked down at once, without waiting for its next health check; its
+// monitor checks it again straight away, and it becomes available again as
+// soon as it's found up.
+
+var backendConnectionsLostMetric = defineMetric("pgreplicaproxy_backend_connections_lost_total", counterMetric,
+	"Sessions whose backend closed the connection unexpectedly.", nil, "backend")
+
+// Returns whether the backend ended the session without warning, given the
+// result of copying from it to the client.  Must be called from the goroutine
+// reading from the backend.
+func (s *session) backendClosedUnexpectedly(copyErr error) bool {
+	if copyErr != nil && !isConnectionReset(copyErr) {
+		// Most likely closed by the proxy
+		return false
+	}
+	return atomic.LoadInt32(&s.clientTerminated) == 0 && atomic.LoadInt32(&s.lastBackendMessage) != 'E'
+}
+
+func isConnectionReset(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	return ok && sysErr.Err == syscall.ECONNRESET
+}
+
+// Tells the client of a session whose backend went away that the session has
+// ended, and has the backend marked down.
+func (s *session) backendConnectionLost(clientOut io.Writer) {
+	label := backendLabel(s.backend)
+	incMetric(backendConnectionsLostMetric, label)
+	logLimited("backend lost "+label, "session %v: %v closed the connection unexpectedly; marking it down", s.id, label)
+
+	// A message cut short can't be completed, so the client will have to
+	// make do with the closed connection
+	if !s.framers[fromBackend].midMessage() {
+		clientOut.Write(fatalErrorMessage("57P01", "terminating connection because the backend server shut down"))
+	}
+	suspectBackend(s.backend)
+}
+
+func fatalErrorMessage(code, message string) []byte {
+	var body []byte
+	body = append(body, "SFATAL\x00VFATAL\x00C"+code+"\x00M"+message+"\x00\x00"...)
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = 'E'
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)+4))
+	return append(msg, body...)
+}
+
+// Has a backend's monitor mark it down and check it again straight away.
+func suspectBackend(backend string) {
+	monitoredBackends.Lock()
+	monitor, ok := monitoredBackends.monitors[backend]
+	monitoredBackends.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case monitor.suspect <- true:
+	default:
+		// Already pending
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Proxied connections to backends honour the libpq TLS parameters of the
+// backend's connection string (sslmode, sslrootcert, sslcert and sslkey), the
+// same parameters that lib/pq uses for the monitoring connections.
+// backend-sslmode and backend-sslrootcert set sslmode and sslrootcert for the
+// backends whose connection strings don't, on both kinds of connections.  As
+// in libpq, verify-ca and verify-full need an sslrootcert.
+
+var backendSSLUnsupported = errors.New("Backend server does not support SSL, but sslmode requires it")
+
+const sslRequestCode = 80877103
+
+var backendTLSConfigs = struct {
+	sync.Mutex
+	configs map[string]*tls.Config
+}{configs: make(map[string]*tls.Config)}
+
+// Opens a connection to a backend server, negotiating TLS if the backend's
+// sslmode calls for it.  Connections through a tunnel are encrypted by the
+// tunnel instead.
+func dialBackend(backend string) (net.Conn, error) {
+	return dialBackendTimeout(backend, backendConnectTimeout(backend))
+}
+
+// Like dialBackend, but connecting and negotiating TLS must finish within
+// timeout, unless it's zero.
+func dialBackendTimeout(backend string, timeout time.Duration) (net.Conn, error) {
+	if name, tunnel := backendTunnel(backend); tunnel != nil {
+		return dialTunnel(name, tunnel, backendLabel(backend), false)
+	}
+	return dialBackendDirect(backend, timeout)
+}
+
+func dialBackendDirect(backend string, timeout time.Duration) (net.Conn, error) {
+	conn, err := dialBackendSocket(backend, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	o := backendTLSOptions(backend)
+	sslmode := o.Get("sslmode")
+	if sslmode == "" {
+		sslmode = "prefer"
+	}
+	if sslmode == "disable" || sslmode == "allow" || conn.RemoteAddr().Network() == "unix" {
+		return conn, nil
+	}
+
+	config, err := backendTLSConfig(backend, o, sslmode)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	err = binary.Write(conn, binary.BigEndian, []int32{8, sslRequestCode})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response := make([]byte, 1)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if response[0] != 'S' {
+		if sslmode == "prefer" {
+			return conn, nil
+		}
+		conn.Close()
+		return nil, backendSSLUnsupported
+	}
+
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Returns a backend's connection options, with backend-sslmode and
+// backend-sslrootcert filling in the TLS parameters that it doesn't set.
+func backendTLSOptions(backend string) Values {
+	o := connectionOptions(backend)
+	if o.Get("sslmode") == "" && cfg.Pgreplicaproxy.Backend_Sslmode != "" {
+		o.Set("sslmode", cfg.Pgreplicaproxy.Backend_Sslmode)
+	}
+	if o.Get("sslrootcert") == "" && cfg.Pgreplicaproxy.Backend_Sslrootcert != "" {
+		o.Set("sslrootcert", cfg.Pgreplicaproxy.Backend_Sslrootcert)
+	}
+	return o
+}
+
+func validateBackendTLSDefaults() {
+	switch cfg.Pgreplicaproxy.Backend_Sslmode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		log.Fatalf("backend-sslmode: unsupported sslmode %q", cfg.Pgreplicaproxy.Backend_Sslmode)
+	}
+	if rootCert := cfg.Pgreplicaproxy.Backend_Sslrootcert; rootCert != "" {
+		if _, err := os.Stat(rootCert); err != nil {
+			log.Fatalf("backend-sslrootcert: %v", err)
+		}
+	}
+	for _, backends := range [][]string{cfg.Pgreplicaproxy.Backend, currentBackendClusters().backends()} {
+		if err := validateBackendTLS(backends); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Checks that the backends whose sslmode verifies certificates have an
+// sslrootcert to verify them against, rather than silently trusting the
+// system's roots, and that those that get RDS IAM tokens require TLS.
+func validateBackendTLS(backends []string) error {
+	for _, backend := range backends {
+		o := backendTLSOptions(backend)
+		err := checkBackendRootCert(o)
+		if err == nil {
+			err = checkRDSIAMSslmode(o)
+		}
+		if err != nil {
+			return fmt.Errorf("backend %v: %v", backendLabel(backend), err)
+		}
+	}
+	return nil
+}
+
+func checkBackendRootCert(o Values) error {
+	if sslmode := o.Get("sslmode"); (sslmode == "verify-ca" || sslmode == "verify-full") && o.Get("sslrootcert") == "" {
+		return fmt.Errorf("sslmode %v requires sslrootcert", sslmode)
+	}
+	return nil
+}
+
+func backendTLSConfig(backend string, o Values, sslmode string) (*tls.Config, error) {
+	backendTLSConfigs.Lock()
+	defer backendTLSConfigs.Unlock()
+
+	config, ok := backendTLSConfigs.configs[backend]
+	if ok {
+		return config, nil
+	}
+
+	config = &tls.Config{InsecureSkipVerify: true}
+
+	if err := checkBackendRootCert(o); err != nil {
+		return nil, err
+	}
+	if rootCert := o.Get("sslrootcert"); rootCert != "" {
+		pem, err := ioutil.ReadFile(rootCert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in sslrootcert %v", rootCert)
+		}
+	}
+
+	switch sslmode {
+	case "require", "prefer":
+	case "verify-ca":
+		// Verify the certificate chain, but not the host name
+		roots := config.RootCAs
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCertificateChain(rawCerts, roots, x509.ExtKeyUsageServerAuth)
+		}
+	case "verify-full":
+		config.InsecureSkipVerify = false
+		config.ServerName = o.Get("host")
+	default:
+		return nil, fmt.Errorf("unsupported sslmode %q", sslmode)
+	}
+
+	if certFile := o.Get("sslcert"); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, o.Get("sslkey"))
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	applyBackendTLSPolicy(config)
+	backendTLSConfigs.configs[backend] = config
+	return config, nil
+}
+
+// Verifies a peer's certificate chain against the given roots, without
+// checking the host name.
+func verifyCertificateChain(rawCerts [][]byte, roots *x509.CertPool, usage x509.ExtKeyUsage) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return errors.New("no certificate presented")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sync"
+)
+
+// Sessions of backup tools, recognized by their application_name, are routed
+// to backup-backend (typically a standby dedicated to backups) when it's an
+// available replica, so that bulk dumps stay off the replicas serving
+// latency-sensitive traffic.
+
+var defaultBackupApplicationNames = []string{"pg_dump*"}
+
+// The backup routing options, which may change when the config is reloaded.
+var backupRouting = struct {
+	sync.Mutex
+	applicationNames []string
+	backend          string
+}{}
+
+func setupBackupRouting() {
+	err := setBackupRouting(&cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func setBackupRouting(c *config) error {
+	applicationNames := c.Pgreplicaproxy.Backup_Application_Name
+	if len(applicationNames) == 0 {
+		applicationNames = defaultBackupApplicationNames
+	}
+	for _, pattern := range applicationNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("backup-application-name %q: %v", pattern, err)
+		}
+	}
+
+	backupRouting.Lock()
+	backupRouting.applicationNames = applicationNames
+	backupRouting.backend = c.Pgreplicaproxy.Backup_Backend
+	backupRouting.Unlock()
+	return nil
+}
+
+// Returns the network address of the backend for a session, if its startup
+// parameters identify it as a backup tool's and backup routing is
+// configured, or "" otherwise.
+func backupBackendFor(startupParameters map[string]string) string {
+	backupRouting.Lock()
+	defer backupRouting.Unlock()
+
+	applicationName := startupParameters["application_name"]
+	if backupRouting.backend == "" || applicationName == "" {
+		return ""
+	}
+	for _, pattern := range backupRouting.applicationNames {
+		if matched, _ := path.Match(pattern, applicationName); matched {
+			return backupRouting.backend
+		}
+	}
+	return ""
+}
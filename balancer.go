@@ -0,0 +1,136 @@
+package main
+
+import (
+	"container/ring"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// A snapshot of the oracle's balancing state, for debugging uneven traffic
+// distribution with the admin console's SHOW BALANCER.
+type balancerState struct {
+	master      *string
+	replicas    []string // in ring order, starting after the last one chosen
+	lastReplica string
+	selections  map[string]int64
+
+	// The replica the next request without a replica-group, cluster or
+	// affinity key would get, or "" if that isn't known in advance
+	nextReplica string
+}
+
+var balancerStateChannel = make(chan chan balancerState)
+
+// Called by the oracle.
+func newBalancerState(master *string, replicas *ring.Ring, lastReplica string, selections map[string]int64, credits map[string]int) balancerState {
+	state := balancerState{master: master, lastReplica: lastReplica, selections: make(map[string]int64)}
+	if replicas.Len() > 0 {
+		for i, r := 0, replicas.Next(); i < replicas.Len(); i, r = i+1, r.Next() {
+			state.replicas = append(state.replicas, r.Value.(string))
+		}
+	}
+	for backend, count := range selections {
+		state.selections[backend] = count
+	}
+
+	switch balancerPolicy() {
+	case "round-robin":
+		if len(state.replicas) > 0 {
+			state.nextReplica = state.replicas[0]
+		}
+	case "weighted-round-robin":
+		// As the oracle would choose, without disturbing its credits
+		trial := make(map[string]int)
+		for backend, credit := range credits {
+			trial[backend] = credit
+		}
+		if replicas.Len() > 0 {
+			state.nextReplica = nextWeightedMember(replicas, nil, trial).Value.(string)
+		}
+	}
+	return state
+}
+
+// Returns how the oracle chooses replicas for requests without a
+// replica-group or cluster.
+func balancerPolicy() string {
+	switch {
+	case cfg.Pgreplicaproxy.Replica_Affinity != "" && cfg.Pgreplicaproxy.Replica_Affinity != "none":
+		return "affinity-" + cfg.Pgreplicaproxy.Replica_Affinity
+	case cfg.Pgreplicaproxy.Response_Time_Weighting:
+		return "response-time-weighted"
+	case replicaWeightsConfigured():
+		return "weighted-round-robin"
+	}
+	return "round-robin"
+}
+
+func getBalancerState() (balancerState, error) {
+	returnChan := make(chan balancerState, 1)
+	select {
+	case balancerStateChannel <- returnChan:
+	case <-time.After(oracleRequestTimeout):
+		return balancerState{}, oracleTimeout
+	}
+	return <-returnChan, nil
+}
+
+func adminShowBalancer(args []string, out io.Writer) error {
+	state, err := getBalancerState()
+	if err != nil {
+		return err
+	}
+
+	if state.master != nil {
+		fmt.Fprintf(out, "master %v selections=%v\n", backendLabel(*state.master), state.selections[*state.master])
+	} else {
+		fmt.Fprintln(out, "master none")
+	}
+
+	fmt.Fprintf(out, "replica policy %v\n", balancerPolicy())
+
+	responseTimes.Lock()
+	averages := make(map[string]float64)
+	for backend, average := range responseTimes.averages {
+		averages[backend] = average
+	}
+	responseTimes.Unlock()
+
+	for i, replica := range state.replicas {
+		next := ""
+		if replica == state.nextReplica {
+			next = " next"
+		}
+		last := ""
+		if replica == state.lastReplica {
+			last = " last"
+		}
+		weight := "-"
+		if average, ok := averages[replica]; ok && average > 0 && cfg.Pgreplicaproxy.Response_Time_Weighting {
+			weight = fmt.Sprintf("%.1f", 1/average*float64(backendWeight(replica)))
+		} else if replicaWeightsConfigured() {
+			weight = fmt.Sprint(backendWeight(replica))
+		}
+		fmt.Fprintf(out, "replica %v position=%v selections=%v response_time=%.3fms weight=%v%v%v\n",
+			backendLabel(replica), i, state.selections[replica], averages[replica]*1000, weight, next, last)
+	}
+
+	// Backends that have been selected before, but aren't currently eligible
+	var others []string
+	for backend := range state.selections {
+		eligible := state.master != nil && *state.master == backend
+		for _, replica := range state.replicas {
+			eligible = eligible || replica == backend
+		}
+		if !eligible {
+			others = append(others, backend)
+		}
+	}
+	sort.Strings(others)
+	for _, backend := range others {
+		fmt.Fprintf(out, "ineligible %v selections=%v\n", backendLabel(backend), state.selections[backend])
+	}
+	return nil
+}
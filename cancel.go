@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// A CancelRequest is sent to the backend on a new connection of its own,
+// negotiating TLS like any other connection to it, since a backend that
+// requires TLS refuses the request otherwise.  Nobody waits for the result,
+// so the connection is given a short time, and the outcome is only counted.
+
+const cancelRequestTimeout = 5 * time.Second
+
+var cancelRequestsMetric = defineMetric("pgreplicaproxy_cancel_requests_total", counterMetric,
+	"CancelRequests sent to backends, by result.", nil, "backend", "result")
+
+func sendCancelRequest(backend string, key backendKeyDataMessage) {
+	err := writeCancelRequest(backend, key)
+	if err != nil {
+		incMetric(cancelRequestsMetric, backendLabel(backend), "failure")
+		logLimited("cancel "+backendLabel(backend), "%v: CancelRequest failed: %v", backendLabel(backend), err)
+		return
+	}
+	incMetric(cancelRequestsMetric, backendLabel(backend), "success")
+}
+
+func writeCancelRequest(backend string, key backendKeyDataMessage) error {
+	timeout := cancelRequestTimeout
+	if connectTimeout := backendConnectTimeout(backend); connectTimeout > 0 && connectTimeout < timeout {
+		timeout = connectTimeout
+	}
+
+	backendConn, err := dialBackendTimeout(backend, timeout)
+	if err != nil {
+		return err
+	}
+	defer backendConn.Close()
+
+	backendConn.SetWriteDeadline(time.Now().Add(timeout))
+	return binary.Write(backendConn, binary.BigEndian, []int32{16, 80877102, key.processId, key.secretKey})
+}
+
+// Sends a CancelRequest whose key isn't known to every backend, for the one
+// that issued the key to act on.
+func broadcastCancelRequest(key backendKeyDataMessage) {
+	logDebug("CancelRequest for unknown pid=%v will be sent to every backend", key.processId)
+	for _, backend := range currentBackends() {
+		go sendCancelRequest(backend, key)
+	}
+}
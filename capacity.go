@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Each database can be given a virtual max_connections at the proxy
+// (max-connections in its [database] section, or database-max-connections
+// for all databases).  Clients beyond it wait in a first-come-first-served
+// queue for up to database-queue-timeout, and the queue depth and wait times
+// are published as metrics for capacity planning.  As clients can name any
+// database, the metrics of databases without a [database] section are added
+// up under "other".
+
+var databaseQueueTimeout = errors.New("Timed out waiting for a connection slot for the database")
+
+const defaultDatabaseQueueTimeout = 30 * time.Second
+
+var databaseConnectionsMetric = defineMetric("pgreplicaproxy_database_connections", gaugeMetric,
+	"Client sessions currently holding a database connection slot.", nil, "database")
+var databaseQueueDepthMetric = defineMetric("pgreplicaproxy_database_queue_depth", gaugeMetric,
+	"Clients currently waiting for a database connection slot.", nil, "database")
+var databaseQueueWaitMetric = defineMetric("pgreplicaproxy_database_queue_wait_seconds", histogramMetric,
+	"Time clients waited for a database connection slot.", latencyBuckets, "database")
+var databaseQueueTimeoutsMetric = defineMetric("pgreplicaproxy_database_queue_timeouts_total", counterMetric,
+	"Clients refused after waiting too long for a database connection slot.", nil, "database")
+
+// The returnChan of an acquire message first receives whether the slot was
+// granted immediately, and if not, receives true once it's granted later.
+type acquireCapacityMessage struct {
+	database   string
+	returnChan chan bool
+}
+
+var acquireCapacityChan = make(chan acquireCapacityMessage)
+var releaseCapacityChan = make(chan string)
+var abandonCapacityChan = make(chan acquireCapacityMessage)
+
+func databaseMaxConnections(database string) int {
+	if db, ok := cfg.Database[database]; ok && db.Max_Connections > 0 {
+		return db.Max_Connections
+	}
+	return cfg.Pgreplicaproxy.Database_Max_Connections
+}
+
+// Waits for a connection slot for the database.  If the client has to wait,
+// beforeWait is called first, so that the caller can release resources that
+// other clients may need in the meantime.  Returns a function that releases
+// the slot.
+func acquireDatabaseCapacity(database string, beforeWait func()) (func(), error) {
+	if databaseMaxConnections(database) <= 0 {
+		return func() {}, nil
+	}
+
+	label := configuredDatabaseLabel(database)
+	msg := acquireCapacityMessage{database, make(chan bool, 1)}
+	acquireCapacityChan <- msg
+	release := func() { releaseCapacityChan <- database }
+
+	if <-msg.returnChan {
+		observeMetric(databaseQueueWaitMetric, 0, label)
+		return release, nil
+	}
+
+	beforeWait()
+
+	timeout := cfg.Pgreplicaproxy.Database_Queue_Timeout.Duration
+	if timeout <= 0 {
+		timeout = defaultDatabaseQueueTimeout
+	}
+	start := time.Now()
+	select {
+	case <-msg.returnChan:
+		observeMetric(databaseQueueWaitMetric, time.Since(start).Seconds(), label)
+		return release, nil
+	case <-time.After(timeout):
+		abandonCapacityChan <- msg
+		// The slot may have been granted just as we gave up
+		select {
+		case <-msg.returnChan:
+			release()
+		default:
+		}
+		observeMetric(databaseQueueWaitMetric, time.Since(start).Seconds(), label)
+		incMetric(databaseQueueTimeoutsMetric, label)
+		return nil, databaseQueueTimeout
+	}
+}
+
+// Keeps track of the connection slots in use and the clients waiting for one,
+// for each database.
+func manageDatabaseCapacity() {
+	active := make(map[string]int)
+	waiting := make(map[string][]acquireCapacityMessage)
+
+	// Adds the changes to a database's slots since they were looked at to its
+	// metrics, and forgets the database once it has none in use or waited for.
+	publish := func(database string, wasActive, wasWaiting int) {
+		label := configuredDatabaseLabel(database)
+		addMetric(databaseConnectionsMetric, float64(active[database]-wasActive), label)
+		addMetric(databaseQueueDepthMetric, float64(len(waiting[database])-wasWaiting), label)
+		if active[database] == 0 {
+			delete(active, database)
+		}
+		if len(waiting[database]) == 0 {
+			delete(waiting, database)
+		}
+	}
+
+	for {
+		select {
+		case acquire := <-acquireCapacityChan:
+			wasActive, wasWaiting := active[acquire.database], len(waiting[acquire.database])
+			if active[acquire.database] < databaseMaxConnections(acquire.database) {
+				active[acquire.database]++
+				acquire.returnChan <- true
+			} else {
+				acquire.returnChan <- false
+				waiting[acquire.database] = append(waiting[acquire.database], acquire)
+			}
+			publish(acquire.database, wasActive, wasWaiting)
+
+		case database := <-releaseCapacityChan:
+			wasActive, wasWaiting := active[database], len(waiting[database])
+			active[database]--
+			if queue := waiting[database]; len(queue) > 0 && active[database] < databaseMaxConnections(database) {
+				active[database]++
+				queue[0].returnChan <- true
+				waiting[database] = queue[1:]
+			}
+			publish(database, wasActive, wasWaiting)
+
+		case abandon := <-abandonCapacityChan:
+			wasActive, wasWaiting := active[abandon.database], len(waiting[abandon.database])
+			queue := waiting[abandon.database]
+			for i, w := range queue {
+				if w.returnChan == abandon.returnChan {
+					waiting[abandon.database] = append(queue[:i:i], queue[i+1:]...)
+					break
+				}
+			}
+			publish(abandon.database, wasActive, wasWaiting)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Wire captures record the protocol traffic of selected sessions to a file,
+// for diagnosing driver and protocol incompatibilities through the proxy.
+// Credentials are scrubbed, and each capture is bounded in size.
+
+const defaultCaptureLimit = 10 * 1024 * 1024
+const maxCapturedMessageBody = 64 * 1024
+
+var captureRules sessionRuleSet
+
+func (s *session) startCapture() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.capture != nil {
+		return
+	}
+	capture, err := newWireCapture(s)
+	if err != nil {
+		log.Printf("session %v: unable to start wire capture: %v", s.id, err)
+		return
+	}
+	log.Printf("session %v: wire capture started, writing to %v", s.id, capture.file.Name())
+	s.capture = capture
+	s.updateFramers()
+}
+
+func (s *session) stopCapture() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.capture == nil {
+		return
+	}
+	s.capture.close()
+	log.Printf("session %v: wire capture stopped", s.id)
+	s.capture = nil
+	s.updateFramers()
+}
+
+type wireCapture struct {
+	mutex   sync.Mutex
+	file    *os.File
+	out     *bufio.Writer
+	written int
+	limit   int
+}
+
+func newWireCapture(s *session) (*wireCapture, error) {
+	dir := cfg.Pgreplicaproxy.Capture_Dir
+	if dir == "" {
+		dir = "."
+	}
+	limit := cfg.Pgreplicaproxy.Capture_Limit
+	if limit <= 0 {
+		limit = defaultCaptureLimit
+	}
+
+	name := filepath.Join(dir, fmt.Sprintf("session-%v-%v.capture", s.id, time.Now().Format("20060102T150405")))
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &wireCapture{file: file, out: bufio.NewWriter(file), limit: limit}
+	_, backendAddress := network(s.backend)
+	c.printf("# pgreplicaproxy wire capture of session %v\n", s.id)
+	c.printf("# client %v, user %v, database %v, backend %v\n", s.clientAddr, s.user, s.database, backendAddress)
+	c.printf("# startup parameters:%v\n", scrubbedStartupParameters(s.startupParameters))
+	c.out.Flush()
+	return c, nil
+}
+
+// Records a single protocol message; returns false once the capture has
+// reached its size limit and should be stopped.
+func (c *wireCapture) recordMessage(direction int, msgType byte, length int32, body []byte) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return false
+	}
+
+	c.printf("%v %v %q length=%v\n", time.Now().Format(time.RFC3339Nano), directionNames[direction], msgType, length)
+	if direction == fromClient && msgType == 'p' {
+		// PasswordMessage, SASLInitialResponse, SASLResponse & GSSResponse
+		c.printf("<%v bytes of credentials scrubbed>\n", length-4)
+	} else if len(body) > 0 {
+		c.printf("%v", hex.Dump(body))
+		if int32(len(body)) < length-4 {
+			c.printf("<truncated; %v bytes not captured>\n", length-4-int32(len(body)))
+		}
+	}
+	c.out.Flush()
+
+	if c.written >= c.limit {
+		c.printf("# capture size limit reached\n")
+		return false
+	}
+	return true
+}
+
+func (c *wireCapture) printf(format string, a ...interface{}) {
+	n, _ := fmt.Fprintf(c.out, format, a...)
+	c.written += n
+}
+
+func (c *wireCapture) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file != nil {
+		c.out.Flush()
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+func scrubbedStartupParameters(parameters startupMessage) string {
+	keys := make([]string, 0, len(parameters))
+	for key := range parameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var result string
+	for _, key := range keys {
+		result += fmt.Sprintf(" %v=%q", key, redactedStartupValue(key, parameters[key]))
+	}
+	return result
+}
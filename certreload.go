@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A certReloader provides a certificate and private key loaded from files,
+// and reloads them when the files change on disk, so that certificates can
+// be rotated without restarting the proxy.  On SIGHUP, every certificate is
+// reloaded, whether or not its files' modification times have changed.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	cert    *tls.Certificate
+}
+
+// The reloaders of the certificates in use, for SIGHUP.
+var certReloaders = struct {
+	sync.Mutex
+	reloaders []interface {
+		reload() error
+	}
+}{}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	_, err := r.certificate()
+	if err == nil {
+		certReloaders.Lock()
+		certReloaders.reloaders = append(certReloaders.reloaders, r)
+		certReloaders.Unlock()
+	}
+	return r, err
+}
+
+// Reloads all the certificates in use, logging those that fail; they keep
+// their previous certificates.
+func reloadCertificates() {
+	certReloaders.Lock()
+	reloaders := certReloaders.reloaders
+	certReloaders.Unlock()
+
+	for _, r := range reloaders {
+		if err := r.reload(); err != nil {
+			log.Printf("Certificate reload failed, keeping the previous certificate: %v", err)
+		}
+	}
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("%v: %v", r.certFile, err)
+	}
+	r.mutex.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			// Probably replaced in a non-atomic way; keep using the old one
+			return r.cert, nil
+		}
+		return nil, err
+	}
+
+	if r.cert == nil || !modTime.Equal(r.modTime) {
+		cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			if r.cert != nil {
+				return r.cert, nil
+			}
+			return nil, err
+		}
+		r.cert = &cert
+		r.modTime = modTime
+	}
+	return r.cert, nil
+}
+
+// A caReloader provides a pool of CA certificates loaded from a file, and
+// reloads it when the file changes on disk.
+type caReloader struct {
+	file string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	pool    *x509.CertPool
+}
+
+func newCAReloader(file string) (*caReloader, error) {
+	r := &caReloader{file: file}
+	_, err := r.certPool()
+	if err == nil {
+		certReloaders.Lock()
+		certReloaders.reloaders = append(certReloaders.reloaders, r)
+		certReloaders.Unlock()
+	}
+	return r, err
+}
+
+func (r *caReloader) reload() error {
+	modTime, err := latestModTime(r.file)
+	if err != nil {
+		return err
+	}
+	pem, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %v", r.file)
+	}
+	r.mutex.Lock()
+	r.pool = pool
+	r.modTime = modTime
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *caReloader) certPool() (*x509.CertPool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	modTime, err := latestModTime(r.file)
+	if err != nil {
+		if r.pool != nil {
+			return r.pool, nil
+		}
+		return nil, err
+	}
+
+	if r.pool == nil || !modTime.Equal(r.modTime) {
+		pem, err := ioutil.ReadFile(r.file)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			if r.pool != nil {
+				return r.pool, nil
+			}
+			return nil, fmt.Errorf("no certificates found in %v", r.file)
+		}
+		r.pool = pool
+		r.modTime = modTime
+	}
+	return r.pool, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -check-config, pgreplicaproxy validates its config and prints the
+// topology it describes instead of starting, and exits with a non-zero
+// status if anything is wrong, eg. for CI or pre-deploy checks.  With -probe
+// as well, each backend is connected to once, and must be up.  Errors in the
+// config that stop the proxy from starting also stop the check, with the
+// same message.
+
+var checkConfigFlag = flag.Bool("check-config", false, "validate the config, print the topology, and exit")
+var probeFlag = flag.Bool("probe", false, "with -check-config, connect to each backend once")
+
+const defaultProbeTimeout = 10 * time.Second
+
+// Checks the config, after it has been through the usual setup, and returns
+// the exit status.
+func checkConfig(defaultFrontend *frontend, frontends map[string]*frontend) int {
+	failed := false
+	fail := func(format string, v ...interface{}) {
+		fmt.Printf("  ERROR: "+format+"\n", v...)
+		failed = true
+	}
+
+	fmt.Println("Listeners:")
+	var names []string
+	for name := range frontends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range append([]string{""}, names...) {
+		fe, addresses := defaultFrontend, cfg.Pgreplicaproxy.Listen
+		if name != "" {
+			fe, addresses = frontends[name], cfg.Listener[name].Listen
+		} else if len(addresses) == 0 {
+			continue
+		}
+		fmt.Printf("  %v: %v", fe.name, strings.Join(addresses, ", "))
+		if fe.readOnly {
+			fmt.Print(" (read-only)")
+		} else if fe.readWrite {
+			fmt.Print(" (read-write)")
+		}
+		if fe.tlsConfig != nil {
+			fmt.Print(" (TLS)")
+		}
+		fmt.Println()
+		if len(addresses) == 0 {
+			fail("listener %v has no listen addresses", fe.name)
+		}
+	}
+	if len(cfg.Pgreplicaproxy.Listen) == 0 && len(frontends) == 0 {
+		fail("no listen addresses are configured")
+	}
+
+	if *probeFlag && cfg.Pgreplicaproxy.Connect_Timeout.Duration <= 0 {
+		cfg.Pgreplicaproxy.Connect_Timeout.Duration = defaultProbeTimeout
+	}
+
+	fmt.Println("Backends:")
+	if len(cfg.Pgreplicaproxy.Backend) == 0 {
+		fail("no backends are configured")
+	}
+	seen := make(map[string]bool)
+	for _, backend := range configuredBackends() {
+		label := backendLabel(backend)
+		fmt.Printf("  %v", label)
+		if _, tunnel := backendTunnel(backend); tunnel != nil {
+			fmt.Printf(" (through %v)", tunnel.Address)
+		}
+		if replicaOnlyBackend(backend) {
+			fmt.Print(" (replica-only)")
+		}
+		if *probeFlag {
+			status, err := probeBackend(backend)
+			if err != nil {
+				status = fmt.Sprintf("down (%v)", err)
+				failed = true
+			}
+			fmt.Printf(": %v", status)
+		}
+		fmt.Println()
+
+		if seen[label] {
+			fail("%v is configured more than once", label)
+		}
+		seen[label] = true
+		if err := checkBackend(backend); err != nil {
+			fail("%v: %v", label, err)
+		}
+	}
+
+	for _, address := range cfg.Pgreplicaproxy.Replica_Only {
+		if !seen[address] {
+			fail("replica-only: %v isn't a configured backend", address)
+		}
+	}
+
+	if len(cfg.Tunnel) > 0 {
+		fmt.Println("Tunnels:")
+		names = nil
+		for name := range cfg.Tunnel {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			tunnel := cfg.Tunnel[name]
+			fmt.Printf("  %v: %v, backends %v\n", name, tunnel.Address, strings.Join(tunnel.Backend, ", "))
+			for _, member := range tunnel.Backend {
+				if !seen[member] {
+					fail("tunnel %v: %v isn't a configured backend", name, member)
+				}
+			}
+		}
+	}
+
+	if clusters := currentBackendClusters().clusters; len(clusters) > 0 {
+		fmt.Println("Backend clusters:")
+		for _, cluster := range clusters {
+			var labels []string
+			for _, backend := range cluster.backends {
+				labels = append(labels, backendLabel(backend))
+			}
+			fmt.Printf("  %v: %v, backends %v\n", cluster.name, strings.Join(cluster.databases, ", "), strings.Join(labels, ", "))
+		}
+	}
+
+	scheduledRoutes.Lock()
+	routes := scheduledRoutes.routes
+	scheduledRoutes.Unlock()
+	if len(routes) > 0 {
+		fmt.Println("Scheduled routes:")
+		for _, route := range routes {
+			rc := cfg.Route[route.name]
+			fmt.Printf("  %v: %v, %q, replica group %v\n", route.name, strings.Join(rc.Database, ", "), rc.Schedule, rc.Replica_Group)
+			for member := range route.members {
+				if !seen[member] {
+					fail("route %v: replica group member %v isn't a configured backend", route.name, member)
+				}
+			}
+		}
+	}
+
+	if failed {
+		fmt.Println("Config check failed")
+		return 1
+	}
+	fmt.Println("Config OK")
+	return 0
+}
+
+// Checks the parts of a backend's connection string that are only used when
+// connecting to it.
+func checkBackend(backend string) error {
+	o := connectionOptions(backend)
+	network, _ := network(backend)
+	if network == "tcp" {
+		port, err := strconv.Atoi(o.Get("port"))
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %q", o.Get("port"))
+		}
+	}
+	sslmode := o.Get("sslmode")
+	switch sslmode {
+	case "", "disable", "allow":
+	default:
+		if _, err := backendTLSConfig(backend, o, sslmode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Connects to a backend once, and returns whether it's the master or a
+// replica.
+func probeBackend(backend string) (string, error) {
+	db, err := sql.Open(monitorDriver(backend), monitorConnectionString(backend))
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var inRecovery bool
+	err = db.QueryRow("SELECT pg_is_in_recovery()").Scan(&inRecovery)
+	if err != nil {
+		return "", err
+	}
+	if inRecovery {
+		return "replica", nil
+	}
+	return "master", nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Some middleboxes (firewalls, NAT gateways, load balancers) silently drop
+// connections that have been idle for a while, TCP keepalives or not.  With
+// client-keepalive-interval, a session where neither side has sent anything
+// for that long gets a message sent to its client, which the client
+// ignores: a ParameterStatus for a parameter PostgreSQL doesn't have (the
+// default), or a NoticeResponse at DEBUG severity for clients that don't
+// accept unknown parameters, though some clients print notices.  Both are
+// messages that the protocol allows at any time, but they're only inserted
+// between the backend's messages, never in the middle of one.
+
+const clientKeepaliveCheckInterval = time.Second
+const clientKeepaliveParameter = "pgreplicaproxy.keepalive"
+
+var clientKeepalivesMetric = defineMetric("pgreplicaproxy_client_keepalives_total", counterMetric,
+	"Keepalive messages sent to idle clients.", nil)
+
+// Writes the backend's messages to the client, keeping track of where they
+// start and end, so that keepalives can be inserted between them.  writeMutex
+// is held across writes to the connection, and mutex only while the framing
+// is read or updated, so that a write blocked on a slow client doesn't hold
+// up the keepalives of other sessions.
+type clientWriter struct {
+	writeMutex sync.Mutex
+	conn       net.Conn
+
+	mutex     sync.Mutex
+	writers   int // Writes waiting for or holding writeMutex
+	header    [5]byte
+	headerLen int
+	remaining int // bytes of the current message's body still to come
+}
+
+func newClientWriter(conn net.Conn) *clientWriter {
+	return &clientWriter{conn: conn}
+}
+
+func (w *clientWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	w.writers++
+	w.mutex.Unlock()
+
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+	n, err := w.conn.Write(p)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.writers--
+	for written := p[:n]; len(written) > 0; {
+		if w.remaining > 0 {
+			skip := w.remaining
+			if skip > len(written) {
+				skip = len(written)
+			}
+			w.remaining -= skip
+			written = written[skip:]
+			continue
+		}
+		copied := copy(w.header[w.headerLen:], written)
+		w.headerLen += copied
+		written = written[copied:]
+		if w.headerLen == len(w.header) {
+			w.remaining = int(binary.BigEndian.Uint32(w.header[1:])) - 4
+			w.headerLen = 0
+		}
+	}
+	return n, err
+}
+
+// Writes a whole message, if the client isn't in the middle of receiving one
+// and no other write is under way.  The write has to finish within
+// clientKeepaliveCheckInterval; a client that can't take it by then (or
+// takes only part of it) is cut off, since the rest of the session's messages
+// can't follow a partial one.
+func (w *clientWriter) writeBetweenMessages(message []byte) bool {
+	w.mutex.Lock()
+	if w.writers > 0 || w.remaining > 0 || w.headerLen > 0 {
+		w.mutex.Unlock()
+		return false
+	}
+	w.writers++
+	w.mutex.Unlock()
+
+	w.writeMutex.Lock()
+	w.conn.SetWriteDeadline(time.Now().Add(clientKeepaliveCheckInterval))
+	_, err := w.conn.Write(message)
+	w.conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		w.conn.Close()
+	}
+	w.writeMutex.Unlock()
+
+	w.mutex.Lock()
+	w.writers--
+	w.mutex.Unlock()
+	return err == nil
+}
+
+// Writes whole messages of the proxy's own, such as a refused query's error,
+// once the client isn't in the middle of receiving one of the backend's.
+func (w *clientWriter) writeMessages(p []byte) (int, error) {
+	w.mutex.Lock()
+	w.writers++
+	w.mutex.Unlock()
+	defer func() {
+		w.mutex.Lock()
+		w.writers--
+		w.mutex.Unlock()
+	}()
+
+	for {
+		w.writeMutex.Lock()
+		w.mutex.Lock()
+		between := w.remaining == 0 && w.headerLen == 0
+		w.mutex.Unlock()
+		if between {
+			break
+		}
+		// Let the rest of the backend's message through first
+		w.writeMutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	defer w.writeMutex.Unlock()
+	return w.conn.Write(p)
+}
+
+func clientKeepaliveMessage(kind string) []byte {
+	var body []byte
+	msgType := byte('S')
+	if kind == "notice" {
+		msgType = 'N'
+		body = append(body, "SDEBUG\x00VDEBUG\x00C00000\x00Mpgreplicaproxy keepalive\x00\x00"...)
+	} else {
+		body = append(body, clientKeepaliveParameter+"\x00\x00"...)
+	}
+	message := make([]byte, 5, 5+len(body))
+	message[0] = msgType
+	binary.BigEndian.PutUint32(message[1:], uint32(len(body)+4))
+	return append(message, body...)
+}
+
+func sendClientKeepalives() {
+	for range time.Tick(clientKeepaliveCheckInterval) {
+		now := time.Now().UnixNano()
+		for _, s := range listSessions() {
+			s.mutex.Lock()
+			writer, interval, message := s.clientWriter, s.clientKeepaliveInterval, s.clientKeepaliveMessage
+			s.mutex.Unlock()
+			if writer == nil || interval <= 0 {
+				continue
+			}
+
+			lastActivity := atomic.LoadInt64(&s.lastKeepalive)
+			for direction := range s.lastActivity {
+				if last := atomic.LoadInt64(&s.lastActivity[direction]); last > lastActivity {
+					lastActivity = last
+				}
+			}
+			if now-lastActivity < int64(interval) {
+				continue
+			}
+			if writer.writeBetweenMessages(message) {
+				atomic.StoreInt64(&s.lastKeepalive, now)
+				incMetric(clientKeepalivesMetric)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+)
+
+// When ssl-cert and ssl-key are configured, clients that send an SSLRequest
+// have their connections encrypted between the client and the proxy.
+//
+// Client certificate authentication is enabled with ssl-client-cert: with
+// "verify", clients must present a certificate issued by ssl-ca; with
+// "verify-full", the certificate's common name must also match the user name
+// the client connects as.  Presented certificates are also checked for
+// revocation, if a CRL or OCSP responder is configured.
+//
+// Listeners may have their own TLS settings; these are the defaults.
+var clientTLSConfig *tls.Config
+
+var clientCertificateRequired = errors.New("A client certificate is required")
+var clientCertificateUserMismatch = errors.New("Client certificate common name does not match the user name")
+var sslRequired = errors.New("SSL connection is required")
+
+func setupClientTLS() {
+	clientTLSConfig = newClientTLSConfig(cfg.Pgreplicaproxy.Ssl_Cert, cfg.Pgreplicaproxy.Ssl_Key,
+		cfg.Pgreplicaproxy.Ssl_Ca, cfg.Pgreplicaproxy.Ssl_Client_Cert)
+}
+
+// Returns the TLS configuration for client connections, or nil if certFile
+// isn't set.
+func newClientTLSConfig(certFile, keyFile, caFile, clientCertMode string) *tls.Config {
+	if certFile == "" {
+		return nil
+	}
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.certificate()
+		},
+		NextProtos: []string{postgresqlALPN},
+	}
+
+	var ca *caReloader
+	switch clientCertMode {
+	case "", "none":
+	case "verify", "verify-full":
+		ca, err = newCAReloader(caFile)
+		if err != nil {
+			log.Fatalf("ssl-ca: %v", err)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return checkRevocation(verifiedChains)
+		}
+		setupRevocationChecking()
+	default:
+		log.Fatalf("ssl-client-cert must be none, verify, or verify-full")
+	}
+
+	applyTLSPolicy(config)
+	if ca != nil {
+		// The CA certificates are only consulted through the config, so
+		// each handshake gets a copy with the current ones
+		base := config.Clone()
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			pool, err := ca.certPool()
+			if err != nil {
+				return nil, err
+			}
+			handshakeConfig := base.Clone()
+			handshakeConfig.ClientCAs = pool
+			return handshakeConfig, nil
+		}
+	}
+	return config
+}
+
+// Checks that a client connection satisfies the client certificate
+// authentication requirements for the user it's connecting as.
+func checkClientCertificate(conn net.Conn, mode string, user string) error {
+	if mode == "" || mode == "none" {
+		return nil
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return clientCertificateRequired
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return clientCertificateRequired
+	}
+	if mode == "verify-full" && certs[0].Subject.CommonName != user {
+		return clientCertificateUserMismatch
+	}
+	return nil
+}
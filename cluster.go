@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// In cluster mode, several proxies in front of the same backends forward
+// CancelRequests to each other: a client's cancel connection may arrive at a
+// different proxy than the one its session is running through.  Proxies
+// communicate over mutual TLS, with certificates issued by a dedicated
+// cluster CA.  The certificates and CA are reloaded when they change on
+// disk.
+
+const peerTimeout = 5 * time.Second
+
+var clusterServerTLSConfig *tls.Config
+var clusterClientTLSConfig *tls.Config
+
+func clusterEnabled() bool {
+	return cfg.Pgreplicaproxy.Cluster_Listen != "" || len(cfg.Pgreplicaproxy.Peer) > 0 ||
+		cfg.Pgreplicaproxy.Tunnel_Listen != "" || len(cfg.Tunnel) > 0
+}
+
+func setupClusterTLS() {
+	if !clusterEnabled() {
+		return
+	}
+
+	certs, err := newCertReloader(cfg.Pgreplicaproxy.Cluster_Cert, cfg.Pgreplicaproxy.Cluster_Key)
+	if err != nil {
+		log.Fatalf("cluster-cert: %v", err)
+	}
+	ca, err := newCAReloader(cfg.Pgreplicaproxy.Cluster_Ca)
+	if err != nil {
+		log.Fatalf("cluster-ca: %v", err)
+	}
+
+	verifyPeer := func(usage x509.ExtKeyUsage) func([][]byte, [][]*x509.Certificate) error {
+		return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			pool, err := ca.certPool()
+			if err != nil {
+				return err
+			}
+			return verifyCertificateChain(rawCerts, pool, usage)
+		}
+	}
+
+	clusterServerTLSConfig = &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.certificate()
+		},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: verifyPeer(x509.ExtKeyUsageClientAuth),
+	}
+	applyTLSPolicy(clusterServerTLSConfig)
+
+	// Peers are identified by their certificate being issued by the cluster
+	// CA, rather than by host name.
+	clusterClientTLSConfig = &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.certificate()
+		},
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPeer(x509.ExtKeyUsageServerAuth),
+	}
+	applyTLSPolicy(clusterClientTLSConfig)
+}
+
+func listenCluster(listen string) {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln = tls.NewListener(ln, clusterServerTLSConfig)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go handlePeerConnection(conn)
+	}
+}
+
+// A peer connection carries a single CancelRequest packet, in the same format
+// a client would send it.  It's only proxied to a backend by this proxy, never
+// forwarded on to other peers.
+func handlePeerConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+
+	var packet [4]int32
+	err := binary.Read(conn, binary.BigEndian, &packet)
+	if err != nil {
+		if err != io.EOF {
+			logLimited("peer read", "peer %v: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+	if packet[0] != 16 || packet[1] != 80877102 {
+		logLimited("peer packet", "peer %v: unexpected packet", conn.RemoteAddr())
+		return
+	}
+
+	key := backendKeyDataMessage{processId: packet[2], secretKey: packet[3]}
+	if proxyCancelRequest(key) {
+		log.Printf("CancelRequest from peer %v proxied, pid=%v", conn.RemoteAddr(), key.processId)
+	}
+}
+
+// Forwards a CancelRequest whose key isn't known locally to all the peers.
+func forwardCancelRequestToPeers(key backendKeyDataMessage) {
+	for _, peer := range cfg.Pgreplicaproxy.Peer {
+		go func(peer string) {
+			dialer := &net.Dialer{Timeout: peerTimeout}
+			conn, err := tls.DialWithDialer(dialer, "tcp", peer, clusterClientTLSConfig)
+			if err != nil {
+				logLimited("peer dial "+peer, "peer %v: %v", peer, err)
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(peerTimeout))
+			binary.Write(conn, binary.BigEndian, []int32{16, 80877102, key.processId, key.secretKey})
+		}(peer)
+	}
+}
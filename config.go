@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reads the config file, the files it includes, the PGPROXY_* environment
+// variables, and the pgbouncer-ini file if any, into c, and applies the
+// sidecar defaults.  The config file may be missing if the environment
+// provides a config.
+func readConfig(c *config) error {
+	err := readConfigFile(c, *configFile)
+	if os.IsNotExist(err) && haveEnvironmentConfig() {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	err = readIncludedConfig(c, filepath.Dir(*configFile))
+	if err != nil {
+		return err
+	}
+	err = applyEnvironment(c)
+	if err != nil {
+		return err
+	}
+	if c.Pgreplicaproxy.Pgbouncer_Ini != "" {
+		err = applyPgbouncerIni(c)
+		if err != nil {
+			return err
+		}
+	}
+	return applySidecar(c)
+}
+
+// Reads the files matching the config file's include patterns, in name order
+// for each pattern, into c.  Their options are added to the config file's,
+// as if they were part of it; single-valued options that are given again
+// replace the earlier value.  Included files can't include others.
+// Relative patterns are relative to dir.
+func readIncludedConfig(c *config, dir string) error {
+	patterns := c.Pgreplicaproxy.Include
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("include %v: %v", pattern, err)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			err = readConfigFile(c, file)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	c.Pgreplicaproxy.Include = patterns
+	return nil
+}
+
+// A duration is a time.Duration that can be read from the config file in the
+// format understood by time.ParseDuration, eg. "1m30s".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// A boolean option of a section whose options default to [pgreplicaproxy]'s,
+// so that a section can turn off a global setting as well as turn it on.
+type optionalBool struct {
+	set   bool
+	value bool
+}
+
+func (b *optionalBool) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "true", "yes", "on", "1":
+		b.value = true
+	case "false", "no", "off", "0":
+		b.value = false
+	default:
+		return fmt.Errorf("invalid boolean %q", text)
+	}
+	b.set = true
+	return nil
+}
+
+// Returns the option's value, or fallback if it isn't set.
+func (b optionalBool) or(fallback bool) bool {
+	if b.set {
+		return b.value
+	}
+	return fallback
+}
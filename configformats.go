@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/gcfg"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Config files (and included files) whose names end in .toml, .yaml or .yml
+// are read as TOML or YAML rather than gcfg.  They hold the same sections and
+// options: each section is a table (or mapping) of its options, a section
+// with names, such as [database "name"], is a table of tables keyed by name,
+// and a multi-valued option can be given a list.  They're translated into
+// gcfg, so their options mean exactly what they do in the gcfg format.
+
+// Reads a config file into c, in the format given by its extension.
+func readConfigFile(c *config, file string) error {
+	format := strings.ToLower(filepath.Ext(file))
+	if format != ".toml" && format != ".yaml" && format != ".yml" {
+		return gcfg.ReadFileInto(c, file)
+	}
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var sections map[string]interface{}
+	if format == ".toml" {
+		_, err = toml.Decode(string(contents), &sections)
+	} else {
+		err = yaml.Unmarshal(contents, &sections)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %v", file, err)
+	}
+	text, err := configText(sections)
+	if err != nil {
+		return fmt.Errorf("%v: %v", file, err)
+	}
+	if err = gcfg.ReadStringInto(c, text); err != nil {
+		return fmt.Errorf("%v: %v", file, err)
+	}
+	return nil
+}
+
+// Translates the sections of a TOML or YAML config into gcfg.
+func configText(sections map[string]interface{}) (string, error) {
+	text := &bytes.Buffer{}
+	for _, name := range sortedKeys(sections) {
+		section, ok := configTable(sections[name])
+		if !ok {
+			return "", fmt.Errorf("section %v must be a table of options", name)
+		}
+		if !namedSection(name) {
+			fmt.Fprintf(text, "[%v]\n", name)
+			if err := writeConfigOptions(text, name, section); err != nil {
+				return "", err
+			}
+			continue
+		}
+		for _, subsection := range sortedKeys(section) {
+			options, ok := configTable(section[subsection])
+			if !ok {
+				return "", fmt.Errorf("section %v %q must be a table of options", name, subsection)
+			}
+			fmt.Fprintf(text, "[%v %v]\n", name, quoteConfigValue(subsection))
+			if err := writeConfigOptions(text, name, options); err != nil {
+				return "", err
+			}
+		}
+	}
+	return text.String(), nil
+}
+
+func writeConfigOptions(text *bytes.Buffer, section string, options map[string]interface{}) error {
+	for _, name := range sortedKeys(options) {
+		values, ok := options[name].([]interface{})
+		if !ok {
+			values = []interface{}{options[name]}
+		}
+		for _, value := range values {
+			s, ok := configScalar(value)
+			if !ok {
+				return fmt.Errorf("%v option %v must be a string, number, boolean or list of them", section, name)
+			}
+			fmt.Fprintf(text, "%v=%v\n", name, quoteConfigValue(s))
+		}
+	}
+	return nil
+}
+
+// Returns whether the config's section of this name has named subsections,
+// as [database "name"] does.
+func namedSection(name string) bool {
+	fieldName := strings.Replace(name, "-", "_", -1)
+	sections := reflect.TypeOf(config{})
+	for i := 0; i < sections.NumField(); i++ {
+		field := sections.Field(i)
+		if strings.EqualFold(field.Name, fieldName) {
+			return field.Type.Kind() == reflect.Map
+		}
+	}
+	return false
+}
+
+// Returns a TOML table or YAML mapping with string keys.
+func configTable(value interface{}) (map[string]interface{}, bool) {
+	switch table := value.(type) {
+	case map[string]interface{}:
+		return table, true
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(table))
+		for key, value := range table {
+			converted[fmt.Sprint(key)] = value
+		}
+		return converted, true
+	}
+	return nil, false
+}
+
+func configScalar(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
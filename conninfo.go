@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The admin console's CONNINFO command shows the connection strings a client
+// should use through the proxy for a user and database, generated from the
+// running config: one for each listen address, and for the master and a
+// replica where the listener offers both, so that application teams don't
+// have to work out the port, sslmode and replica database name themselves.
+
+var conninfoListeners struct {
+	defaultFrontend *frontend
+	frontends       map[string]*frontend
+}
+
+// Records the frontends for CONNINFO; called once at startup.
+func setConninfoListeners(defaultFrontend *frontend, frontends map[string]*frontend) {
+	conninfoListeners.defaultFrontend = defaultFrontend
+	conninfoListeners.frontends = frontends
+}
+
+func adminConninfo(args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return invalidAdminArguments
+	}
+	user, database := args[0], args[1]
+
+	var names []string
+	for name := range conninfoListeners.frontends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range append([]string{""}, names...) {
+		fe, addresses := conninfoListeners.defaultFrontend, cfg.Pgreplicaproxy.Listen
+		if name != "" {
+			fe, addresses = conninfoListeners.frontends[name], cfg.Listener[name].Listen
+		}
+		if fe == nil {
+			continue
+		}
+		for _, listen := range addresses {
+			if strings.HasPrefix(listen, "fd://") || strings.HasPrefix(listen, "@") {
+				// Not an address clients can be given
+				continue
+			}
+			if !fe.readOnly {
+				fmt.Fprintf(out, "%v %v master: %v\n", fe.name, listen, frontendConninfo(fe, listen, user, database))
+			}
+			if replicaDatabase := frontendReplicaDatabase(fe, database); replicaDatabase != "" {
+				fmt.Fprintf(out, "%v %v replica: %v\n", fe.name, listen, frontendConninfo(fe, listen, user, replicaDatabase))
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the database name that routes a client of the frontend to a
+// replica of the database, or "" if there's none.
+func frontendReplicaDatabase(fe *frontend, database string) string {
+	switch {
+	case databaseReplicaRouting(database) != "allow":
+		return ""
+	case fe.readOnly:
+		return database
+	case fe.readWrite:
+		return ""
+	case fe.replicaSuffix != "":
+		return database + fe.replicaSuffix
+	case fe.replicaPrefix != "":
+		return fe.replicaPrefix + database
+	}
+	if cluster, ok := currentBackendClusters().byDatabase[database]; ok && cluster.replicaSuffix != "" {
+		return database + cluster.replicaSuffix
+	}
+	return ""
+}
+
+func frontendConninfo(fe *frontend, listen, user, database string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		host, port = listen, "5432"
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		if hostname, err := os.Hostname(); err == nil {
+			host = hostname
+		}
+	}
+
+	sslmode := "disable"
+	if fe.sslRequired {
+		sslmode = "require"
+	} else if fe.tlsConfig != nil {
+		sslmode = "prefer"
+	}
+
+	params := []string{
+		"host=" + quoteConnectionValue(host),
+		"port=" + quoteConnectionValue(port),
+		"user=" + quoteConnectionValue(user),
+		"dbname=" + quoteConnectionValue(database),
+		"sslmode=" + sslmode,
+	}
+	conninfo := strings.Join(params, " ")
+	if fe.clientCertMode == "verify" || fe.clientCertMode == "verify-full" {
+		conninfo += " -- a client certificate is required"
+	}
+	return conninfo
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The admin console's CUTOVER command moves a database from its backend
+// cluster to another, eg. at the end of a blue/green upgrade where the new
+// cluster has been kept up to date by logical replication:
+//
+//  1. New sessions to the database are refused, as with DRAIN.
+//  2. Handshakes already past the drain check are waited for, and existing
+//     sessions are left to finish; in protocol-aware mode, those that are
+//     idle outside a transaction are closed.  If any are still open after
+//     the timeout, the cutover is abandoned.
+//  3. If a replication slot is given, the old master's current WAL position
+//     is read, and the cutover waits, within the same timeout, for the
+//     slot's subscriber to confirm it has received everything up to it.
+//  4. The database is routed to the new cluster, and the drain ends.
+//
+// The cluster "default" is the [pgreplicaproxy] backends.  The new routing
+// lasts until the proxy restarts, so the config should be changed to match.
+
+const defaultCutoverTimeout = 30 * time.Second
+const cutoverPollInterval = 100 * time.Millisecond
+const cutoverMessage = "This database is being moved to another cluster; try again shortly"
+
+var cutoverSessionsRemain = errors.New("sessions are still open; cutover abandoned")
+var cutoverSlotBehind = errors.New("the replication slot didn't catch up; cutover abandoned")
+
+// Databases moved by CUTOVER, and the name of the cluster each is now on.
+var cutovers = struct {
+	sync.Mutex
+	clusters map[string]string
+}{clusters: make(map[string]string)}
+
+// Returns the cluster a database was moved to by CUTOVER, if any.
+func cutoverCluster(database string) (string, bool) {
+	cutovers.Lock()
+	defer cutovers.Unlock()
+	name, ok := cutovers.clusters[database]
+	return name, ok
+}
+
+// Returns the network addresses of the backends of the named cluster, or of
+// the [pgreplicaproxy] backends for "default".
+func (m *backendClusterMap) namedClusterMembers(name string) (map[string]bool, bool) {
+	if name == "default" {
+		return m.defaultMembers, true
+	}
+	for _, cluster := range m.clusters {
+		if cluster.name == name {
+			return cluster.members, true
+		}
+	}
+	return nil, false
+}
+
+func adminCutover(args []string, out io.Writer) error {
+	if len(args) < 2 || len(args) > 4 {
+		return invalidAdminArguments
+	}
+	database, target := args[0], args[1]
+	timeout := defaultCutoverTimeout
+	if len(args) > 2 {
+		seconds, err := strconv.Atoi(args[2])
+		if err != nil || seconds <= 0 {
+			return invalidAdminArguments
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	var slot string
+	if len(args) > 3 {
+		slot = args[3]
+	}
+
+	if _, ok := currentBackendClusters().namedClusterMembers(target); !ok {
+		return fmt.Errorf("unknown backend cluster %v", target)
+	}
+	deadline := time.Now().Add(timeout)
+
+	if drainMessage(database) != "" {
+		return fmt.Errorf("database %v is already being drained", database)
+	}
+	startDrain(database, cutoverMessage, 0)
+	defer stopDrain(database)
+	log.Printf("Cutover of database %v to cluster %v started", database, target)
+
+	// Handshakes are counted first, as they become sessions once done
+	remaining := databaseHandshakes(database) + closeIdleSessions(database)
+	for remaining > 0 && time.Now().Before(deadline) {
+		time.Sleep(cutoverPollInterval)
+		remaining = databaseHandshakes(database) + closeIdleSessions(database)
+	}
+	if remaining > 0 {
+		log.Printf("Cutover of database %v abandoned: %v sessions still open", database, remaining)
+		return cutoverSessionsRemain
+	}
+	fmt.Fprintf(out, "database %v has no sessions\n", database)
+
+	if slot != "" {
+		lsn, err := waitForReplicationSlot(database, slot, deadline)
+		if err != nil {
+			log.Printf("Cutover of database %v abandoned: %v", database, err)
+			return err
+		}
+		fmt.Fprintf(out, "replication slot %v has confirmed %v\n", slot, lsn)
+	}
+
+	cutovers.Lock()
+	cutovers.clusters[database] = target
+	cutovers.Unlock()
+	log.Printf("Cutover of database %v to cluster %v finished", database, target)
+	fmt.Fprintf(out, "database %v is now routed to cluster %v\n", database, target)
+	return nil
+}
+
+// Closes the database's sessions that are idle outside a transaction, which
+// are only known in protocol-aware mode, and returns how many are left.
+func closeIdleSessions(database string) int {
+	remaining := 0
+	for _, s := range listSessions() {
+		if s.database != database {
+			continue
+		}
+		if cfg.Pgreplicaproxy.Protocol_Aware && atomic.LoadInt32(&s.backendIdle) == 1 && atomic.LoadInt32(&s.transactionStatus) == 'I' {
+			log.Printf("session %v: closing idle session for the cutover of database %v", s.id, database)
+			s.closeConnections()
+			continue
+		}
+		remaining++
+	}
+	return remaining
+}
+
+// Reads the current WAL position of the database's master, and waits until
+// the replication slot has confirmed it, or the deadline passes.
+func waitForReplicationSlot(database, slot string, deadline time.Time) (string, error) {
+	master, err := requestBackend(masterRequestChannel, databaseCluster(database), nil, false)
+	if err != nil {
+		return "", err
+	}
+	if master == nil {
+		return "", fmt.Errorf("no master is available for database %v", database)
+	}
+
+	db, err := sql.Open(monitorDriver(*master), monitorConnectionString(*master))
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var lsn string
+	if err := db.QueryRow("SELECT pg_current_wal_lsn()::text").Scan(&lsn); err != nil {
+		return "", err
+	}
+	for {
+		var caughtUp bool
+		err := db.QueryRow("SELECT coalesce(confirmed_flush_lsn >= $2::pg_lsn, false) FROM pg_replication_slots WHERE slot_name = $1", slot, lsn).Scan(&caughtUp)
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("no replication slot %v", slot)
+		} else if err != nil {
+			return "", err
+		}
+		if caughtUp {
+			return lsn, nil
+		}
+		if time.Now().After(deadline) {
+			return "", cutoverSlotBehind
+		}
+		time.Sleep(cutoverPollInterval)
+	}
+}
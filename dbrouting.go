@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+)
+
+// A database's [database "name"] section can override how its sessions that
+// ask for a replica (by the replica suffix or prefix, a cluster's suffix, or a
+// read-only listener) are routed.  With replica-routing=force-master they're
+// sent to the master instead, and with replica-routing=deny they're refused,
+// so that sensitive databases are never read from a replica; a read-only
+// listener refuses them either way.  With replica-fallback, sessions that ask
+// for a replica use the master when no replica is available, except on
+// read-only listeners, so that reads carry on through replica maintenance;
+// each such session is counted in pgreplicaproxy_replica_fallbacks_total,
+// by database for those with a section and as "other" for the rest, since
+// clients can name any database.
+
+var replicaFallbacksMetric = defineMetric("pgreplicaproxy_replica_fallbacks_total", counterMetric,
+	"Sessions that asked for a replica and were sent to the master because none was available.", nil, "database")
+
+func databaseReplicaRouting(database string) string {
+	if db, ok := cfg.Database[database]; ok && db.Replica_Routing != "" {
+		return db.Replica_Routing
+	}
+	return "allow"
+}
+
+// Returns the label of a database in per-database metrics and log rate
+// limits: its name if it has a [database "name"] section, or else "other".
+func configuredDatabaseLabel(database string) string {
+	if _, ok := cfg.Database[database]; ok {
+		return database
+	}
+	return "other"
+}
+
+func databaseReplicaFallback(database string) bool {
+	db, ok := cfg.Database[database]
+	return ok && db.Replica_Fallback
+}
+
+func validateDatabaseRouting() {
+	for database, db := range cfg.Database {
+		switch db.Replica_Routing {
+		case "", "allow", "force-master", "deny":
+		default:
+			log.Fatalf("database %v: replica-routing must be allow, force-master or deny", database)
+		}
+	}
+}
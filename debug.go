@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+)
+
+// Protocol debugging logs a decoded description of every message of selected
+// sessions; much more useful than byte counts when diagnosing protocol issues.
+
+const maxDebuggedMessageBody = 1024
+
+var debugRules sessionRuleSet
+
+func (s *session) startDebug() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.debug {
+		log.Printf("session %v: protocol debugging started", s.id)
+		s.debug = true
+		s.updateFramers()
+	}
+}
+
+func (s *session) stopDebug() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.debug {
+		log.Printf("session %v: protocol debugging stopped", s.id)
+		s.debug = false
+		s.updateFramers()
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// A [backend "address"] section gives dial options for the backend with that
+// network address (host:port, as shown in the metrics): its own
+// connect-timeout and tcp-keepalive, and a source-address to connect from,
+// for proxies with several networks.  Options left unset take their values
+// from [pgreplicaproxy].  They apply to proxied sessions, cancel requests and
+// health checks alike; tunnelled backends are dialled by the remote proxy.
+
+// Returns the dial options of a backend, or nil if it has none.
+func backendDialOptions(backend string) *backendDialConfig {
+	return cfg.Backend[backendLabel(backend)]
+}
+
+func backendConnectTimeout(backend string) time.Duration {
+	if options := backendDialOptions(backend); options != nil && options.Connect_Timeout.Duration > 0 {
+		return options.Connect_Timeout.Duration
+	}
+	return cfg.Pgreplicaproxy.Connect_Timeout.Duration
+}
+
+// Opens a TCP or Unix socket connection to a backend with its dial options,
+// giving up after timeout unless it's zero.
+func dialBackendSocket(backend string, timeout time.Duration) (net.Conn, error) {
+	network, address := network(backend)
+	dialer := &net.Dialer{Timeout: timeout}
+	keepalive := cfg.Pgreplicaproxy.Tcp_Keepalive.Duration
+	if options := backendDialOptions(backend); options != nil {
+		if options.Source_Address != "" && network != "unix" {
+			dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(options.Source_Address)}
+		}
+		if options.Tcp_Keepalive.Duration > 0 {
+			keepalive = options.Tcp_Keepalive.Duration
+		}
+	}
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	setKeepalivePeriod(conn, keepalive)
+	return conn, nil
+}
+
+func validateBackendDialOptions() {
+	for address, options := range cfg.Backend {
+		if options.Source_Address != "" && net.ParseIP(options.Source_Address) == nil {
+			log.Fatalf("backend %v: source-address must be an IP address", address)
+		}
+	}
+	validateBackendWeights()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+// PostgreSQL 17 clients with sslnegotiation=direct start the TLS handshake
+// straight away, without an SSLRequest.  A connection whose first byte is
+// that of a TLS handshake record is handled as such on the same port, when
+// TLS is configured.  As in PostgreSQL, the client must negotiate the
+// "postgresql" ALPN protocol, so that a connection meant for another
+// protocol can't be mistaken for one of ours; the proxy offers it on every
+// TLS connection.
+
+const tlsHandshakeRecord = 0x16
+const postgresqlALPN = "postgresql"
+
+var directTLSWithoutALPN = errors.New("Direct TLS connection without the postgresql ALPN protocol")
+
+// Returns whether a client connection starts with a TLS handshake, and the
+// connection to read from in its place.
+func peekDirectTLS(conn net.Conn) (net.Conn, bool) {
+	reader := bufio.NewReaderSize(conn, 64)
+	peeked := &peekedConn{conn, reader}
+	first, err := reader.Peek(1)
+	return peeked, err == nil && first[0] == tlsHandshakeRecord
+}
+
+// Completes the TLS handshake of a direct TLS connection, and reads the
+// startup message that follows it.
+func acceptDirectTLS(conn net.Conn, tlsConfig *tls.Config) (net.Conn, *startupMessage, error) {
+	logDebug("Direct TLS connection")
+	tlsConn := tls.Server(conn, tlsConfig)
+	err := tlsConn.Handshake()
+	if err != nil {
+		return conn, nil, err
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol != postgresqlALPN {
+		sendErrorWithCode(tlsConn, "08P01", "Direct TLS connections must use the postgresql ALPN protocol") // protocol violation
+		return tlsConn, nil, directTLSWithoutALPN
+	}
+	return readStartupMessageInternal(tlsConn, nil, 0)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"strings"
+)
+
+// The DNS responder answers queries for a single configured name (dns-name)
+// with the address of the current master, so that tools that can't be
+// pointed at the proxy can still follow the failovers it detects.  Queries
+// for any other name are refused.
+
+const defaultDNSTTL = 5
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeANY  = 255
+	dnsClassIN  = 1
+
+	dnsRcodeNoError  = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeRefused  = 5
+)
+
+func listenDNS(listen string) {
+	conn, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	buffer := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		response := answerDNSQuery(buffer[:n])
+		if response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// Builds the response to a DNS query, or returns nil if the query is too
+// malformed to respond to.
+func answerDNSQuery(query []byte) []byte {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return nil
+	}
+
+	id := query[0:2]
+	questionCount := binary.BigEndian.Uint16(query[4:6])
+	if questionCount != 1 {
+		return dnsResponse(id, query[2], nil, dnsRcodeFormErr, nil)
+	}
+
+	// The question: a sequence of labels, then the type and class
+	var labels []string
+	offset := 12
+	for {
+		if offset >= len(query) {
+			return dnsResponse(id, query[2], nil, dnsRcodeFormErr, nil)
+		}
+		length := int(query[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		if length > 63 || offset+length > len(query) {
+			return dnsResponse(id, query[2], nil, dnsRcodeFormErr, nil)
+		}
+		labels = append(labels, string(query[offset:offset+length]))
+		offset += length
+	}
+	if offset+4 > len(query) {
+		return dnsResponse(id, query[2], nil, dnsRcodeFormErr, nil)
+	}
+	question := query[12 : offset+4]
+	qtype := binary.BigEndian.Uint16(query[offset:])
+	qclass := binary.BigEndian.Uint16(query[offset+2:])
+
+	name := strings.Join(labels, ".")
+	if !strings.EqualFold(name, strings.TrimSuffix(cfg.Pgreplicaproxy.Dns_Name, ".")) || qclass != dnsClassIN {
+		return dnsResponse(id, query[2], question, dnsRcodeRefused, nil)
+	}
+
+	ips := masterAddresses()
+	if ips == nil {
+		return dnsResponse(id, query[2], question, dnsRcodeServFail, nil)
+	}
+
+	ttl := uint32(cfg.Pgreplicaproxy.Dns_Ttl)
+	if ttl == 0 {
+		ttl = defaultDNSTTL
+	}
+	var answers []byte
+	for _, ip := range ips {
+		var rtype uint16
+		var rdata []byte
+		if ip4 := ip.To4(); ip4 != nil {
+			rtype, rdata = dnsTypeA, ip4
+		} else {
+			rtype, rdata = dnsTypeAAAA, ip.To16()
+		}
+		if qtype != rtype && qtype != dnsTypeANY {
+			continue
+		}
+
+		answer := make([]byte, 12, 12+len(rdata))
+		binary.BigEndian.PutUint16(answer[0:], 0xc00c) // pointer to the question's name
+		binary.BigEndian.PutUint16(answer[2:], rtype)
+		binary.BigEndian.PutUint16(answer[4:], dnsClassIN)
+		binary.BigEndian.PutUint32(answer[6:], ttl)
+		binary.BigEndian.PutUint16(answer[10:], uint16(len(rdata)))
+		answers = append(answers, append(answer, rdata...)...)
+	}
+
+	return dnsResponse(id, query[2], question, dnsRcodeNoError, answers)
+}
+
+func dnsResponse(id []byte, queryFlags byte, question []byte, rcode byte, answers []byte) []byte {
+	answerCount := 0
+	for offset := 0; offset < len(answers); {
+		answerCount++
+		offset += 12 + int(binary.BigEndian.Uint16(answers[offset+10:]))
+	}
+
+	response := make([]byte, 12, 12+len(question)+len(answers))
+	copy(response[0:2], id)
+	response[2] = 0x80 | 0x04 | (queryFlags & 0x01) // response, authoritative, copy RD
+	response[3] = rcode
+	if question != nil {
+		binary.BigEndian.PutUint16(response[4:], 1)
+	}
+	binary.BigEndian.PutUint16(response[6:], uint16(answerCount))
+	response = append(response, question...)
+	return append(response, answers...)
+}
+
+// Returns the IP addresses of the current master, or nil if there isn't one.
+func masterAddresses() []net.IP {
+	master, err := requestBackend(masterRequestChannel, currentBackendClusters().defaultMembers, nil, false)
+	if err != nil || master == nil {
+		return nil
+	}
+
+	o := connectionOptions(*master)
+	host := o.Get("hostaddr")
+	if host == "" {
+		host = o.Get("host")
+	}
+	if strings.HasPrefix(host, "/") {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		logLimited("dns lookup "+host, "Unable to resolve master host %v: %v", host, err)
+		return nil
+	}
+	return ips
+}
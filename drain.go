@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A database can be drained from the admin console, eg. before moving it
+// elsewhere: new sessions to it are refused with drain-message (or the
+// message given to DRAIN), while the existing ones are left to finish, or
+// closed once the drain's deadline passes.  Draining lasts until UNDRAIN,
+// and isn't remembered across restarts.
+
+const defaultDrainMessage = "This database is being drained; try again later"
+
+var sessionsDrainedMetric = defineMetric("pgreplicaproxy_sessions_drained_total", counterMetric,
+	"Sessions closed because their database's drain deadline passed.", nil, "database")
+
+type databaseDrain struct {
+	message  string
+	started  time.Time
+	deadline time.Time
+	timer    *time.Timer
+}
+
+var drains = struct {
+	sync.Mutex
+	databases map[string]*databaseDrain
+
+	// The handshakes of new sessions to each database that have passed the
+	// drain check but aren't registered yet
+	handshakes map[string]int
+}{databases: make(map[string]*databaseDrain), handshakes: make(map[string]int)}
+
+// Returns the error message for new sessions to database, or "" if it isn't
+// being drained.
+func drainMessage(database string) string {
+	drains.Lock()
+	defer drains.Unlock()
+	if drain := drains.databases[database]; drain != nil {
+		return drain.message
+	}
+	return ""
+}
+
+// Returns the error message for a new session to database if it's being
+// drained.  Otherwise the session's handshake is counted as in flight until
+// done is called, once the session is registered or has failed.
+func startDatabaseHandshake(database string) (message string, done func()) {
+	drains.Lock()
+	defer drains.Unlock()
+	if drain := drains.databases[database]; drain != nil {
+		return drain.message, nil
+	}
+	drains.handshakes[database]++
+	var once sync.Once
+	return "", func() {
+		once.Do(func() {
+			drains.Lock()
+			defer drains.Unlock()
+			if drains.handshakes[database]--; drains.handshakes[database] == 0 {
+				delete(drains.handshakes, database)
+			}
+		})
+	}
+}
+
+// Returns how many handshakes of new sessions to database are in flight.
+func databaseHandshakes(database string) int {
+	drains.Lock()
+	defer drains.Unlock()
+	return drains.handshakes[database]
+}
+
+// Starts draining database, replacing any drain already in progress.  With a
+// non-zero timeout, the sessions still open after it are closed.
+func startDrain(database, message string, timeout time.Duration) {
+	if message == "" {
+		message = firstNonEmpty(cfg.Pgreplicaproxy.Drain_Message, defaultDrainMessage)
+	}
+	drain := &databaseDrain{message: message, started: time.Now()}
+	if timeout > 0 {
+		drain.deadline = drain.started.Add(timeout)
+		drain.timer = time.AfterFunc(timeout, func() {
+			closeDrainedSessions(database, drain)
+		})
+	}
+
+	drains.Lock()
+	defer drains.Unlock()
+	if previous := drains.databases[database]; previous != nil && previous.timer != nil {
+		previous.timer.Stop()
+	}
+	drains.databases[database] = drain
+	log.Printf("Draining database %v", database)
+}
+
+// Stops draining database; returns false if it wasn't being drained.
+func stopDrain(database string) bool {
+	drains.Lock()
+	defer drains.Unlock()
+	drain := drains.databases[database]
+	if drain == nil {
+		return false
+	}
+	if drain.timer != nil {
+		drain.timer.Stop()
+	}
+	delete(drains.databases, database)
+	log.Printf("Stopped draining database %v", database)
+	return true
+}
+
+func closeDrainedSessions(database string, drain *databaseDrain) {
+	drains.Lock()
+	current := drains.databases[database] == drain
+	drains.Unlock()
+	if !current {
+		return
+	}
+
+	for _, s := range listSessions() {
+		if s.database == database {
+			log.Printf("session %v: closing session; database %v was drained", s.id, database)
+			incMetric(sessionsDrainedMetric, database)
+			s.closeConnections()
+		}
+	}
+}
+
+func adminDrain(args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return invalidAdminArguments
+	}
+	database := args[0]
+	var timeout time.Duration
+	var message string
+	if len(args) > 1 {
+		seconds, err := strconv.Atoi(args[1])
+		if err != nil || seconds < 0 {
+			return invalidAdminArguments
+		}
+		timeout = time.Duration(seconds) * time.Second
+		message = strings.Join(args[2:], " ")
+	}
+
+	startDrain(database, message, timeout)
+	if timeout > 0 {
+		fmt.Fprintf(out, "database %v is draining; remaining sessions will be closed in %v seconds\n", database, int(timeout/time.Second))
+	} else {
+		fmt.Fprintf(out, "database %v is draining\n", database)
+	}
+	return nil
+}
+
+func adminUndrain(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return invalidAdminArguments
+	}
+	if !stopDrain(args[0]) {
+		return fmt.Errorf("database %v isn't being drained", args[0])
+	}
+	fmt.Fprintf(out, "database %v accepts new sessions\n", args[0])
+	return nil
+}
+
+func adminShowDrains(args []string, out io.Writer) error {
+	sessions := make(map[string]int)
+	for _, s := range listSessions() {
+		sessions[s.database]++
+	}
+
+	drains.Lock()
+	defer drains.Unlock()
+	var databases []string
+	for database := range drains.databases {
+		databases = append(databases, database)
+	}
+	sort.Strings(databases)
+
+	for _, database := range databases {
+		drain := drains.databases[database]
+		deadline := "none"
+		if !drain.deadline.IsZero() {
+			deadline = drain.deadline.Format(time.RFC3339)
+		}
+		fmt.Fprintf(out, "%v sessions=%v age=%v deadline=%v message=%q\n",
+			database, sessions[database], time.Since(drain.started)/time.Second*time.Second, deadline, drain.message)
+	}
+	return nil
+}
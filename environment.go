@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/gcfg"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The options of [pgreplicaproxy] can also be set with PGPROXY_* environment
+// variables, for running in containers without a config file: the option's
+// name in upper case, with dashes as underscores, eg. PGPROXY_REPLICA_SUFFIX
+// for replica-suffix.  Options with several values take them from variables
+// with a numeric suffix, in order: PGPROXY_BACKEND_1, PGPROXY_BACKEND_2, and
+// so on (PGPROXY_BACKEND also works for a single value).  Environment
+// variables override the config file, whose values for an option given in
+// the environment are discarded, and are overridden by command-line flags.
+// Other sections can't be set this way, as their names (listener names,
+// backend addresses, database names) can't be spelled in variable names.
+
+const environmentPrefix = "PGPROXY_"
+
+type environmentValue struct {
+	index int
+	value string
+}
+
+// Returns the config options given in the environment, by option name.
+func environmentOptions() map[string][]environmentValue {
+	options := make(map[string][]environmentValue)
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, environmentPrefix) {
+			continue
+		}
+		parts := strings.SplitN(variable[len(environmentPrefix):], "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name, index := parts[0], 0
+		if i := strings.LastIndex(name, "_"); i != -1 {
+			if n, err := strconv.Atoi(name[i+1:]); err == nil {
+				name, index = name[:i], n
+			}
+		}
+		name = strings.ToLower(strings.Replace(name, "_", "-", -1))
+		options[name] = append(options[name], environmentValue{index, parts[1]})
+	}
+	return options
+}
+
+// Applies the options given in the environment to c.
+func applyEnvironment(c *config) error {
+	options := environmentOptions()
+	if len(options) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	text := &bytes.Buffer{}
+	text.WriteString("[pgreplicaproxy]\n")
+	for _, name := range names {
+		values := options[name]
+		sort.Sort(environmentValuesByIndex(values))
+		if multiValuedOption(name) {
+			// A blank value clears the values from the config file
+			fmt.Fprintf(text, "%v=\n", name)
+		}
+		for _, value := range values {
+			fmt.Fprintf(text, "%v=%v\n", name, quoteConfigValue(value.value))
+		}
+	}
+
+	err := gcfg.ReadStringInto(c, text.String())
+	if err != nil {
+		return fmt.Errorf("%v* environment variables: %v", environmentPrefix, err)
+	}
+	return nil
+}
+
+func multiValuedOption(name string) bool {
+	fieldName := strings.Replace(name, "-", "_", -1)
+	options := reflect.TypeOf(cfg.Pgreplicaproxy)
+	for i := 0; i < options.NumField(); i++ {
+		field := options.Field(i)
+		if strings.EqualFold(field.Name, fieldName) {
+			return field.Type.Kind() == reflect.Slice
+		}
+	}
+	return false
+}
+
+func haveEnvironmentConfig() bool {
+	return len(environmentOptions()) > 0
+}
+
+// Quotes a value for gcfg, so that it's read back unchanged.
+func quoteConfigValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	value = strings.Replace(value, "\t", `\t`, -1)
+	return `"` + value + `"`
+}
+
+type environmentValuesByIndex []environmentValue
+
+func (v environmentValuesByIndex) Len() int           { return len(v) }
+func (v environmentValuesByIndex) Less(i, j int) bool { return v[i].index < v[j].index }
+func (v environmentValuesByIndex) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
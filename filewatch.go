@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Files whose changes reload the config, the backend file and (with sidecar)
+// the config file, share one fsnotify watcher.  It watches their directories
+// rather than the files themselves, as editors replace a file by renaming a
+// new one over it, and Kubernetes updates a mounted ConfigMap by swapping a
+// symlink in the file's directory; a watch on the file would be lost either
+// way.  After a burst of events in a directory, its watched files are looked
+// at again, and the config is reloaded if one of them has been replaced or
+// modified.  A file that's missing, perhaps because it's being replaced, is
+// looked at again on the next event.
+
+const fileWatchSettleTime = 100 * time.Millisecond
+
+type watchedFile struct {
+	file        string
+	description string
+	info        os.FileInfo
+}
+
+// Returns the files whose changes reload the config, with their
+// descriptions.
+func reloadWatchedFiles() []*watchedFile {
+	var files []*watchedFile
+	if cfg.Pgreplicaproxy.Sidecar {
+		files = append(files, &watchedFile{file: *configFile, description: "Config file"})
+	}
+	if cfg.Pgreplicaproxy.Backend_File != "" {
+		files = append(files, &watchedFile{file: cfg.Pgreplicaproxy.Backend_File, description: "Backend file"})
+	}
+	return files
+}
+
+// Reloads the config whenever one of files changes.
+func watchFilesForReload(files []*watchedFile) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatalf("Watching files for changes: %v", err)
+	}
+	for _, w := range files {
+		dir := filepath.Dir(w.file)
+		if err := watcher.Add(dir); err != nil {
+			log.Fatalf("Watching %v for changes: %v", dir, err)
+		}
+		w.info, _ = os.Stat(w.file)
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if settled == nil {
+				settled = time.After(fileWatchSettleTime)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logLimited("file watch", "Watching files for changes: %v", err)
+		case <-settled:
+			settled = nil
+			var changed *watchedFile
+			for _, w := range files {
+				if w.changed() {
+					changed = w
+				}
+			}
+			if changed == nil {
+				continue
+			}
+			log.Printf("%v %v changed; reloading", changed.description, changed.file)
+			if err := reloadConfig(); err != nil {
+				log.Printf("Config reload failed, keeping the previous config: %v", err)
+			}
+		}
+	}
+}
+
+// Returns whether the file has been replaced or modified since it was last
+// looked at.
+func (w *watchedFile) changed() bool {
+	info, err := os.Stat(w.file)
+	if err != nil {
+		return false
+	}
+	previous := w.info
+	w.info = info
+	return previous == nil || !os.SameFile(info, previous) ||
+		!info.ModTime().Equal(previous.ModTime()) || info.Size() != previous.Size()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Pathological clients, usually misconfigured connection pools, can open
+// hundreds of identical sessions.  Sessions are fingerprinted by user,
+// database, application_name and client IP, and fingerprint-max-connections
+// caps the sessions with the same fingerprint.  Clients beyond it wait in a
+// first-come-first-served queue for up to fingerprint-queue-timeout, so that
+// a pool that reconnects in a tight loop is slowed down rather than allowed
+// to exhaust the backends' connections.
+
+var fingerprintQueueTimeout = errors.New("Timed out waiting for an identical session to finish")
+
+const defaultFingerprintQueueTimeout = 30 * time.Second
+
+var fingerprintQueueWaitMetric = defineMetric("pgreplicaproxy_fingerprint_queue_wait_seconds", histogramMetric,
+	"Time clients waited for a session slot for their fingerprint.", latencyBuckets)
+var fingerprintQueueTimeoutsMetric = defineMetric("pgreplicaproxy_fingerprint_queue_timeouts_total", counterMetric,
+	"Clients refused after waiting too long for a session slot for their fingerprint.", nil)
+
+type acquireFingerprintMessage struct {
+	fingerprint string
+	returnChan  chan bool
+}
+
+var acquireFingerprintChan = make(chan acquireFingerprintMessage)
+var releaseFingerprintChan = make(chan string)
+var abandonFingerprintChan = make(chan acquireFingerprintMessage)
+
+func sessionFingerprint(sess *session) string {
+	return sess.user + "\x00" + sess.database + "\x00" + sess.startupParameters["application_name"] + "\x00" + clientIP(sess.clientAddr)
+}
+
+// Waits for a session slot for the session's fingerprint, in the same way as
+// acquireDatabaseCapacity.  Returns a function that releases the slot.
+func acquireFingerprintSlot(sess *session, beforeWait func()) (func(), error) {
+	if cfg.Pgreplicaproxy.Fingerprint_Max_Connections <= 0 {
+		return func() {}, nil
+	}
+
+	fingerprint := sessionFingerprint(sess)
+	msg := acquireFingerprintMessage{fingerprint, make(chan bool, 1)}
+	acquireFingerprintChan <- msg
+	release := func() { releaseFingerprintChan <- fingerprint }
+
+	if <-msg.returnChan {
+		return release, nil
+	}
+
+	logLimited("fingerprint "+fingerprint, "session %v: %v sessions for user %v, database %v, application %q from %v; waiting",
+		sess.id, cfg.Pgreplicaproxy.Fingerprint_Max_Connections, sess.user, sess.database,
+		sess.startupParameters["application_name"], clientIP(sess.clientAddr))
+	beforeWait()
+
+	timeout := cfg.Pgreplicaproxy.Fingerprint_Queue_Timeout.Duration
+	if timeout <= 0 {
+		timeout = defaultFingerprintQueueTimeout
+	}
+	start := time.Now()
+	select {
+	case <-msg.returnChan:
+		observeMetric(fingerprintQueueWaitMetric, time.Since(start).Seconds())
+		return release, nil
+	case <-time.After(timeout):
+		abandonFingerprintChan <- msg
+		// The slot may have been granted just as we gave up
+		select {
+		case <-msg.returnChan:
+			release()
+		default:
+		}
+		observeMetric(fingerprintQueueWaitMetric, time.Since(start).Seconds())
+		incMetric(fingerprintQueueTimeoutsMetric)
+		return nil, fingerprintQueueTimeout
+	}
+}
+
+// Keeps track of the sessions with each fingerprint and the clients waiting
+// for one to finish.  Fingerprints are forgotten once they have no sessions
+// and no waiting clients.
+func manageFingerprintSlots() {
+	active := make(map[string]int)
+	waiting := make(map[string][]acquireFingerprintMessage)
+
+	forget := func(fingerprint string) {
+		if active[fingerprint] <= 0 && len(waiting[fingerprint]) == 0 {
+			delete(active, fingerprint)
+			delete(waiting, fingerprint)
+		}
+	}
+
+	for {
+		select {
+		case acquire := <-acquireFingerprintChan:
+			if active[acquire.fingerprint] < cfg.Pgreplicaproxy.Fingerprint_Max_Connections {
+				active[acquire.fingerprint]++
+				acquire.returnChan <- true
+			} else {
+				acquire.returnChan <- false
+				waiting[acquire.fingerprint] = append(waiting[acquire.fingerprint], acquire)
+			}
+
+		case fingerprint := <-releaseFingerprintChan:
+			active[fingerprint]--
+			if queue := waiting[fingerprint]; len(queue) > 0 && active[fingerprint] < cfg.Pgreplicaproxy.Fingerprint_Max_Connections {
+				active[fingerprint]++
+				queue[0].returnChan <- true
+				waiting[fingerprint] = queue[1:]
+			}
+			forget(fingerprint)
+
+		case abandon := <-abandonFingerprintChan:
+			queue := waiting[abandon.fingerprint]
+			for i, w := range queue {
+				if w.returnChan == abandon.returnChan {
+					waiting[abandon.fingerprint] = append(queue[:i:i], queue[i+1:]...)
+					break
+				}
+			}
+			forget(abandon.fingerprint)
+		}
+	}
+}
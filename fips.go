@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// In FIPS mode (tls-fips=true) TLS on both the client and backend legs is
+// restricted to FIPS-approved protocol versions, cipher suites, curves and
+// key sizes, and the configured certificates are checked for compliance at
+// startup.  The TLS 1.3 cipher suites can't be restricted, so TLS 1.3 isn't
+// used in FIPS mode.
+
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+var fipsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+// Applies the configured TLS restrictions to a client or cluster TLS config.
+func applyTLSPolicy(config *tls.Config) {
+	clientTLSPolicy.apply(config)
+	applyFIPSPolicy(config)
+}
+
+// Applies the configured TLS restrictions to a backend TLS config.
+func applyBackendTLSPolicy(config *tls.Config) {
+	backendTLSPolicy.apply(config)
+	applyFIPSPolicy(config)
+}
+
+func applyFIPSPolicy(config *tls.Config) {
+	if cfg.Pgreplicaproxy.Tls_Fips {
+		config.MinVersion = tls.VersionTLS12
+		config.MaxVersion = tls.VersionTLS12
+		config.CipherSuites = fipsCipherSuites
+		config.CurvePreferences = fipsCurves
+	}
+}
+
+// Checks that the listener certificate and the backends' client and root
+// certificates comply with FIPS requirements, exiting if they don't.
+func validateFIPSCertificates() {
+	if !cfg.Pgreplicaproxy.Tls_Fips {
+		return
+	}
+
+	files := []string{cfg.Pgreplicaproxy.Ssl_Cert}
+	for _, backend := range configuredBackends() {
+		o := backendTLSOptions(backend)
+		files = append(files, o.Get("sslcert"), o.Get("sslrootcert"))
+	}
+
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		err := validateFIPSCertificateFile(file)
+		if err != nil {
+			log.Fatalf("tls-fips: %v: %v", file, err)
+		}
+	}
+}
+
+func validateFIPSCertificateFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		err = validateFIPSCertificate(cert)
+		if err != nil {
+			return fmt.Errorf("certificate %q: %v", cert.Subject.CommonName, err)
+		}
+	}
+}
+
+func validateFIPSCertificate(cert *x509.Certificate) error {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return fmt.Errorf("RSA key size %v is less than 2048 bits", key.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() && key.Curve != elliptic.P384() && key.Curve != elliptic.P521() {
+			return fmt.Errorf("ECDSA curve %v is not approved", key.Curve.Params().Name)
+		}
+	default:
+		return fmt.Errorf("public key type %T is not approved", cert.PublicKey)
+	}
+
+	switch cert.SignatureAlgorithm {
+	case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+		x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS,
+		x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512:
+	default:
+		return fmt.Errorf("signature algorithm %v is not approved", cert.SignatureAlgorithm)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"time"
+)
+
+// Command-line flags override the corresponding config file options, so that
+// the same config file can be reused against different clusters.
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var configFile = flag.String("config", "pgreplicaproxy.cfg", "the configuration file to read; read as TOML or YAML if it ends in .toml, .yaml or .yml")
+
+var listenFlag stringList
+var backendFlag stringList
+var healthCheckIntervalFlag = flag.Duration("health-check-interval", 0, "time between health checks of each backend (overrides health-check-interval)")
+var connectTimeoutFlag = flag.Duration("connect-timeout", 0, "timeout for connecting to backends (overrides connect-timeout)")
+var logLevelFlag = flag.String("log-level", "", "debug or info (overrides log-level)")
+
+func init() {
+	flag.Var(&listenFlag, "listen", "an address to listen on; may be repeated (overrides listen)")
+	flag.Var(&backendFlag, "backend", "a backend connection string; may be repeated (overrides backend)")
+}
+
+const defaultHealthCheckInterval = 5 * time.Second
+
+// Applies the command-line flags to the config read from the config file.
+func applyFlags() {
+	if len(listenFlag) > 0 {
+		cfg.Pgreplicaproxy.Listen = listenFlag
+	}
+	if len(backendFlag) > 0 {
+		cfg.Pgreplicaproxy.Backend = backendFlag
+	}
+	if *healthCheckIntervalFlag > 0 {
+		cfg.Pgreplicaproxy.Health_Check_Interval.Duration = *healthCheckIntervalFlag
+	}
+	if *connectTimeoutFlag > 0 {
+		cfg.Pgreplicaproxy.Connect_Timeout.Duration = *connectTimeoutFlag
+	}
+	if *logLevelFlag != "" {
+		cfg.Pgreplicaproxy.Log_Level = *logLevelFlag
+	}
+
+	switch cfg.Pgreplicaproxy.Log_Level {
+	case "", "debug", "info":
+	default:
+		log.Fatalf("log-level must be debug or info")
+	}
+}
+
+// Returns how often a backend's health is checked; its cluster's
+// health-check-interval takes precedence.
+func healthCheckInterval(backend string) time.Duration {
+	if cluster := currentBackendClusters().backendCluster(backend); cluster != nil && cluster.healthCheckInterval > 0 {
+		return cluster.healthCheckInterval
+	}
+	if cfg.Pgreplicaproxy.Health_Check_Interval.Duration > 0 {
+		return cfg.Pgreplicaproxy.Health_Check_Interval.Duration
+	}
+	return defaultHealthCheckInterval
+}
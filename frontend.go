@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A frontend describes how the connections accepted on its listen addresses
+// are handled.  The listen addresses in [pgreplicaproxy] share the default
+// frontend; each [listener "name"] section defines another, so that one
+// proxy can offer, say, a plaintext listener for internal clients and a TLS
+// listener with stricter limits for external ones.
+type frontend struct {
+	name string
+
+	// Route every connection to a replica, whether or not its database name
+	// asks for one.
+	readOnly bool
+
+	// Route every connection to the master, leaving database names as they
+	// are.
+	readWrite bool
+
+	// Database names ending in replicaSuffix, or starting with
+	// replicaPrefix, are routed to a replica, with the suffix or prefix
+	// removed; "" disables either form.
+	replicaSuffix string
+	replicaPrefix string
+
+	// What to do when a client's startup message has no database: "user"
+	// connects to the database named after the user, as PostgreSQL does,
+	// "default" connects to defaultDatabase, and "reject" refuses the
+	// connection.
+	missingDatabase string
+	defaultDatabase string
+
+	tlsConfig      *tls.Config
+	clientCertMode string
+	sslRequired    bool
+
+	// Where clients starting with an SSLRequest are sent, encrypted traffic
+	// and all, when TLS is passed through to the backends: "master",
+	// "replica", or "" to terminate TLS in the proxy.
+	tlsPassthrough string
+
+	// Connections whose TLS server name matches one of sniRoutes go to the
+	// master or a replica, as it says, whatever their database name.
+	sniRoutes []sniRoute
+
+	// Client networks allowed to connect, or nil for any.
+	allowed []*net.IPNet
+
+	maxConnections int32
+	connections    int32
+
+	tcpKeepalive            time.Duration
+	clientKeepaliveInterval time.Duration
+	clientKeepaliveMessage  string
+}
+
+var clientAddressNotAllowed = errors.New("Connections from this address are not allowed")
+var tooManyListenerConnections = errors.New("Too many connections on this listener")
+
+const defaultReplicaSuffix = "_replica"
+
+// Creates a frontend from a listener's options, taking any that aren't set
+// from [pgreplicaproxy].
+func newFrontend(name string, lc *listenerConfig) *frontend {
+	global := &cfg.Pgreplicaproxy
+	fe := &frontend{
+		name:            name,
+		readOnly:        lc.Read_Only,
+		readWrite:       lc.Read_Write,
+		replicaSuffix:   firstNonEmpty(lc.Replica_Suffix, global.Replica_Suffix, defaultReplicaSuffix),
+		replicaPrefix:   firstNonEmpty(lc.Replica_Prefix, global.Replica_Prefix),
+		missingDatabase: firstNonEmpty(lc.Missing_Database, global.Missing_Database, "user"),
+		defaultDatabase: firstNonEmpty(lc.Default_Database, global.Default_Database),
+		clientCertMode:  firstNonEmpty(lc.Ssl_Client_Cert, global.Ssl_Client_Cert),
+		sslRequired:     lc.Ssl_Required.or(global.Ssl_Required),
+		tlsPassthrough:  lc.Tls_Passthrough,
+		maxConnections:  int32(global.Max_Client_Connections),
+
+		tcpKeepalive:            global.Tcp_Keepalive.Duration,
+		clientKeepaliveInterval: global.Client_Keepalive_Interval.Duration,
+		clientKeepaliveMessage:  firstNonEmpty(lc.Client_Keepalive_Message, global.Client_Keepalive_Message, "parameter-status"),
+	}
+	if fe.replicaSuffix == "none" || fe.readWrite {
+		fe.replicaSuffix = ""
+	}
+	if fe.replicaPrefix == "none" || fe.readWrite {
+		fe.replicaPrefix = ""
+	}
+	if fe.readOnly && fe.readWrite {
+		log.Fatalf("listener %v: read-only and read-write are mutually exclusive", name)
+	}
+	if lc.Max_Client_Connections > 0 {
+		fe.maxConnections = int32(lc.Max_Client_Connections)
+	}
+	if lc.Tcp_Keepalive.Duration > 0 {
+		fe.tcpKeepalive = lc.Tcp_Keepalive.Duration
+	}
+	if lc.Client_Keepalive_Interval.Duration > 0 {
+		fe.clientKeepaliveInterval = lc.Client_Keepalive_Interval.Duration
+	}
+	if fe.clientKeepaliveMessage != "parameter-status" && fe.clientKeepaliveMessage != "notice" {
+		log.Fatalf("listener %v: client-keepalive-message must be parameter-status or notice", name)
+	}
+
+	switch fe.missingDatabase {
+	case "user", "reject":
+	case "default":
+		if fe.defaultDatabase == "" {
+			log.Fatalf("listener %v: missing-database=default requires default-database", name)
+		}
+	default:
+		log.Fatalf("listener %v: missing-database must be user, default, or reject", name)
+	}
+
+	if lc.Ssl_Cert != "" || lc.Ssl_Ca != "" || lc.Ssl_Client_Cert != "" {
+		certFile, keyFile := global.Ssl_Cert, global.Ssl_Key
+		if lc.Ssl_Cert != "" {
+			certFile, keyFile = lc.Ssl_Cert, lc.Ssl_Key
+		}
+		fe.tlsConfig = newClientTLSConfig(certFile, keyFile, firstNonEmpty(lc.Ssl_Ca, global.Ssl_Ca), fe.clientCertMode)
+	} else {
+		fe.tlsConfig = clientTLSConfig
+	}
+	switch fe.tlsPassthrough {
+	case "", "master", "replica":
+	default:
+		log.Fatalf("listener %v: tls-passthrough must be master or replica", name)
+	}
+	if fe.readOnly && fe.tlsPassthrough == "master" {
+		log.Fatalf("listener %v: read-only and tls-passthrough=master are mutually exclusive", name)
+	}
+	if fe.readWrite && fe.tlsPassthrough == "replica" {
+		log.Fatalf("listener %v: read-write and tls-passthrough=replica are mutually exclusive", name)
+	}
+	sniRoutes := lc.Sni_Route
+	if len(sniRoutes) == 0 {
+		sniRoutes = global.Sni_Route
+	}
+	for _, route := range sniRoutes {
+		fields := strings.Fields(route)
+		if len(fields) != 2 || (fields[1] != "master" && fields[1] != "replica") {
+			log.Fatalf("listener %v: sni-route must be a hostname followed by master or replica: %v", name, route)
+		}
+		fe.sniRoutes = append(fe.sniRoutes, sniRoute{strings.ToLower(fields[0]), fields[1] == "replica"})
+	}
+	if len(fe.sniRoutes) > 0 && fe.tlsConfig == nil {
+		log.Fatalf("listener %v: sni-route requires ssl-cert and ssl-key", name)
+	}
+	if fe.sslRequired && fe.tlsConfig == nil && fe.tlsPassthrough == "" {
+		log.Fatalf("listener %v: ssl-required requires ssl-cert and ssl-key, or tls-passthrough", name)
+	}
+
+	allow := lc.Allow
+	if len(allow) == 0 {
+		allow = global.Allow
+	}
+	for _, cidr := range allow {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("listener %v: allow: %v", name, err)
+		}
+		fe.allowed = append(fe.allowed, network)
+	}
+
+	return fe
+}
+
+func (fe *frontend) allows(addr net.Addr) bool {
+	if fe.allowed == nil {
+		return true
+	}
+	ip := net.ParseIP(clientIP(addr))
+	for _, network := range fe.allowed {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Takes one of the listener's connection slots; returns a function that
+// releases it.
+func (fe *frontend) acquireConnection() (func(), error) {
+	connections := atomic.AddInt32(&fe.connections, 1)
+	if fe.maxConnections > 0 && connections > fe.maxConnections {
+		atomic.AddInt32(&fe.connections, -1)
+		return nil, tooManyListenerConnections
+	}
+	return func() { atomic.AddInt32(&fe.connections, -1) }, nil
+}
+
+type sniRoute struct {
+	// A hostname, or a wildcard such as *.ro.example.com matching any name
+	// directly under ro.example.com.
+	hostname string
+	replica  bool
+}
+
+// Returns whether a connection with the given TLS server name should go to a
+// replica, and whether one of the listener's sni-route options matched it.
+func (fe *frontend) routeServerName(serverName string) (replica bool, ok bool) {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if serverName == "" {
+		return false, false
+	}
+	for _, route := range fe.sniRoutes {
+		if route.hostname == serverName {
+			return route.replica, true
+		}
+		if strings.HasPrefix(route.hostname, "*.") {
+			i := strings.IndexByte(serverName, '.')
+			if i > 0 && serverName[i:] == route.hostname[1:] {
+				return route.replica, true
+			}
+		}
+	}
+	return false, false
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// A sample of sessions (handshake-trace-sample, a fraction between 0 and 1)
+// have the establishment of their connection traced: the time taken by each
+// phase from accepting the client connection to the backend's first
+// ReadyForQuery is logged and published as a metric, so that slow
+// handshakes can be attributed to the proxy, the network or the backend's
+// authentication.  The phases end when
+//
+//   startup:  the client's startup message has been read (and the client
+//             authenticated, with proxy-terminated auth)
+//   select:   a backend has been chosen, including any waits for capacity
+//   dial:     the connection to the backend is open, TLS included
+//   auth:     the backend has sent BackendKeyData, after authentication
+//   ready:    the backend has sent its first ReadyForQuery
+
+const (
+	tracePhaseStartup = iota
+	tracePhaseSelect
+	tracePhaseDial
+	tracePhaseAuth
+	tracePhaseReady
+	numTracePhases
+)
+
+var tracePhaseNames = []string{"startup", "select", "dial", "auth", "ready"}
+
+var handshakePhaseMetric = defineMetric("pgreplicaproxy_handshake_phase_seconds", histogramMetric,
+	"Time taken by each phase of traced connection handshakes.", latencyBuckets, "phase")
+
+// When each phase ended; the zero time for phases not reached yet.
+type handshakeTrace struct {
+	ends [numTracePhases]time.Time
+}
+
+// Starts tracing a new session's handshake, if it's sampled.
+func (s *session) sampleHandshakeTrace() {
+	if sample := cfg.Pgreplicaproxy.Handshake_Trace_Sample; sample > 0 && rand.Float64() < sample {
+		s.trace = &handshakeTrace{}
+	}
+}
+
+// Records the end of a phase of a traced handshake; the last phase publishes
+// the trace.
+func (s *session) tracePhase(phase int) {
+	if s.trace == nil {
+		return
+	}
+	s.trace.ends[phase] = time.Now()
+	if phase == tracePhaseReady {
+		s.publishHandshakeTrace()
+	}
+}
+
+func (s *session) publishHandshakeTrace() {
+	var summary bytes.Buffer
+	start := s.started
+	for phase, end := range s.trace.ends {
+		if end.IsZero() {
+			continue
+		}
+		duration := end.Sub(start)
+		start = end
+		observeMetric(handshakePhaseMetric, duration.Seconds(), tracePhaseNames[phase])
+		fmt.Fprintf(&summary, " %v=%.3fms", tracePhaseNames[phase], duration.Seconds()*1000)
+	}
+	log.Printf("session %v: handshake trace: %v total=%.3fms%v", s.id, backendLabel(s.backend),
+		start.Sub(s.started).Seconds()*1000, summary.String())
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With auth-type=jwt, clients send a JSON Web Token as their (cleartext)
+// password, as service meshes and workload identity systems issue them.  The
+// token must be signed with RSA (RS256, RS384, RS512, PS256, PS384, PS512) or
+// ECDSA (ES256, ES384, ES512) by a key from the JWKS at jwt-jwks-url, which
+// is fetched at startup, every jwt-jwks-refresh (default 1h), and when a
+// token names an unknown key, at most once a minute.  It must be current,
+// and have the issuer jwt-issuer and the audience jwt-audience, if set.
+// The role is the value of its jwt-role-claim (default sub), or, if
+// jwt-role-map is set, what its entries, each a claim value followed by a
+// role, map that to; the user name in the startup message must be the role.
+// The proxy then connects to the backend as the role with its own
+// credentials, found as user-map's are (see usermap.go).
+
+const defaultJWKSRefresh = time.Hour
+const jwksMinRefetch = time.Minute
+const jwtLeeway = time.Minute
+const jwksTimeout = 10 * time.Second
+
+var invalidJWT = errors.New("Invalid JWT")
+
+var jwks = struct {
+	sync.Mutex
+	keys      map[string]crypto.PublicKey
+	attempted time.Time
+}{keys: make(map[string]crypto.PublicKey)}
+
+var jwtRoleMap map[string]string
+
+func setupJWT() {
+	global := &cfg.Pgreplicaproxy
+	if global.Jwt_Jwks_Url == "" {
+		log.Fatal("auth-type jwt requires jwt-jwks-url")
+	}
+	jwtRoleMap = make(map[string]string)
+	for _, entry := range global.Jwt_Role_Map {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			log.Fatalf("jwt-role-map must be a claim value followed by a role: %v", entry)
+		}
+		jwtRoleMap[fields[0]] = fields[1]
+	}
+	if err := fetchJWKS(); err != nil {
+		log.Fatalf("jwt-jwks-url: %v", err)
+	}
+	jwks.attempted = time.Now()
+
+	refresh := global.Jwt_Jwks_Refresh.Duration
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+	go func() {
+		for range time.Tick(refresh) {
+			if err := fetchJWKS(); err != nil {
+				log.Printf("jwt-jwks-url: keeping the previous keys: %v", err)
+			}
+		}
+	}()
+}
+
+// Authenticates a client with a JWT sent as its password.  On success, the
+// client is waiting for the backend's AuthenticationOk.
+func authenticateJWT(conn io.ReadWriter, user string) (*authCredentials, error) {
+	writeAuthRequest(conn, authenticationCleartextPassword, nil)
+	response, err := readPasswordMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	token, _ := readCString(response)
+
+	claims, err := verifyJWT(token)
+	if err != nil {
+		return nil, clientAuthError{err.Error()}
+	}
+	role, err := jwtRole(claims)
+	if err != nil {
+		return nil, clientAuthError{err.Error()}
+	}
+	if role != user {
+		logDebug("JWT role %v doesn't match user %v", role, user)
+		return nil, authenticationFailed
+	}
+	return &authCredentials{user: user, backendRole: role}, nil
+}
+
+func jwtRole(claims map[string]interface{}) (string, error) {
+	claim := firstNonEmpty(cfg.Pgreplicaproxy.Jwt_Role_Claim, "sub")
+	value, ok := claims[claim].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("JWT has no %v claim", claim)
+	}
+	if role, ok := jwtRoleMap[value]; ok {
+		return role, nil
+	}
+	if len(jwtRoleMap) > 0 {
+		return "", fmt.Errorf("JWT %v claim %v isn't in jwt-role-map", claim, value)
+	}
+	return value, nil
+}
+
+// Checks a JWT's signature and validity, returning its claims.
+func verifyJWT(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidJWT
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, invalidJWT
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidJWT
+	}
+	key, err := jwksKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, invalidJWT
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("JWT has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("JWT isn't valid yet")
+	}
+	if issuer := cfg.Pgreplicaproxy.Jwt_Issuer; issuer != "" && claims["iss"] != issuer {
+		return nil, fmt.Errorf("JWT issuer %v isn't %v", claims["iss"], issuer)
+	}
+	if audience := cfg.Pgreplicaproxy.Jwt_Audience; audience != "" && !jwtHasAudience(claims["aud"], audience) {
+		return nil, fmt.Errorf("JWT isn't meant for audience %v", audience)
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func jwtHasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("JWT algorithm %v isn't supported", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("JWT algorithm %v isn't supported", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return invalidJWT
+		}
+		if alg[0] == 'P' {
+			err := rsa.VerifyPSS(pub, hash, digest, signature, nil)
+			if err != nil {
+				return invalidJWT
+			}
+			return nil
+		}
+		if rsa.VerifyPKCS1v15(pub, hash, digest, signature) != nil {
+			return invalidJWT
+		}
+		return nil
+	case strings.HasPrefix(alg, "ES"):
+		// Each algorithm has its own curve (ES512 uses P-521), and the
+		// signature is r and s, each the size of the curve's order
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != ecdsaAlgorithmCurves[alg] {
+			return invalidJWT
+		}
+		half := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*half {
+			return invalidJWT
+		}
+		r := new(big.Int).SetBytes(signature[:half])
+		s := new(big.Int).SetBytes(signature[half:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return invalidJWT
+		}
+		return nil
+	}
+	// Including "none" and the HMAC algorithms, which would make the
+	// public key a shared secret
+	return fmt.Errorf("JWT algorithm %v isn't supported", alg)
+}
+
+var ecdsaAlgorithmCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// Returns the JWKS key with the given id, refetching the JWKS if the key
+// isn't known and it hasn't been fetched recently.
+func jwksKey(kid string) (crypto.PublicKey, error) {
+	jwks.Lock()
+	key, ok := jwks.keys[kid]
+	stale := time.Since(jwks.attempted) > jwksMinRefetch
+	if !ok && stale {
+		jwks.attempted = time.Now()
+	}
+	jwks.Unlock()
+	if ok {
+		return key, nil
+	}
+	if stale {
+		if err := fetchJWKS(); err != nil {
+			logLimited("jwks", "jwt-jwks-url: %v", err)
+		}
+		jwks.Lock()
+		key, ok = jwks.keys[kid]
+		jwks.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("JWT signed with unknown key %q", kid)
+}
+
+func fetchJWKS() error {
+	client := &http.Client{Timeout: jwksTimeout}
+	resp, err := client.Get(cfg.Pgreplicaproxy.Jwt_Jwks_Url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS endpoint returned %v", resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("the JWKS has no usable signing keys")
+	}
+
+	jwks.Lock()
+	jwks.keys = keys
+	jwks.Unlock()
+	return nil
+}
@@ -1,13 +1,31 @@
 package main
 
+import (
+	"time"
+)
+
+// Every established session registers its BackendKeyData here, so that a
+// CancelRequest can be routed to the session's backend, and deregisters it
+// when it ends.  Should a session end without deregistering (eg. on a panic
+// path), its entry would stay forever, so the entries whose session is no
+// longer registered are swept periodically, and counted as leaked.
+
+const backendKeySweepInterval = time.Minute
+
+var backendKeysMetric = defineMetric("pgreplicaproxy_backend_keys", gaugeMetric,
+	"Entries in the BackendKeyData store, used to route CancelRequests.", nil)
+var backendKeysLeakedMetric = defineMetric("pgreplicaproxy_backend_keys_leaked_total", counterMetric,
+	"BackendKeyData entries swept because their session ended without deregistering them.", nil)
+
 type backendKeyDataMessage struct {
 	processId int32
 	secretKey int32
 }
 
 type registerBackendKeyMessage struct {
-	key     backendKeyDataMessage
-	backend string
+	key       backendKeyDataMessage
+	backend   string
+	sessionId uint64
 }
 
 type deregisterBackendKeyMessage struct {
@@ -19,14 +37,30 @@ type getBackendForBackendKeyMessage struct {
 	returnChan chan *string
 }
 
+// Removes the entries registered before asOf whose session isn't among
+// sessions, and returns how many were removed.
+type sweepBackendKeysMessage struct {
+	sessions   map[uint64]bool
+	asOf       time.Time
+	returnChan chan int
+}
+
+type backendKeyEntry struct {
+	backend    string
+	sessionId  uint64
+	registered time.Time
+}
+
 var registerBackendKeyChan chan registerBackendKeyMessage = make(chan registerBackendKeyMessage)
 var deregisterBackedKeyChan chan deregisterBackendKeyMessage = make(chan deregisterBackendKeyMessage)
 var getBackendForBackendKeyChan chan getBackendForBackendKeyMessage = make(chan getBackendForBackendKeyMessage)
+var sweepBackendKeysChan chan sweepBackendKeysMessage = make(chan sweepBackendKeysMessage)
 
-func registerBackendKey(backendKeyData backendKeyDataMessage, backend string) {
+func registerBackendKey(backendKeyData backendKeyDataMessage, backend string, sessionId uint64) {
 	registerBackendKeyChan <- registerBackendKeyMessage{
 		backendKeyData,
 		backend,
+		sessionId,
 	}
 }
 
@@ -44,11 +78,11 @@ func getBackendForBackendKeyData(backendKeyData backendKeyDataMessage) *string {
 }
 
 func manageBackendKeyDataStorage() {
-	store := make(map[backendKeyDataMessage]string)
+	store := make(map[backendKeyDataMessage]backendKeyEntry)
 	for {
 		select {
 		case register := <-registerBackendKeyChan:
-			store[register.key] = register.backend
+			store[register.key] = backendKeyEntry{register.backend, register.sessionId, time.Now()}
 
 		case deregister := <-deregisterBackedKeyChan:
 			delete(store, deregister.key)
@@ -56,10 +90,41 @@ func manageBackendKeyDataStorage() {
 		case get := <-getBackendForBackendKeyChan:
 			v, ok := store[get.key]
 			if ok {
-				get.returnChan <- &v
+				get.returnChan <- &v.backend
 			} else {
 				get.returnChan <- nil
 			}
+
+		case sweep := <-sweepBackendKeysChan:
+			swept := 0
+			for key, entry := range store {
+				if entry.registered.Before(sweep.asOf) && !sweep.sessions[entry.sessionId] {
+					delete(store, key)
+					swept++
+				}
+			}
+			sweep.returnChan <- swept
+		}
+		setMetric(backendKeysMetric, float64(len(store)))
+	}
+}
+
+// Periodically removes the BackendKeyData entries of sessions that have
+// ended.  Sessions register before their key, so an entry registered before
+// the list of sessions was taken belongs to a session on that list, unless
+// it has leaked.
+func sweepBackendKeys() {
+	for range time.Tick(backendKeySweepInterval) {
+		asOf := time.Now()
+		sessions := make(map[uint64]bool)
+		for _, s := range listSessions() {
+			sessions[s.id] = true
+		}
+		msg := sweepBackendKeysMessage{sessions, asOf, make(chan int)}
+		sweepBackendKeysChan <- msg
+		if swept := <-msg.returnChan; swept > 0 {
+			addMetric(backendKeysLeakedMetric, float64(swept))
+			logLimited("backend-keys-leaked", "Removed %v BackendKeyData entries whose session ended without deregistering them", swept)
 		}
 	}
 }
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// With auth-type=ldap, the proxy asks clients for their password in
+// cleartext, as PostgreSQL's ldap method does, and checks it by binding to
+// the LDAP servers in ldap-server (ldap:// or ldaps:// URLs, tried in turn
+// until one answers).  In simple bind mode, the DN bound as is ldap-prefix,
+// the user name and ldap-suffix, eg. "uid=" and ",ou=people,dc=example,dc=net".
+// In search+bind mode, set with ldap-base-dn, the proxy first binds as
+// ldap-bind-dn with ldap-bind-password (or anonymously), searches the base DN
+// for the entry whose ldap-search-attribute (default uid) is the user name,
+// and then binds as that entry.  ldap-tls upgrades ldap:// connections with
+// StartTLS, and ldap-ca verifies the servers' certificates.  As the proxy
+// then knows the password, it authenticates to the backends with it.
+// Clients should connect with TLS, as their password crosses the network.
+
+const ldapTimeout = 10 * time.Second
+const maxLDAPMessageSize = 1 << 20
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+const (
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+)
+
+var ldapTLSConfig *tls.Config
+var malformedLDAPMessage = errors.New("Malformed LDAP message")
+
+func setupLDAP() {
+	global := &cfg.Pgreplicaproxy
+	if len(global.Ldap_Server) == 0 {
+		log.Fatal("auth-type ldap requires ldap-server")
+	}
+	for _, server := range global.Ldap_Server {
+		u, err := url.Parse(server)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			log.Fatalf("ldap-server must be an ldap:// or ldaps:// URL: %v", server)
+		}
+	}
+	if global.Ldap_Base_Dn == "" && global.Ldap_Prefix == "" && global.Ldap_Suffix == "" {
+		log.Fatal("auth-type ldap requires ldap-base-dn, or ldap-prefix and ldap-suffix")
+	}
+	if global.Ldap_Base_Dn != "" && (global.Ldap_Prefix != "" || global.Ldap_Suffix != "") {
+		log.Fatal("ldap-base-dn can't be combined with ldap-prefix and ldap-suffix")
+	}
+
+	ldapTLSConfig = &tls.Config{}
+	if global.Ldap_Ca != "" {
+		pem, err := ioutil.ReadFile(global.Ldap_Ca)
+		if err != nil {
+			log.Fatalf("ldap-ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("ldap-ca: no certificates found in %v", global.Ldap_Ca)
+		}
+		ldapTLSConfig.RootCAs = pool
+	}
+	applyBackendTLSPolicy(ldapTLSConfig)
+}
+
+// Authenticates a client with its cleartext password against LDAP.  On
+// success, the client is waiting for the backend's AuthenticationOk.
+func authenticateLDAP(conn io.ReadWriter, user string) (*authCredentials, error) {
+	writeAuthRequest(conn, authenticationCleartextPassword, nil)
+	response, err := readPasswordMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	password, _ := readCString(response)
+	if password == "" {
+		// An empty password would be an unauthenticated bind, which
+		// servers accept
+		return nil, authenticationFailed
+	}
+
+	ldap, err := dialLDAP()
+	if err != nil {
+		return nil, err
+	}
+	defer ldap.close()
+
+	global := &cfg.Pgreplicaproxy
+	var dn string
+	if global.Ldap_Base_Dn != "" {
+		code, message, err := ldap.bind(global.Ldap_Bind_Dn, global.Ldap_Bind_Password)
+		if err != nil {
+			return nil, err
+		} else if code != ldapResultSuccess {
+			return nil, fmt.Errorf("LDAP bind as ldap-bind-dn failed: %v (%v)", message, code)
+		}
+		dn, err = ldap.searchUser(global.Ldap_Base_Dn, firstNonEmpty(global.Ldap_Search_Attribute, "uid"), user)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if strings.ContainsAny(user, ",+\"\\<>;=#") {
+			return nil, clientAuthError{fmt.Sprintf("user name %q contains characters that can't be used in an LDAP DN", user)}
+		}
+		dn = global.Ldap_Prefix + user + global.Ldap_Suffix
+	}
+
+	code, message, err := ldap.bind(dn, password)
+	if err != nil {
+		return nil, err
+	} else if code == ldapResultInvalidCredentials {
+		return nil, authenticationFailed
+	} else if code != ldapResultSuccess {
+		return nil, fmt.Errorf("LDAP bind as %v failed: %v (%v)", dn, message, code)
+	}
+	return &authCredentials{user: user, password: password, md5Hash: md5Password(password, user)}, nil
+}
+
+type ldapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int
+}
+
+// Connects to the first LDAP server that answers.
+func dialLDAP() (*ldapConn, error) {
+	var lastErr error
+	for _, server := range cfg.Pgreplicaproxy.Ldap_Server {
+		ldap, err := dialLDAPServer(server)
+		if err == nil {
+			return ldap, nil
+		}
+		logLimited("ldap "+server, "LDAP server %v: %v", server, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func dialLDAPServer(server string) (*ldapConn, error) {
+	u, _ := url.Parse(server)
+	address := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "ldaps" {
+			address = net.JoinHostPort(u.Hostname(), "636")
+		} else {
+			address = net.JoinHostPort(u.Hostname(), "389")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", address, ldapTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+
+	config := ldapTLSConfig.Clone()
+	config.ServerName = u.Hostname()
+	if u.Scheme == "ldaps" {
+		conn = tls.Client(conn, config)
+	}
+	ldap := &ldapConn{conn: conn, reader: bufio.NewReader(conn)}
+	if u.Scheme == "ldap" && cfg.Pgreplicaproxy.Ldap_Tls {
+		code, message, err := ldap.request(berElement(0x77, berElement(0x80, []byte(ldapStartTLSOID))), 0x78)
+		if err == nil && code != ldapResultSuccess {
+			err = fmt.Errorf("StartTLS refused: %v (%v)", message, code)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		ldap.conn = tls.Client(conn, config)
+		ldap.reader = bufio.NewReader(ldap.conn)
+	}
+	return ldap, nil
+}
+
+func (l *ldapConn) close() {
+	// UnbindRequest
+	l.send(berElement(0x42))
+	l.conn.Close()
+}
+
+func (l *ldapConn) bind(dn, password string) (int, string, error) {
+	op := berElement(0x60, berInteger(3), berElement(0x04, []byte(dn)), berElement(0x80, []byte(password)))
+	return l.request(op, 0x61)
+}
+
+// Returns the DN of the single entry under baseDN whose attribute is value.
+func (l *ldapConn) searchUser(baseDN, attribute, value string) (string, error) {
+	filter := berElement(0xa3, berElement(0x04, []byte(attribute)), berElement(0x04, []byte(value)))
+	op := berElement(0x63,
+		berElement(0x04, []byte(baseDN)),
+		berElement(0x0a, []byte{2}), // wholeSubtree
+		berElement(0x0a, []byte{0}), // neverDerefAliases
+		berInteger(2),               // sizeLimit
+		berInteger(int(ldapTimeout.Seconds())),
+		berElement(0x01, []byte{0}), // typesOnly
+		filter,
+		berElement(0x30, berElement(0x04, []byte("1.1")))) // no attributes
+	err := l.send(op)
+	if err != nil {
+		return "", err
+	}
+
+	var dns []string
+	for {
+		tag, content, err := l.receive()
+		if err != nil {
+			return "", err
+		}
+		switch tag {
+		case 0x64: // SearchResultEntry
+			fields, err := parseBER(content)
+			if err != nil || len(fields) < 1 {
+				return "", malformedLDAPMessage
+			}
+			dns = append(dns, string(fields[0].content))
+		case 0x73: // SearchResultReference
+		case 0x65: // SearchResultDone
+			code, message, err := parseLDAPResult(content)
+			if err != nil {
+				return "", err
+			}
+			if code != ldapResultSuccess && !(code == 4 && len(dns) > 1) { // sizeLimitExceeded
+				return "", fmt.Errorf("LDAP search failed: %v (%v)", message, code)
+			}
+			if len(dns) != 1 {
+				return "", clientAuthError{fmt.Sprintf("LDAP search for %v=%v found %v entries", attribute, value, len(dns))}
+			}
+			return dns[0], nil
+		default:
+			return "", malformedLDAPMessage
+		}
+	}
+}
+
+// Sends a request and reads its LDAPResult, which must have the given tag.
+func (l *ldapConn) request(op []byte, responseTag byte) (int, string, error) {
+	err := l.send(op)
+	if err != nil {
+		return 0, "", err
+	}
+	tag, content, err := l.receive()
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != responseTag {
+		return 0, "", malformedLDAPMessage
+	}
+	return parseLDAPResult(content)
+}
+
+func (l *ldapConn) send(op []byte) error {
+	l.messageID++
+	_, err := l.conn.Write(berElement(0x30, berInteger(l.messageID), op))
+	return err
+}
+
+// Reads the next LDAPMessage for the current request, returning its
+// protocolOp's tag and content.
+func (l *ldapConn) receive() (byte, []byte, error) {
+	tag, content, err := readBERElement(l.reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	fields, err := parseBER(content)
+	if tag != 0x30 || err != nil || len(fields) < 2 || berIntegerValue(fields[0].content) != l.messageID {
+		return 0, nil, malformedLDAPMessage
+	}
+	return fields[1].tag, fields[1].content, nil
+}
+
+func parseLDAPResult(content []byte) (int, string, error) {
+	fields, err := parseBER(content)
+	if err != nil || len(fields) < 3 || fields[0].tag != 0x0a {
+		return 0, "", malformedLDAPMessage
+	}
+	return berIntegerValue(fields[0].content), string(fields[2].content), nil
+}
+
+// A minimal encoding of ASN.1 BER elements, as LDAP uses them.
+
+type berField struct {
+	tag     byte
+	content []byte
+}
+
+func berElement(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, part := range parts {
+		content = append(content, part...)
+	}
+	element := []byte{tag}
+	if n := len(content); n < 0x80 {
+		element = append(element, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		element = append(element, 0x80|byte(len(length)))
+		element = append(element, length...)
+	}
+	return append(element, content...)
+}
+
+func berInteger(n int) []byte {
+	content := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		content = append([]byte{byte(n)}, content...)
+	}
+	if content[0]&0x80 != 0 {
+		content = append([]byte{0}, content...)
+	}
+	return berElement(0x02, content)
+}
+
+func berIntegerValue(content []byte) int {
+	n := 0
+	for _, b := range content {
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+func readBERElement(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		if first&0x7f > 4 {
+			return 0, nil, malformedLDAPMessage
+		}
+		length = 0
+		for i := 0; i < int(first&0x7f); i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxLDAPMessageSize {
+		return 0, nil, malformedLDAPMessage
+	}
+	content := make([]byte, length)
+	_, err = io.ReadFull(r, content)
+	return tag, content, err
+}
+
+// Splits the content of a constructed element into its elements.
+func parseBER(content []byte) ([]berField, error) {
+	var fields []berField
+	for len(content) > 0 {
+		if len(content) < 2 {
+			return nil, malformedLDAPMessage
+		}
+		tag, length, offset := content[0], int(content[1]), 2
+		if content[1]&0x80 != 0 {
+			octets := int(content[1] & 0x7f)
+			if octets > 4 || len(content) < 2+octets {
+				return nil, malformedLDAPMessage
+			}
+			length = 0
+			for _, b := range content[2 : 2+octets] {
+				length = length<<8 | int(b)
+			}
+			offset += octets
+		}
+		if length < 0 || len(content)-offset < length {
+			return nil, malformedLDAPMessage
+		}
+		fields = append(fields, berField{tag, content[offset : offset+length]})
+		content = content[offset+length:]
+	}
+	return fields, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var handshakeQueueTimeout = errors.New("Timed out waiting for a connection handshake slot")
+
+const defaultHandshakeQueueTime = 5 * time.Second
+
+// Opens a listener for a listen address: host:port for TCP, @name for an
+// abstract Unix socket, or fd://N for a socket that's already listening on
+// file descriptor N, handed over by a process supervisor, eg. so that the
+// proxy can serve a privileged port without CAP_NET_BIND_SERVICE.
+func listenAddress(address string, backlog int) (net.Listener, error) {
+	if strings.HasPrefix(address, "fd://") {
+		fd, err := strconv.Atoi(address[len("fd://"):])
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("%v: invalid file descriptor", address)
+		}
+		file := os.NewFile(uintptr(fd), address)
+		defer file.Close()
+		return net.FileListener(file)
+	}
+	if strings.HasPrefix(address, "@") {
+		return net.Listen("unix", address)
+	}
+	return listenTCP(address, backlog)
+}
+
+// Opens a TCP listener with the given listen backlog.  The standard library
+// always uses the system's maximum backlog, so when a backlog is configured
+// the socket is created by hand.
+func listenTCP(address string, backlog int) (net.Listener, error) {
+	if backlog <= 0 {
+		return net.Listen("tcp", address)
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Listening on every address uses a dual-stack IPv6 socket where possible,
+	// like net.Listen does.
+	var fd int
+	var sa syscall.Sockaddr
+	err = syscall.EAFNOSUPPORT
+	if addr.IP == nil || addr.IP.To4() == nil {
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+		fd, err = syscall.Socket(syscall.AF_INET6, syscall.SOCK_STREAM, 0)
+	}
+	if err != nil && (addr.IP == nil || addr.IP.To4() != nil) {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], addr.IP.To4())
+		sa = sa4
+		fd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err == nil {
+		err = os.NewSyscallError("bind", syscall.Bind(fd, sa))
+	}
+	if err == nil {
+		err = os.NewSyscallError("listen", syscall.Listen(fd, backlog))
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	file := os.NewFile(uintptr(fd), address)
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// The startup phase of a connection (reading the startup packet, choosing a
+// backend, and authenticating against it) is the most expensive part of its
+// life.  handshakeSlots limits how many connections can be in that phase at
+// once, so that a storm of reconnecting clients is handled in an orderly way.
+var handshakeSlots chan bool
+
+func setupHandshakeLimit() {
+	if cfg.Pgreplicaproxy.Handshake_Limit > 0 {
+		handshakeSlots = make(chan bool, cfg.Pgreplicaproxy.Handshake_Limit)
+	}
+}
+
+// Waits for a free handshake slot, for up to handshake-queue-time.  Returns a
+// function that releases the slot, which may be called more than once.
+func acquireHandshakeSlot() (func(), error) {
+	if handshakeSlots == nil {
+		return func() {}, nil
+	}
+
+	queueTime := cfg.Pgreplicaproxy.Handshake_Queue_Time.Duration
+	if queueTime <= 0 {
+		queueTime = defaultHandshakeQueueTime
+	}
+
+	select {
+	case handshakeSlots <- true:
+	case <-time.After(queueTime):
+		return nil, handshakeQueueTimeout
+	}
+
+	released := false
+	return func() {
+		if !released {
+			released = true
+			<-handshakeSlots
+		}
+	}, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// When a backend is down, connection handlers can produce the same errors at
+// a very high rate.  logLimited allows a burst of messages for each key
+// within a window, and suppresses the rest, summarizing them with a "message
+// repeated N times" line once the window has passed.
+
+const defaultLogBurst = 5
+const defaultLogWindow = 10 * time.Second
+
+type logLimit struct {
+	windowStart time.Time
+	count       int
+	suppressed  int
+	lastMessage string
+}
+
+var logLimits = struct {
+	sync.Mutex
+	limits map[string]*logLimit
+}{limits: make(map[string]*logLimit)}
+
+func logBurst() int {
+	if cfg.Pgreplicaproxy.Log_Burst > 0 {
+		return cfg.Pgreplicaproxy.Log_Burst
+	}
+	return defaultLogBurst
+}
+
+func logWindow() time.Duration {
+	if cfg.Pgreplicaproxy.Log_Window.Duration > 0 {
+		return cfg.Pgreplicaproxy.Log_Window.Duration
+	}
+	return defaultLogWindow
+}
+
+// Logs the details of individual connections and requests, which are only
+// wanted with log-level=debug (the default).
+func logDebug(format string, v ...interface{}) {
+	if cfg.Pgreplicaproxy.Log_Level != "info" {
+		log.Printf(format, v...)
+	}
+}
+
+// Logs a message, unless too many messages with the same key have been
+// logged recently.  The key is typically the format string, possibly combined
+// with the name of the backend involved.
+func logLimited(key string, format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	now := time.Now()
+
+	logLimits.Lock()
+	defer logLimits.Unlock()
+
+	limit, ok := logLimits.limits[key]
+	if !ok {
+		limit = &logLimit{windowStart: now}
+		logLimits.limits[key] = limit
+	} else if now.Sub(limit.windowStart) >= logWindow() {
+		limit.flush()
+		limit.windowStart = now
+		limit.count = 0
+	}
+
+	limit.count++
+	if limit.count <= logBurst() {
+		log.Print(message)
+	} else {
+		limit.suppressed++
+		limit.lastMessage = message
+	}
+}
+
+func (limit *logLimit) flush() {
+	if limit.suppressed > 0 {
+		log.Printf("message repeated %v times in the last %v: %v", limit.suppressed, logWindow(), limit.lastMessage)
+		limit.suppressed = 0
+	}
+}
+
+// Periodically summarizes suppressed messages, so that a burst of errors that
+// stops isn't left unreported, and forgets keys that have gone quiet.
+func flushLimitedLogs() {
+	for {
+		time.Sleep(logWindow())
+
+		now := time.Now()
+		logLimits.Lock()
+		for key, limit := range logLimits.limits {
+			if now.Sub(limit.windowStart) >= logWindow() {
+				limit.flush()
+				delete(logLimits.limits, key)
+			}
+		}
+		logLimits.Unlock()
+	}
+}
+
+// A rotatingLogFile is a log destination that renames the log file aside and
+// starts a new one when it grows beyond maxSize bytes or has been open for
+// longer than maxAge.  Old files beyond keep are removed.  It can also be
+// asked to reopen its file, for use with external log rotation tools.  If a
+// new file can't be opened, it carries on writing to the old one.
+type rotatingLogFile struct {
+	mutex   sync.Mutex
+	name    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingLogFile(name string, maxSize int64, maxAge time.Duration, keep int) (*rotatingLogFile, error) {
+	f := &rotatingLogFile{name: name, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Rotated log files are named after the log file, with the time of their
+// rotation appended to a nanosecond, so that they sort in order.
+const rotatedLogTimeFormat = "20060102-150405.000000000"
+
+var rotatedLogSuffix = regexp.MustCompile(`^\.\d{8}-\d{6}(\.\d{9})?$`)
+
+// Opens the log file, closing the one that was open only once it has.
+func (f *rotatingLogFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *rotatingLogFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if (f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize && f.size > 0) ||
+		(f.maxAge > 0 && time.Since(f.opened) >= f.maxAge) {
+		err := f.rotate()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Must be called with the mutex held.
+func (f *rotatingLogFile) rotate() error {
+	rotatedName := f.name + "." + time.Now().Format(rotatedLogTimeFormat)
+	err := os.Rename(f.name, rotatedName)
+	if err != nil {
+		return err
+	}
+	err = f.open()
+	if err != nil {
+		return err
+	}
+
+	if f.keep > 0 {
+		matches, _ := filepath.Glob(f.name + ".*")
+		var rotated []string
+		for _, name := range matches {
+			if rotatedLogSuffix.MatchString(name[len(f.name):]) {
+				rotated = append(rotated, name)
+			}
+		}
+		sort.Strings(rotated)
+		for len(rotated) > f.keep {
+			os.Remove(rotated[0])
+			rotated = rotated[1:]
+		}
+	}
+	return nil
+}
+
+// Closes and reopens the log file under its configured name; used when an
+// external tool has moved the file aside.
+func (f *rotatingLogFile) reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.open()
+}
+
+// Directs the log to the configured log file, if any, and reopens it
+// whenever SIGUSR1 is received.
+func setupLogFile() {
+	if cfg.Pgreplicaproxy.Log_File == "" {
+		return
+	}
+
+	logFile, err := newRotatingLogFile(cfg.Pgreplicaproxy.Log_File, cfg.Pgreplicaproxy.Log_Max_Size,
+		cfg.Pgreplicaproxy.Log_Max_Age.Duration, cfg.Pgreplicaproxy.Log_Keep)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetOutput(logFile)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			err := logFile.reopen()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "log file reopen failed: %v\n", err)
+			}
+			log.Printf("log file reopened")
+		}
+	}()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Long-running transactions on a standby hold back the cleanup that the
+// master's vacuum replicates to it, and when the standby can't wait any
+// longer, queries are cancelled.  A standby with many long sessions at once
+// is most prone to such cancellation storms, so the number of each replica's
+// sessions whose transaction has been open for longer than
+// long-session-threshold is published, and can be capped with
+// replica-max-long-sessions: new sessions are then sent to other replicas,
+// or wait for a long session to end.  Transactions are tracked by the
+// statistics, from the client's first message to the backend's
+// ReadyForQuery that reports it idle, whose status is only kept in
+// protocol-aware mode, so long sessions are only counted then.
+
+const defaultLongSessionThreshold = time.Minute
+const defaultLongSessionQueueTimeout = 30 * time.Second
+const longSessionsPublishInterval = 5 * time.Second
+const longSessionsRetryInterval = 250 * time.Millisecond
+
+var longSessionsMetric = defineMetric("pgreplicaproxy_backend_long_sessions", gaugeMetric,
+	"Replica sessions whose transaction has been open longer than long-session-threshold.", nil, "backend")
+
+var longSessionQueueTimeout = errors.New("Timed out waiting for a replica with fewer long sessions")
+
+func longSessionThreshold() time.Duration {
+	if cfg.Pgreplicaproxy.Long_Session_Threshold.Duration > 0 {
+		return cfg.Pgreplicaproxy.Long_Session_Threshold.Duration
+	}
+	return defaultLongSessionThreshold
+}
+
+func validateLongSessions() {
+	if cfg.Pgreplicaproxy.Protocol_Aware {
+		return
+	}
+	if cfg.Pgreplicaproxy.Long_Session_Threshold.Duration > 0 {
+		log.Fatal("long-session-threshold requires protocol-aware")
+	}
+	if cfg.Pgreplicaproxy.Replica_Max_Long_Sessions > 0 {
+		log.Fatal("replica-max-long-sessions requires protocol-aware")
+	}
+}
+
+// Counts the long sessions of each replica, by backend.
+func countLongSessions() map[string]int {
+	counts := make(map[string]int)
+	longSince := time.Now().Add(-longSessionThreshold()).UnixNano()
+	for _, s := range listSessions() {
+		xactStarted := atomic.LoadInt64(&s.xactStarted)
+		if s.replica && xactStarted != 0 && xactStarted < longSince {
+			counts[s.backend]++
+		}
+	}
+	return counts
+}
+
+func publishLongSessions() {
+	for range time.Tick(longSessionsPublishInterval) {
+		counts := countLongSessions()
+		for _, backend := range currentBackends() {
+			setMetric(longSessionsMetric, float64(counts[backend]), backendLabel(backend))
+		}
+	}
+}
+
+// Given the replica chosen for a new session, finds one with fewer than
+// replica-max-long-sessions long sessions, asking the oracle for the others
+// in turn, and waiting for up to long-session-queue-timeout if they're all
+// at the limit.  onWait is called before waiting.
+func avoidLongSessions(replica *string, cluster, members map[string]bool, onWait func()) (*string, error) {
+	limit := cfg.Pgreplicaproxy.Replica_Max_Long_Sessions
+	if limit <= 0 {
+		return replica, nil
+	}
+	queueTimeout := cfg.Pgreplicaproxy.Long_Session_Queue_Timeout.Duration
+	if queueTimeout <= 0 {
+		queueTimeout = defaultLongSessionQueueTimeout
+	}
+
+	deadline := time.Now().Add(queueTimeout)
+	for {
+		counts := countLongSessions()
+		for i := 0; i < len(currentBackends()); i++ {
+			if counts[*replica] < limit {
+				return replica, nil
+			}
+			next, err := requestBackend(replicaRequestChannel, cluster, members, false)
+			if err != nil {
+				return nil, err
+			} else if next == nil {
+				break
+			}
+			replica = next
+		}
+
+		if time.Now().After(deadline) {
+			return nil, longSessionQueueTimeout
+		}
+		if onWait != nil {
+			onWait()
+			onWait = nil
+		}
+		time.Sleep(longSessionsRetryInterval)
+	}
+}
@@ -1,53 +1,474 @@
 package main
 
 import (
-	"code.google.com/p/gcfg"
+	"flag"
 	"log"
 	"net"
+	"os"
+	"time"
 )
 
 type config struct {
 	Pgreplicaproxy struct {
-		Listen  []string
-		Backend []string
+		Include       []string
+		Listen        []string
+		Backend       []string
+		Backend_File  string
+		Pgbouncer_Ini string
+		Admin         string
+		Sidecar       bool
+
+		Replica_Suffix   string
+		Replica_Prefix   string
+		Missing_Database string
+		Default_Database string
+
+		Ssl_Required           bool
+		Allow                  []string
+		Max_Client_Connections int
+
+		Listen_Backlog         int
+		Handshake_Limit        int
+		Handshake_Queue_Time   duration
+		Handshake_Trace_Sample float64
+
+		Startup_Max_Packet_Size      int
+		Startup_Max_Parameters       int
+		Startup_Max_Parameter_Length int
+		Special_Request              []string
+		Sni_Route                    []string
+		Routing_Hint_Prefix          string
+		Startup_Parameter            []string
+
+		Tcp_Keepalive     duration
+		Half_Open_Timeout duration
+
+		Client_Keepalive_Interval duration
+		Client_Keepalive_Message  string
+
+		Service_File string
+
+		Ssl_Cert string
+		Ssl_Key  string
+		Tls_Fips bool
+
+		Tls_Min_Version         string
+		Tls_Ciphers             []string
+		Tls_Curves              []string
+		Backend_Tls_Min_Version string
+		Backend_Tls_Ciphers     []string
+		Backend_Tls_Curves      []string
+
+		Backend_Sslmode     string
+		Backend_Sslrootcert string
+
+		Ssl_Ca                 string
+		Ssl_Client_Cert        string
+		Ssl_Crl                string
+		Ssl_Ocsp_Responder     string
+		Ssl_Revocation_Refresh duration
+		Ssl_Revocation_Strict  bool
+
+		Auth_Type     string
+		Auth_File     string
+		Auth_Query    string
+		Auth_User     string
+		Auth_Password string
+		Auth_Database string
+
+		Ldap_Server           []string
+		Ldap_Tls              bool
+		Ldap_Ca               string
+		Ldap_Prefix           string
+		Ldap_Suffix           string
+		Ldap_Base_Dn          string
+		Ldap_Bind_Dn          string
+		Ldap_Bind_Password    string
+		Ldap_Search_Attribute string
+
+		Jwt_Jwks_Url     string
+		Jwt_Jwks_Refresh duration
+		Jwt_Issuer       string
+		Jwt_Audience     string
+		Jwt_Role_Claim   string
+		Jwt_Role_Map     []string
+
+		Auth_Failure_Delay           duration
+		Auth_Failure_Ban_Threshold   int
+		Auth_Failure_Ban_Time        duration
+		Auth_Failure_Window          duration
+		Auth_Failure_Max_Delay       duration
+		Auth_Failure_Protocol_Errors bool
+
+		Cluster_Listen string
+		Peer           []string
+		Cluster_Ca     string
+		Cluster_Cert   string
+		Cluster_Key    string
+		Tunnel_Listen  string
+
+		Cancel_Broadcast bool
+
+		Protocol_Aware      bool
+		Query_Rate_Limit    float64
+		Query_Rate_Burst    int
+		Query_Rate_Limit_By string
+		Query_Rate_Action   string
+
+		Replica_Max_Result_Rows  int64
+		Replica_Max_Result_Bytes int64
+
+		Response_Time_Weighting bool
+		Balancer_Seed           int64
+		Zone                    string
+		Client_Zone             []string
+		Replica_Affinity        string
+
+		Long_Session_Threshold     duration
+		Replica_Max_Long_Sessions  int
+		Long_Session_Queue_Timeout duration
+
+		Rebalance_Interval duration
+		Rebalance_Skew     float64
+		Rebalance_Fraction float64
+
+		Query_Cache_Max_Bytes       int
+		Query_Cache_Max_Entry_Bytes int
+
+		Backup_Application_Name []string
+		Backup_Backend          string
+
+		Replica_Only []string
+
+		Database_Max_Connections int
+		Database_Queue_Timeout   duration
+		Drain_Message            string
+
+		Fingerprint_Max_Connections int
+		Fingerprint_Queue_Timeout   duration
+
+		Metrics_Listen string
+		Stats_Period   duration
+
+		Slo_Target float64
+		Slo_Period duration
+
+		Shutdown_Timeout duration
+
+		Stats_Table           string
+		Stats_Export_Interval duration
+
+		Warmup_Query   []string
+		Warmup_Script  string
+		Warmup_Timeout duration
+
+		Dns_Listen string
+		Dns_Name   string
+		Dns_Ttl    int
+
+		Capture_Dir   string
+		Capture_Limit int
+
+		Health_Check_Interval duration
+		Connect_Timeout       duration
+		Parameter_Check       []string
+		Max_Replication_Lag   duration
+
+		Parameter_Status_Prefix string
+		Master_Outage_Reads     bool
+
+		Monitor_User     string
+		Monitor_Password string
+		Monitor_Database string
+		Monitor_Passfile string
+
+		Vault_Address        string
+		Vault_Token_File     string
+		Vault_Ca             string
+		Vault_Monitor_Secret string
+		Vault_Role_Secret    []string
+
+		Aws_Iam_Auth bool
+		Aws_Region   string
+
+		Log_Level  string
+		Log_Burst  int
+		Log_Window duration
+		Log_Redact []string
+
+		Log_File     string
+		Log_Max_Size int64
+		Log_Max_Age  duration
+		Log_Keep     int
+	}
+
+	Database map[string]*struct {
+		Max_Connections    int
+		Min_Server_Version string
+		Max_Server_Version string
+		Replica_Routing    string
+		Replica_Fallback   bool
+
+		Cache_Query []string
+		Cache_Ttl   duration
+
+		User_Map []string
+	}
+
+	Listener map[string]*listenerConfig
+
+	Tunnel map[string]*tunnelConfig
+
+	Backend map[string]*backendDialConfig
+
+	Backend_Cluster map[string]*backendClusterConfig
+
+	Replica_Group map[string]*struct {
+		Member []string
+	}
+
+	Route map[string]*struct {
+		Database      []string
+		Schedule      string
+		Time_Zone     string
+		Replica_Group string
+	}
+
+	Routing_Rule map[string]*struct {
+		User             []string
+		Database         []string
+		Client           []string
+		Application_Name []string
+		Action           string
+		Replica_Group    string
+		Message          string
 	}
 }
 
-var masterRequestChannel = make(chan serverRequest)
-var replicaRequestChannel = make(chan serverRequest)
-var serverStatusUpdateChannel = make(chan serverStatusUpdate)
+// Options of a [listener "name"] section; those left unset take their values
+// from [pgreplicaproxy].
+type listenerConfig struct {
+	Listen           []string
+	Read_Only        bool
+	Read_Write       bool
+	Replica_Suffix   string
+	Replica_Prefix   string
+	Missing_Database string
+	Default_Database string
+
+	Ssl_Cert        string
+	Ssl_Key         string
+	Ssl_Ca          string
+	Ssl_Client_Cert string
+	Ssl_Required    optionalBool
+	Tls_Passthrough string
+	Sni_Route       []string
+
+	Allow                  []string
+	Max_Client_Connections int
+
+	Tcp_Keepalive             duration
+	Client_Keepalive_Interval duration
+	Client_Keepalive_Message  string
+}
+
+// Options of a [backend-cluster "name"] section; those left unset take their
+// values from [pgreplicaproxy].
+type backendClusterConfig struct {
+	Backend  []string
+	Database []string
+
+	Replica_Suffix        string
+	Health_Check_Interval duration
+}
+
+// Options of a [tunnel "name"] section: the backends, by network address,
+// whose connections go through the pgreplicaproxy at address.
+type tunnelConfig struct {
+	Address  string
+	Backend  []string
+	Compress bool
+}
+
+// Options of a [backend "address"] section: dial options, the weight and
+// maintenance windows for the backend with that network address.  Those
+// left unset take their values from [pgreplicaproxy].
+type backendDialConfig struct {
+	Connect_Timeout duration
+	Tcp_Keepalive   duration
+	Source_Address  string
+	Weight          int
+	Zone            string
+
+	Maintenance_Schedule      string
+	Maintenance_Time_Zone     string
+	Maintenance_Drain_Timeout duration
+}
+
+var cfg config
+
+const oracleRequestQueue = 128
+
+var masterRequestChannel = make(chan serverRequest, oracleRequestQueue)
+var replicaRequestChannel = make(chan serverRequest, oracleRequestQueue)
+var serverStatusUpdateChannel = make(chan bool, 1)
+var simulateFailoverChannel = make(chan time.Duration, 1)
+var oraclePingChannel = make(chan chan bool)
 var exitChan = make(chan bool)
 
 func main() {
-	cfg := config{}
-	err := gcfg.ReadFileInto(&cfg, "pgreplicaproxy.cfg")
+	flag.Parse()
+	if *selfTestFlag {
+		os.Exit(runSelfTest())
+	}
+	err := readConfig(&cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	applyFlags()
+	if !*checkConfigFlag {
+		setupLogFile()
+	}
+
+	cfg.Pgreplicaproxy.Backend, err = appendBackendFile(&cfg, cfg.Pgreplicaproxy.Backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Pgreplicaproxy.Backend, err = expandBackendServices(cfg.Pgreplicaproxy.Backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Pgreplicaproxy.Backend, err = expandMultiHostBackends(cfg.Pgreplicaproxy.Backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setupBackendClusters()
+	setupServerVersionWindows()
+	validateDatabaseRouting()
+	setupHandshakeLimit()
+	setupSpecialRequests()
+	validateLogRedact()
+	setupTLSPolicy()
+	validateBackendTLSDefaults()
+	validateFIPSCertificates()
+	setupClientTLS()
+	setupAuthFile()
+	validateAuthQuery()
+	setupClusterTLS()
+	validateTunnels()
+	validateBackendDialOptions()
+	setupMaintenanceWindows()
+	validateQueryRateLimit()
+	validateRebalance()
+	validateLongSessions()
+	setupSLO()
+	setupQueryCache()
+	setupUserMap()
+	setupVault()
+	validateRDSIAMAuth()
+	setupBalancerSeed()
+	setupScheduledRoutes()
+	setupRoutingRules()
+	setupZones()
+	setupStartupParameters()
+	validateReplicaAffinity()
+	setupBackupRouting()
+
+	defaultFrontend := newFrontend("default", &listenerConfig{})
+	frontends := map[string]*frontend{}
+	for name, listener := range cfg.Listener {
+		frontends[name] = newFrontend(name, listener)
+	}
+	if *checkConfigFlag {
+		os.Exit(checkConfig(defaultFrontend, frontends))
+	}
+	setConninfoListeners(defaultFrontend, frontends)
+	checkSidecarListeners()
 
 	go serverStatusOracle()
 	go manageBackendKeyDataStorage()
-	for _, backend := range cfg.Pgreplicaproxy.Backend {
-		go monitorBackend(backend)
+	go manageSessionStorage()
+	go sweepBackendKeys()
+	go flushLimitedLogs()
+	go manageDatabaseCapacity()
+	go manageFingerprintSlots()
+	go reapHalfOpenSessions()
+	go rollStatsPeriods()
+	go pruneAuthFailures()
+	go sendClientKeepalives()
+	go sampleMasterAvailability()
+	go publishSLO()
+	setBackends(configuredBackends())
+	go reloadConfigOnSIGHUP()
+	if cfg.Pgreplicaproxy.Shutdown_Timeout.Duration > 0 {
+		go drainOnSIGTERM()
+	}
+	if files := reloadWatchedFiles(); len(files) > 0 {
+		go watchFilesForReload(files)
+	}
+	if cfg.Pgreplicaproxy.Stats_Table != "" {
+		go exportStatsPeriodically()
+	}
+	if cfg.Pgreplicaproxy.Rebalance_Interval.Duration > 0 {
+		go rebalanceReplicasPeriodically()
+	}
+	if cfg.Pgreplicaproxy.Protocol_Aware {
+		go publishLongSessions()
 	}
 	for _, listen := range cfg.Pgreplicaproxy.Listen {
-		go listenFrontend(listen)
+		listenersReady.Add(1)
+		go listenFrontend(listen, defaultFrontend)
+	}
+	for name, listener := range cfg.Listener {
+		for _, listen := range listener.Listen {
+			listenersReady.Add(1)
+			go listenFrontend(listen, frontends[name])
+		}
+	}
+	go notifySystemd()
+	if cfg.Pgreplicaproxy.Cluster_Listen != "" {
+		go listenCluster(cfg.Pgreplicaproxy.Cluster_Listen)
+	}
+	if cfg.Pgreplicaproxy.Tunnel_Listen != "" {
+		go listenTunnel(cfg.Pgreplicaproxy.Tunnel_Listen)
+	}
+	if cfg.Pgreplicaproxy.Dns_Listen != "" {
+		go listenDNS(cfg.Pgreplicaproxy.Dns_Listen)
+	}
+	if cfg.Pgreplicaproxy.Metrics_Listen != "" {
+		go listenMetrics(cfg.Pgreplicaproxy.Metrics_Listen)
+	}
+	if cfg.Pgreplicaproxy.Admin != "" {
+		go listenAdmin(cfg.Pgreplicaproxy.Admin)
 	}
 
 	// Don't finish main()
 	<-exitChan
 }
 
-func listenFrontend(listen string) {
-	ln, err := net.Listen("tcp", listen)
+func listenFrontend(listen string, fe *frontend) {
+	ln, err := listenAddress(listen, cfg.Pgreplicaproxy.Listen_Backlog)
 	if err != nil {
 		log.Fatal(err)
 	}
+	listenersReady.Done()
+
+	// Wake up periodically to show the systemd watchdog this loop is alive
+	deadlineListener, canSetDeadline := ln.(interface {
+		SetDeadline(time.Time) error
+	})
 	for {
+		if canSetDeadline {
+			deadlineListener.SetDeadline(time.Now().Add(acceptHeartbeatInterval))
+		}
 		conn, err := ln.Accept()
+		acceptHeartbeat(listen)
 		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
 			log.Fatal(err)
 		}
-		go handleIncomingConnection(conn, masterRequestChannel, replicaRequestChannel)
+		go handleIncomingConnection(conn, fe, masterRequestChannel, replicaRequestChannel)
 	}
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// A backend can have a maintenance-schedule in its [backend "address"]
+// section, in the cron-like format of scheduled routes: a window is every
+// minute that the schedule matches, eg. "* 2-3 * * 0" for 02:00-03:59 on
+// Sundays, in the backend's maintenance-time-zone.  During a window the
+// backend's monitor reports it down instead of checking it, so that no new
+// sessions are routed to it, and its existing sessions are closed once
+// maintenance-drain-timeout has passed, if set; otherwise they're left to
+// finish.  Once the window ends, the backend is checked and re-admitted as
+// usual, warm-up included.
+
+type maintenanceWindow struct {
+	schedule     *cronSchedule
+	location     *time.Location
+	drainTimeout time.Duration
+}
+
+var maintenanceWindows = struct {
+	sync.Mutex
+	windows map[string]*maintenanceWindow // by network address
+}{windows: make(map[string]*maintenanceWindow)}
+
+var sessionsClosedForMaintenanceMetric = defineMetric("pgreplicaproxy_sessions_closed_for_maintenance_total", counterMetric,
+	"Sessions closed because their backend's maintenance window began.", nil, "backend")
+
+func setupMaintenanceWindows() {
+	windows := make(map[string]*maintenanceWindow)
+	for address, options := range cfg.Backend {
+		if options.Maintenance_Schedule == "" {
+			continue
+		}
+		window := &maintenanceWindow{location: time.Local, drainTimeout: options.Maintenance_Drain_Timeout.Duration}
+		var err error
+		window.schedule, err = parseCronSchedule(options.Maintenance_Schedule)
+		if err != nil {
+			log.Fatalf("backend %v: maintenance-schedule: %v", address, err)
+		}
+		if options.Maintenance_Time_Zone != "" {
+			window.location, err = time.LoadLocation(options.Maintenance_Time_Zone)
+			if err != nil {
+				log.Fatalf("backend %v: maintenance-time-zone: %v", address, err)
+			}
+		}
+		windows[address] = window
+	}
+
+	maintenanceWindows.Lock()
+	maintenanceWindows.windows = windows
+	maintenanceWindows.Unlock()
+}
+
+// Returns the maintenance window a backend is in now, or nil if none.
+func currentMaintenanceWindow(backend string, now time.Time) *maintenanceWindow {
+	maintenanceWindows.Lock()
+	window := maintenanceWindows.windows[backendLabel(backend)]
+	maintenanceWindows.Unlock()
+	if window == nil || !window.schedule.matches(now.In(window.location)) {
+		return nil
+	}
+	return window
+}
+
+// Closes the sessions to a backend whose maintenance window began at start,
+// once its drain timeout has passed.
+func drainForMaintenance(backend string, window *maintenanceWindow, start, now time.Time) {
+	if window.drainTimeout <= 0 || now.Sub(start) < window.drainTimeout {
+		return
+	}
+	label := backendLabel(backend)
+	for _, s := range listSessions() {
+		if s.backend == backend {
+			log.Printf("session %v: closing session; %v is in a maintenance window", s.id, label)
+			incMetric(sessionsClosedForMaintenanceMetric, label)
+			s.closeConnections()
+		}
+	}
+}
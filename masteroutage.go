@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// With master-outage-reads, sessions that would go to the master are sent to
+// a replica while no master is available, rather than being refused, so that
+// read-heavy applications survive the window of a failover.  They're told
+// with a WARNING NoticeResponse during the handshake, and their writes fail
+// as they would on any replica.  Sessions that can't work on a replica are
+// still refused: those on read-write listeners, those that ask for the master
+// with target_session_attrs or a routing hint, and those of databases whose
+// replica-routing isn't allow.
+
+const masterOutageNoticeText = "No master is available; this session is connected to a read-only replica"
+
+var masterOutageReadsMetric = defineMetric("pgreplicaproxy_master_outage_sessions_total", counterMetric,
+	"Sessions sent to a replica because no master was available.", nil, "database")
+
+func masterOutageReadsAllowed(fe *frontend, database string, masterRequired bool) bool {
+	return cfg.Pgreplicaproxy.Master_Outage_Reads && !fe.readWrite && !masterRequired && databaseReplicaRouting(database) == "allow"
+}
+
+func masterOutageNotice() []byte {
+	var body []byte
+	body = append(body, "SWARNING\x00VWARNING\x00C01000\x00M"...) // warning
+	body = append(body, masterOutageNoticeText...)
+	body = append(body, "\x00\x00"...)
+	message := make([]byte, 5, 5+len(body))
+	message[0] = 'N'
+	binary.BigEndian.PutUint32(message[1:], uint32(len(body)+4))
+	return append(message, body...)
+}
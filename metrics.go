@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics are kept in a simple registry of counters, gauges, and histograms,
+// each of which may be labelled.  They can be read with the admin console's
+// SHOW METRICS command, or scraped from metrics-listen in the Prometheus text
+// format; metrics-listen also serves the service level status at /status,
+// and a readiness probe at /ready.
+
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+// Default histogram buckets, in seconds.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type metricFamily struct {
+	name      string
+	kind      string
+	help      string
+	labelKeys []string
+	buckets   []float64
+	series    map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+
+	// Histograms only
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+var metrics = struct {
+	sync.Mutex
+	families map[string]*metricFamily
+}{families: make(map[string]*metricFamily)}
+
+// Defines a metric; labelKeys are the names of the labels, whose values are
+// given (in the same order) when the metric is updated.
+func defineMetric(name, kind, help string, buckets []float64, labelKeys ...string) string {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	metrics.families[name] = &metricFamily{
+		name:      name,
+		kind:      kind,
+		help:      help,
+		labelKeys: labelKeys,
+		buckets:   buckets,
+		series:    make(map[string]*metricSeries),
+	}
+	return name
+}
+
+// Must be called with the metrics lock held.
+func metricSeriesFor(name string, labelValues []string) *metricSeries {
+	family, ok := metrics.families[name]
+	if !ok {
+		panic("undefined metric " + name)
+	}
+	key := strings.Join(labelValues, "\x00")
+	series, ok := family.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if family.kind == histogramMetric {
+			series.counts = make([]int64, len(family.buckets))
+		}
+		family.series[key] = series
+	}
+	return series
+}
+
+func addMetric(name string, delta float64, labelValues ...string) {
+	metrics.Lock()
+	metricSeriesFor(name, labelValues).value += delta
+	metrics.Unlock()
+}
+
+func incMetric(name string, labelValues ...string) {
+	addMetric(name, 1, labelValues...)
+}
+
+func setMetric(name string, value float64, labelValues ...string) {
+	metrics.Lock()
+	metricSeriesFor(name, labelValues).value = value
+	metrics.Unlock()
+}
+
+func metricValue(name string, labelValues ...string) float64 {
+	metrics.Lock()
+	defer metrics.Unlock()
+	return metricSeriesFor(name, labelValues).value
+}
+
+func observeMetric(name string, value float64, labelValues ...string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	family := metrics.families[name]
+	series := metricSeriesFor(name, labelValues)
+	for i, bound := range family.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+// Estimates a quantile (0 < q < 1) of a histogram by interpolating within its
+// buckets, like Prometheus' histogram_quantile.  Returns NaN if there are no
+// observations.
+func metricQuantile(name string, q float64, labelValues ...string) float64 {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	family := metrics.families[name]
+	series := metricSeriesFor(name, labelValues)
+	if series.count == 0 {
+		return math.NaN()
+	}
+
+	rank := q * float64(series.count)
+	lowerBound, lowerCount := 0.0, int64(0)
+	for i, bound := range family.buckets {
+		if float64(series.counts[i]) >= rank {
+			inBucket := series.counts[i] - lowerCount
+			if inBucket == 0 {
+				return bound
+			}
+			return lowerBound + (bound-lowerBound)*(rank-float64(lowerCount))/float64(inBucket)
+		}
+		lowerBound, lowerCount = bound, series.counts[i]
+	}
+	return lowerBound
+}
+
+// Writes all metrics in the Prometheus text exposition format.
+func writeMetrics(out io.Writer) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	names := make([]string, 0, len(metrics.families))
+	for name := range metrics.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := metrics.families[name]
+		fmt.Fprintf(out, "# HELP %v %v\n", name, family.help)
+		fmt.Fprintf(out, "# TYPE %v %v\n", name, family.kind)
+
+		bucketLabelKeys := append(append([]string(nil), family.labelKeys...), "le")
+
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := family.series[key]
+			labels := formatLabels(family.labelKeys, series.labelValues)
+			if family.kind != histogramMetric {
+				fmt.Fprintf(out, "%v%v %v\n", name, labels, series.value)
+				continue
+			}
+			bucketLabelValues := append(append([]string(nil), series.labelValues...), "")
+			for i, bound := range family.buckets {
+				bucketLabelValues[len(bucketLabelValues)-1] = fmt.Sprint(bound)
+				fmt.Fprintf(out, "%v_bucket%v %v\n", name, formatLabels(bucketLabelKeys, bucketLabelValues), series.counts[i])
+			}
+			bucketLabelValues[len(bucketLabelValues)-1] = "+Inf"
+			fmt.Fprintf(out, "%v_bucket%v %v\n", name, formatLabels(bucketLabelKeys, bucketLabelValues), series.count)
+			fmt.Fprintf(out, "%v_sum%v %v\n", name, labels, series.sum)
+			fmt.Fprintf(out, "%v_count%v %v\n", name, labels, series.count)
+		}
+	}
+}
+
+func formatLabels(keys, values []string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("%v=%q", key, values[i])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Identifies a backend in metric labels by its network address, since the
+// backend's connection string may contain a password.
+func backendLabel(backend string) string {
+	_, address := network(backend)
+	return address
+}
+
+func listenMetrics(listen string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeSLOStatus(w)
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !proxyReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+	log.Fatal(http.ListenAndServe(listen, mux))
+}
@@ -3,14 +3,107 @@ package main
 import (
 	"container/ring"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
 )
 
+// The oracle must never wait for anybody, or one stuck component would stop
+// topology management for everyone.  Requesters wait for the oracle for a
+// limited time, and provide a buffered channel for the response, which the
+// oracle abandons if it isn't ready.  Monitors don't wait for the oracle at
+// all: each backend's latest status is left for the oracle to collect,
+// replacing any earlier status it hasn't collected yet.
+
+const oracleRequestTimeout = 5 * time.Second
+
+var oracleTimeout = errors.New("Timed out waiting for the backend status oracle")
+
 type serverRequest struct {
 	responseChannel chan<- *string
+
+	// The network addresses of the backends that may be chosen, or nil for
+	// any; see databaseCluster.
+	cluster map[string]bool
+
+	// For replica requests, the network addresses of the replicas to prefer,
+	// or nil for any.
+	members map[string]bool
+	// Whether to respond with nil rather than a replica outside members
+	membersOnly bool
+	// For replica requests, a key that chooses the same replica for as long
+	// as it's available, or "" for the rotation; see replica-affinity.
+	affinity string
+}
+
+func (r serverRequest) respond(backend *string) {
+	select {
+	case r.responseChannel <- backend:
+	default:
+		log.Printf("Abandoned response to a requester that isn't waiting")
+	}
+}
+
+// Asks the oracle for a master or replica backend, through requestChannel.
+// cluster and members optionally restrict the choice; see serverRequest.
+func requestBackend(requestChannel chan<- serverRequest, cluster, members map[string]bool, membersOnly bool) (*string, error) {
+	return requestBackendWithAffinity(requestChannel, cluster, members, membersOnly, "")
+}
+
+// Like requestBackend, but for replica requests with an affinity key, always
+// chooses the same replica among those available.
+func requestBackendWithAffinity(requestChannel chan<- serverRequest, cluster, members map[string]bool, membersOnly bool, affinity string) (*string, error) {
+	responseChannel := make(chan *string, 1)
+	timeout := time.After(oracleRequestTimeout)
+	select {
+	case requestChannel <- serverRequest{responseChannel, cluster, members, membersOnly, affinity}:
+	case <-timeout:
+		return nil, oracleTimeout
+	}
+	select {
+	case backend := <-responseChannel:
+		return backend, nil
+	case <-timeout:
+		return nil, oracleTimeout
+	}
+}
+
+var pendingStatusUpdates = struct {
+	sync.Mutex
+	statuses map[string]int
+	order    []string
+}{statuses: make(map[string]int)}
+
+func reportStatus(update serverStatusUpdate) {
+	pendingStatusUpdates.Lock()
+	if _, ok := pendingStatusUpdates.statuses[update.backend]; !ok {
+		pendingStatusUpdates.order = append(pendingStatusUpdates.order, update.backend)
+	}
+	pendingStatusUpdates.statuses[update.backend] = update.status
+	pendingStatusUpdates.Unlock()
+
+	// Wake the oracle, unless it's already due to collect
+	select {
+	case serverStatusUpdateChannel <- true:
+	default:
+	}
+}
+
+func takeStatusUpdates() []serverStatusUpdate {
+	pendingStatusUpdates.Lock()
+	defer pendingStatusUpdates.Unlock()
+
+	updates := make([]serverStatusUpdate, 0, len(pendingStatusUpdates.order))
+	for _, backend := range pendingStatusUpdates.order {
+		updates = append(updates, serverStatusUpdate{pendingStatusUpdates.statuses[backend], backend})
+	}
+	pendingStatusUpdates.statuses = make(map[string]int)
+	pendingStatusUpdates.order = nil
+	return updates
 }
 
 const (
@@ -19,6 +112,7 @@ const (
 	StatusBroken
 	StatusMaster
 	StatusReplica
+	StatusLagging // a replica behind by more than max-replication-lag
 )
 
 type serverStatusUpdate struct {
@@ -32,45 +126,143 @@ func serverStatusOracle() {
 	var masterServer *string
 	var replicaServers = ring.New(0)
 
+	// Every backend that reports itself master, most recent last, for
+	// requests limited to a cluster, each of which has its own master.
+	var masterServers []string
+
+	// For the admin console's SHOW BALANCER
+	selections := make(map[string]int64)
+	var lastReplica string
+
+	// Each replica's running credit for weighted rotation
+	credits := make(map[string]int)
+
+	// While a failover simulation is running, the master is treated as down
+	// from the proxy's point of view, without touching the database servers.
+	var simulatedFailoverEnd <-chan time.Time
+
 	for {
 		select {
 		case masterRequest := (<-masterRequestChannel):
-			log.Printf("masterRequest: %v", masterRequest)
-			masterRequest.responseChannel <- masterServer
+			logDebug("masterRequest: %v", masterRequest)
+			if simulatedFailoverEnd != nil {
+				log.Printf("masterRequest refused; simulated master failure in progress")
+				masterRequest.respond(nil)
+			} else {
+				master := masterServer
+				if masterRequest.cluster != nil {
+					master = clusterMaster(masterServers, masterRequest.cluster)
+				}
+				masterRequest.respond(master)
+				if master != nil {
+					selections[*master]++
+				}
+			}
+
+		case duration := (<-simulateFailoverChannel):
+			if duration == 0 {
+				simulatedFailoverEnd = nil
+				log.Printf("Simulated master failure ended by request")
+			} else {
+				simulatedFailoverEnd = time.After(duration)
+				log.Printf("Simulating master failure for %v", duration)
+			}
+
+		case returnChan := (<-balancerStateChannel):
+			returnChan <- newBalancerState(masterServer, replicaServers, lastReplica, selections, credits)
+
+		case ping := (<-oraclePingChannel):
+			select {
+			case ping <- true:
+			default:
+			}
+
+		case <-simulatedFailoverEnd:
+			simulatedFailoverEnd = nil
+			log.Printf("Simulated master failure ended")
 
 		case replicaRequest := (<-replicaRequestChannel):
-			log.Printf("replicaRequest: %v", replicaRequest)
+			logDebug("replicaRequest: %v", replicaRequest)
 			if replicaServers.Len() == 0 {
-				replicaRequest.responseChannel <- nil
+				replicaRequest.respond(nil)
 			} else {
-				replicaServers = replicaServers.Next()
-				replica := replicaServers.Value.(string)
-				replicaRequest.responseChannel <- &replica
-			}
-
-		case statusUpdate := (<-serverStatusUpdateChannel):
-			if statusUpdate.status == StatusMaster {
-				// This is now master
-				masterServer = &statusUpdate.backend
-				// And it's no longer a replica, if it ever was.
-				replicaServers = removeFromRing(replicaServers, statusUpdate.backend)
-			} else if statusUpdate.status == StatusReplica {
-				// No longer master if it was
-				if masterServer != nil && *masterServer == statusUpdate.backend {
-					masterServer = nil
+				members := replicaRequest.members
+				if replicaRequest.cluster != nil {
+					members = intersectMembers(members, replicaRequest.cluster)
 				}
-				// Make sure backend is only in the ring once by removing first
-				replicaServers = removeFromRing(replicaServers, statusUpdate.backend)
-				replicaServers = addToRing(replicaServers, statusUpdate.backend)
-			} else {
-				// No longer master if it was
-				if masterServer != nil && *masterServer == statusUpdate.backend {
-					masterServer = nil
+				weighted := replicaWeightsConfigured()
+				affinity := replicaRequest.affinity
+				var member *ring.Ring
+				if affinity != "" && members != nil {
+					member = stickyMember(replicaServers, members, affinity)
+				} else if weighted && members != nil {
+					member = nextWeightedMember(replicaServers, members, credits)
+				} else {
+					member = nextMember(replicaServers, members)
+				}
+				if member == nil && replicaRequest.membersOnly {
+					replicaRequest.respond(nil)
+					break
+				}
+				if member == nil && affinity != "" {
+					member = stickyMember(replicaServers, replicaRequest.cluster, affinity)
+				} else if member == nil && cfg.Pgreplicaproxy.Response_Time_Weighting {
+					member = chooseWeightedReplica(replicaServers, replicaRequest.cluster)
+				} else if member == nil && weighted {
+					member = nextWeightedMember(replicaServers, replicaRequest.cluster, credits)
+				} else if member == nil && replicaRequest.cluster != nil {
+					member = nextMember(replicaServers, replicaRequest.cluster)
+				} else if member == nil {
+					member = replicaServers.Next()
+				}
+				if member == nil {
+					// None of the cluster's replicas is up
+					replicaRequest.respond(nil)
+					break
+				}
+				if affinity == "" {
+					// Sticky choices leave the rotation where it was
+					replicaServers = member
+				}
+				replica := member.Value.(string)
+				selections[replica]++
+				lastReplica = replica
+				replicaRequest.respond(&replica)
+			}
+
+		case <-serverStatusUpdateChannel:
+			for _, statusUpdate := range takeStatusUpdates() {
+				masterServers = removeMaster(masterServers, statusUpdate.backend)
+				if statusUpdate.status == StatusMaster {
+					// This is now master
+					newMaster := statusUpdate.backend
+					masterServer = &newMaster
+					masterServers = append(masterServers, newMaster)
+					// And it's no longer a replica, if it ever was.
+					replicaServers = removeFromRing(replicaServers, statusUpdate.backend)
+				} else if statusUpdate.status == StatusReplica {
+					// No longer master if it was
+					if masterServer != nil && *masterServer == statusUpdate.backend {
+						masterServer = nil
+					}
+					// Make sure backend is only in the ring once by removing first
+					replicaServers = removeFromRing(replicaServers, statusUpdate.backend)
+					replicaServers = addToRing(replicaServers, statusUpdate.backend)
+				} else {
+					// No longer master if it was
+					if masterServer != nil && *masterServer == statusUpdate.backend {
+						masterServer = nil
+					}
+					// And it's no longer a replica, if it ever was.
+					replicaServers = removeFromRing(replicaServers, statusUpdate.backend)
 				}
-				// And it's no longer a replica, if it ever was.
-				replicaServers = removeFromRing(replicaServers, statusUpdate.backend)
 			}
 
+			if cfg.Pgreplicaproxy.Balancer_Seed != 0 {
+				replicaServers = orderRing(replicaServers)
+			}
+			credits = make(map[string]int)
+
 			master := "-none-"
 			if masterServer != nil {
 				master = *masterServer
@@ -80,23 +272,130 @@ func serverStatusOracle() {
 	}
 }
 
+// Returns the most recent of masters in cluster, or nil if there's none.
+func clusterMaster(masters []string, cluster map[string]bool) *string {
+	for i := len(masters) - 1; i >= 0; i-- {
+		if cluster[backendLabel(masters[i])] {
+			master := masters[i]
+			return &master
+		}
+	}
+	return nil
+}
+
+func removeMaster(masters []string, backend string) []string {
+	remaining := masters[:0]
+	for _, master := range masters {
+		if master != backend {
+			remaining = append(remaining, master)
+		}
+	}
+	return remaining
+}
+
+// The connection string for health checks of a backend, with the monitor
+// credentials (see pgpass.go, vault.go and rdsiam.go) and connect-timeout
+// applied; connect-timeout doesn't override the backend's own
+// connect_timeout.
+func monitorConnectionString(backend string) string {
+	conninfo := backend
+	o := connectionOptions(backend)
+	user, password := cfg.Pgreplicaproxy.Monitor_User, cfg.Pgreplicaproxy.Monitor_Password
+	if vaultUser, vaultPassword, ok := vaultMonitorCredentials(); ok {
+		user, password = vaultUser, vaultPassword
+	}
+	overrides := []struct{ key, value string }{
+		{"user", user},
+		{"password", password},
+		{"dbname", cfg.Pgreplicaproxy.Monitor_Database},
+	}
+	for _, override := range overrides {
+		if override.value != "" {
+			conninfo += fmt.Sprintf(" %v=%v", override.key, quoteConnectionValue(override.value))
+			o.Set(override.key, override.value)
+		}
+	}
+
+	for _, key := range []string{"sslmode", "sslrootcert"} {
+		if o.Get(key) == "" {
+			if value := backendTLSOptions(backend).Get(key); value != "" {
+				conninfo += fmt.Sprintf(" %v=%v", key, quoteConnectionValue(value))
+			}
+		}
+	}
+
+	if o.Get("password") == "" {
+		if password := lookupBackendPassword(o); password != "" {
+			conninfo += " password=" + quoteConnectionValue(password)
+		}
+	}
+
+	timeout := backendConnectTimeout(backend)
+	if timeout <= 0 || o.Get("connect_timeout") != "" {
+		return conninfo
+	}
+	seconds := int((timeout + time.Second - 1) / time.Second)
+	return fmt.Sprintf("%v connect_timeout=%v", conninfo, seconds)
+}
+
+// Returns whether a backend is listed in replica-only, by network address.
+func replicaOnlyBackend(backend string) bool {
+	for _, address := range cfg.Pgreplicaproxy.Replica_Only {
+		if address == backendLabel(backend) {
+			return true
+		}
+	}
+	return false
+}
+
 // Monitors a single Postgres server and reports changes in status to the
-// serverStatusUpdateChannel provided.
-func monitorBackend(backend string) {
+// oracle, until stop is closed, when it reports the server down.  When
+// suspect is signalled, it reports the server down and checks it again
+// without waiting for the next health check.
+func monitorBackend(backend string, stop <-chan bool, suspect <-chan bool) {
 	first := true
 	status := StatusUnknown
+	var maintenanceStarted time.Time
 
 	for {
 		if !first {
-			time.Sleep(time.Second * 5)
+			select {
+			case <-stop:
+				reportStatus(serverStatusUpdate{StatusDown, backend})
+				return
+			case <-suspect:
+				if status != StatusDown {
+					status = StatusDown
+					reportStatus(serverStatusUpdate{StatusDown, backend}) // I'm  DOWN!
+					log.Printf("%v Lost a session's connection; checking again", backendLabel(backend))
+				}
+			case <-time.After(healthCheckInterval(backend)):
+			}
 		}
 		first = false
 
-		db, err := sql.Open("postgres", backend)
+		now := time.Now()
+		if window := currentMaintenanceWindow(backend, now); window != nil {
+			if maintenanceStarted.IsZero() {
+				maintenanceStarted = now
+				log.Printf("%v Maintenance window began", backendLabel(backend))
+			}
+			if status != StatusDown {
+				status = StatusDown
+				reportStatus(serverStatusUpdate{StatusDown, backend}) // I'm  DOWN!
+			}
+			drainForMaintenance(backend, window, maintenanceStarted, now)
+			continue
+		} else if !maintenanceStarted.IsZero() {
+			maintenanceStarted = time.Time{}
+			log.Printf("%v Maintenance window ended", backendLabel(backend))
+		}
+
+		db, err := sql.Open(monitorDriver(backend), monitorConnectionString(backend))
 		if err != nil {
 			if status != StatusDown {
 				status = StatusDown
-				serverStatusUpdateChannel <- serverStatusUpdate{StatusDown, backend} // I'm  DOWN!
+				reportStatus(serverStatusUpdate{StatusDown, backend}) // I'm  DOWN!
 				log.Printf("%v Connection open failed: %v", backend, err)
 			}
 			continue
@@ -106,7 +405,7 @@ func monitorBackend(backend string) {
 		if err != nil {
 			if status != StatusDown {
 				status = StatusDown
-				serverStatusUpdateChannel <- serverStatusUpdate{StatusDown, backend} // I'm  DOWN!
+				reportStatus(serverStatusUpdate{StatusDown, backend}) // I'm  DOWN!
 				log.Printf("%v Query failed: %v", backend, err)
 			}
 			continue
@@ -118,7 +417,7 @@ func monitorBackend(backend string) {
 			if err != nil {
 				if status != StatusBroken {
 					status = StatusBroken
-					serverStatusUpdateChannel <- serverStatusUpdate{StatusBroken, backend} // I'm  DOWN!
+					reportStatus(serverStatusUpdate{StatusBroken, backend}) // I'm  DOWN!
 					log.Printf("%v .Scan() failed: %v", backend, err)
 				}
 				continue
@@ -128,22 +427,50 @@ func monitorBackend(backend string) {
 		if err != nil {
 			if status != StatusBroken {
 				status = StatusBroken
-				serverStatusUpdateChannel <- serverStatusUpdate{StatusBroken, backend} // I'm  DOWN!
+				reportStatus(serverStatusUpdate{StatusBroken, backend}) // I'm  DOWN!
 				log.Printf("%v Query rows failed: %v", backend, err)
 			}
 			continue
 		}
 
-		if inRecovery {
+		if !inRecovery && replicaOnlyBackend(backend) {
+			// Never handed out for writes, whatever it reports
 			if status != StatusReplica {
+				log.Printf("%v reports itself master, but is replica-only", backendLabel(backend))
+			}
+			inRecovery = true
+		}
+
+		if (inRecovery && status != StatusReplica && status != StatusLagging) || (!inRecovery && status != StatusMaster) {
+			recordServerVersion(db, backend)
+		}
+
+		if inRecovery && replicaLagging(db, backend, status == StatusLagging) {
+			if status != StatusLagging {
+				status = StatusLagging
+				reportStatus(serverStatusUpdate{StatusLagging, backend})
+				log.Printf("%v Replication lag exceeds max-replication-lag", backendLabel(backend))
+			}
+		} else if inRecovery {
+			if status != StatusReplica {
+				if status == StatusLagging {
+					log.Printf("%v Caught up with the master", backendLabel(backend))
+				} else if status != StatusUnknown {
+					// Newly promoted or recovered, rather than just discovered
+					warmBackend(db, backend, StatusReplica)
+				}
 				status = StatusReplica
-				serverStatusUpdateChannel <- serverStatusUpdate{StatusReplica, backend} // I'm a replica!
+				reportStatus(serverStatusUpdate{StatusReplica, backend}) // I'm a replica!
 				log.Printf("%v I'm a replica!", backend)
 			}
 		} else {
 			if status != StatusMaster {
+				if status != StatusUnknown {
+					// Newly promoted or recovered, rather than just discovered
+					warmBackend(db, backend, StatusMaster)
+				}
 				status = StatusMaster
-				serverStatusUpdateChannel <- serverStatusUpdate{StatusMaster, backend} // I'm the master!
+				reportStatus(serverStatusUpdate{StatusMaster, backend}) // I'm the master!
 				log.Printf("%v I'm a master", backend)
 			}
 		}
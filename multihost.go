@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A backend may list several hosts in libpq's multi-host format, eg.
+// "host=db1,db2,db3 port=5432,5432,5433", as client-side failover
+// configurations do.  Each host becomes a separately monitored backend with
+// the other parameters in common.
+
+// Returns the backends with any multi-host entries replaced by one backend per
+// host.  As in libpq, a single port applies to every host, and hostaddr may
+// list addresses corresponding to the hosts.
+func expandMultiHostBackends(backends []string) ([]string, error) {
+	expanded := make([]string, 0, len(backends))
+	seen := make(map[string]bool)
+
+	for _, backend := range backends {
+		o := make(Values)
+		if err := parseOpts(backend, o); err != nil {
+			return nil, fmt.Errorf("backend %v: %v", backendLabel(backend), err)
+		}
+		hosts := strings.Split(o.Get("host"), ",")
+		hostaddrs := strings.Split(o.Get("hostaddr"), ",")
+		ports := strings.Split(o.Get("port"), ",")
+		if len(hosts) == 1 && len(hostaddrs) == 1 && len(ports) == 1 {
+			expanded = append(expanded, backend)
+			continue
+		}
+
+		count := len(hosts)
+		if o.Get("host") == "" {
+			count = len(hostaddrs)
+		}
+		if o.Get("hostaddr") != "" && len(hostaddrs) != count {
+			return nil, fmt.Errorf("backend %q: hostaddr lists %v addresses but host lists %v", backend, len(hostaddrs), count)
+		}
+		if len(ports) != 1 && len(ports) != count {
+			return nil, fmt.Errorf("backend %q: port lists %v ports for %v hosts", backend, len(ports), count)
+		}
+
+		for i := 0; i < count; i++ {
+			single := make(Values)
+			for k, v := range o {
+				single.Set(k, v)
+			}
+			setListElement(single, "host", hosts, i)
+			setListElement(single, "hostaddr", hostaddrs, i)
+			setListElement(single, "port", ports, i)
+
+			singleBackend := single.String()
+			if seen[singleBackend] {
+				continue
+			}
+			seen[singleBackend] = true
+			expanded = append(expanded, singleBackend)
+		}
+	}
+
+	return expanded, nil
+}
+
+// Sets parameter k to the i'th element of a multi-host list, or its only
+// element.  Empty elements leave the parameter to its default, as in libpq.
+func setListElement(o Values, k string, list []string, i int) {
+	value := list[0]
+	if len(list) > 1 {
+		value = list[i]
+	}
+	if value == "" {
+		delete(o, k)
+	} else {
+		o.Set(k, value)
+	}
+}
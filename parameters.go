@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ParameterStatus messages that each backend sends while a session is
+// established are cached, for SHOW PARAMETERS.  Some parameters (TimeZone,
+// DateStyle, and so on) can be set by the client, so the values shown are
+// those of the last session.  The parameters listed in parameter-check, which
+// only the server's own configuration decides, are compared between each
+// replica and its cluster's master: a replica that differs is probably
+// misconfigured, or left behind by an upgrade, so it's logged and shown in
+// the pgreplicaproxy_backend_parameter_divergent metric.
+
+var defaultParameterCheck = []string{"server_version", "server_encoding", "integer_datetimes"}
+
+var parameterDivergentMetric = defineMetric("pgreplicaproxy_backend_parameter_divergent", gaugeMetric,
+	"1 if a replica reports a different value of a parameter-check parameter than its master.", nil, "backend", "parameter")
+
+type backendParameterSet struct {
+	replica    bool
+	parameters map[string]string
+	updated    time.Time
+}
+
+var backendParameters = struct {
+	sync.Mutex
+	backends  map[string]*backendParameterSet
+	divergent map[string]bool
+}{backends: make(map[string]*backendParameterSet), divergent: make(map[string]bool)}
+
+func checkedParameters() []string {
+	if len(cfg.Pgreplicaproxy.Parameter_Check) > 0 {
+		return cfg.Pgreplicaproxy.Parameter_Check
+	}
+	return defaultParameterCheck
+}
+
+// Records the parameters reported by a backend to a new session, and checks
+// them against the other backends if any of the checked ones has changed.
+func recordBackendParameters(backend string, replica bool, parameters map[string]string) {
+	backendParameters.Lock()
+	defer backendParameters.Unlock()
+
+	previous := backendParameters.backends[backend]
+	backendParameters.backends[backend] = &backendParameterSet{replica, parameters, time.Now()}
+
+	changed := previous == nil || previous.replica != replica
+	for _, name := range checkedParameters() {
+		if previous != nil && previous.parameters[name] != parameters[name] {
+			changed = true
+		}
+	}
+	if changed {
+		checkParameterDivergence()
+	}
+}
+
+// Compares every replica's checked parameters with the most recently seen
+// master of its cluster.  Must be called with backendParameters locked.
+func checkParameterDivergence() {
+	clusters := currentBackendClusters()
+	masters := make(map[string]string)
+	for backend, set := range backendParameters.backends {
+		cluster := clusters.clusterOf(backend)
+		master, ok := masters[cluster]
+		if !set.replica && (!ok || backendParameters.backends[master].updated.Before(set.updated)) {
+			masters[cluster] = backend
+		}
+	}
+
+	for backend, set := range backendParameters.backends {
+		master, ok := masters[clusters.clusterOf(backend)]
+		if !set.replica || !ok {
+			continue
+		}
+		for _, name := range checkedParameters() {
+			key := backend + "\x00" + name
+			value, masterValue := set.parameters[name], backendParameters.backends[master].parameters[name]
+			if value == masterValue {
+				if backendParameters.divergent[key] {
+					delete(backendParameters.divergent, key)
+					setMetric(parameterDivergentMetric, 0, backendLabel(backend), name)
+				}
+				continue
+			}
+			if !backendParameters.divergent[key] {
+				backendParameters.divergent[key] = true
+				setMetric(parameterDivergentMetric, 1, backendLabel(backend), name)
+				logLimited("parameter "+key, "%v: replica reports %v=%q, but master %v reports %q",
+					backendLabel(backend), name, value, backendLabel(master), masterValue)
+			}
+		}
+	}
+}
+
+func adminShowParameters(args []string, out io.Writer) error {
+	backendParameters.Lock()
+	defer backendParameters.Unlock()
+
+	var backends []string
+	for backend := range backendParameters.backends {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+
+	for _, backend := range backends {
+		set := backendParameters.backends[backend]
+		role := "master"
+		if set.replica {
+			role = "replica"
+		}
+		var names []string
+		for name := range set.parameters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var values []string
+		for _, name := range names {
+			value := fmt.Sprintf("%v=%q", name, set.parameters[name])
+			if backendParameters.divergent[backend+"\x00"+name] {
+				value += "(divergent)"
+			}
+			values = append(values, value)
+		}
+		fmt.Fprintf(out, "%v role=%v age=%v %v\n", backendLabel(backend), role,
+			time.Since(set.updated)/time.Second*time.Second, strings.Join(values, " "))
+	}
+	return nil
+}
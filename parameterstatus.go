@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// With parameter-status-prefix set (eg. to "pgproxy"), each session is sent
+// ParameterStatus messages for "<prefix>.backend", the network address of the
+// backend it was routed to, and "<prefix>.role", master or replica, just
+// before the backend's BackendKeyData.  Drivers keep the parameters they're
+// sent (libpq's PQparameterStatus, for example), so applications can see
+// where they landed, for debugging and to decide whether to retry elsewhere.
+
+func parameterStatusMessage(name, value string) []byte {
+	body := make([]byte, 0, len(name)+len(value)+2)
+	body = append(body, name...)
+	body = append(body, 0)
+	body = append(body, value...)
+	body = append(body, 0)
+	message := make([]byte, 5, 5+len(body))
+	message[0] = 'S'
+	binary.BigEndian.PutUint32(message[1:], uint32(len(body)+4))
+	return append(message, body...)
+}
+
+// Returns the ParameterStatus messages to inject into a new session's
+// handshake, or nil if none are configured.
+func injectedParameterStatus(backend string, replica bool) []byte {
+	prefix := cfg.Pgreplicaproxy.Parameter_Status_Prefix
+	if prefix == "" {
+		return nil
+	}
+	role := "master"
+	if replica {
+		role = "replica"
+	}
+	messages := parameterStatusMessage(prefix+".backend", backendLabel(backend))
+	return append(messages, parameterStatusMessage(prefix+".role", role)...)
+}
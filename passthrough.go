@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+)
+
+// A listener with tls-passthrough (master or replica) doesn't terminate TLS
+// itself: a client whose first message is an SSLRequest is routed to the
+// master or a replica of the default backends, as tls-passthrough says, and
+// the SSLRequest and everything after it are relayed untouched, so that the
+// client negotiates TLS with the backend directly and the backend's
+// certificate (and client certificate authentication) apply end to end.  As
+// the proxy can't read the startup message, the database name, routing rules
+// and per-database limits play no part, and the session's messages aren't
+// observed.  That includes the BackendKeyData, so the client's
+// CancelRequests can only reach the backend through cancel-broadcast.
+// Direct TLS connections (see directtls.go) are passed through too.
+// Plaintext connections, and those that start with GSSENCRequest, are
+// handled as usual.
+
+// A connection whose first bytes have been peeked at through reader.
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Returns whether a client connection starts with an SSLRequest or a TLS
+// handshake, and the connection to read from in its place.
+func peekSSLRequest(conn net.Conn) (net.Conn, bool) {
+	reader := bufio.NewReaderSize(conn, 64)
+	peeked := &peekedConn{conn, reader}
+	if first, err := reader.Peek(1); err == nil && first[0] == tlsHandshakeRecord {
+		return peeked, true
+	}
+	header, err := reader.Peek(8)
+	if err != nil {
+		return peeked, false
+	}
+	return peeked, binary.BigEndian.Uint32(header) == 8 && binary.BigEndian.Uint32(header[4:]) == sslRequestCode
+}
+
+// Relays a client connection starting with an SSLRequest or a TLS handshake
+// to a backend chosen by the listener's tls-passthrough.
+func proxyTLSPassthrough(sess *session, conn net.Conn, fe *frontend, masterRequestChannel, replicaRequestChannel chan<- serverRequest, releaseHandshakeSlot func()) {
+	sess.replica = fe.tlsPassthrough == "replica"
+	requestChannel := masterRequestChannel
+	if sess.replica {
+		requestChannel = replicaRequestChannel
+	}
+	backend, err := requestBackend(requestChannel, currentBackendClusters().defaultMembers, nil, false)
+	if err != nil || backend == nil {
+		sendError(conn, "Unable to find satisfactory backend server")
+		logLimited("passthrough "+fe.name, "%v: no %v is available for TLS passthrough (%v)", conn.RemoteAddr(), sess.route(), err)
+		return
+	}
+
+	upstream, err := dialBackendPlain(*backend)
+	if err != nil {
+		sendError(conn, "Unable to connect to backend server")
+		logLimited("dial "+*backend, "%v", err)
+		return
+	}
+	defer upstream.Close()
+	logDebug("%v: passing TLS through to %v", conn.RemoteAddr(), *backend)
+
+	sess.backend = *backend
+	sess.backendConn = upstream
+	sess.passthrough = true
+	registerSession(sess)
+	defer deregisterSession(sess)
+	defer sess.finished()
+	releaseHandshakeSlot()
+
+	go func() {
+		numCopied, err := io.Copy(upstream, sess.tapReader(conn, fromClient))
+		logDebug("Copy(upstream, conn) -> %v, %v", numCopied, err)
+		sess.directionFinished(fromClient)
+	}()
+	numCopied, err := io.Copy(conn, sess.tapReader(upstream, fromBackend))
+	logDebug("Copy(conn, upstream) -> %v, %v", numCopied, err)
+	if err != nil && !isConnectionReset(err) {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Teams moving from pgbouncer can point pgbouncer-ini at their pgbouncer.ini
+// to reuse its database definitions.  Each [databases] entry's host (or
+// comma-separated hosts) and port become backends: those of the "*" entry
+// are added to the [pgreplicaproxy] backends, and each other entry's become
+// a backend cluster serving the entry's database, with entries on the same
+// servers sharing one cluster.  Entries on the same servers as "*" need no
+// cluster.  The entry's user and password, if given, are used for health
+// checks.  An entry whose dbname differs from its name can't be served, as
+// the proxy doesn't rename databases.
+//
+// From the [pgbouncer] section, listen_addr and listen_port, auth_type
+// (md5 or scram-sha-256) and auth_file are used unless pgreplicaproxy's own
+// config sets them; other pgbouncer settings are ignored.
+
+// Reads a pgbouncer-style ini file into sections of key/value pairs, in file
+// order.
+func readPgbouncerIni(file string) (map[string][][2]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sections := make(map[string][][2]string)
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("%v:%v: expected key = value", file, lineNumber)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		sections[section] = append(sections[section], [2]string{key, value})
+	}
+	return sections, scanner.Err()
+}
+
+// Adds the definitions of the config's pgbouncer-ini file to the config.
+func applyPgbouncerIni(c *config) error {
+	file := c.Pgreplicaproxy.Pgbouncer_Ini
+	sections, err := readPgbouncerIni(file)
+	if err != nil {
+		return fmt.Errorf("pgbouncer-ini: %v", err)
+	}
+
+	// Entries by the backends they're on, in file order
+	var defaultBackends []string
+	var backendSets []string
+	databasesOn := make(map[string][]string)
+	backendsOf := make(map[string][]string)
+	for _, entry := range sections["databases"] {
+		name := entry[0]
+		o := make(Values)
+		if err := parseOpts(entry[1], o); err != nil {
+			return fmt.Errorf("pgbouncer-ini: database %v: %v", name, err)
+		}
+		backends := pgbouncerEntryBackends(o)
+		if name == "*" {
+			defaultBackends = backends
+			continue
+		}
+		if dbname := o.Get("dbname"); dbname != "" && dbname != name {
+			return fmt.Errorf("pgbouncer-ini: database %v: dbname %v differs from the database name", name, dbname)
+		}
+		key := pgbouncerBackendSet(backends)
+		if _, ok := databasesOn[key]; !ok {
+			backendSets = append(backendSets, key)
+			backendsOf[key] = backends
+		}
+		databasesOn[key] = append(databasesOn[key], name)
+	}
+
+	c.Pgreplicaproxy.Backend = append(c.Pgreplicaproxy.Backend, defaultBackends...)
+	defaultSet := pgbouncerBackendSet(defaultBackends)
+	for _, key := range backendSets {
+		if key == defaultSet {
+			continue
+		}
+		name := "pgbouncer-" + databasesOn[key][0]
+		if c.Backend_Cluster == nil {
+			c.Backend_Cluster = make(map[string]*backendClusterConfig)
+		}
+		if _, ok := c.Backend_Cluster[name]; ok {
+			return fmt.Errorf("pgbouncer-ini: backend-cluster %v is already defined", name)
+		}
+		c.Backend_Cluster[name] = &backendClusterConfig{Backend: backendsOf[key], Database: databasesOn[key]}
+	}
+
+	settings := make(map[string]string)
+	for _, setting := range sections["pgbouncer"] {
+		settings[setting[0]] = setting[1]
+	}
+	if len(c.Pgreplicaproxy.Listen) == 0 && settings["listen_addr"] != "" {
+		port := firstNonEmpty(settings["listen_port"], "6432")
+		for _, addr := range strings.Split(settings["listen_addr"], ",") {
+			addr = strings.TrimSpace(addr)
+			if addr == "*" {
+				addr = ""
+			}
+			c.Pgreplicaproxy.Listen = append(c.Pgreplicaproxy.Listen, net.JoinHostPort(addr, port))
+		}
+	}
+	if c.Pgreplicaproxy.Auth_Type == "" {
+		switch settings["auth_type"] {
+		case "md5", "scram-sha-256":
+			c.Pgreplicaproxy.Auth_Type = settings["auth_type"]
+		}
+	}
+	if c.Pgreplicaproxy.Auth_File == "" {
+		c.Pgreplicaproxy.Auth_File = settings["auth_file"]
+	}
+	return nil
+}
+
+// Returns the backend connection strings for a [databases] entry's
+// connection options, one for each of its hosts.
+func pgbouncerEntryBackends(o Values) []string {
+	hosts := firstNonEmpty(o.Get("host"), "localhost")
+	port := firstNonEmpty(o.Get("port"), "5432")
+
+	var params string
+	for _, key := range []string{"user", "password", "dbname"} {
+		if value := o.Get(key); value != "" {
+			params += fmt.Sprintf(" %v=%v", key, quoteConnectionValue(value))
+		}
+	}
+	var backends []string
+	for _, host := range strings.Split(hosts, ",") {
+		backends = append(backends, fmt.Sprintf("host=%v port=%v%v", quoteConnectionValue(strings.TrimSpace(host)), port, params))
+	}
+	return backends
+}
+
+// Identifies a set of backends by their network addresses.
+func pgbouncerBackendSet(backends []string) string {
+	labels := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		labels = append(labels, backendLabel(backend))
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The health checks' credentials can be kept out of the backend connection
+// strings: monitor-user, monitor-password and monitor-database override the
+// backends' own, and a password that's still missing is looked up in a
+// password file, in the format of libpq's ~/.pgpass.  The file is
+// monitor-passfile, PGPASSFILE, or ~/.pgpass, in that order, and like libpq,
+// it's ignored if its permissions allow access by group or others.
+
+// Returns the password for a connection from the password file, or "".
+func lookupPassfile(o Values) string {
+	path := cfg.Pgreplicaproxy.Monitor_Passfile
+	if path == "" {
+		path = os.Getenv("PGPASSFILE")
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		path = filepath.Join(home, ".pgpass")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logLimited("passfile", "password file %v: %v", path, err)
+		}
+		return ""
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return ""
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		logLimited("passfile", "password file %v has group or world access; ignoring it", path)
+		return ""
+	}
+
+	host := o.Get("host")
+	if host == "" || strings.HasPrefix(host, "/") {
+		host = "localhost"
+	}
+	user := o.Get("user")
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	database := o.Get("dbname")
+	if database == "" {
+		database = user
+	}
+	want := []string{host, o.Get("port"), database, user}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := splitPassfileLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+		matched := true
+		for i, value := range want {
+			if fields[i] != "*" && fields[i] != value {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return fields[4]
+		}
+	}
+	return ""
+}
+
+// Splits a password file line into its colon-separated fields, in which
+// backslash escapes a colon or a backslash.
+func splitPassfileLine(line string) []string {
+	var fields []string
+	var field []byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field = append(field, line[i])
+		case line[i] == ':' && len(fields) < 4:
+			fields = append(fields, string(field))
+			field = nil
+		default:
+			field = append(field, line[i])
+		}
+	}
+	return append(fields, string(field))
+}
+
+// Quotes a value for a connection string, if it's empty or contains
+// whitespace, quotes, backslashes or equals signs.
+func quoteConnectionValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\n\r\f\v'\\=") {
+		return value
+	}
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
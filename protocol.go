@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// A messageFramer follows a stream of protocol messages written to it (in
+// arbitrarily sized pieces) and reports each message once it is complete.
+// Only the first bodyLimit bytes of each message body are retained and
+// reported, so that following a stream is cheap when nobody is interested
+// in message contents.
+type messageFramer struct {
+	onMessage func(msgType byte, length int32, body []byte)
+
+	bodyLimit int32
+
+	header    [5]byte
+	headerLen int
+	msgType   byte
+	length    int32
+	remaining int32
+	body      []byte
+}
+
+func (f *messageFramer) setBodyLimit(limit int) {
+	atomic.StoreInt32(&f.bodyLimit, int32(limit))
+}
+
+func (f *messageFramer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if f.headerLen < len(f.header) {
+			copied := copy(f.header[f.headerLen:], p)
+			f.headerLen += copied
+			p = p[copied:]
+			if f.headerLen < len(f.header) {
+				break
+			}
+
+			f.msgType = f.header[0]
+			f.length = int32(binary.BigEndian.Uint32(f.header[1:]))
+			f.remaining = f.length - 4 // length includes the Int32 containing the length
+			if f.remaining < 0 {
+				f.remaining = 0
+			}
+			f.body = f.body[:0]
+		}
+
+		chunk := p
+		if int32(len(chunk)) > f.remaining {
+			chunk = chunk[:f.remaining]
+		}
+		f.remaining -= int32(len(chunk))
+		p = p[len(chunk):]
+
+		keep := int(atomic.LoadInt32(&f.bodyLimit)) - len(f.body)
+		if keep > len(chunk) {
+			keep = len(chunk)
+		}
+		if keep > 0 {
+			f.body = append(f.body, chunk[:keep]...)
+		}
+
+		if f.remaining == 0 {
+			f.headerLen = 0
+			if f.onMessage != nil {
+				f.onMessage(f.msgType, f.length, f.body)
+			}
+		}
+	}
+	return n, nil
+}
+
+// Returns whether only part of a message has been written.
+func (f *messageFramer) midMessage() bool {
+	return f.headerLen > 0
+}
+
+var clientMessageNames = map[byte]string{
+	'B': "Bind",
+	'C': "Close",
+	'd': "CopyData",
+	'c': "CopyDone",
+	'f': "CopyFail",
+	'D': "Describe",
+	'E': "Execute",
+	'H': "Flush",
+	'F': "FunctionCall",
+	'P': "Parse",
+	'p': "PasswordMessage",
+	'Q': "Query",
+	'S': "Sync",
+	'X': "Terminate",
+}
+
+var backendMessageNames = map[byte]string{
+	'R': "Authentication",
+	'K': "BackendKeyData",
+	'2': "BindComplete",
+	'3': "CloseComplete",
+	'C': "CommandComplete",
+	'd': "CopyData",
+	'c': "CopyDone",
+	'G': "CopyInResponse",
+	'H': "CopyOutResponse",
+	'W': "CopyBothResponse",
+	'D': "DataRow",
+	'I': "EmptyQueryResponse",
+	'E': "ErrorResponse",
+	'V': "FunctionCallResponse",
+	'v': "NegotiateProtocolVersion",
+	'n': "NoData",
+	'N': "NoticeResponse",
+	'A': "NotificationResponse",
+	't': "ParameterDescription",
+	'S': "ParameterStatus",
+	'1': "ParseComplete",
+	's': "PortalSuspended",
+	'Z': "ReadyForQuery",
+	'T': "RowDescription",
+}
+
+const maxDecodedText = 200
+
+// Returns a human readable description of a protocol message, including the
+// interesting fields of the message body (which may be truncated).
+func describeMessage(direction int, msgType byte, length int32, body []byte) string {
+	names := clientMessageNames
+	if direction == fromBackend {
+		names = backendMessageNames
+	}
+	name, ok := names[msgType]
+	if !ok {
+		name = fmt.Sprintf("Unknown(%q)", msgType)
+	}
+	description := fmt.Sprintf("%v length=%v", name, length)
+
+	if direction == fromClient {
+		switch msgType {
+		case 'Q':
+			query, _ := readCString(body)
+			description += fmt.Sprintf(" query=%q", truncateText(query))
+		case 'P':
+			statement, rest := readCString(body)
+			query, _ := readCString(rest)
+			description += fmt.Sprintf(" statement=%q query=%q", statement, truncateText(query))
+		case 'B':
+			portal, rest := readCString(body)
+			statement, _ := readCString(rest)
+			description += fmt.Sprintf(" portal=%q statement=%q", portal, statement)
+		case 'E':
+			portal, rest := readCString(body)
+			if len(rest) >= 4 {
+				description += fmt.Sprintf(" portal=%q maxrows=%v", portal, binary.BigEndian.Uint32(rest))
+			}
+		case 'D', 'C':
+			if len(body) >= 1 {
+				name, _ := readCString(body[1:])
+				description += fmt.Sprintf(" kind=%q name=%q", body[0], name)
+			}
+		case 'p':
+			description += " <credentials not shown>"
+		}
+	} else {
+		switch msgType {
+		case 'Z':
+			if len(body) >= 1 {
+				description += fmt.Sprintf(" status=%q", body[0])
+			}
+		case 'C':
+			tag, _ := readCString(body)
+			description += fmt.Sprintf(" tag=%q", tag)
+		case 'E', 'N':
+			for len(body) > 1 && body[0] != 0 {
+				field := body[0]
+				var value string
+				value, body = readCString(body[1:])
+				if field == 'S' || field == 'C' || field == 'M' {
+					description += fmt.Sprintf(" %c=%q", field, truncateText(value))
+				}
+			}
+		case 'S':
+			name, rest := readCString(body)
+			value, _ := readCString(rest)
+			description += fmt.Sprintf(" %v=%q", name, value)
+		case 'R':
+			if len(body) >= 4 {
+				description += fmt.Sprintf(" code=%v", binary.BigEndian.Uint32(body))
+			}
+		case 'K':
+			if len(body) >= 4 {
+				description += fmt.Sprintf(" pid=%v", binary.BigEndian.Uint32(body))
+			}
+		case 'T', 'D':
+			if len(body) >= 2 {
+				description += fmt.Sprintf(" columns=%v", binary.BigEndian.Uint16(body))
+			}
+		}
+	}
+
+	return description
+}
+
+// Splits a null-terminated string off the front of data.  If there's no
+// terminator (eg. the data was truncated), all of data is returned.
+func readCString(data []byte) (string, []byte) {
+	end := bytes.IndexByte(data, 0)
+	if end == -1 {
+		return string(data), nil
+	}
+	return string(data[:end]), data[end+1:]
+}
+
+// Returns a field of an ErrorResponse or NoticeResponse body, or "" if it's
+// not present.
+func errorResponseField(body []byte, field byte) string {
+	for len(body) > 1 && body[0] != 0 {
+		fieldType := body[0]
+		var value string
+		value, body = readCString(body[1:])
+		if fieldType == field {
+			return value
+		}
+	}
+	return ""
+}
+
+func truncateText(text string) string {
+	if len(text) > maxDecodedText {
+		return text[:maxDecodedText] + "..."
+	}
+	return text
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// In protocol-aware mode (protocol-aware=true), messages from the client are
+// proxied to the backend one at a time, rather than copied as a byte stream,
+// so that they can be inspected, delayed, or refused before they reach the
+// backend.
+
+type clientMessageAction int
+
+const (
+	forwardMessage clientMessageAction = iota
+	refuseMessage
+)
+
+// Proxies client -> backend one message at a time, until an error occurs or
+// the client disconnects.  Returns the number of bytes forwarded.
+func proxyClientMessages(sess *session, client io.Reader, backend io.Writer) (int64, error) {
+	bufferedClient := bufio.NewReader(client)
+	bufferedBackend := bufio.NewWriter(backend)
+	var forwarded int64
+	header := make([]byte, 5)
+
+	for {
+		// Flush what we have before waiting for more from the client
+		if bufferedClient.Buffered() == 0 {
+			err := bufferedBackend.Flush()
+			if err != nil {
+				return forwarded, err
+			}
+		}
+
+		_, err := io.ReadFull(bufferedClient, header)
+		if err != nil {
+			bufferedBackend.Flush()
+			return forwarded, err
+		}
+		msgType := header[0]
+		bodyLength := int64(binary.BigEndian.Uint32(header[1:])) - 4
+		if bodyLength < 0 {
+			return forwarded, incorrectlyFormattedPacket
+		}
+
+		// Queries that may be cached are read whole, as are those that may
+		// change the settings of a session whose queries may be cached;
+		// other messages only have the start of their body peeked at
+		var body []byte
+		wholeBody := (msgType == 'Q' || msgType == 'P') && queryCacheCandidate(sess, bodyLength)
+		if wholeBody {
+			body = make([]byte, bodyLength)
+			_, err = io.ReadFull(bufferedClient, body)
+			if err != nil {
+				return forwarded, err
+			}
+		} else if msgType == 'Q' || msgType == 'P' {
+			peekLength := bodyLength
+			if peekLength > twoPhasePeekLength {
+				peekLength = twoPhasePeekLength
+			}
+			body, _ = bufferedClient.Peek(int(peekLength))
+		}
+
+		if body != nil {
+			noteSessionStateChange(sess, msgType, body, bodyLength)
+		}
+
+		// Two-phase commit commands on replicas are replaced by a query that
+		// refuses them (see twophase.go)
+		replaced := false
+		if body != nil {
+			if replacement := inspectTwoPhaseCommit(sess, msgType, body); replacement != nil {
+				if !wholeBody {
+					_, err = io.CopyN(ioutil.Discard, bufferedClient, bodyLength)
+					if err != nil {
+						return forwarded, err
+					}
+				}
+				body, bodyLength, wholeBody, replaced = replacement, int64(len(replacement)), true, true
+				binary.BigEndian.PutUint32(header[1:], uint32(bodyLength+4))
+			}
+		}
+
+		action := inspectClientMessage(sess, msgType)
+		if action == forwardMessage && msgType == 'Q' && wholeBody && !replaced && answerFromQueryCache(sess, body) {
+			action = refuseMessage
+		}
+		if action == refuseMessage {
+			if !wholeBody {
+				_, err = io.CopyN(ioutil.Discard, bufferedClient, bodyLength)
+				if err != nil {
+					return forwarded, err
+				}
+			}
+			continue
+		}
+
+		atomic.StoreInt32(&sess.backendIdle, 0)
+		_, err = bufferedBackend.Write(header)
+		if err != nil {
+			return forwarded, err
+		}
+		var n int64
+		if wholeBody {
+			var written int
+			written, err = bufferedBackend.Write(body)
+			n = int64(written)
+		} else {
+			n, err = io.CopyN(bufferedBackend, bufferedClient, bodyLength)
+		}
+		forwarded += int64(len(header)) + n
+		if err != nil {
+			return forwarded, err
+		}
+	}
+}
+
+// Decides what to do with a message from the client.  Refusing a message is
+// only done when the backend is idle, so that the proxy's response to the
+// client can't be interleaved with the backend's.
+func inspectClientMessage(sess *session, msgType byte) clientMessageAction {
+	canRefuse := msgType == 'Q' && atomic.LoadInt32(&sess.backendIdle) == 1
+	if msgType == 'Q' || msgType == 'E' {
+		if !applyQueryRateLimit(sess, canRefuse) {
+			// Sent whole, so that it can't be interleaved with the backend's
+			// asynchronous messages
+			var reply bytes.Buffer
+			sendErrorWithCode(&reply, "53400", "Query rate limit exceeded")
+			sendReadyForQuery(&reply, byte(atomic.LoadInt32(&sess.transactionStatus)))
+			sess.writeToClient(reply.Bytes())
+			return refuseMessage
+		}
+	}
+	return forwardMessage
+}
+
+func sendReadyForQuery(conn io.Writer, transactionStatus byte) {
+	conn.Write([]byte{'Z', 0, 0, 0, 5, transactionStatus})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// In protocol-aware mode, a database's [database "name"] section can have
+// the results of some replica queries cached in the proxy: simple Query
+// messages matching one of its cache-query regular expressions, sent outside
+// a transaction, are answered from the cache for cache-ttl (default 5s)
+// after a replica last answered them, absorbing the hot queries of
+// dashboards that many users have open.  Entries are keyed by the query text
+// and every startup parameter but application_name, the database, user,
+// search_path, TimeZone and the like all changing results.  Only complete,
+// successful responses that leave the session idle are cached, up to
+// query-cache-max-entry-bytes (default 1MB) each and query-cache-max-bytes
+// (default 64MB) in all, the entries closest to expiry being evicted first.
+// Queries of the extended protocol aren't cached.  Nor are those of sessions
+// that may have changed their settings, whose results could depend on them:
+// once a session's Query or Parse message mentions SET, RESET, DISCARD or
+// set_config, or is too long to look through, its queries go to the replica.
+
+const defaultQueryCacheTTL = 5 * time.Second
+const defaultQueryCacheMaxBytes = 64 << 20
+const defaultQueryCacheMaxEntryBytes = 1 << 20
+const maxCachedQueryLength = 64 << 10
+
+var sessionStateCommand = regexp.MustCompile(`(?i)\b(set|reset|discard|set_config)\b`)
+
+var queryCacheHitsMetric = defineMetric("pgreplicaproxy_query_cache_hits_total", counterMetric,
+	"Replica queries answered from the query cache, by database.", nil, "database")
+var queryCacheMissesMetric = defineMetric("pgreplicaproxy_query_cache_misses_total", counterMetric,
+	"Cacheable replica queries sent to a replica, by database.", nil, "database")
+var queryCacheBytesMetric = defineMetric("pgreplicaproxy_query_cache_bytes", gaugeMetric,
+	"Size of the responses held in the query cache.", nil)
+
+type queryCacheRules struct {
+	patterns []*regexp.Regexp
+	ttl      time.Duration
+}
+
+// The cache rules of each database with cache-query patterns.
+var queryCacheDatabases map[string]*queryCacheRules
+
+type queryCacheEntry struct {
+	response []byte
+	expires  time.Time
+}
+
+var queryCache = struct {
+	sync.Mutex
+	entries map[string]*queryCacheEntry
+	bytes   int
+}{entries: make(map[string]*queryCacheEntry)}
+
+// A response being collected for the cache, from a session's backend.
+type queryCacheFill struct {
+	database string
+	key      string
+	ttl      time.Duration
+	response []byte
+}
+
+func setupQueryCache() {
+	databases := make(map[string]*queryCacheRules)
+	for database, db := range cfg.Database {
+		if len(db.Cache_Query) == 0 {
+			continue
+		}
+		if !cfg.Pgreplicaproxy.Protocol_Aware {
+			log.Fatalf("database %v: cache-query requires protocol-aware", database)
+		}
+		rules := &queryCacheRules{ttl: db.Cache_Ttl.Duration}
+		if rules.ttl <= 0 {
+			rules.ttl = defaultQueryCacheTTL
+		}
+		for _, pattern := range db.Cache_Query {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				log.Fatalf("database %v: cache-query: %v", database, err)
+			}
+			rules.patterns = append(rules.patterns, re)
+		}
+		databases[database] = rules
+	}
+	queryCacheDatabases = databases
+}
+
+func queryCacheMaxBytes() int {
+	if cfg.Pgreplicaproxy.Query_Cache_Max_Bytes > 0 {
+		return cfg.Pgreplicaproxy.Query_Cache_Max_Bytes
+	}
+	return defaultQueryCacheMaxBytes
+}
+
+func queryCacheMaxEntryBytes() int {
+	if cfg.Pgreplicaproxy.Query_Cache_Max_Entry_Bytes > 0 {
+		return cfg.Pgreplicaproxy.Query_Cache_Max_Entry_Bytes
+	}
+	return defaultQueryCacheMaxEntryBytes
+}
+
+// Returns whether a Query or Parse message of the given length may be
+// cacheable for the session, or may change the session's settings, so that
+// its whole body should be read.
+func queryCacheCandidate(sess *session, bodyLength int64) bool {
+	return sess.replica && queryCacheDatabases[sess.database] != nil && bodyLength <= maxCachedQueryLength
+}
+
+// Notes a Query or Parse message that may change the session's settings.
+// body may be the start of the message's body.
+func noteSessionStateChange(sess *session, msgType byte, body []byte, bodyLength int64) {
+	if !sess.replica || queryCacheDatabases[sess.database] == nil || atomic.LoadInt32(&sess.stateChanged) == 1 {
+		return
+	}
+	if int64(len(body)) < bodyLength || sessionStateCommand.MatchString(messageQuery(msgType, body)) {
+		atomic.StoreInt32(&sess.stateChanged, 1)
+		logDebug("session %v: settings may have changed; its queries won't be cached", sess.id)
+	}
+}
+
+// Answers a Query message from the cache, returning true, if its response is
+// cached.  Otherwise, if it's cacheable, has the backend's response collected
+// for the cache.  The session's backend must be idle.
+func answerFromQueryCache(sess *session, body []byte) bool {
+	if atomic.LoadInt32(&sess.backendIdle) != 1 || atomic.LoadInt32(&sess.transactionStatus) != 'I' ||
+		atomic.LoadInt32(&sess.stateChanged) == 1 {
+		return false
+	}
+	rules := queryCacheDatabases[sess.database]
+	query := strings.TrimRight(string(body), "\x00")
+	matched := false
+	for _, re := range rules.patterns {
+		if re.MatchString(query) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+
+	key := queryCacheKey(sess, query)
+	queryCache.Lock()
+	entry := queryCache.entries[key]
+	queryCache.Unlock()
+	if entry != nil && time.Now().Before(entry.expires) {
+		incMetric(queryCacheHitsMetric, sess.database)
+		logDebug("session %v: query answered from the cache", sess.id)
+		sess.writeToClient(entry.response)
+		return true
+	}
+
+	incMetric(queryCacheMissesMetric, sess.database)
+	sess.mutex.Lock()
+	sess.cacheFill = &queryCacheFill{database: sess.database, key: key, ttl: rules.ttl}
+	sess.updateFramers()
+	sess.mutex.Unlock()
+	return false
+}
+
+// Returns the cache key of a query of the session: its database and user,
+// its startup parameters but application_name as sorted key=value pairs, and
+// the query.
+func queryCacheKey(sess *session, query string) string {
+	var parts []string
+	for key, value := range sess.startupParameters {
+		if key != "application_name" {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	sort.Strings(parts)
+	parts = append([]string{sess.database, sess.user}, parts...)
+	return strings.Join(append(parts, query), "\x00")
+}
+
+// Adds a message from the backend to the response being collected, and
+// stores the response once it's complete.
+func (s *session) fillQueryCache(fill *queryCacheFill, msgType byte, length int32, body []byte) {
+	switch msgType {
+	case 'T', 'D', 'C', 'I', 'N':
+		if int(length)-4 > len(body) || len(fill.response)+int(length)+1 > queryCacheMaxEntryBytes() {
+			s.endQueryCacheFill()
+			return
+		}
+		fill.response = appendMessage(fill.response, msgType, body)
+	case 'Z':
+		if len(body) == 1 && body[0] == 'I' {
+			fill.response = appendMessage(fill.response, msgType, body)
+			storeQueryCacheEntry(fill)
+		}
+		s.endQueryCacheFill()
+	default:
+		// Errors, notifications, COPY and anything else aren't cached
+		s.endQueryCacheFill()
+	}
+}
+
+func (s *session) endQueryCacheFill() {
+	s.mutex.Lock()
+	s.cacheFill = nil
+	s.updateFramers()
+	s.mutex.Unlock()
+}
+
+func appendMessage(buf []byte, msgType byte, body []byte) []byte {
+	length := uint32(len(body) + 4)
+	buf = append(buf, msgType, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	return append(buf, body...)
+}
+
+func storeQueryCacheEntry(fill *queryCacheFill) {
+	now := time.Now()
+	queryCache.Lock()
+	defer queryCache.Unlock()
+
+	if previous, ok := queryCache.entries[fill.key]; ok {
+		queryCache.bytes -= len(previous.response)
+		delete(queryCache.entries, fill.key)
+	}
+	for queryCache.bytes+len(fill.response) > queryCacheMaxBytes() && len(queryCache.entries) > 0 {
+		var evict string
+		var evictExpires time.Time
+		for key, entry := range queryCache.entries {
+			if evict == "" || entry.expires.Before(evictExpires) {
+				evict, evictExpires = key, entry.expires
+			}
+		}
+		queryCache.bytes -= len(queryCache.entries[evict].response)
+		delete(queryCache.entries, evict)
+	}
+	queryCache.entries[fill.key] = &queryCacheEntry{fill.response, now.Add(fill.ttl)}
+	queryCache.bytes += len(fill.response)
+	setMetric(queryCacheBytesMetric, float64(queryCache.bytes))
+}
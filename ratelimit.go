@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// In protocol-aware mode, the rate of queries (simple Query messages, and
+// Execute messages of the extended protocol) can be limited per user or per
+// database with a token bucket, to protect shared backends from runaway batch
+// jobs.  Excess queries are delayed, or refused when query-rate-action is
+// "reject" and the query can be refused safely.
+
+const defaultQueryRateBurst = 10
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+var queryRateBuckets = struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}{buckets: make(map[string]*tokenBucket)}
+
+// Takes a token for a query, waiting for one if necessary.  If canRefuse is
+// set and the action is "reject", returns false rather than waiting.
+func applyQueryRateLimit(sess *session, canRefuse bool) bool {
+	rate := cfg.Pgreplicaproxy.Query_Rate_Limit
+	if rate <= 0 {
+		return true
+	}
+
+	key := sess.user
+	if cfg.Pgreplicaproxy.Query_Rate_Limit_By == "database" {
+		key = sess.database
+	}
+
+	wait := takeToken(key, rate)
+	if wait <= 0 {
+		return true
+	}
+	if canRefuse && cfg.Pgreplicaproxy.Query_Rate_Action == "reject" {
+		logLimited("query rate "+key, "session %v: query refused; rate limit for %v exceeded", sess.id, key)
+		returnToken(key)
+		return false
+	}
+
+	logLimited("query rate "+key, "session %v: query delayed %v; rate limit for %v exceeded", sess.id, wait, key)
+	time.Sleep(wait)
+	return true
+}
+
+// Takes a token from the key's bucket, going into debt if none are
+// available; returns how long to wait until the debt is repaid.
+func takeToken(key string, rate float64) time.Duration {
+	burst := float64(cfg.Pgreplicaproxy.Query_Rate_Burst)
+	if burst <= 0 {
+		burst = defaultQueryRateBurst
+	}
+
+	queryRateBuckets.Lock()
+	defer queryRateBuckets.Unlock()
+
+	now := time.Now()
+	bucket, ok := queryRateBuckets.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, updated: now}
+		queryRateBuckets.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * rate
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.updated = now
+
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / rate * float64(time.Second))
+}
+
+func returnToken(key string) {
+	queryRateBuckets.Lock()
+	defer queryRateBuckets.Unlock()
+
+	if bucket, ok := queryRateBuckets.buckets[key]; ok {
+		bucket.tokens++
+	}
+}
+
+func validateQueryRateLimit() {
+	switch cfg.Pgreplicaproxy.Query_Rate_Limit_By {
+	case "", "user", "database":
+	default:
+		log.Fatalf("query-rate-limit-by must be user or database")
+	}
+	switch cfg.Pgreplicaproxy.Query_Rate_Action {
+	case "", "delay", "reject":
+	default:
+		log.Fatalf("query-rate-action must be delay or reject")
+	}
+	if cfg.Pgreplicaproxy.Query_Rate_Limit > 0 && !cfg.Pgreplicaproxy.Protocol_Aware {
+		log.Fatalf("query-rate-limit requires protocol-aware=true")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With aws-iam-auth, the proxy connects to Amazon RDS and Aurora backends
+// with IAM authentication tokens rather than passwords, wherever it would
+// otherwise look a password up in the password file: for the health checks,
+// auth-user and mapped roles (see usermap.go).  Tokens are signed for the
+// backend's host, port and user in aws-region (default AWS_REGION), are
+// valid for 15 minutes, and are generated again after 10.  The AWS
+// credentials come from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY (and
+// AWS_SESSION_TOKEN), the ECS task role, or the EC2 instance profile, in
+// that order.  RDS requires TLS for IAM authentication, so the backends
+// need sslmode=require or stronger.
+
+const rdsTokenLifetime = 15 * time.Minute
+const rdsTokenReuse = 10 * time.Minute
+const awsCredentialsMargin = 5 * time.Minute
+const awsMetadataTimeout = 5 * time.Second
+const ec2MetadataAddress = "http://169.254.169.254"
+const ecsCredentialsAddress = "http://169.254.170.2"
+
+var rdsTokensMetric = defineMetric("pgreplicaproxy_rds_iam_tokens_total", counterMetric,
+	"RDS IAM authentication tokens generated, by result.", nil, "result")
+
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	expires         time.Time // zero if they don't expire
+}
+
+type rdsToken struct {
+	token     string
+	generated time.Time
+}
+
+var rdsTokens = struct {
+	sync.Mutex
+	tokens      map[string]*rdsToken
+	credentials *awsCredentials
+}{tokens: make(map[string]*rdsToken)}
+
+func awsRegion() string {
+	return firstNonEmpty(cfg.Pgreplicaproxy.Aws_Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"))
+}
+
+func validateRDSIAMAuth() {
+	if cfg.Pgreplicaproxy.Aws_Iam_Auth && awsRegion() == "" {
+		log.Fatal("aws-iam-auth requires aws-region, or AWS_REGION")
+	}
+}
+
+// RDS refuses IAM authentication without TLS, and a token sent in the clear
+// could be replayed for the rest of its lifetime.
+func checkRDSIAMSslmode(o Values) error {
+	if !cfg.Pgreplicaproxy.Aws_Iam_Auth || strings.HasPrefix(o.Get("host"), "/") {
+		return nil
+	}
+	switch o.Get("sslmode") {
+	case "require", "verify-ca", "verify-full":
+		return nil
+	}
+	return fmt.Errorf("aws-iam-auth requires sslmode require, verify-ca or verify-full")
+}
+
+// Returns the password to connect with when the connection options don't
+// have one: an RDS IAM token with aws-iam-auth, or else the password file's.
+func lookupBackendPassword(o Values) string {
+	if !cfg.Pgreplicaproxy.Aws_Iam_Auth || strings.HasPrefix(o.Get("host"), "/") {
+		return lookupPassfile(o)
+	}
+	token, err := rdsIAMToken(o.Get("host"), o.Get("port"), o.Get("user"))
+	if err != nil {
+		logLimited("rds iam", "aws-iam-auth: %v", err)
+		return ""
+	}
+	return token
+}
+
+// Returns an IAM authentication token for a user on an RDS endpoint,
+// generating one if the last one is due to be replaced.
+func rdsIAMToken(host, port, user string) (string, error) {
+	endpoint := host + ":" + port
+	key := endpoint + "/" + user
+
+	rdsTokens.Lock()
+	if cached := rdsTokens.tokens[key]; cached != nil && time.Since(cached.generated) < rdsTokenReuse {
+		rdsTokens.Unlock()
+		return cached.token, nil
+	}
+	credentials := rdsTokens.credentials
+	rdsTokens.Unlock()
+
+	// Fetched without holding rdsTokens, as the metadata services can be
+	// slow; connections that need them at the same time each fetch them
+	if credentials == nil || (!credentials.expires.IsZero() && time.Until(credentials.expires) < awsCredentialsMargin) {
+		var err error
+		credentials, err = loadAWSCredentials()
+		if err != nil {
+			incMetric(rdsTokensMetric, "error")
+			return "", err
+		}
+		rdsTokens.Lock()
+		rdsTokens.credentials = credentials
+		rdsTokens.Unlock()
+	}
+
+	now := time.Now().UTC()
+	token := signRDSToken(endpoint, user, awsRegion(), credentials, now)
+	rdsTokens.Lock()
+	rdsTokens.tokens[key] = &rdsToken{token, now}
+	rdsTokens.Unlock()
+	incMetric(rdsTokensMetric, "ok")
+	return token, nil
+}
+
+// Presigns an rds-db:connect request with AWS Signature Version 4; the token
+// is the presigned URL without its scheme.
+func signRDSToken(endpoint, user, region string, credentials *awsCredentials, now time.Time) string {
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	scope := date + "/" + region + "/rds-db/aws4_request"
+
+	params := map[string]string{
+		"Action":              "connect",
+		"DBUser":              user,
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    credentials.accessKeyID + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       fmt.Sprint(int(rdsTokenLifetime.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+	if credentials.sessionToken != "" {
+		params["X-Amz-Security-Token"] = credentials.sessionToken
+	}
+	var keys []string
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var query []string
+	for _, key := range keys {
+		query = append(query, awsURIEncode(key)+"="+awsURIEncode(params[key]))
+	}
+	canonicalQuery := strings.Join(query, "&")
+
+	emptyPayload := sha256.Sum256(nil)
+	canonicalRequest := strings.Join([]string{
+		"GET", "/", canonicalQuery, "host:" + endpoint + "\n", "host", hex.EncodeToString(emptyPayload[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	signingKey := awsHMAC([]byte("AWS4"+credentials.secretAccessKey), date)
+	for _, part := range []string{region, "rds-db", "aws4_request"} {
+		signingKey = awsHMAC(signingKey, part)
+	}
+	signature := hex.EncodeToString(awsHMAC(signingKey, stringToSign))
+	return endpoint + "/?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+func awsHMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// URI-encodes a query component as SigV4 expects: everything but unreserved
+// characters, with spaces as %20.
+func awsURIEncode(value string) string {
+	return strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+}
+
+func loadAWSCredentials() (*awsCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &awsCredentials{accessKeyID: id, secretAccessKey: secret, sessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	client := &http.Client{Timeout: awsMetadataTimeout}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return fetchAWSCredentials(client, ecsCredentialsAddress+uri, nil)
+	}
+
+	// The EC2 instance metadata service, version 2
+	req, _ := http.NewRequest("PUT", ec2MetadataAddress+"/latest/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := awsMetadataRequest(client, req)
+	if err != nil {
+		return nil, fmt.Errorf("no AWS credentials in the environment, and the instance metadata service failed: %v", err)
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+	req, _ = http.NewRequest("GET", ec2MetadataAddress+"/latest/meta-data/iam/security-credentials/", nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	roles, err := awsMetadataRequest(client, req)
+	if err != nil {
+		return nil, fmt.Errorf("instance profile: %v", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return nil, fmt.Errorf("the instance has no instance profile")
+	}
+	return fetchAWSCredentials(client, ec2MetadataAddress+"/latest/meta-data/iam/security-credentials/"+role, headers)
+}
+
+// Reads temporary credentials from the ECS or EC2 credentials endpoint.
+func fetchAWSCredentials(client *http.Client, address string, headers map[string]string) (*awsCredentials, error) {
+	req, err := http.NewRequest("GET", address, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	body, err := awsMetadataRequest(client, req)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	if response.AccessKeyId == "" || response.SecretAccessKey == "" {
+		return nil, fmt.Errorf("%v returned no credentials", address)
+	}
+	return &awsCredentials{response.AccessKeyId, response.SecretAccessKey, response.Token, response.Expiration}, nil
+}
+
+func awsMetadataRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v returned %v", req.URL, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A session whose client or backend has gone away without closing its
+// connection (a crashed host, a dropped NAT mapping) would otherwise keep its
+// goroutines, backend connection, and database slot forever.  TCP keepalives
+// turn dead peers into read errors, and the reaper closes both sides of any
+// session where one direction has stopped, or where either side has been
+// silent for longer than half-open-timeout.
+
+const defaultTCPKeepalive = time.Minute
+const reaperInterval = 10 * time.Second
+
+var sessionsReapedMetric = defineMetric("pgreplicaproxy_sessions_reaped_total", counterMetric,
+	"Sessions closed by the half-open connection reaper, by reason.", nil, "reason")
+
+func setKeepalive(conn net.Conn) {
+	setKeepalivePeriod(conn, cfg.Pgreplicaproxy.Tcp_Keepalive.Duration)
+}
+
+// Enables TCP keepalives with the given period, or the default if it's zero.
+func setKeepalivePeriod(conn net.Conn, period time.Duration) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if period <= 0 {
+		period = defaultTCPKeepalive
+	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(period)
+}
+
+// Records that the copy reading from one side of the session has ended.
+func (s *session) directionFinished(direction int) {
+	atomic.StoreInt32(&s.finishedDirections[direction], 1)
+}
+
+func reapHalfOpenSessions() {
+	for range time.Tick(reaperInterval) {
+		now := time.Now()
+		for _, s := range listSessions() {
+			if reason, detail := s.halfOpen(now); reason != "" {
+				s.reap(reason, detail)
+			}
+		}
+	}
+}
+
+func (s *session) halfOpen(now time.Time) (string, string) {
+	for direction := range s.finishedDirections {
+		if atomic.LoadInt32(&s.finishedDirections[direction]) == 1 {
+			return "half-closed", fmt.Sprintf("%v stopped sending", directionNames[direction])
+		}
+	}
+
+	limit := cfg.Pgreplicaproxy.Half_Open_Timeout.Duration
+	if limit <= 0 {
+		return "", ""
+	}
+	for direction := range s.lastActivity {
+		silent := now.Sub(time.Unix(0, atomic.LoadInt64(&s.lastActivity[direction])))
+		if silent > limit {
+			return "silent", fmt.Sprintf("%v silent for %v", directionNames[direction], silent)
+		}
+	}
+	return "", ""
+}
+
+func (s *session) reap(reason, detail string) {
+	log.Printf("session %v: closing half-open session: %v", s.id, detail)
+	incMetric(sessionsReapedMetric, reason)
+	s.closeConnections()
+}
+
+// Tells the client, between messages, that its session is being ended with
+// an admin_shutdown error, and closes it.
+func (s *session) terminate(message string) {
+	fatal := fatalErrorMessage("57P01", message)
+	s.mutex.Lock()
+	writer := s.clientWriter
+	s.mutex.Unlock()
+	if writer != nil {
+		writer.writeBetweenMessages(fatal)
+	} else {
+		s.clientConn.Write(fatal)
+	}
+	s.closeConnections()
+}
+
+// Closes both sides of the session, which ends it.
+func (s *session) closeConnections() {
+	s.clientConn.Close()
+	if s.backendConn != nil {
+		s.backendConn.Close()
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Sessions stay on the replica they were first routed to, so long-lived
+// connection pools don't spread onto replicas added later.  With
+// rebalance-interval, the replica sessions of each cluster are counted that
+// often, and when the busiest replica has more than rebalance-skew (default
+// 0.25) above the average, the oldest sessions of the replicas above the
+// average are closed, at most rebalance-fraction (default 0.1) of the
+// cluster's replica sessions each time.  Only sessions idle outside a
+// transaction are closed, with a FATAL admin_shutdown error, which poolers
+// take as a cue to reconnect; as that's only known in protocol-aware mode,
+// rebalancing requires it.
+
+const defaultRebalanceSkew = 0.25
+const defaultRebalanceFraction = 0.1
+const rebalanceMessage = "terminating connection to rebalance sessions across the replicas"
+
+var sessionsRebalancedMetric = defineMetric("pgreplicaproxy_sessions_rebalanced_total", counterMetric,
+	"Idle replica sessions closed to rebalance the replicas, by backend.", nil, "backend")
+
+func validateRebalance() {
+	if cfg.Pgreplicaproxy.Rebalance_Interval.Duration > 0 && !cfg.Pgreplicaproxy.Protocol_Aware {
+		log.Fatal("rebalance-interval requires protocol-aware")
+	}
+	if skew := cfg.Pgreplicaproxy.Rebalance_Skew; skew < 0 {
+		log.Fatal("rebalance-skew must not be negative")
+	}
+	if fraction := cfg.Pgreplicaproxy.Rebalance_Fraction; fraction < 0 || fraction > 1 {
+		log.Fatal("rebalance-fraction must be between 0 and 1")
+	}
+}
+
+func rebalanceReplicasPeriodically() {
+	for range time.Tick(cfg.Pgreplicaproxy.Rebalance_Interval.Duration) {
+		rebalanceReplicas()
+	}
+}
+
+func rebalanceReplicas() {
+	state, err := getBalancerState()
+	if err != nil {
+		logLimited("rebalance", "rebalance: %v", err)
+		return
+	}
+	clusters := currentBackendClusters()
+	groups := []map[string]bool{clusters.defaultMembers}
+	for _, cluster := range clusters.clusters {
+		groups = append(groups, cluster.members)
+	}
+
+	sessions := listSessions()
+	for _, members := range groups {
+		var replicas []string
+		for _, replica := range state.replicas {
+			if members[backendLabel(replica)] {
+				replicas = append(replicas, replica)
+			}
+		}
+		rebalanceReplicaGroup(replicas, sessions)
+	}
+}
+
+// Closes idle sessions of the busiest of a cluster's available replicas, if
+// the sessions are skewed enough.  The sessions are ordered by id, so oldest
+// first.
+func rebalanceReplicaGroup(replicas []string, sessions []*session) {
+	if len(replicas) < 2 {
+		return
+	}
+	byReplica := make(map[string][]*session)
+	for _, replica := range replicas {
+		byReplica[replica] = nil
+	}
+	total := 0
+	for _, s := range sessions {
+		if _, ok := byReplica[s.backend]; ok && s.replica && !s.passthrough {
+			byReplica[s.backend] = append(byReplica[s.backend], s)
+			total++
+		}
+	}
+
+	sort.Slice(replicas, func(i, j int) bool {
+		return len(byReplica[replicas[i]]) > len(byReplica[replicas[j]])
+	})
+	mean := float64(total) / float64(len(replicas))
+	skew := cfg.Pgreplicaproxy.Rebalance_Skew
+	if skew == 0 {
+		skew = defaultRebalanceSkew
+	}
+	if float64(len(byReplica[replicas[0]])) <= mean*(1+skew) {
+		return
+	}
+
+	fraction := cfg.Pgreplicaproxy.Rebalance_Fraction
+	if fraction == 0 {
+		fraction = defaultRebalanceFraction
+	}
+	budget := int(float64(total) * fraction)
+	if budget < 1 {
+		budget = 1
+	}
+	target := int(math.Ceil(mean))
+	closed := 0
+	for _, replica := range replicas {
+		excess := len(byReplica[replica]) - target
+		for _, s := range byReplica[replica] {
+			if excess <= 0 || closed == budget {
+				break
+			}
+			if atomic.LoadInt32(&s.backendIdle) == 1 && atomic.LoadInt32(&s.transactionStatus) == 'I' {
+				s.terminateForRebalance()
+				excess--
+				closed++
+			}
+		}
+	}
+	if closed > 0 {
+		log.Printf("Rebalanced the replicas: closed %v of %v sessions (busiest %v has %v, average %.1f)",
+			closed, total, backendLabel(replicas[0]), len(byReplica[replicas[0]]), mean)
+	}
+}
+
+func (s *session) terminateForRebalance() {
+	label := backendLabel(s.backend)
+	logDebug("session %v: closing idle session on %v to rebalance the replicas", s.id, label)
+	incMetric(sessionsRebalancedMetric, label)
+	s.terminate(rebalanceMessage)
+}
@@ -3,24 +3,34 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var startupPacketSizeInvalid = errors.New("Terminating connection that provided an abnormally sized startup message packet")
 var unsupportedProtocolVersion = errors.New("Unexpected protocol version number; expected 196608")
 var incorrectlyFormattedPacket = errors.New("Incorrectly formatted protocol packet")
+var tooManyStartupParameters = errors.New("Startup message has too many parameters")
+var startupParameterNameTooLong = errors.New("Startup message has an overly long parameter name")
+var startupParameterValueTooLong = errors.New("Startup message has an overly long parameter value")
 
 type startupMessage map[string]string
 
 func sendError(conn net.Conn, errorMessage string) {
+	sendErrorWithCode(conn, "08000", errorMessage) // connection exception
+}
+
+func sendErrorWithCode(conn io.Writer, code string, errorMessage string) {
 	errorMessageExcludingSize := &bytes.Buffer{}
 	errorMessageExcludingSize.Grow(1024)
 
@@ -29,7 +39,7 @@ func sendError(conn net.Conn, errorMessage string) {
 	errorMessageExcludingSize.Write([]byte{0})
 
 	errorMessageExcludingSize.Write([]byte("C"))
-	errorMessageExcludingSize.Write([]byte("08000")) // connection exception
+	errorMessageExcludingSize.Write([]byte(code))
 	errorMessageExcludingSize.Write([]byte{0})
 
 	errorMessageExcludingSize.Write([]byte("M"))
@@ -46,79 +56,57 @@ func sendError(conn net.Conn, errorMessage string) {
 	conn.Write(errorMessageExcludingSize.Bytes())
 }
 
-func readStartupMessage(conn net.Conn) (*startupMessage, error) {
-	return readStartupMessageInternal(conn, true)
+// Reads the startup message from a new client connection.  If the client
+// negotiates TLS, or starts with it directly, the returned connection is the
+// TLS connection that should be used from then on.
+func readStartupMessage(conn net.Conn, tlsConfig *tls.Config) (net.Conn, *startupMessage, error) {
+	if tlsConfig != nil {
+		var directTLS bool
+		conn, directTLS = peekDirectTLS(conn)
+		if directTLS {
+			return acceptDirectTLS(conn, tlsConfig)
+		}
+	}
+	return readStartupMessageInternal(conn, tlsConfig, maxSpecialRequests)
 }
 
-func readStartupMessageInternal(conn net.Conn, allowRecursion bool) (*startupMessage, error) {
+func readStartupMessageInternal(conn net.Conn, tlsConfig *tls.Config, requestsLeft int) (net.Conn, *startupMessage, error) {
 	var startupMessageSize int32
 	err := binary.Read(conn, binary.BigEndian, &startupMessageSize)
 	if err != nil {
-		return nil, err
+		return conn, nil, err
 	}
 
-	if startupMessageSize < 0 || startupMessageSize > 8096 {
+	// Room for the size and protocol version, at least
+	if startupMessageSize < 8 || startupMessageSize > startupMaxPacketSize() {
 		sendError(conn, "Startup packet size invalid")
-		return nil, startupPacketSizeInvalid
+		return conn, nil, startupPacketSizeInvalid
 	}
 
-	log.Printf("startup packet was %v bytes", startupMessageSize)
+	logDebug("startup packet was %v bytes", startupMessageSize)
 
 	startupMessageData := make([]byte, startupMessageSize-4)
 	_, err = io.ReadFull(conn, startupMessageData)
 	if err != nil {
 		sendError(conn, "Socket read error")
-		return nil, err
+		return conn, nil, err
 	}
 
-	log.Printf("startup packet read")
+	logDebug("startup packet read")
 
 	var protocolVersionNumber int32
 	buf := bytes.NewBuffer(startupMessageData)
 	err = binary.Read(buf, binary.BigEndian, &protocolVersionNumber)
 	if err != nil {
 		sendError(conn, "Socket read error")
-		return nil, err
+		return conn, nil, err
 	}
 
-	if protocolVersionNumber == 80877103 && allowRecursion {
-		log.Printf("SSLRequest received; returning N")
-		conn.Write([]byte{'N'})
-		return readStartupMessageInternal(conn, false)
-	} else if protocolVersionNumber == 80877102 {
-		// CancelRequest message; if possible, match the processId and
-		// secretKey to an existing connection and proxy the cancel to
-		// the correct backend.
-
-		key := backendKeyDataMessage{}
-		err = binary.Read(buf, binary.BigEndian, &key.processId)
-		if err != nil {
-			return nil, err
-		}
-		err = binary.Read(buf, binary.BigEndian, &key.secretKey)
-		if err != nil {
-			return nil, err
-		}
-
-		log.Printf("Received CancelRequest, pid=%v, secret=%v", key.processId, key.secretKey)
-
-		backend := getBackendForBackendKeyData(key)
-		if backend != nil {
-			log.Printf("CancelRequest will be proxied to matching backend, %v", *backend)
-			backendConn, err := net.Dial(network(*backend))
-			if err == nil {
-				binary.Write(backendConn, binary.BigEndian, &startupMessageSize)
-				binary.Write(backendConn, binary.BigEndian, &protocolVersionNumber)
-				binary.Write(backendConn, binary.BigEndian, &key.processId)
-				binary.Write(backendConn, binary.BigEndian, &key.secretKey)
-				backendConn.Close()
-			}
-		}
-
-		return nil, nil
+	if handler, ok := lookupSpecialRequest(protocolVersionNumber); ok {
+		return handler(conn, tlsConfig, protocolVersionNumber, buf, requestsLeft)
 	} else if protocolVersionNumber != 196608 {
 		sendError(conn, "Unsupported protocol version")
-		return nil, unsupportedProtocolVersion
+		return conn, nil, unsupportedProtocolVersion
 	}
 
 	startupMessageData = startupMessageData[4:]
@@ -127,44 +115,126 @@ func readStartupMessageInternal(conn net.Conn, allowRecursion bool) (*startupMes
 		nextZero := bytes.IndexByte(startupMessageData, 0)
 		if nextZero == -1 {
 			sendError(conn, "Malformed startup packet")
-			return nil, incorrectlyFormattedPacket
+			return conn, nil, incorrectlyFormattedPacket
 		} else if nextZero == 0 {
 			break
 		}
 
 		key := string(startupMessageData[:nextZero])
 		startupMessageData = startupMessageData[nextZero+1:]
+		if len(startupParameters) >= startupMaxParameters() {
+			rejectStartupMessage(conn, "too many parameters")
+			return conn, nil, tooManyStartupParameters
+		}
+		if len(key) > startupMaxNameLength {
+			rejectStartupMessage(conn, "parameter name too long")
+			return conn, nil, startupParameterNameTooLong
+		}
 
 		nextZero = bytes.IndexByte(startupMessageData, 0)
 		if nextZero == -1 {
 			sendError(conn, "Malformed startup packet")
-			return nil, incorrectlyFormattedPacket
+			return conn, nil, incorrectlyFormattedPacket
 		}
 		value := string(startupMessageData[:nextZero])
 		startupMessageData = startupMessageData[nextZero+1:]
+		if len(value) > startupMaxValueLength() {
+			rejectStartupMessage(conn, "parameter value too long")
+			return conn, nil, startupParameterValueTooLong
+		}
 
-		log.Printf("key = %v, value = %v", key, value)
+		logDebug("key = %v, value = %v", key, redactedStartupValue(key, value))
 		startupParameters[key] = value
 	}
 
-	return &startupParameters, nil
+	return conn, &startupParameters, nil
 }
 
-func handleIncomingConnection(conn net.Conn, masterRequestChannel, replicaRequestChannel chan<- serverRequest) {
+// Sends a CancelRequest to the backend that the given key was received from,
+// if it's known.  Returns false if the key isn't known.
+func proxyCancelRequest(key backendKeyDataMessage) bool {
+	backend := getBackendForBackendKeyData(key)
+	if backend == nil {
+		return false
+	}
+
+	logDebug("CancelRequest will be proxied to matching backend, %v", *backend)
+	sendCancelRequest(*backend, key)
+	return true
+}
+
+func handleIncomingConnection(conn net.Conn, fe *frontend, masterRequestChannel, replicaRequestChannel chan<- serverRequest) {
 	defer conn.Close()
+	setKeepalivePeriod(conn, fe.tcpKeepalive)
+
+	sess := newSession(conn)
+	sess.frontend = fe.name
+	sess.sampleHandshakeTrace()
+
+	if !fe.allows(sess.clientAddr) {
+		sendErrorWithCode(conn, "28000", clientAddressNotAllowed.Error()) // invalid authorization specification
+		logLimited("not allowed "+fe.name, "%v: not allowed on listener %v", conn.RemoteAddr(), fe.name)
+		return
+	}
+
+	// Delayed before taking a listener slot, so that a client being delayed
+	// can't use up the listener's connections
+	if err := tarpit(clientIP(sess.clientAddr)); err != nil {
+		sendErrorWithCode(conn, "08004", err.Error()) // server rejected establishment of connection
+		logLimited("tarpit", "%v: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	releaseListenerConnection, err := fe.acquireConnection()
+	if err != nil {
+		sendErrorWithCode(conn, "53300", err.Error()) // too many connections
+		logLimited("listener connections "+fe.name, "%v: listener %v: %v", conn.RemoteAddr(), fe.name, err)
+		return
+	}
+	defer releaseListenerConnection()
+
+	if shutdownStarted() {
+		sendErrorWithCode(conn, "57P03", "The proxy is shutting down") // cannot_connect_now
+		return
+	}
+
+	releaseHandshakeSlot, err := acquireHandshakeSlot()
+	if err != nil {
+		sendError(conn, "Too many connections are being established; try again later")
+		logLimited("handshake slot", "%v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer func() { releaseHandshakeSlot() }()
 
 	// One-minute timeout to read the startup message
 	conn.SetReadDeadline(time.Now().Add(time.Minute))
 
-	startupMessage, err := readStartupMessage(conn)
+	if fe.tlsPassthrough != "" {
+		var sslRequest bool
+		conn, sslRequest = peekSSLRequest(conn)
+		if sslRequest {
+			conn.SetReadDeadline(time.Time{})
+			proxyTLSPassthrough(sess, conn, fe, masterRequestChannel, replicaRequestChannel, releaseHandshakeSlot)
+			return
+		}
+	}
+
+	conn, startupMessage, err := readStartupMessage(conn, fe.tlsConfig)
 	if err != nil {
-		log.Print(err)
+		recordProtocolError(clientIP(sess.clientAddr), err)
+		logLimited("startup", "%v: %v", conn.RemoteAddr(), err)
 		return
 	} else if startupMessage == nil {
 		// Occurs in a CancelRequest connection
 		return
 	}
+	if _, isTLS := conn.(*tls.Conn); fe.sslRequired && !isTLS {
+		sendErrorWithCode(conn, "28000", sslRequired.Error()) // invalid authorization specification
+		logLimited("ssl required "+fe.name, "%v: plaintext connection refused on listener %v", conn.RemoteAddr(), fe.name)
+		return
+	}
 	startupParameters := *startupMessage
+	sess.clientConn = conn
 
 	// Reset read deadline to no timeout
 	conn.SetReadDeadline(time.Time{})
@@ -172,34 +242,322 @@ func handleIncomingConnection(conn net.Conn, masterRequestChannel, replicaReques
 	// Check if we're going to connect to a replica or to the master
 	dbName, ok := startupParameters["database"]
 	wantReplica := false
-	if !ok {
-		dbName, ok = startupParameters["user"]
-		if !ok {
-			sendError(conn, "Missing database or user parameter")
-			log.Printf("Expected database or user parameter, neither found")
+	if !ok || dbName == "" {
+		switch fe.missingDatabase {
+		case "default":
+			dbName = fe.defaultDatabase
+			startupParameters["database"] = dbName
+		case "reject":
+			sendErrorWithCode(conn, "3D000", "A database name must be given") // invalid catalog name
+			logLimited("missing database "+fe.name, "%v: no database parameter; rejected", conn.RemoteAddr())
 			return
+		default:
+			dbName, ok = startupParameters["user"]
+			if !ok {
+				sendError(conn, "Missing database or user parameter")
+				log.Printf("Expected database or user parameter, neither found")
+				return
+			}
 		}
 	}
-	if strings.HasSuffix(dbName, "_replica") {
+	if fe.replicaSuffix != "" && strings.HasSuffix(dbName, fe.replicaSuffix) {
+		wantReplica = true
+		startupParameters["database"] = dbName[:len(dbName)-len(fe.replicaSuffix)]
+		logDebug("Rewriting database name from %v to %v", dbName, startupParameters["database"])
+	} else if fe.replicaPrefix != "" && strings.HasPrefix(dbName, fe.replicaPrefix) {
 		wantReplica = true
-		startupParameters["database"] = dbName[:len(dbName)-8]
-		log.Printf("Rewriting database name from %v to %v", dbName, startupParameters["database"])
+		startupParameters["database"] = dbName[len(fe.replicaPrefix):]
+		logDebug("Rewriting database name from %v to %v", dbName, startupParameters["database"])
+	} else if database, ok := clusterReplicaDatabase(dbName); ok && !fe.readWrite {
+		wantReplica = true
+		startupParameters["database"] = database
+		logDebug("Rewriting database name from %v to %v", dbName, startupParameters["database"])
+	}
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS && len(fe.sniRoutes) > 0 {
+		serverName := tlsConn.ConnectionState().ServerName
+		if replica, ok := fe.routeServerName(serverName); ok {
+			logDebug("%v: server name %v matched sni-route (replica: %v)", conn.RemoteAddr(), serverName, replica)
+			wantReplica = replica
+		}
+	}
+	targetSessionAttrs, err := takeTargetSessionAttrs(startupParameters)
+	if err != nil {
+		sendErrorWithCode(conn, "22023", err.Error()) // invalid parameter value
+		logLimited("target session attrs", "%v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	replicaRequired, replicaPreferred, masterRequired := false, false, false
+	// The errors to refuse the connection with on a read-only listener, as
+	// it insists on the master, or on a read-write one, as it insists on a
+	// replica
+	masterRefusal, replicaRefusal := "", ""
+	switch targetSessionAttrs {
+	case "read-write", "primary":
+		wantReplica, masterRequired = false, true
+		masterRefusal = fmt.Sprintf("No server matching target_session_attrs=%v is available on this read-only listener", targetSessionAttrs)
+	case "read-only", "standby":
+		wantReplica, replicaRequired = true, true
+		replicaRefusal = fmt.Sprintf("No server matching target_session_attrs=%v is available on this read-write listener", targetSessionAttrs)
+	case "prefer-standby":
+		wantReplica, replicaPreferred = true, true
+	}
+	hints, err := takeRoutingHints(startupParameters)
+	if err != nil {
+		sendErrorWithCode(conn, "22023", err.Error()) // invalid parameter value
+		logLimited("routing hints", "%v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	var ruleMembers map[string]bool
+	if hints != nil && hints.target != "" {
+		logDebug("%v: routing hints: target %v, replica-group %q", conn.RemoteAddr(), hints.target, hints.group)
+		wantReplica = hints.target == "replica"
+		replicaRequired, replicaPreferred, masterRequired = false, false, !wantReplica
+		masterRefusal, replicaRefusal = "", ""
+		if masterRequired {
+			masterRefusal = fmt.Sprintf("This listener doesn't connect to the master, which %v.target asks for", cfg.Pgreplicaproxy.Routing_Hint_Prefix)
+		}
+		ruleMembers = hints.members
+	}
+	ruleDatabase := startupParameters["database"]
+	if ruleDatabase == "" {
+		ruleDatabase = startupParameters["user"]
+	}
+	if rule := matchRoutingRule(startupParameters["user"], ruleDatabase, sess.clientAddr, startupParameters["application_name"]); rule != nil {
+		logDebug("%v: routing rule %v matched: %v", conn.RemoteAddr(), rule.name, rule.action)
+		switch rule.action {
+		case "reject":
+			sendErrorWithCode(conn, "08004", rule.message) // server rejected establishment of connection
+			logLimited("routing rule "+rule.name, "%v: rejected by routing rule %v", conn.RemoteAddr(), rule.name)
+			return
+		case "master":
+			wantReplica = false
+			masterRefusal, replicaRefusal = "This listener doesn't connect to the master, where a routing rule sends this connection", ""
+		case "replica":
+			wantReplica = true
+			masterRefusal = ""
+			ruleMembers = rule.members
+		}
+	}
+	rewrite := &startupRewrite{fe.name, sess.clientAddr, wantReplica, startupParameters}
+	if err := rewriteStartup(rewrite); err != nil {
+		sendErrorWithCode(conn, "08004", err.Error()) // server rejected establishment of connection
+		logLimited("startup rewrite", "%v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	wantReplica = rewrite.replica
+	if fe.readOnly && masterRefusal != "" {
+		sendErrorWithCode(conn, "08004", masterRefusal) // server rejected establishment of connection
+		logLimited("master refused "+fe.name, "%v: %v", conn.RemoteAddr(), masterRefusal)
+		return
+	} else if fe.readWrite && replicaRefusal != "" {
+		sendErrorWithCode(conn, "08004", replicaRefusal) // server rejected establishment of connection
+		logLimited("replica refused "+fe.name, "%v: %v", conn.RemoteAddr(), replicaRefusal)
+		return
+	}
+	if fe.readOnly {
+		// Never the master, even if no replica is available
+		wantReplica = true
+	} else if fe.readWrite {
+		wantReplica = false
+	}
+	sess.user = startupParameters["user"]
+	sess.database, ok = startupParameters["database"]
+	if !ok {
+		sess.database = sess.user
+	}
+	sess.startupParameters = startupParameters
+
+	message, handshakeDone := startDatabaseHandshake(sess.database)
+	if message != "" {
+		sendErrorWithCode(conn, "57P03", message) // cannot connect now
+		logLimited("drained "+sess.database, "%v: database %v is being drained; rejected", conn.RemoteAddr(), sess.database)
+		return
+	}
+	defer handshakeDone()
+
+	replicaRouting := databaseReplicaRouting(sess.database)
+	if wantReplica && (replicaRouting == "deny" || (replicaRouting == "force-master" && fe.readOnly)) {
+		sendErrorWithCode(conn, "08004", fmt.Sprintf("Database %v can't be used on a replica", sess.database)) // server rejected establishment of connection
+		logLimited("replica routing "+sess.database, "%v: database %v can't be used on a replica; rejected", conn.RemoteAddr(), sess.database)
+		return
+	} else if wantReplica && replicaRouting == "force-master" {
+		wantReplica = false
+	} else if wantReplica && !fe.readOnly && !replicaRequired && twoPhasePinned(sess.user, sess.database) {
+		logDebug("%v: user %v has used two-phase commit on database %v; routing to the master", conn.RemoteAddr(), sess.user, sess.database)
+		incMetric(twoPhaseSessionsPinnedMetric, configuredDatabaseLabel(sess.database))
+		wantReplica = false
+	}
+
+	if err := checkClientCertificate(conn, fe.clientCertMode, sess.user); err != nil {
+		sendErrorWithCode(conn, "28000", err.Error()) // invalid authorization specification
+		logLimited("client certificate", "%v: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	var credentials *authCredentials
+	if proxyTerminatedAuth() {
+		conn.SetReadDeadline(time.Now().Add(time.Minute))
+		credentials, err = authenticateClient(conn, sess.user, sess.database, clientChannelBinding(conn, fe.tlsConfig))
+		if err != nil {
+			if clientAuthFailure(err) {
+				recordAuthFailure(clientIP(sess.clientAddr), "proxy")
+			}
+			sendErrorWithCode(conn, "28P01", fmt.Sprintf("password authentication failed for user %q", sess.user)) // invalid password
+			logLimited("auth "+sess.user, "%v: user %v: %v", conn.RemoteAddr(), sess.user, err)
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+	sess.tracePhase(tracePhaseStartup)
+
+	// Wait for a connection slot for the database without holding up other
+	// clients' handshakes
+	waited := false
+	releaseDatabaseCapacity, err := acquireDatabaseCapacity(sess.database, func() {
+		waited = true
+		releaseHandshakeSlot()
+	})
+	if err != nil {
+		sendErrorWithCode(conn, "53300", "Too many connections for database")
+		logLimited("capacity "+sess.database, "%v: database %v: %v", conn.RemoteAddr(), sess.database, err)
+		return
+	}
+	defer releaseDatabaseCapacity()
+	releaseFingerprintSlot, err := acquireFingerprintSlot(sess, func() {
+		if !waited {
+			waited = true
+			releaseHandshakeSlot()
+		}
+	})
+	if err != nil {
+		sendErrorWithCode(conn, "53300", "Too many identical sessions from this client")
+		logLimited("fingerprint", "%v: user %v, database %v: %v", conn.RemoteAddr(), sess.user, sess.database, err)
+		return
+	}
+	defer releaseFingerprintSlot()
+	if waited {
+		// The deferred release is only replaced once there's a slot to release
+		release, err := acquireHandshakeSlot()
+		if err != nil {
+			sendError(conn, "Too many connections are being established; try again later")
+			logLimited("handshake slot", "%v: %v", conn.RemoteAddr(), err)
+			return
+		}
+		releaseHandshakeSlot = release
 	}
 
 	// Fetch a backend server, either a master or a replica
-	responseChannel := make(chan *string)
-	request := serverRequest{responseChannel}
-	if wantReplica {
-		replicaRequestChannel <- request
-	} else {
-		masterRequestChannel <- request
-	}
-	backend := <-responseChannel
-	if backend == nil {
+	var backend *string
+	var members map[string]bool
+	masterOutage := false
+	cluster := serverVersionAllowed(sess.database, databaseCluster(sess.database))
+	if backupBackend := backupBackendFor(startupParameters); backupBackend != "" && !fe.readWrite && replicaRouting == "allow" {
+		backend, err = requestBackend(replicaRequestChannel, cluster, map[string]bool{backupBackend: true}, true)
+	}
+	backupReplica := backend != nil
+	affinity := replicaAffinityKey(sess.user, sess.database, sess.clientAddr)
+	if err == nil && backend == nil {
+		requestChannel := masterRequestChannel
+		if wantReplica {
+			requestChannel = replicaRequestChannel
+			members = ruleMembers
+			if members == nil {
+				members = scheduledReplicaGroup(sess.database, time.Now())
+			}
+			backend, err = requestLocalReplica(requestChannel, cluster, members, sess.clientAddr, affinity)
+		}
+		if err == nil && backend == nil {
+			backend, err = requestBackendWithAffinity(requestChannel, cluster, members, false, affinity)
+		}
+		if err == nil && backend == nil && wantReplica && !fe.readOnly && !replicaRequired && (replicaPreferred || databaseReplicaFallback(sess.database)) {
+			label := configuredDatabaseLabel(sess.database)
+			logLimited("replica fallback "+label, "database %v: no replica is available; using the master", sess.database)
+			incMetric(replicaFallbacksMetric, label)
+			wantReplica = false
+			backend, err = requestBackend(masterRequestChannel, cluster, nil, false)
+		} else if err == nil && backend == nil && !wantReplica && masterOutageReadsAllowed(fe, sess.database, masterRequired) {
+			members = scheduledReplicaGroup(sess.database, time.Now())
+			backend, err = requestBackendWithAffinity(replicaRequestChannel, cluster, members, false, affinity)
+			if backend != nil {
+				label := configuredDatabaseLabel(sess.database)
+				logLimited("master outage "+label, "database %v: no master is available; using a replica", sess.database)
+				incMetric(masterOutageReadsMetric, label)
+				wantReplica, masterOutage = true, true
+			}
+		}
+	}
+	routingSLO.record(err == nil && backend != nil)
+	if err != nil {
+		sendError(conn, "Unable to find satisfactory backend server")
+		logLimited("oracle", "%v", err)
+		return
+	} else if window := serverVersionWindowDescription(sess.database); backend == nil && window != "" {
+		sendErrorWithCode(conn, "08004", fmt.Sprintf("No backend with %v is available for database %v", window, sess.database)) // server rejected establishment of connection
+		logLimited("version window "+sess.database, "%v: database %v: no backend with %v", conn.RemoteAddr(), sess.database, window)
+		return
+	} else if backend == nil && fe.readOnly {
+		sendError(conn, "No replica is available, and this listener doesn't connect to the master")
+		logLimited("no replica "+fe.name, "No replica available for read-only listener %v", fe.name)
+		return
+	} else if backend == nil && wantReplica && replicaRequired {
+		sendError(conn, fmt.Sprintf("No replica is available for target_session_attrs=%v", targetSessionAttrs))
+		logLimited("no replica "+targetSessionAttrs, "No replica available for target_session_attrs=%v", targetSessionAttrs)
+		return
+	} else if backend == nil {
 		sendError(conn, "Unable to find satisfactory backend server")
-		log.Println("Unable to find satisfactory backend server")
+		logLimited("no backend", "Unable to find satisfactory backend server")
 		return
 	}
+	if backupReplica {
+		wantReplica = true
+	} else if wantReplica {
+		waited = false
+		backend, err = avoidLongSessions(backend, cluster, members, func() {
+			waited = true
+			releaseHandshakeSlot()
+		})
+		if err != nil {
+			sendErrorWithCode(conn, "53300", "Too many long-running sessions on the replicas")
+			logLimited("long sessions", "%v: database %v: %v", conn.RemoteAddr(), sess.database, err)
+			return
+		}
+		if waited {
+			release, err := acquireHandshakeSlot()
+			if err != nil {
+				sendError(conn, "Too many connections are being established; try again later")
+				logLimited("handshake slot", "%v: %v", conn.RemoteAddr(), err)
+				return
+			}
+			releaseHandshakeSlot = release
+		}
+	}
+
+	sess.tracePhase(tracePhaseSelect)
+	// Handshakes that fail authentication, or that the client gives up on,
+	// aren't the proxy's failures
+	handshakeRejected := false
+	defer func() {
+		clientGone := atomic.LoadInt32(&sess.finishedDirections[fromClient]) == 1
+		if !sess.ready && !handshakeRejected && !clientGone {
+			handshakeSLO.record(false)
+		}
+	}()
+
+	role := mappedBackendRole(sess.database, sess.user)
+	if role == "" && credentials != nil {
+		role = credentials.backendRole
+	}
+	if role != "" && credentials != nil {
+		credentials, err = backendRoleCredentials(*backend, sess.database, role)
+		if err != nil {
+			handshakeRejected = true
+			sendError(conn, "Unable to authenticate to backend server")
+			logLimited("user map "+role, "database %v: user %v: %v", sess.database, sess.user, err)
+			return
+		}
+		logDebug("database %v: user %v connects as %v", sess.database, sess.user, credentials.user)
+		startupParameters["user"] = credentials.user
+	}
 
 	// Create the new startup message w/ the possibly different startupParameters
 	var protocolVersion int32 = 196608
@@ -216,57 +574,130 @@ func handleIncomingConnection(conn net.Conn, masterRequestChannel, replicaReques
 	newStartupMessageExcludingSize.Write([]byte{0})
 
 	// Send the new connection our startup packet
-	log.Printf("backend to connect to: %v", *backend)
-	upstream, err := net.Dial(network(*backend))
+	logDebug("backend to connect to: %v", backendLabel(*backend))
+	upstream, err := dialBackend(*backend)
 	if err != nil {
 		sendError(conn, "Unable to connect to backend server")
-		log.Print(err)
+		logLimited("dial "+*backend, "%v", err)
 		return
 	}
+	defer upstream.Close()
+	sess.tracePhase(tracePhaseDial)
 	err = binary.Write(upstream, binary.BigEndian, int32(newStartupMessageExcludingSize.Len()+4))
 	if err != nil {
 		sendError(conn, "Backend network error")
-		log.Print(err)
+		logLimited("write "+*backend, "%v", err)
 		return
 	}
 	_, err = upstream.Write(newStartupMessageExcludingSize.Bytes())
 	if err != nil {
 		sendError(conn, "Backend network error")
-		log.Print(err)
+		logLimited("write "+*backend, "%v", err)
 		return
 	}
+	if credentials != nil {
+		err = authenticateBackend(upstream, conn, credentials)
+		if err == backendCredentialsRefused || err == backendCredentialsUnavailable {
+			// The client has the backend's error already if it refused
+			handshakeRejected = true
+			if err == backendCredentialsUnavailable {
+				sendError(conn, "Unable to authenticate to backend server")
+			}
+			logLimited("backend auth "+*backend, "user %v: as %v: %v", sess.user, credentials.user, err)
+			return
+		} else if err != nil {
+			sendError(conn, "Unable to authenticate to backend server")
+			logLimited("backend auth "+*backend, "user %v: %v", sess.user, err)
+			return
+		}
+	}
+
+	sess.backend = *backend
+	sess.backendConn = upstream
+	sess.replica = wantReplica
+	registerSession(sess)
+	handshakeDone()
+	sess.countSessionStats()
+	defer deregisterSession(sess)
+	defer sess.finished()
+	defer sess.stopCapture()
+	sess.applySessionRules()
+
+	clientReader := sess.tapReader(conn, fromClient)
+	upstreamReader := sess.tapReader(upstream, fromBackend)
 
 	// Begin copying all input from the client to the upstream connection.
 	go func() {
-		numCopied, err := io.Copy(conn, upstream)
-		log.Printf("Copy(conn, upstream) -> %v, %v", numCopied, err)
+		var numCopied int64
+		var err error
+		if cfg.Pgreplicaproxy.Protocol_Aware {
+			numCopied, err = proxyClientMessages(sess, clientReader, upstream)
+		} else {
+			numCopied, err = io.Copy(upstream, clientReader)
+		}
+		logDebug("Copy(upstream, conn) -> %v, %v", numCopied, err)
+		sess.directionFinished(fromClient)
 	}()
 
 	// Proxy upstream -> conn, but attempting to extract the BackendKeyData packet
-	backendKeyData, err := proxyPacketsUntilBackendKeyDataReceived(conn, upstream)
-	if err != nil {
+	parameters := make(map[string]string)
+	injected := injectedParameterStatus(*backend, wantReplica)
+	if masterOutage {
+		injected = append(injected, masterOutageNotice()...)
+	}
+	backendKeyData, err := proxyPacketsUntilBackendKeyDataReceived(conn, upstreamReader, parameters, injected)
+	if err == backendAuthenticationFailed {
+		// The client has the backend's error already
+		handshakeRejected = true
+		recordAuthFailure(clientIP(sess.clientAddr), "backend")
+		return
+	} else if err != nil {
 		sendError(conn, err.Error())
 		log.Print(err)
 		return
 	}
+	recordAuthSuccess(clientIP(sess.clientAddr))
+	sess.tracePhase(tracePhaseAuth)
+	recordBackendParameters(*backend, wantReplica, parameters)
+
+	releaseHandshakeSlot()
 
-	registerBackendKey(*backendKeyData, *backend)
+	sess.backendKey = backendKeyData
+	registerBackendKey(*backendKeyData, *backend, sess.id)
 	defer deregisterBackedKey(*backendKeyData)
 
 	// Stream data between the two network connections
 	// Also begin copying all input from the upstream connection to the client.
-	numCopied, err := io.Copy(upstream, conn)
-	log.Printf("Copy(upstream, conn) -> %v, %v", numCopied, err)
+	// In protocol-aware mode, the proxy's own replies to the client go
+	// through the same writer, between the backend's messages
+	var clientOut io.Writer = conn
+	if fe.clientKeepaliveInterval > 0 || cfg.Pgreplicaproxy.Protocol_Aware {
+		writer := newClientWriter(conn)
+		sess.mutex.Lock()
+		sess.clientWriter = writer
+		sess.clientKeepaliveInterval = fe.clientKeepaliveInterval
+		sess.clientKeepaliveMessage = clientKeepaliveMessage(fe.clientKeepaliveMessage)
+		sess.mutex.Unlock()
+		clientOut = writer
+	}
+	numCopied, err := io.Copy(clientOut, upstreamReader)
+	logDebug("Copy(conn, upstream) -> %v, %v", numCopied, err)
+	if sess.backendClosedUnexpectedly(err) {
+		sess.backendConnectionLost(clientOut)
+		return
+	}
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	log.Printf("Connection closed softly")
+	logDebug("Connection closed softly")
 }
 
-// Proxy backend -> client, but attempting to extract the BackendKeyData packet
-func proxyPacketsUntilBackendKeyDataReceived(client, backend net.Conn) (*backendKeyDataMessage, error) {
+// Proxy backend -> client, but attempting to extract the BackendKeyData packet.
+// The ParameterStatus messages seen on the way are added to parameters, and
+// the injected messages are sent to the client before the BackendKeyData.
+func proxyPacketsUntilBackendKeyDataReceived(client net.Conn, backend io.Reader, parameters map[string]string, injected []byte) (*backendKeyDataMessage, error) {
 
 	typeBuffer := make([]byte, 1)
 	bufferedClient := bufio.NewWriter(client)
@@ -277,6 +708,12 @@ func proxyPacketsUntilBackendKeyDataReceived(client, backend net.Conn) (*backend
 		if err != nil {
 			return nil, err
 		}
+		if typeBuffer[0] == 'K' {
+			_, err = bufferedClient.Write(injected)
+			if err != nil {
+				return nil, err
+			}
+		}
 		_, err = bufferedClient.Write(typeBuffer)
 		if err != nil {
 			return nil, err
@@ -314,7 +751,7 @@ func proxyPacketsUntilBackendKeyDataReceived(client, backend net.Conn) (*backend
 				return nil, err
 			}
 
-			log.Printf("backendKeyData %v %v", retval.processId, retval.secretKey)
+			logDebug("backendKeyData pid=%v", retval.processId)
 
 			err = bufferedClient.Flush()
 			if err != nil {
@@ -337,27 +774,29 @@ func proxyPacketsUntilBackendKeyDataReceived(client, backend net.Conn) (*backend
 			if err != nil {
 				return nil, err
 			}
+
+			if typeBuffer[0] == 'R' && len(messageBuffer) > 4 && binary.BigEndian.Uint32(messageBuffer) == authenticationSASL {
+				warnUnrelayableChannelBinding(client, messageBuffer[4:])
+			}
+			if typeBuffer[0] == 'S' {
+				name, rest := readCString(messageBuffer)
+				value, _ := readCString(rest)
+				parameters[name] = value
+			}
+			if typeBuffer[0] == 'E' {
+				code := errorResponseField(messageBuffer, 'C')
+				if code == "28P01" || code == "28000" {
+					// invalid password, invalid authorization specification
+					return nil, backendAuthenticationFailed
+				}
+			}
 		}
 	}
 }
 
 //// BEGIN: Copy/hacked from lib/pq
 func network(name string) (string, string) {
-	o := make(Values)
-
-	// A number of defaults are applied here, in this order:
-	//
-	// * Very low precedence defaults applied in every situation
-	// * Environment variables
-	// * Explicitly passed connection information
-	o.Set("host", "localhost")
-	o.Set("port", "5432")
-
-	for k, v := range parseEnviron(os.Environ()) {
-		o.Set(k, v)
-	}
-
-	parseOpts(name, o)
+	o := connectionOptions(name)
 
 	// Don't care about user, just host & port
 	//// If a user is not provided by any other means, the last
@@ -374,6 +813,11 @@ func network(name string) (string, string) {
 
 	host := o.Get("host")
 
+	// As in libpq, hostaddr is connected to rather than host when it's given
+	if hostaddr := o.Get("hostaddr"); hostaddr != "" {
+		return "tcp", net.JoinHostPort(hostaddr, o.Get("port"))
+	}
+
 	if strings.HasPrefix(host, "/") {
 		sockPath := path.Join(host, ".s.PGSQL."+o.Get("port"))
 		return "unix", sockPath
@@ -382,6 +826,28 @@ func network(name string) (string, string) {
 	return "tcp", host + ":" + o.Get("port")
 }
 
+func connectionOptions(name string) Values {
+	o := make(Values)
+
+	// A number of defaults are applied here, in this order:
+	//
+	// * Very low precedence defaults applied in every situation
+	// * Environment variables
+	// * Explicitly passed connection information
+	o.Set("host", "localhost")
+	o.Set("port", "5432")
+
+	for k, v := range parseEnviron(os.Environ()) {
+		o.Set(k, v)
+	}
+
+	// Backends are checked when the config is read (see
+	// expandBackendServices), so they parse
+	parseOpts(name, o)
+
+	return o
+}
+
 type Values map[string]string
 
 func (vs Values) Set(k, v string) {
@@ -392,21 +858,58 @@ func (vs Values) Get(k string) (v string) {
 	return vs[k]
 }
 
-func parseOpts(name string, o Values) {
-	if len(name) == 0 {
-		return
+// Parses a key=value connection string, as libpq does: values may be quoted
+// with single quotes, and a backslash escapes the character after it.  The
+// errors don't quote the values, which may be passwords.
+func parseOpts(name string, o Values) error {
+	isSpace := func(c byte) bool { return strings.IndexByte(" \t\n\r\f\v", c) >= 0 }
+	skipSpace := func(i int) int {
+		for i < len(name) && isSpace(name[i]) {
+			i++
+		}
+		return i
 	}
 
-	name = strings.TrimSpace(name)
+	for i := skipSpace(0); i < len(name); i = skipSpace(i) {
+		start := i
+		for i < len(name) && name[i] != '=' && !isSpace(name[i]) {
+			i++
+		}
+		key := name[start:i]
+		i = skipSpace(i)
+		if key == "" {
+			return errors.New("missing connection option name")
+		} else if i >= len(name) || name[i] != '=' {
+			return fmt.Errorf("missing \"=\" after connection option %q", key)
+		}
+		i = skipSpace(i + 1)
 
-	ps := strings.Split(name, " ")
-	for _, p := range ps {
-		kv := strings.Split(p, "=")
-		if len(kv) < 2 {
-			log.Fatalf("invalid option: %q", p)
+		var value []byte
+		quoted := i < len(name) && name[i] == '\''
+		if quoted {
+			i++
+		}
+		for ; i < len(name); i++ {
+			c := name[i]
+			if quoted && c == '\'' {
+				break
+			} else if !quoted && isSpace(c) {
+				break
+			} else if c == '\\' && i+1 < len(name) {
+				i++
+				c = name[i]
+			}
+			value = append(value, c)
+		}
+		if quoted {
+			if i >= len(name) {
+				return fmt.Errorf("unterminated quoted value of connection option %q", key)
+			}
+			i++
 		}
-		o.Set(kv[0], kv[1])
+		o.Set(key, string(value))
 	}
+	return nil
 }
 
 // parseEnviron tries to mimic some of libpq's environment handling
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"path"
+	"strings"
+)
+
+// Startup parameters that may hold secrets have their values replaced with
+// <scrubbed> wherever they're logged or captured: those whose names contain
+// password, passwd, secret, token or credential, and those matching one of
+// the log-redact patterns (case-insensitive, with * and ? wildcards), such
+// as app.* for custom settings.  The same goes for the settings given in the
+// options parameter, as -c name=value or --name=value: only their values
+// are scrubbed, and the rest of options is logged as it is.
+
+const scrubbedValue = "<scrubbed>"
+
+var sensitiveParameterWords = []string{"password", "passwd", "secret", "token", "credential"}
+
+func validateLogRedact() {
+	for _, pattern := range cfg.Pgreplicaproxy.Log_Redact {
+		if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+			log.Fatalf("log-redact: invalid pattern %v", pattern)
+		}
+	}
+}
+
+func sensitiveStartupParameter(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range sensitiveParameterWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	for _, pattern := range cfg.Pgreplicaproxy.Log_Redact {
+		if matched, _ := path.Match(strings.ToLower(pattern), key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a startup parameter's value as it may be logged.
+func redactedStartupValue(key, value string) string {
+	if sensitiveStartupParameter(key) {
+		return scrubbedValue
+	} else if key == "options" {
+		return redactedStartupOptions(value)
+	}
+	return value
+}
+
+// Returns the options startup parameter with the values of its sensitive
+// settings scrubbed.
+func redactedStartupOptions(options string) string {
+	tokens := splitStartupOptions(options)
+	redacted := false
+	for i := 0; i < len(tokens); i++ {
+		setting, prefix := tokens[i], ""
+		switch {
+		case setting == "-c" && i+1 < len(tokens):
+			i++
+			setting = tokens[i]
+		case strings.HasPrefix(setting, "-c"), strings.HasPrefix(setting, "--"):
+			setting, prefix = setting[2:], setting[:2]
+		default:
+			continue
+		}
+		// As in PostgreSQL, dashes in the name stand for underscores
+		equals := strings.IndexByte(setting, '=')
+		if equals > 0 && sensitiveStartupParameter(strings.Replace(setting[:equals], "-", "_", -1)) {
+			tokens[i] = prefix + setting[:equals+1] + scrubbedValue
+			redacted = true
+		}
+	}
+	if !redacted {
+		return options
+	}
+	return strings.Join(tokens, " ")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// On SIGHUP, or when the backend file changes, the config file is read again,
+// and the backends and routing rules ([backend-cluster], [route],
+// [routing-rule] and [replica-group] sections, and backup routing) are
+// updated from it: new backends are monitored and become available once
+// they're found up, and removed backends stop being monitored and are taken
+// out of the rotation.  Existing sessions, including those to removed
+// backends, carry on undisturbed.  Other options only take effect on
+// restart.  If the new config file has errors, nothing is changed.  SIGHUP
+// also reloads the TLS certificates and keys, from the files already in use.
+
+var monitoredBackends = struct {
+	sync.Mutex
+	backends []string
+	monitors map[string]*backendMonitor
+}{monitors: make(map[string]*backendMonitor)}
+
+type backendMonitor struct {
+	stop chan bool
+	done chan bool
+
+	// Signalled when a session loses its connection to the backend.
+	suspect chan bool
+}
+
+// Returns the backends currently configured.
+func currentBackends() []string {
+	monitoredBackends.Lock()
+	defer monitoredBackends.Unlock()
+	return monitoredBackends.backends
+}
+
+// Starts monitoring the backends that are new, and stops monitoring those
+// that are no longer listed, waiting for their monitors to finish.
+func setBackends(backends []string) (added, removed []string) {
+	monitoredBackends.Lock()
+	listed := make(map[string]bool)
+	for _, backend := range backends {
+		listed[backend] = true
+		if _, ok := monitoredBackends.monitors[backend]; !ok {
+			monitor := &backendMonitor{stop: make(chan bool), done: make(chan bool), suspect: make(chan bool, 1)}
+			monitoredBackends.monitors[backend] = monitor
+			added = append(added, backend)
+			go func(backend string) {
+				monitorBackend(backend, monitor.stop, monitor.suspect)
+				close(monitor.done)
+			}(backend)
+		}
+	}
+	var stopped []*backendMonitor
+	for backend, monitor := range monitoredBackends.monitors {
+		if !listed[backend] {
+			delete(monitoredBackends.monitors, backend)
+			close(monitor.stop)
+			stopped = append(stopped, monitor)
+			removed = append(removed, backend)
+		}
+	}
+	monitoredBackends.backends = backends
+	monitoredBackends.Unlock()
+
+	// A backend that's removed and added back mustn't have its old monitor
+	// report on it after the new one
+	for _, monitor := range stopped {
+		<-monitor.done
+	}
+	return added, removed
+}
+
+func reloadConfigOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadCertificates()
+		err := reloadConfig()
+		if err != nil {
+			log.Printf("Config reload failed, keeping the previous config: %v", err)
+		}
+	}
+}
+
+func reloadConfig() error {
+	var newCfg config
+	err := readConfig(&newCfg)
+	if err != nil {
+		return err
+	}
+
+	backends := newCfg.Pgreplicaproxy.Backend
+	if len(backendFlag) > 0 {
+		backends = backendFlag
+	}
+	backends, err = appendBackendFile(&newCfg, backends)
+	if err != nil {
+		return err
+	}
+	backends, err = expandBackendServices(backends)
+	if err != nil {
+		return err
+	}
+	backends, err = expandMultiHostBackends(backends)
+	if err != nil {
+		return err
+	}
+	clusters, err := compileBackendClusters(&newCfg, backends)
+	if err != nil {
+		return err
+	}
+	routes, err := compileScheduledRoutes(&newCfg)
+	if err != nil {
+		return err
+	}
+	rules, err := compileRoutingRules(&newCfg)
+	if err != nil {
+		return err
+	}
+	err = setBackupRouting(&newCfg)
+	if err != nil {
+		return err
+	}
+	for _, list := range [][]string{backends, clusters.backends()} {
+		if err := validateBackendTLS(list); err != nil {
+			return err
+		}
+	}
+
+	setScheduledRoutes(routes)
+	setRoutingRules(rules)
+	setBackendClusters(clusters)
+	backends = append(backends, clusters.backends()...)
+	added, removed := setBackends(backends)
+	for _, backend := range added {
+		log.Printf("Config reload: added backend %v", backendLabel(backend))
+	}
+	for _, backend := range removed {
+		log.Printf("Config reload: removed backend %v", backendLabel(backend))
+	}
+	log.Printf("Config reloaded from %v: %v backends, %v routes", *configFile, len(backends), len(routes))
+	return nil
+}
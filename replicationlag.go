@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"time"
+)
+
+// With max-replication-lag, each health check of a replica also measures how
+// far behind the master it is: nothing if its WAL receiver is running and it
+// has replayed all the WAL it has received, or else the time since the last
+// transaction it replayed was committed.  A replica whose WAL receiver has
+// stopped (it has no row in pg_stat_wal_receiver) isn't receiving anything
+// to replay, so it's measured by that time too, and is lagging without
+// bound if it hasn't replayed anything.  A replica further behind than
+// max-replication-lag is taken out of the replica ring, as if it were down,
+// and put back once it has caught up.  Each replica's latest lag is exported
+// as pgreplicaproxy_backend_replication_lag_seconds.
+
+var replicationLagMetric = defineMetric("pgreplicaproxy_backend_replication_lag_seconds", gaugeMetric,
+	"Replication lag of replicas at their latest health check.", nil, "backend")
+
+const replicationLagQuery = `SELECT CASE
+	WHEN NOT EXISTS (SELECT 1 FROM pg_stat_wal_receiver) THEN EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`
+
+// Before PostgreSQL 10 renamed the functions
+const replicationLagQuery96 = `SELECT CASE
+	WHEN NOT EXISTS (SELECT 1 FROM pg_stat_wal_receiver) THEN EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())
+	WHEN pg_last_xlog_receive_location() = pg_last_xlog_replay_location() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`
+
+func replicationLag(db *sql.DB, backend string) (time.Duration, error) {
+	query := replicationLagQuery
+	backendVersions.Lock()
+	version := backendVersions.versions[backend]
+	backendVersions.Unlock()
+	if version > 0 && version < 100000 {
+		query = replicationLagQuery96
+	}
+	var seconds sql.NullFloat64
+	if err := db.QueryRow(query).Scan(&seconds); err != nil {
+		return 0, err
+	}
+	if !seconds.Valid {
+		// No WAL receiver, and nothing replayed
+		setMetric(replicationLagMetric, math.Inf(1), backendLabel(backend))
+		return time.Duration(math.MaxInt64), nil
+	}
+	setMetric(replicationLagMetric, seconds.Float64, backendLabel(backend))
+	return time.Duration(seconds.Float64 * float64(time.Second)), nil
+}
+
+// Returns whether a replica lags too far behind to be used.  If its lag
+// can't be measured, it stays as it was.
+func replicaLagging(db *sql.DB, backend string, wasLagging bool) bool {
+	max := cfg.Pgreplicaproxy.Max_Replication_Lag.Duration
+	if max <= 0 {
+		return false
+	}
+	lag, err := replicationLag(db, backend)
+	if err != nil {
+		logLimited("replication lag "+backendLabel(backend), "%v Replication lag query failed: %v", backendLabel(backend), err)
+		return wasLagging
+	}
+	return lag > max
+}
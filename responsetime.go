@@ -0,0 +1,122 @@
+package main
+
+import (
+	"container/ring"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The time from a client's request to the first message of the backend's
+// response is tracked for every session, and kept per backend as an
+// exponentially weighted moving average.  With response-time-weighting,
+// replicas are chosen at random with probability inversely proportional to
+// their average, so that a replica that's up but degraded is given less
+// work.  Replicas without any observations yet are weighted like the fastest
+// replica, so that they start receiving traffic.
+
+const responseTimeDecay = 0.05
+
+var responseTimeMetric = defineMetric("pgreplicaproxy_backend_response_time_ewma_seconds", gaugeMetric,
+	"Moving average of the time to the first message of backends' responses on live sessions.", nil, "backend")
+
+var responseTimes = struct {
+	sync.Mutex
+	averages map[string]float64
+}{averages: make(map[string]float64)}
+
+// Tracks the time to first response on a session; called for every message
+// in either direction.
+func (s *session) timeResponse(direction int, msgType byte) {
+	if direction == fromClient {
+		switch msgType {
+		case 'p', 'd', 'X':
+			// Authentication, COPY data, and Terminate aren't requests
+		default:
+			atomic.CompareAndSwapInt64(&s.requestStarted, 0, time.Now().UnixNano())
+		}
+		return
+	}
+
+	started := atomic.SwapInt64(&s.requestStarted, 0)
+	if started != 0 {
+		recordResponseTime(s.backend, time.Since(time.Unix(0, started)))
+	}
+}
+
+func recordResponseTime(backend string, elapsed time.Duration) {
+	responseTimes.Lock()
+	average, ok := responseTimes.averages[backend]
+	if ok {
+		average += responseTimeDecay * (elapsed.Seconds() - average)
+	} else {
+		average = elapsed.Seconds()
+	}
+	responseTimes.averages[backend] = average
+	responseTimes.Unlock()
+
+	setMetric(responseTimeMetric, average, backendLabel(backend))
+}
+
+// Picks a replica from the ring, weighted by response time, among those in
+// allowed unless it's nil.  Returns the ring positioned at the chosen
+// replica, or nil if none is allowed.
+func chooseWeightedReplica(replicas *ring.Ring, allowed map[string]bool) *ring.Ring {
+	if allowed != nil && nextMember(replicas, allowed) == nil {
+		return nil
+	}
+
+	responseTimes.Lock()
+	fastest := 0.0
+	averages := make([]float64, replicas.Len())
+	backends := make([]string, replicas.Len())
+	for i, r := 0, replicas; i < len(averages); i, r = i+1, r.Next() {
+		backends[i] = r.Value.(string)
+		if allowed != nil && !allowed[backendLabel(r.Value.(string))] {
+			averages[i] = -1
+			continue
+		}
+		averages[i] = responseTimes.averages[r.Value.(string)]
+		if averages[i] > 0 && (fastest == 0 || averages[i] < fastest) {
+			fastest = averages[i]
+		}
+	}
+	responseTimes.Unlock()
+
+	if fastest == 0 && allowed != nil {
+		return nextMember(replicas, allowed)
+	} else if fastest == 0 {
+		return replicas.Next()
+	}
+	configured := replicaWeightsConfigured()
+	weights := make([]float64, len(averages))
+	total := 0.0
+	for i, average := range averages {
+		if average < 0 {
+			// Not allowed
+			continue
+		}
+		if average == 0 {
+			average = fastest
+		}
+		weights[i] = 1 / average
+		if configured {
+			weights[i] *= float64(backendWeight(backends[i]))
+		}
+		total += weights[i]
+	}
+
+	choice := balancerRand.Float64() * total
+	r := replicas
+	for _, weight := range weights {
+		if choice < weight {
+			return r
+		}
+		choice -= weight
+		r = r.Next()
+	}
+	if allowed != nil {
+		return nextMember(replicas, allowed)
+	}
+	return replicas
+}
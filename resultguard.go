@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+)
+
+// The result-set size guard counts the DataRow messages returned for each
+// query on replica sessions, and cancels queries that return more than
+// replica-max-result-rows rows or replica-max-result-bytes bytes, catching
+// accidental unbounded exports.  A query's results are counted until its
+// CommandComplete, however many batches an Execute with a row limit fetches
+// them in, and the count starts over at every ReadyForQuery, so each FETCH
+// from a cursor is counted on its own.
+
+type resultSize struct {
+	rows      int64
+	bytes     int64
+	cancelled bool
+}
+
+func resultGuardConfigured() bool {
+	return cfg.Pgreplicaproxy.Replica_Max_Result_Rows > 0 || cfg.Pgreplicaproxy.Replica_Max_Result_Bytes > 0
+}
+
+func (s *session) guardResultSize(msgType byte, length int32, body []byte) {
+	switch msgType {
+	case 'D':
+		s.result.rows++
+		s.result.bytes += int64(length) + 1
+	case 'C', 'E', 'I', 'Z':
+		s.result = resultSize{}
+		return
+	default:
+		return
+	}
+
+	maxRows := cfg.Pgreplicaproxy.Replica_Max_Result_Rows
+	maxBytes := cfg.Pgreplicaproxy.Replica_Max_Result_Bytes
+	if s.result.cancelled || s.backendKey == nil {
+		return
+	}
+	if (maxRows > 0 && s.result.rows > maxRows) || (maxBytes > 0 && s.result.bytes > maxBytes) {
+		s.result.cancelled = true
+		log.Printf("session %v: cancelling query after %v rows, %v bytes; result size limit exceeded",
+			s.id, s.result.rows, s.result.bytes)
+		go sendCancelRequest(s.backend, *s.backendKey)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Client certificates are checked for revocation against a CRL file
+// (ssl-crl), an OCSP responder (ssl-ocsp-responder), or both.  The CRL file
+// is reloaded when it changes, and OCSP responses are cached until their
+// nextUpdate time, but no longer than ssl-revocation-refresh.  When
+// revocation status can't be determined, connections are allowed unless
+// ssl-revocation-strict is set, but a certificate listed by a CRL that has
+// expired is still rejected.
+
+const defaultRevocationRefresh = time.Hour
+const ocspTimeout = 10 * time.Second
+
+var certificateRevoked = errors.New("Client certificate has been revoked")
+
+var revocationCheckMetric = defineMetric("pgreplicaproxy_client_certificate_revocation_checks_total", counterMetric,
+	"Client certificate revocation checks, by source and result.", nil, "source", "result")
+
+func revocationRefresh() time.Duration {
+	if cfg.Pgreplicaproxy.Ssl_Revocation_Refresh.Duration > 0 {
+		return cfg.Pgreplicaproxy.Ssl_Revocation_Refresh.Duration
+	}
+	return defaultRevocationRefresh
+}
+
+var revocationCheckingSetup sync.Once
+
+// Called for each TLS configuration that verifies client certificates.
+func setupRevocationChecking() {
+	revocationCheckingSetup.Do(startRevocationChecking)
+}
+
+func startRevocationChecking() {
+	if cfg.Pgreplicaproxy.Ssl_Crl != "" {
+		if err := crls.reload(); err != nil {
+			log.Fatalf("ssl-crl: %v", err)
+		}
+	}
+	if cfg.Pgreplicaproxy.Ssl_Crl != "" || cfg.Pgreplicaproxy.Ssl_Ocsp_Responder != "" {
+		go refreshRevocationData()
+	}
+}
+
+func refreshRevocationData() {
+	for range time.Tick(revocationRefresh()) {
+		if cfg.Pgreplicaproxy.Ssl_Crl != "" {
+			if err := crls.reload(); err != nil {
+				logLimited("ssl-crl", "Unable to reload ssl-crl: %v", err)
+			}
+		}
+		ocspCache.expire()
+	}
+}
+
+// Called from the TLS handshake with the client's verified certificate chains.
+func checkRevocation(verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) < 2 {
+		// A self-signed certificate in ssl-ca; there's nobody to revoke it
+		return nil
+	}
+	cert, issuer := verifiedChains[0][0], verifiedChains[0][1]
+
+	if cfg.Pgreplicaproxy.Ssl_Crl != "" {
+		revoked, err := crls.isRevoked(cert, issuer)
+		if err := revocationResult("crl", cert, revoked, err); err != nil {
+			return err
+		}
+	}
+	if cfg.Pgreplicaproxy.Ssl_Ocsp_Responder != "" {
+		revoked, err := ocspCache.isRevoked(cert, issuer)
+		if err := revocationResult("ocsp", cert, revoked, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func revocationResult(source string, cert *x509.Certificate, revoked bool, err error) error {
+	switch {
+	case revoked:
+		// Even by an expired CRL
+		incMetric(revocationCheckMetric, source, "revoked")
+		log.Printf("Rejected revoked client certificate %v (serial %v)", cert.Subject.CommonName, cert.SerialNumber)
+		return certificateRevoked
+	case err != nil:
+		incMetric(revocationCheckMetric, source, "unknown")
+		logLimited("revocation "+source, "Unable to check revocation of client certificate %v (serial %v) by %v: %v",
+			cert.Subject.CommonName, cert.SerialNumber, source, err)
+		if cfg.Pgreplicaproxy.Ssl_Revocation_Strict {
+			return err
+		}
+	default:
+		incMetric(revocationCheckMetric, source, "good")
+	}
+	return nil
+}
+
+// The CRLs loaded from ssl-crl, which may contain several PEM-encoded CRLs
+// (eg. one per intermediate CA) or a single DER-encoded one.
+var crls crlSet
+
+type crlSet struct {
+	mutex   sync.Mutex
+	modTime time.Time
+	lists   []*loadedCRL
+}
+
+type loadedCRL struct {
+	list     *x509.RevocationList
+	revoked  map[string]bool
+	verified bool
+}
+
+func (c *crlSet) reload() error {
+	file := cfg.Pgreplicaproxy.Ssl_Crl
+	modTime, err := latestModTime(file)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	unchanged := c.lists != nil && modTime.Equal(c.modTime)
+	c.mutex.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var ders [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{data}
+	}
+
+	var lists []*loadedCRL
+	for _, der := range ders {
+		list, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return err
+		}
+		loaded := &loadedCRL{list: list, revoked: make(map[string]bool)}
+		for _, entry := range list.RevokedCertificateEntries {
+			loaded.revoked[entry.SerialNumber.String()] = true
+		}
+		lists = append(lists, loaded)
+	}
+
+	c.mutex.Lock()
+	c.lists = lists
+	c.modTime = modTime
+	c.mutex.Unlock()
+	log.Printf("Loaded %v CRLs from %v", len(lists), file)
+	return nil
+}
+
+func (c *crlSet) isRevoked(cert, issuer *x509.Certificate) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, crl := range c.lists {
+		if !bytes.Equal(crl.list.RawIssuer, issuer.RawSubject) {
+			continue
+		}
+		if !crl.verified {
+			if err := crl.list.CheckSignatureFrom(issuer); err != nil {
+				return false, fmt.Errorf("invalid CRL signature: %v", err)
+			}
+			crl.verified = true
+		}
+		if !crl.list.NextUpdate.IsZero() && time.Now().After(crl.list.NextUpdate) {
+			return crl.revoked[cert.SerialNumber.String()], fmt.Errorf("CRL for %v expired at %v", issuer.Subject, crl.list.NextUpdate)
+		}
+		return crl.revoked[cert.SerialNumber.String()], nil
+	}
+	return false, fmt.Errorf("no CRL for issuer %v", issuer.Subject)
+}
+
+// OCSP (RFC 6960) structures, as far as they're needed to make requests and
+// check responses.
+
+var oidSHA1 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+var oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+var ocspSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.3.101.112":           x509.PureEd25519,
+}
+
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			CertID ocspCertID
+		}
+	}
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type basicOCSPResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+	Extensions  []pkix.Extension `asn1:"optional,explicit,tag:1"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag        `asn1:"optional,tag:0"`
+	Revoked    ocspRevokedInfo  `asn1:"optional,tag:1"`
+	Unknown    asn1.Flag        `asn1:"optional,tag:2"`
+	ThisUpdate time.Time        `asn1:"generalized"`
+	NextUpdate time.Time        `asn1:"optional,generalized,explicit,tag:0"`
+	Extensions []pkix.Extension `asn1:"optional,explicit,tag:1"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"optional,explicit,tag:0"`
+}
+
+var ocspCache = &ocspStatusCache{entries: make(map[string]ocspStatus)}
+
+type ocspStatus struct {
+	revoked bool
+	expires time.Time
+}
+
+type ocspStatusCache struct {
+	mutex   sync.Mutex
+	entries map[string]ocspStatus
+}
+
+func (c *ocspStatusCache) isRevoked(cert, issuer *x509.Certificate) (bool, error) {
+	key := string(issuer.RawSubject) + "\x00" + cert.SerialNumber.String()
+	c.mutex.Lock()
+	status, ok := c.entries[key]
+	c.mutex.Unlock()
+	if ok && time.Now().Before(status.expires) {
+		return status.revoked, nil
+	}
+
+	revoked, nextUpdate, err := queryOCSP(cert, issuer)
+	if err != nil {
+		return false, err
+	}
+	expires := time.Now().Add(revocationRefresh())
+	if !nextUpdate.IsZero() && nextUpdate.Before(expires) {
+		expires = nextUpdate
+	}
+	c.mutex.Lock()
+	c.entries[key] = ocspStatus{revoked: revoked, expires: expires}
+	c.mutex.Unlock()
+	return revoked, nil
+}
+
+func (c *ocspStatusCache) expire() {
+	now := time.Now()
+	c.mutex.Lock()
+	for key, status := range c.entries {
+		if now.After(status.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.mutex.Unlock()
+}
+
+// Asks the OCSP responder for the status of cert; returns whether it has been
+// revoked, and when the responder's answer should be refreshed.
+func queryOCSP(cert, issuer *x509.Certificate) (bool, time.Time, error) {
+	certID, err := newOCSPCertID(cert, issuer)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	var request ocspRequest
+	request.TBSRequest.RequestList = append(request.TBSRequest.RequestList, struct{ CertID ocspCertID }{certID})
+	requestBytes, err := asn1.Marshal(request)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	client := &http.Client{Timeout: ocspTimeout}
+	resp, err := client.Post(cfg.Pgreplicaproxy.Ssl_Ocsp_Responder, "application/ocsp-request", bytes.NewReader(requestBytes))
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, time.Time{}, fmt.Errorf("OCSP responder returned %v", resp.Status)
+	}
+	responseBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	single, err := parseOCSPResponse(responseBytes, certID, issuer)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if single.Unknown {
+		return false, time.Time{}, fmt.Errorf("OCSP responder doesn't know the certificate")
+	}
+	return !single.Revoked.RevocationTime.IsZero(), single.NextUpdate, nil
+}
+
+func newOCSPCertID(cert, issuer *x509.Certificate) (ocspCertID, error) {
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return ocspCertID{}, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(publicKeyInfo.PublicKey.RightAlign())
+	return ocspCertID{
+		HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		IssuerNameHash: nameHash[:],
+		IssuerKeyHash:  keyHash[:],
+		SerialNumber:   cert.SerialNumber,
+	}, nil
+}
+
+// Checks an OCSP response's signature, which must be made by the issuer or by
+// a responder certificate the issuer has delegated OCSP signing to, and
+// returns its answer for certID.
+func parseOCSPResponse(data []byte, certID ocspCertID, issuer *x509.Certificate) (*ocspSingleResponse, error) {
+	var response ocspResponse
+	if _, err := asn1.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("malformed OCSP response: %v", err)
+	}
+	if response.Status != 0 {
+		return nil, fmt.Errorf("OCSP responder returned status %v", response.Status)
+	}
+	if !response.ResponseBytes.ResponseType.Equal(oidOCSPBasic) {
+		return nil, fmt.Errorf("unsupported OCSP response type %v", response.ResponseBytes.ResponseType)
+	}
+
+	var basic basicOCSPResponse
+	if _, err := asn1.Unmarshal(response.ResponseBytes.Response, &basic); err != nil {
+		return nil, fmt.Errorf("malformed OCSP response: %v", err)
+	}
+	var responseData ocspResponseData
+	if _, err := asn1.Unmarshal(basic.TBSResponseData.FullBytes, &responseData); err != nil {
+		return nil, fmt.Errorf("malformed OCSP response: %v", err)
+	}
+
+	signer := issuer
+	if len(basic.Certificates) > 0 {
+		responder, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+		if err != nil {
+			return nil, fmt.Errorf("malformed OCSP responder certificate: %v", err)
+		}
+		if !bytes.Equal(responder.Raw, issuer.Raw) {
+			if err := responder.CheckSignatureFrom(issuer); err != nil {
+				return nil, fmt.Errorf("OCSP responder certificate not issued by %v: %v", issuer.Subject, err)
+			}
+			if !hasExtKeyUsage(responder, x509.ExtKeyUsageOCSPSigning) {
+				return nil, fmt.Errorf("OCSP responder certificate not authorized for OCSP signing")
+			}
+			signer = responder
+		}
+	}
+
+	algorithm, ok := ocspSignatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported OCSP signature algorithm %v", basic.SignatureAlgorithm.Algorithm)
+	}
+	if err := signer.CheckSignature(algorithm, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign()); err != nil {
+		return nil, fmt.Errorf("invalid OCSP response signature: %v", err)
+	}
+
+	for i := range responseData.Responses {
+		single := &responseData.Responses[i]
+		if single.CertID.SerialNumber.Cmp(certID.SerialNumber) == 0 &&
+			bytes.Equal(single.CertID.IssuerNameHash, certID.IssuerNameHash) &&
+			bytes.Equal(single.CertID.IssuerKeyHash, certID.IssuerKeyHash) {
+			if time.Now().Before(single.ThisUpdate.Add(-5 * time.Minute)) {
+				return nil, fmt.Errorf("OCSP response is not yet valid")
+			}
+			if !single.NextUpdate.IsZero() && time.Now().After(single.NextUpdate) {
+				return nil, fmt.Errorf("OCSP response has expired")
+			}
+			return single, nil
+		}
+	}
+	return nil, fmt.Errorf("OCSP response doesn't cover the certificate")
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+)
+
+// Startup rewriters can change a client's startup parameters (rename its
+// database, rewrite its user, or add parameters such as options) before the
+// proxy acts on them, without patching handleIncomingConnection.  They're
+// registered at init time, from a file of their own:
+//
+//	func init() {
+//		registerStartupRewriter("tenant-databases", func(r *startupRewrite) error {
+//			r.parameters["database"] = "tenant_" + r.parameters["database"]
+//			return nil
+//		})
+//	}
+//
+// Rewriters run in registration order, after the replica suffix or prefix
+// has been removed from the database name, and before the database's
+// capacity, drains, and routes are looked up.  A rewriter that returns an
+// error rejects the connection, with the error as its message.
+// startup-parameter (startupparameters.go) is one.
+
+type startupRewrite struct {
+	// The listener the client connected to, and the client's address
+	frontend   string
+	clientAddr net.Addr
+
+	// Whether the client is being routed to a replica; a rewriter may
+	// change it.
+	replica bool
+
+	parameters startupMessage
+}
+
+type startupRewriter struct {
+	name    string
+	rewrite func(*startupRewrite) error
+}
+
+var startupRewriters []startupRewriter
+
+// Registers a startup rewriter.  Only to be called from init functions.
+func registerStartupRewriter(name string, rewrite func(*startupRewrite) error) {
+	startupRewriters = append(startupRewriters, startupRewriter{name, rewrite})
+}
+
+// Runs the registered rewriters over a client's startup parameters.
+func rewriteStartup(r *startupRewrite) error {
+	for _, rewriter := range startupRewriters {
+		before := len(r.parameters)
+		err := rewriter.rewrite(r)
+		if err != nil {
+			logDebug("startup rewriter %v rejected the connection: %v", rewriter.name, err)
+			return err
+		}
+		logDebug("startup rewriter %v: %v parameters before, %v after", rewriter.name, before, len(r.parameters))
+	}
+	return nil
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"container/ring"
+	"math/rand"
+	"sort"
+	"time"
 )
 
 func addToRing(r *ring.Ring, s string) *ring.Ring {
@@ -19,3 +22,80 @@ func removeFromRing(r *ring.Ring, s string) *ring.Ring {
 	})
 	return newRing
 }
+
+// Returns the next element of the ring (after r) whose backend's network
+// address is in members, or nil if there's none.
+func nextMember(r *ring.Ring, members map[string]bool) *ring.Ring {
+	if members == nil {
+		return nil
+	}
+	candidate := r
+	for i := 0; i < r.Len(); i++ {
+		candidate = candidate.Next()
+		if members[backendLabel(candidate.Value.(string))] {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// The balancer's source of randomness, only used by the oracle.  With
+// balancer-seed, it's seeded with that, and the replica rotation restarts from
+// the first replica in config order whenever the replicas change, so that
+// the balancer's decisions are reproducible, eg. in integration tests.
+var balancerRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+func setupBalancerSeed() {
+	if cfg.Pgreplicaproxy.Balancer_Seed != 0 {
+		balancerRand = rand.New(rand.NewSource(cfg.Pgreplicaproxy.Balancer_Seed))
+	}
+}
+
+// Returns the members present in both sets; nil if members is nil.
+func intersectMembers(members, allowed map[string]bool) map[string]bool {
+	if members == nil {
+		return nil
+	}
+	intersection := make(map[string]bool)
+	for member := range members {
+		if allowed[member] {
+			intersection[member] = true
+		}
+	}
+	return intersection
+}
+
+// Returns the ring's elements in config order, positioned so that the next
+// element is the first.
+func orderRing(r *ring.Ring) *ring.Ring {
+	order := make(map[string]int)
+	for i, backend := range currentBackends() {
+		order[backend] = i
+	}
+	var values []string
+	r.Do(func(v interface{}) {
+		values = append(values, v.(string))
+	})
+	if len(values) == 0 {
+		return r
+	}
+	sort.Sort(backendsByOrder{values, order})
+
+	ordered := ring.New(len(values))
+	for _, value := range values {
+		ordered.Value = value
+		ordered = ordered.Next()
+	}
+	return ordered.Prev()
+}
+
+type backendsByOrder struct {
+	backends []string
+	order    map[string]int
+}
+
+func (b backendsByOrder) Len() int      { return len(b.backends) }
+func (b backendsByOrder) Swap(i, j int) { b.backends[i], b.backends[j] = b.backends[j], b.backends[i] }
+func (b backendsByOrder) Less(i, j int) bool {
+	return b.order[b.backends[i]] < b.order[b.backends[j]]
+}
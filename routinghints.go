@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+)
+
+// With routing-hint-prefix set (eg. to pgproxy), clients whose frameworks
+// can only pass options can steer routing with settings named after it:
+// pgproxy.target=master or replica, and pgproxy.replica_group=name, which
+// also implies a replica, for a replica in that replica-group.  Like
+// target_session_attrs (see targetsession.go), they're taken from startup
+// parameters or "-c" options and removed before the startup message is sent
+// on.  Routing rules and read-only and read-write listeners still take
+// precedence, though read-only listeners refuse pgproxy.target=master.
+
+type routingHints struct {
+	target  string // "master", "replica", or "" if not given
+	group   string
+	members map[string]bool
+}
+
+// Removes the routing hints from a startup message and returns them; nil if
+// routing-hint-prefix isn't set or none were given.
+func takeRoutingHints(parameters startupMessage) (*routingHints, error) {
+	prefix := cfg.Pgreplicaproxy.Routing_Hint_Prefix
+	if prefix == "" {
+		return nil, nil
+	}
+	targetName, groupName := prefix+".target", prefix+".replica_group"
+	settings := takeStartupSettings(parameters, func(name string) bool {
+		return name == targetName || name == groupName
+	})
+	if len(settings) == 0 {
+		return nil, nil
+	}
+
+	hints := &routingHints{target: settings[targetName], group: settings[groupName]}
+	switch hints.target {
+	case "", "master", "replica":
+	default:
+		return nil, fmt.Errorf("invalid %v value: %q", targetName, hints.target)
+	}
+	if hints.group != "" {
+		if hints.target == "master" {
+			return nil, fmt.Errorf("%v can't be combined with %v=master", groupName, targetName)
+		}
+		group := cfg.Replica_Group[hints.group]
+		if group == nil {
+			return nil, fmt.Errorf("unknown replica-group %q", hints.group)
+		}
+		hints.target = "replica"
+		hints.members = make(map[string]bool)
+		for _, member := range group.Member {
+			hints.members[member] = true
+		}
+	}
+	return hints, nil
+}
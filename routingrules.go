@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Routing rules ([routing-rule "name"] sections) are evaluated in name order
+// for each new session, and the first that matches decides where it goes,
+// whatever its database name asks for: to the master, to a replica (of the
+// rule's replica-group, if given, falling back to the general pool as for
+// scheduled routes), or nowhere, with the rule's message.  A rule matches
+// when each of its user, database, client (addresses or CIDR networks) and
+// application-name (glob patterns) lists is empty or has a match.  Database
+// names are matched without their replica suffix or prefix.  Sessions no
+// rule matches are routed by their database name as usual.  Read-only and
+// read-write listeners keep their routing either way, but read-only ones
+// refuse the sessions a rule sends to the master.
+
+type routingRule struct {
+	name             string
+	users            map[string]bool
+	databases        map[string]bool
+	clients          []*net.IPNet
+	applicationNames []string
+
+	action  string
+	members map[string]bool // network addresses of the replica group's members
+	message string
+}
+
+var routingRules = struct {
+	sync.Mutex
+	rules []*routingRule
+}{}
+
+func setupRoutingRules() {
+	rules, err := compileRoutingRules(&cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setRoutingRules(rules)
+}
+
+func setRoutingRules(rules []*routingRule) {
+	routingRules.Lock()
+	routingRules.rules = rules
+	routingRules.Unlock()
+}
+
+func compileRoutingRules(c *config) ([]*routingRule, error) {
+	names := make([]string, 0, len(c.Routing_Rule))
+	for name := range c.Routing_Rule {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rules []*routingRule
+	for _, name := range names {
+		rc := c.Routing_Rule[name]
+		rule := &routingRule{name: name, action: rc.Action, message: rc.Message, applicationNames: rc.Application_Name}
+		if len(rc.User) > 0 {
+			rule.users = make(map[string]bool)
+			for _, user := range rc.User {
+				rule.users[user] = true
+			}
+		}
+		if len(rc.Database) > 0 {
+			rule.databases = make(map[string]bool)
+			for _, database := range rc.Database {
+				rule.databases[database] = true
+			}
+		}
+		for _, client := range rc.Client {
+			if !strings.Contains(client, "/") {
+				if strings.Contains(client, ":") {
+					client += "/128"
+				} else {
+					client += "/32"
+				}
+			}
+			_, network, err := net.ParseCIDR(client)
+			if err != nil {
+				return nil, fmt.Errorf("routing-rule %v: client: %v", name, err)
+			}
+			rule.clients = append(rule.clients, network)
+		}
+		for _, pattern := range rc.Application_Name {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("routing-rule %v: application-name %q: %v", name, pattern, err)
+			}
+		}
+
+		switch rule.action {
+		case "master", "reject":
+			if rc.Replica_Group != "" {
+				return nil, fmt.Errorf("routing-rule %v: replica-group requires action=replica", name)
+			}
+		case "replica":
+			if rc.Replica_Group != "" {
+				group, ok := c.Replica_Group[rc.Replica_Group]
+				if !ok {
+					return nil, fmt.Errorf("routing-rule %v: unknown replica-group %q", name, rc.Replica_Group)
+				}
+				rule.members = make(map[string]bool)
+				for _, member := range group.Member {
+					rule.members[member] = true
+				}
+			}
+		default:
+			return nil, fmt.Errorf("routing-rule %v: action must be master, replica or reject", name)
+		}
+		if rule.message == "" {
+			rule.message = "Connections like this one are not allowed"
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Returns the first rule matching a session, or nil if none does.
+func matchRoutingRule(user, database string, addr net.Addr, applicationName string) *routingRule {
+	routingRules.Lock()
+	rules := routingRules.rules
+	routingRules.Unlock()
+
+	ip := net.ParseIP(clientIP(addr))
+	for _, rule := range rules {
+		if rule.matches(user, database, ip, applicationName) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (rule *routingRule) matches(user, database string, ip net.IP, applicationName string) bool {
+	if rule.users != nil && !rule.users[user] {
+		return false
+	}
+	if rule.databases != nil && !rule.databases[database] {
+		return false
+	}
+	if len(rule.clients) > 0 {
+		matched := false
+		for _, network := range rule.clients {
+			if ip != nil && network.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.applicationNames) > 0 {
+		matched := false
+		for _, pattern := range rule.applicationNames {
+			if ok, _ := path.Match(pattern, applicationName); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
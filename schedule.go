@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheduled routes send the replica connections of some databases to a
+// replica group while their schedule is active, eg. reporting databases to
+// dedicated replicas during business hours, and to the general pool of
+// replicas otherwise.  Schedules are cron-like ("minute hour day-of-month
+// month day-of-week"), and are evaluated when each session is established.
+// When no member of the group is available, the general pool is used.
+
+type scheduledRoute struct {
+	name      string
+	databases map[string]bool
+	schedule  *cronSchedule
+	location  *time.Location
+	members   map[string]bool // network addresses of the group's members
+}
+
+var scheduledRoutes = struct {
+	sync.Mutex
+	routes []*scheduledRoute
+}{}
+
+func setupScheduledRoutes() {
+	routes, err := compileScheduledRoutes(&cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setScheduledRoutes(routes)
+}
+
+func setScheduledRoutes(routes []*scheduledRoute) {
+	scheduledRoutes.Lock()
+	scheduledRoutes.routes = routes
+	scheduledRoutes.Unlock()
+}
+
+func compileScheduledRoutes(c *config) ([]*scheduledRoute, error) {
+	names := make([]string, 0, len(c.Route))
+	for name := range c.Route {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var routes []*scheduledRoute
+	for _, name := range names {
+		rc := c.Route[name]
+		route := &scheduledRoute{name: name, databases: make(map[string]bool), location: time.Local, members: make(map[string]bool)}
+		for _, database := range rc.Database {
+			route.databases[database] = true
+		}
+
+		var err error
+		route.schedule, err = parseCronSchedule(rc.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("route %v: schedule: %v", name, err)
+		}
+		if rc.Time_Zone != "" {
+			route.location, err = time.LoadLocation(rc.Time_Zone)
+			if err != nil {
+				return nil, fmt.Errorf("route %v: time-zone: %v", name, err)
+			}
+		}
+
+		group, ok := c.Replica_Group[rc.Replica_Group]
+		if !ok {
+			return nil, fmt.Errorf("route %v: unknown replica-group %q", name, rc.Replica_Group)
+		}
+		for _, member := range group.Member {
+			route.members[member] = true
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// Returns the members of the replica group that a database's replica
+// connections should use now, or nil for the general pool.
+func scheduledReplicaGroup(database string, now time.Time) map[string]bool {
+	scheduledRoutes.Lock()
+	routes := scheduledRoutes.routes
+	scheduledRoutes.Unlock()
+
+	for _, route := range routes {
+		if route.databases[database] && route.schedule.matches(now.In(route.location)) {
+			return route.members
+		}
+	}
+	return nil
+}
+
+// A cronSchedule holds the set of allowed values of each field as a bitmask.
+type cronSchedule struct {
+	minutes, hours, daysOfMonth, months, daysOfWeek uint64
+
+	// As in cron, when both day fields are restricted, a time matches if
+	// either does.
+	daysOfMonthRestricted, daysOfWeekRestricted bool
+}
+
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields (minute hour day-of-month month day-of-week), got %v", len(fields))
+	}
+
+	s := &cronSchedule{}
+	var err error
+	if s.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.daysOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.daysOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Sunday is both 0 and 7
+	if s.daysOfWeek&(1<<7) != 0 {
+		s.daysOfWeek |= 1
+	}
+	s.daysOfMonthRestricted = fields[2] != "*"
+	s.daysOfWeekRestricted = fields[4] != "*"
+	return s, nil
+}
+
+// Parses a field of comma-separated items, each "*", a value, or a range
+// "a-b", optionally followed by a step "/n".
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i != -1 {
+			var err error
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+			item = item[:i]
+		}
+
+		low, high := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			low, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", item)
+			}
+			high = low
+			if len(bounds) == 2 {
+				high, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid range %q", item)
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q is out of range %v-%v", item, min, max)
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func (s *cronSchedule) matches(t time.Time) bool {
+	if s.minutes&(1<<uint(t.Minute())) == 0 || s.hours&(1<<uint(t.Hour())) == 0 || s.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dayOfMonth := s.daysOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := s.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if s.daysOfMonthRestricted && s.daysOfWeekRestricted {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
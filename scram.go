@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// SCRAM-SHA-256 (RFC 5802 & RFC 7677), as used by PostgreSQL, with or
+// without channel binding (SCRAM-SHA-256-PLUS; see scrambinding.go).
+// Passwords aren't normalized with SASLprep, which only matters for
+// passwords containing non-ASCII characters.
+
+const scramMechanism = "SCRAM-SHA-256"
+const scramIterations = 4096
+
+var malformedSCRAMMessage = errors.New("Malformed SCRAM message")
+var malformedSCRAMVerifier = errors.New("Malformed SCRAM-SHA-256 verifier")
+
+// The keys derived from a password, which are all that's needed to act as
+// either side of a SCRAM exchange; clientKey is only known once a client has
+// authenticated (or when the password is known).
+type scramKeys struct {
+	salt       []byte
+	iterations int
+	clientKey  []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+func scramKeysFromPassword(password string, salt []byte, iterations int) *scramKeys {
+	saltedPassword := scramHi([]byte(password), salt, iterations)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &scramKeys{
+		salt:       salt,
+		iterations: iterations,
+		clientKey:  clientKey,
+		storedKey:  storedKey[:],
+		serverKey:  scramHMAC(saltedPassword, "Server Key"),
+	}
+}
+
+// Parses a verifier as stored in pg_authid:
+// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+func parseSCRAMVerifier(verifier string) (*scramKeys, error) {
+	parts := strings.Split(verifier, "$")
+	if len(parts) != 3 || parts[0] != scramMechanism {
+		return nil, malformedSCRAMVerifier
+	}
+	iterationsAndSalt := strings.SplitN(parts[1], ":", 2)
+	keys := strings.SplitN(parts[2], ":", 2)
+	if len(iterationsAndSalt) != 2 || len(keys) != 2 {
+		return nil, malformedSCRAMVerifier
+	}
+
+	iterations, err := strconv.Atoi(iterationsAndSalt[0])
+	if err != nil || iterations < 1 {
+		return nil, malformedSCRAMVerifier
+	}
+	salt, err1 := base64.StdEncoding.DecodeString(iterationsAndSalt[1])
+	storedKey, err2 := base64.StdEncoding.DecodeString(keys[0])
+	serverKey, err3 := base64.StdEncoding.DecodeString(keys[1])
+	if err1 != nil || err2 != nil || err3 != nil || len(storedKey) != sha256.Size || len(serverKey) != sha256.Size {
+		return nil, malformedSCRAMVerifier
+	}
+	return &scramKeys{salt: salt, iterations: iterations, storedKey: storedKey, serverKey: serverKey}, nil
+}
+
+// Checks a client's proof against the stored key, and if it's correct,
+// records the client key that it reveals.
+func (k *scramKeys) verifyClientProof(authMessage string, proof []byte) bool {
+	clientSignature := scramHMAC(k.storedKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return false
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], k.storedKey) {
+		return false
+	}
+	k.clientKey = clientKey
+	return true
+}
+
+func (k *scramKeys) clientProof(authMessage string) []byte {
+	proof := scramHMAC(k.storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= k.clientKey[i]
+	}
+	return proof
+}
+
+func (k *scramKeys) serverSignature(authMessage string) []byte {
+	return scramHMAC(k.serverKey, authMessage)
+}
+
+// Hi() from RFC 5802, which is PBKDF2 with HMAC-SHA-256 for a single block.
+func scramHi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func scramNonce() string {
+	nonce := make([]byte, 18)
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(nonce)
+}
+
+// Parses the comma-separated attribute=value pairs of a SCRAM message.
+func scramAttributes(message string) map[byte]string {
+	attributes := make(map[byte]string)
+	for _, field := range strings.Split(message, ",") {
+		if len(field) >= 2 && field[1] == '=' {
+			attributes[field[0]] = field[2:]
+		}
+	}
+	return attributes
+}
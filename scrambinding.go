@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"hash"
+	"net"
+	"strings"
+)
+
+// SCRAM-SHA-256-PLUS binds the SCRAM exchange to the TLS connection it runs
+// over, with the tls-server-end-point channel binding type (RFC 5929): a hash
+// of the server's certificate, which is all PostgreSQL supports.  As the
+// proxy terminates the client's TLS connection, a binding made by the client
+// can only be checked by the proxy, so each leg is bound separately: with
+// proxy-terminated auth, TLS clients are offered SCRAM-SHA-256-PLUS bound to
+// the proxy's certificate, and the proxy uses it with backends that offer it
+// over TLS, bound to the backend's certificate.  With passthrough auth, a
+// client that binds to the proxy's certificate can't authenticate to a
+// backend over TLS, which is logged.
+
+const scramPlusMechanism = scramMechanism + "-PLUS"
+const tlsServerEndPointGS2Header = "p=tls-server-end-point,,"
+
+// Returns the tls-server-end-point channel binding data of a certificate, or
+// nil if its signature algorithm has none.
+func tlsServerEndPoint(cert *x509.Certificate) []byte {
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.ECDSAWithSHA1, x509.SHA256WithRSA, x509.ECDSAWithSHA256, x509.SHA256WithRSAPSS:
+		h = sha256.New()
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = sha512.New()
+	default:
+		return nil
+	}
+	h.Write(cert.Raw)
+	return h.Sum(nil)
+}
+
+// Returns the channel binding data of a client connection that the proxy
+// terminates TLS on, or nil if it's in plaintext.
+func clientChannelBinding(conn net.Conn, config *tls.Config) []byte {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || config == nil || config.GetCertificate == nil {
+		return nil
+	}
+	// The certificate is looked up again rather than remembered from the
+	// handshake; it only differs if it was reloaded in between
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: tlsConn.ConnectionState().ServerName, Conn: conn})
+	if err != nil || cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil
+		}
+	}
+	return tlsServerEndPoint(leaf)
+}
+
+// Returns the channel binding data of a backend connection, or nil if it
+// isn't over TLS.
+func backendChannelBinding(conn interface{}) []byte {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return tlsServerEndPoint(certs[0])
+}
+
+// Logs a passthrough-auth client that the backend offers channel binding to,
+// when the proxy terminates its TLS connection: if the client binds, it binds
+// to the proxy's certificate, and the backend refuses it.
+func warnUnrelayableChannelBinding(client net.Conn, mechanisms []byte) {
+	if _, isTLS := client.(*tls.Conn); !isTLS || !strings.Contains(string(mechanisms), scramPlusMechanism+"\x00") {
+		return
+	}
+	logLimited("scram channel binding", "%v: the backend offers SCRAM channel binding, which can't be relayed through the proxy's TLS connection; "+
+		"clients that use it will fail to authenticate, unless the proxy authenticates them with auth-type=scram-sha-256", client.RemoteAddr())
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// With -self-test, pgreplicaproxy starts against a built-in mock backend,
+// without reading a config file, and runs a scripted client session through
+// itself: startup, a query, a cancelled query, and a disconnect.  It exits
+// with a non-zero status if any step fails, as a smoke test for packaging and
+// builds.
+
+var selfTestFlag = flag.Bool("self-test", false, "run a scripted session against a mock backend, and exit")
+
+const selfTestTimeout = 15 * time.Second
+const selfTestProcessId = 4242
+const selfTestSecretKey = 1234567
+
+var selfTestStepFailed = errors.New("Unexpected response")
+
+func runSelfTest() int {
+	cfg = config{}
+	cfg.Pgreplicaproxy.Log_Level = "info"
+
+	mock, err := startMockBackend()
+	if err != nil {
+		log.Printf("self-test: starting the mock backend: %v", err)
+		return 1
+	}
+	_, port, _ := net.SplitHostPort(mock.listener.Addr().String())
+	cfg.Pgreplicaproxy.Backend = []string{"host=127.0.0.1 port=" + port + " user=selftest dbname=selftest sslmode=disable"}
+
+	go serverStatusOracle()
+	go manageBackendKeyDataStorage()
+	go manageSessionStorage()
+	go flushLimitedLogs()
+	go manageDatabaseCapacity()
+	go manageFingerprintSlots()
+	setBackends(cfg.Pgreplicaproxy.Backend)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Printf("self-test: %v", err)
+		return 1
+	}
+	fe := newFrontend("self-test", &listenerConfig{})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleIncomingConnection(conn, fe, masterRequestChannel, replicaRequestChannel)
+		}
+	}()
+
+	steps := []struct {
+		name string
+		run  func(*selfTestClient) error
+	}{
+		{"backend monitored", func(*selfTestClient) error { return waitForSelfTestMaster() }},
+		{"startup", (*selfTestClient).startup},
+		{"query", (*selfTestClient).query},
+		{"cancel", func(c *selfTestClient) error { return c.cancel(ln.Addr().String()) }},
+		{"disconnect", func(c *selfTestClient) error { return c.disconnect(mock) }},
+	}
+	client := &selfTestClient{proxyAddress: ln.Addr().String()}
+	for _, step := range steps {
+		err := step.run(client)
+		if err != nil {
+			log.Printf("self-test: %v: FAILED: %v", step.name, err)
+			return 1
+		}
+		log.Printf("self-test: %v: OK", step.name)
+	}
+	log.Printf("self-test: passed")
+	return 0
+}
+
+func waitForSelfTestMaster() error {
+	deadline := time.Now().Add(selfTestTimeout)
+	for time.Now().Before(deadline) {
+		master, err := requestBackend(masterRequestChannel, nil, nil, false)
+		if err == nil && master != nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New("the mock backend wasn't found up")
+}
+
+type selfTestClient struct {
+	proxyAddress string
+	conn         net.Conn
+	key          backendKeyDataMessage
+}
+
+// Reads messages until one of the given type, returning its body; an
+// ErrorResponse fails, unless it's expected.
+func (c *selfTestClient) expect(msgType byte) ([]byte, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(selfTestTimeout))
+		t, body, err := readMessage(c.conn)
+		if err != nil {
+			return nil, err
+		}
+		if t == msgType {
+			return body, nil
+		}
+		if t == 'E' {
+			return nil, fmt.Errorf("error from the proxy: %v", errorResponseField(body, 'M'))
+		}
+	}
+}
+
+func (c *selfTestClient) startup() error {
+	var err error
+	c.conn, err = net.DialTimeout("tcp", c.proxyAddress, selfTestTimeout)
+	if err != nil {
+		return err
+	}
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, int32(196608))
+	body.WriteString("user\x00selftest\x00database\x00selftest\x00\x00")
+	binary.Write(c.conn, binary.BigEndian, int32(body.Len()+4))
+	c.conn.Write(body.Bytes())
+
+	if _, err := c.expect('R'); err != nil {
+		return err
+	}
+	keyData, err := c.expect('K')
+	if err != nil {
+		return err
+	}
+	if len(keyData) != 8 {
+		return selfTestStepFailed
+	}
+	c.key.processId = int32(binary.BigEndian.Uint32(keyData))
+	c.key.secretKey = int32(binary.BigEndian.Uint32(keyData[4:]))
+	_, err = c.expect('Z')
+	return err
+}
+
+func (c *selfTestClient) query() error {
+	writeMessage(c.conn, 'Q', []byte("SELECT 1\x00"))
+	row, err := c.expect('D')
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(row, []byte{0, 1, 0, 0, 0, 1, '1'}) {
+		return selfTestStepFailed
+	}
+	_, err = c.expect('Z')
+	return err
+}
+
+func (c *selfTestClient) cancel(proxyAddress string) error {
+	writeMessage(c.conn, 'Q', []byte("SELECT pg_sleep(60)\x00"))
+
+	// Give the query time to reach the backend
+	time.Sleep(100 * time.Millisecond)
+	cancelConn, err := net.DialTimeout("tcp", proxyAddress, selfTestTimeout)
+	if err != nil {
+		return err
+	}
+	binary.Write(cancelConn, binary.BigEndian, []int32{16, 80877102, c.key.processId, c.key.secretKey})
+	cancelConn.Close()
+
+	c.conn.SetReadDeadline(time.Now().Add(selfTestTimeout))
+	t, body, err := readMessage(c.conn)
+	if err != nil {
+		return err
+	}
+	if t != 'E' || errorResponseField(body, 'C') != "57014" {
+		return errors.New("the query wasn't cancelled")
+	}
+	_, err = c.expect('Z')
+	return err
+}
+
+func (c *selfTestClient) disconnect(mock *mockBackend) error {
+	writeMessage(c.conn, 'X', nil)
+	c.conn.Close()
+	select {
+	case <-mock.terminated:
+		return nil
+	case <-time.After(selfTestTimeout):
+		return errors.New("the backend didn't receive the Terminate message")
+	}
+}
+
+// Just enough of a PostgreSQL server for the self-test and the health checks
+// of the monitor: any user may connect, SELECT 1 and pg_is_in_recovery() are
+// answered, and pg_sleep() waits for a CancelRequest.
+type mockBackend struct {
+	listener   net.Listener
+	terminated chan bool
+	cancelled  chan bool
+}
+
+func startMockBackend() (*mockBackend, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	mock := &mockBackend{listener: ln, terminated: make(chan bool, 1), cancelled: make(chan bool, 1)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go mock.serve(conn)
+		}
+	}()
+	return mock, nil
+}
+
+func (m *mockBackend) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var length, code int32
+	for {
+		if binary.Read(conn, binary.BigEndian, &length) != nil || length < 8 || length > 8192 {
+			return
+		}
+		if binary.Read(conn, binary.BigEndian, &code) != nil {
+			return
+		}
+		rest := make([]byte, length-8)
+		if _, err := io.ReadFull(conn, rest); err != nil {
+			return
+		}
+		if code == sslRequestCode {
+			conn.Write([]byte{'N'})
+			continue
+		}
+		if code == 80877102 {
+			if len(rest) == 8 && int32(binary.BigEndian.Uint32(rest)) == selfTestProcessId &&
+				int32(binary.BigEndian.Uint32(rest[4:])) == selfTestSecretKey {
+				select {
+				case m.cancelled <- true:
+				default:
+				}
+			}
+			return
+		}
+		break
+	}
+
+	// The health checks and the self-test's session are served alike
+	writeAuthRequest(conn, authenticationOk, nil)
+	writeMessage(conn, 'S', []byte("server_version\x009.6.0\x00"))
+	keyData := make([]byte, 8)
+	binary.BigEndian.PutUint32(keyData, selfTestProcessId)
+	binary.BigEndian.PutUint32(keyData[4:], selfTestSecretKey)
+	writeMessage(conn, 'K', keyData)
+	writeMessage(conn, 'Z', []byte{'I'})
+
+	for {
+		msgType, body, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		switch msgType {
+		case 'X':
+			select {
+			case m.terminated <- true:
+			default:
+			}
+			return
+		case 'Q':
+			query, _ := readCString(body)
+			m.answer(conn, query)
+		default:
+			sendErrorWithCode(conn, "0A000", "The mock backend only supports simple queries") // feature not supported
+		}
+		writeMessage(conn, 'Z', []byte{'I'})
+	}
+}
+
+func (m *mockBackend) answer(conn net.Conn, query string) {
+	switch {
+	case query == "SELECT 1":
+		m.writeRow(conn, 23, "1") // int4
+	case strings.Contains(query, "pg_is_in_recovery()"):
+		m.writeRow(conn, 16, "f") // bool
+	case query == "SHOW server_version_num":
+		m.writeRow(conn, 25, "90600") // text
+	case strings.Contains(query, "pg_sleep("):
+		select {
+		case <-m.cancelled:
+			sendErrorWithCode(conn, "57014", "canceling statement due to user request") // query canceled
+		case <-time.After(selfTestTimeout):
+			writeMessage(conn, 'C', []byte("SELECT 1\x00"))
+		}
+	default:
+		sendErrorWithCode(conn, "42601", "The mock backend doesn't understand this query") // syntax error
+	}
+}
+
+// Sends a result with a single column and row.
+func (m *mockBackend) writeRow(conn net.Conn, typeOid int32, value string) {
+	description := &bytes.Buffer{}
+	binary.Write(description, binary.BigEndian, int16(1))
+	description.WriteString("?column?\x00")
+	binary.Write(description, binary.BigEndian, []int32{0})
+	binary.Write(description, binary.BigEndian, int16(0))
+	binary.Write(description, binary.BigEndian, typeOid)
+	binary.Write(description, binary.BigEndian, int16(-1))
+	binary.Write(description, binary.BigEndian, int32(-1))
+	binary.Write(description, binary.BigEndian, int16(0))
+	writeMessage(conn, 'T', description.Bytes())
+
+	row := &bytes.Buffer{}
+	binary.Write(row, binary.BigEndian, int16(1))
+	binary.Write(row, binary.BigEndian, int32(len(value)))
+	row.WriteString(value)
+	writeMessage(conn, 'D', row.Bytes())
+	writeMessage(conn, 'C', []byte("SELECT 1\x00"))
+}
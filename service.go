@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Backends may refer to entries of a pg_service.conf-style connection service
+// file with a service=name parameter, as libpq allows, so that the same
+// service definitions used by applications can define the cluster.  As in
+// libpq, services are looked up in the user's service file, then in the
+// system-wide one.
+
+// Returns the backends with any service=name parameters replaced by the
+// parameters of the named service.  Parameters given explicitly in the
+// backend take precedence over those of the service.
+func expandBackendServices(backends []string) ([]string, error) {
+	var serviceFiles []map[string]Values
+	expanded := make([]string, 0, len(backends))
+
+	for _, backend := range backends {
+		o := make(Values)
+		if err := parseOpts(backend, o); err != nil {
+			return nil, fmt.Errorf("backend %v: %v", backendLabel(backend), err)
+		}
+		serviceName := o.Get("service")
+		if serviceName == "" {
+			expanded = append(expanded, backend)
+			continue
+		}
+
+		if serviceFiles == nil {
+			var err error
+			serviceFiles, err = readServiceFiles()
+			if err != nil {
+				return nil, err
+			}
+		}
+		var service Values
+		ok := false
+		for _, services := range serviceFiles {
+			if service, ok = services[serviceName]; ok {
+				break
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("backend %q refers to unknown service %q", backend, serviceName)
+		}
+
+		delete(o, "service")
+		for k, v := range service {
+			if _, ok := o[k]; !ok {
+				o.Set(k, v)
+			}
+		}
+		expanded = append(expanded, o.String())
+	}
+
+	return expanded, nil
+}
+
+// Reads the user's service file and the system-wide one, in that order,
+// skipping those that don't exist.
+func readServiceFiles() ([]map[string]Values, error) {
+	var serviceFiles []map[string]Values
+	for _, name := range serviceFileNames() {
+		services, err := readServiceFile(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		serviceFiles = append(serviceFiles, services)
+	}
+	return serviceFiles, nil
+}
+
+// Finds the user's and the system-wide service files the same way libpq
+// does, except that the service-file config option takes precedence as the
+// user's.
+func serviceFileNames() []string {
+	var names []string
+	if cfg.Pgreplicaproxy.Service_File != "" {
+		names = append(names, cfg.Pgreplicaproxy.Service_File)
+	} else if name := os.Getenv("PGSERVICEFILE"); name != "" {
+		names = append(names, name)
+	} else if home := os.Getenv("HOME"); home != "" {
+		names = append(names, filepath.Join(home, ".pg_service.conf"))
+	}
+	if dir := os.Getenv("PGSYSCONFDIR"); dir != "" {
+		names = append(names, filepath.Join(dir, "pg_service.conf"))
+	} else {
+		names = append(names, "/etc/pg_service.conf")
+	}
+	return names
+}
+
+// Reads a connection service file; each [section] is a service name, and the
+// lines in it are connection parameters.
+func readServiceFile(name string) (map[string]Values, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	services := make(map[string]Values)
+	var service Values
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			service = make(Values)
+			services[line[1:len(line)-1]] = service
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || service == nil {
+			return nil, fmt.Errorf("%v:%v: syntax error in service file", name, lineNumber)
+		}
+		service.Set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+
+	return services, scanner.Err()
+}
+
+// Formats the values as a connection string, ordered by key, quoting values
+// as libpq requires.
+func (vs Values) String() string {
+	keys := make([]string, 0, len(vs))
+	for k := range vs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"="+quoteConnectionValue(vs[k]))
+	}
+	return strings.Join(parts, " ")
+}
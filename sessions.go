@@ -0,0 +1,364 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Directions of traffic through a proxied session.
+const (
+	fromClient = iota
+	fromBackend
+)
+
+var directionNames = []string{"client", "backend"}
+
+var lastSessionId uint64
+
+var sessionDurationMetric = defineMetric("pgreplicaproxy_session_duration_seconds", histogramMetric,
+	"Total duration of proxied sessions.", sessionDurationBuckets, "route", "backend")
+var handshakeDurationMetric = defineMetric("pgreplicaproxy_handshake_duration_seconds", histogramMetric,
+	"Time from accepting a client connection to the backend's first ReadyForQuery.", latencyBuckets, "route", "backend")
+
+var sessionDurationBuckets = []float64{0.01, 0.1, 1, 10, 60, 300, 900, 3600, 4 * 3600, 24 * 3600}
+
+// A session is a single proxied client connection.  The identifying fields
+// are set before the session is registered and don't change afterwards.
+type session struct {
+	id                uint64
+	clientConn        net.Conn
+	clientAddr        net.Addr
+	frontend          string
+	user              string
+	database          string
+	backend           string
+	replica           bool
+	startupParameters startupMessage
+	started           time.Time
+	backendConn       net.Conn
+
+	framers [2]*messageFramer
+
+	// When each side was last heard from (in Unix nanoseconds), and whether
+	// the copy reading from it has ended.
+	lastActivity       [2]int64
+	finishedDirections [2]int32
+
+	// When the client's outstanding request was sent (in Unix nanoseconds),
+	// if the backend hasn't started to respond yet.
+	requestStarted int64
+
+	// When the current query and transaction began (in Unix nanoseconds), or
+	// zero, for the statistics.
+	queryStarted int64
+	xactStarted  int64
+
+	// The session's own statistics, updated atomically, and whether they've
+	// been folded into the totals (guarded by the stats mutex)
+	counters     statsCounters
+	statsRetired bool
+
+	// The transaction status from the backend's last ReadyForQuery, and
+	// whether the backend has been sent anything since.  Only maintained in
+	// protocol-aware mode.
+	transactionStatus int32
+	backendIdle       int32
+
+	// Set once the session has used two-phase commit, in protocol-aware
+	// mode.
+	twoPhase int32
+
+	// Set once the session may have changed its settings, in protocol-aware
+	// mode, after which its queries aren't cached.
+	stateChanged int32
+
+	// Whether the client has sent Terminate, and the type of the last message
+	// from the backend, to tell a backend shutting down from a session
+	// ending normally.
+	clientTerminated   int32
+	lastBackendMessage int32
+
+	// Set for TLS passthrough sessions, whose traffic can't be framed.
+	passthrough bool
+
+	// Only used from the goroutine reading from the backend.
+	backendKey *backendKeyDataMessage
+	result     resultSize
+	ready      bool
+	trace      *handshakeTrace
+
+	// When a keepalive was last sent to the client (in Unix nanoseconds).
+	lastKeepalive int64
+
+	mutex     sync.Mutex
+	capture   *wireCapture
+	debug     bool
+	cacheFill *queryCacheFill
+
+	// Set once the session is established, if client keepalives are enabled.
+	clientWriter            *clientWriter
+	clientKeepaliveInterval time.Duration
+	clientKeepaliveMessage  []byte
+}
+
+func newSession(conn net.Conn) *session {
+	s := &session{
+		id:         atomic.AddUint64(&lastSessionId, 1),
+		clientConn: conn,
+		clientAddr: conn.RemoteAddr(),
+		started:    time.Now(),
+	}
+	for direction := range s.lastActivity {
+		s.lastActivity[direction] = s.started.UnixNano()
+	}
+	for direction := range s.framers {
+		direction := direction
+		s.framers[direction] = &messageFramer{
+			onMessage: func(msgType byte, length int32, body []byte) {
+				s.observeMessage(direction, msgType, length, body)
+			},
+		}
+	}
+	s.updateFramers()
+	return s
+}
+
+// Returns a reader that reports all the protocol messages read through it to
+// the session's observers.
+func (s *session) tapReader(r io.Reader, direction int) io.Reader {
+	return &tapReader{r, s, direction}
+}
+
+// Starts the operator-requested features whose rules match the session.
+func (s *session) applySessionRules() {
+	if captureRules.matches(s) {
+		s.startCapture()
+	}
+	if debugRules.matches(s) {
+		s.startDebug()
+	}
+}
+
+func (s *session) observeMessage(direction int, msgType byte, length int32, body []byte) {
+	s.mutex.Lock()
+	capture := s.capture
+	debug := s.debug
+	cacheFill := s.cacheFill
+	s.mutex.Unlock()
+
+	if direction == fromClient && msgType == 'X' {
+		atomic.StoreInt32(&s.clientTerminated, 1)
+	} else if direction == fromBackend {
+		atomic.StoreInt32(&s.lastBackendMessage, int32(msgType))
+	}
+	if direction == fromBackend && msgType == 'Z' && len(body) >= 1 {
+		atomic.StoreInt32(&s.transactionStatus, int32(body[0]))
+		atomic.StoreInt32(&s.backendIdle, 1)
+	}
+
+	s.recordStats(direction, msgType, length, body)
+
+	if direction == fromBackend && msgType == 'Z' && !s.ready {
+		s.ready = true
+		handshakeSLO.record(true)
+		observeMetric(handshakeDurationMetric, time.Since(s.started).Seconds(), s.route(), backendLabel(s.backend))
+		s.tracePhase(tracePhaseReady)
+	}
+
+	s.timeResponse(direction, msgType)
+
+	if direction == fromBackend && s.replica {
+		s.guardResultSize(msgType, length, body)
+	}
+	if direction == fromBackend && cacheFill != nil {
+		s.fillQueryCache(cacheFill, msgType, length, body)
+	}
+
+	if capture != nil && !capture.recordMessage(direction, msgType, length, body) {
+		s.stopCapture()
+	}
+	if debug {
+		log.Printf("session %v: %v %v", s.id, directionNames[direction], describeMessage(direction, msgType, length, body))
+	}
+}
+
+func (s *session) route() string {
+	if s.replica {
+		return "replica"
+	}
+	return "master"
+}
+
+// Records the session's metrics and statistics once it has ended.
+func (s *session) finished() {
+	s.retireStats()
+	observeMetric(sessionDurationMetric, time.Since(s.started).Seconds(), s.route(), backendLabel(s.backend))
+}
+
+// Writes to the client, through the client writer if there is one, so that
+// keepalives aren't sent in the middle of a message.
+func (s *session) writeToClient(p []byte) (int, error) {
+	s.mutex.Lock()
+	writer := s.clientWriter
+	s.mutex.Unlock()
+	if writer != nil {
+		return writer.writeMessages(p)
+	}
+	return s.clientConn.Write(p)
+}
+
+// Keep enough of each message body to satisfy the session's observers.  Must
+// be called with the session's mutex held.
+func (s *session) updateFramers() {
+	bodyLimit := 0
+	if cfg.Pgreplicaproxy.Protocol_Aware {
+		// ReadyForQuery's transaction status
+		bodyLimit = 1
+	}
+	if s.debug {
+		bodyLimit = maxDebuggedMessageBody
+	}
+	if s.capture != nil {
+		bodyLimit = maxCapturedMessageBody
+	}
+	if s.cacheFill != nil && bodyLimit < queryCacheMaxEntryBytes() {
+		bodyLimit = queryCacheMaxEntryBytes()
+	}
+	for _, framer := range s.framers {
+		framer.setBodyLimit(bodyLimit)
+	}
+}
+
+type tapReader struct {
+	r         io.Reader
+	session   *session
+	direction int
+}
+
+func (t *tapReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&t.session.lastActivity[t.direction], time.Now().UnixNano())
+		if !t.session.passthrough {
+			t.session.framers[t.direction].Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+var registerSessionChan = make(chan *session)
+var deregisterSessionChan = make(chan *session)
+var listSessionsChan = make(chan chan []*session)
+
+func registerSession(s *session) {
+	registerSessionChan <- s
+}
+
+func deregisterSession(s *session) {
+	deregisterSessionChan <- s
+}
+
+// Returns a snapshot of all the registered sessions, ordered by id.
+func listSessions() []*session {
+	returnChan := make(chan []*session)
+	listSessionsChan <- returnChan
+	return <-returnChan
+}
+
+func findSession(id uint64) *session {
+	for _, s := range listSessions() {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func manageSessionStorage() {
+	store := make(map[uint64]*session)
+	for {
+		select {
+		case s := <-registerSessionChan:
+			store[s.id] = s
+
+		case s := <-deregisterSessionChan:
+			delete(store, s.id)
+
+		case returnChan := <-listSessionsChan:
+			sessions := make([]*session, 0, len(store))
+			for _, s := range store {
+				sessions = append(sessions, s)
+			}
+			sort.Sort(sessionsById(sessions))
+			returnChan <- sessions
+		}
+	}
+}
+
+type sessionsById []*session
+
+func (s sessionsById) Len() int           { return len(s) }
+func (s sessionsById) Less(i, j int) bool { return s[i].id < s[j].id }
+func (s sessionsById) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// A sessionRule selects sessions by user or by client IP, for features such
+// as wire capture that operators enable for specific sessions.
+type sessionRule struct {
+	kind  string
+	value string
+}
+
+func (r sessionRule) matches(s *session) bool {
+	switch r.kind {
+	case "USER":
+		return s.user == r.value
+	case "IP":
+		return clientIP(s.clientAddr) == r.value
+	}
+	return false
+}
+
+type sessionRuleSet struct {
+	mutex sync.Mutex
+	rules []sessionRule
+}
+
+func (rs *sessionRuleSet) add(rule sessionRule) {
+	rs.mutex.Lock()
+	rs.rules = append(rs.rules, rule)
+	rs.mutex.Unlock()
+}
+
+func (rs *sessionRuleSet) clear() {
+	rs.mutex.Lock()
+	rs.rules = nil
+	rs.mutex.Unlock()
+}
+
+func (rs *sessionRuleSet) list() []sessionRule {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return append([]sessionRule(nil), rs.rules...)
+}
+
+func (rs *sessionRuleSet) matches(s *session) bool {
+	for _, rule := range rs.list() {
+		if rule.matches(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
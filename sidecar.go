@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// With sidecar, the proxy is set up to run next to a single application, in
+// the same pod or on the same host:
+//
+//   - listen defaults to 127.0.0.1:5432, so that only the application can
+//     connect, and other addresses are warned about
+//   - backend-cluster sections are refused, as a sidecar fronts one cluster
+//   - metrics-listen defaults to :9187, where /ready answers readiness
+//     probes: it succeeds once the listeners are up and a backend has been
+//     found up, and fails again when the proxy starts shutting down
+//   - shutdown-timeout defaults to 25s, inside Kubernetes' default 30s
+//     termination grace period
+//   - the config file is reloaded when it changes, eg. when a mounted
+//     ConfigMap is updated, as on SIGHUP
+//
+// shutdown-timeout can also be set without sidecar.  On SIGTERM, new
+// connections are then refused with cannot_connect_now, sessions that are
+// idle outside a transaction (known in protocol-aware mode) are closed, and
+// the proxy exits once the other sessions have ended, or the timeout has
+// passed.  Without it, SIGTERM exits straight away.
+
+const defaultSidecarListen = "127.0.0.1:5432"
+const defaultSidecarMetricsListen = ":9187"
+const defaultSidecarShutdownTimeout = 25 * time.Second
+const shutdownPollInterval = 100 * time.Millisecond
+const shutdownMessage = "terminating connection because the proxy is shutting down"
+
+var shuttingDown int32
+
+// Set once the listeners are up.
+var listenersUp int32
+
+// Applies the sidecar defaults to a config, and checks that it doesn't
+// define other clusters.
+func applySidecar(c *config) error {
+	if !c.Pgreplicaproxy.Sidecar {
+		return nil
+	}
+	if len(c.Backend_Cluster) > 0 {
+		return fmt.Errorf("sidecar: backend-cluster sections aren't supported; a sidecar fronts a single cluster")
+	}
+	if len(c.Pgreplicaproxy.Listen) == 0 {
+		c.Pgreplicaproxy.Listen = []string{defaultSidecarListen}
+	}
+	if c.Pgreplicaproxy.Metrics_Listen == "" {
+		c.Pgreplicaproxy.Metrics_Listen = defaultSidecarMetricsListen
+	}
+	if c.Pgreplicaproxy.Shutdown_Timeout.Duration == 0 {
+		c.Pgreplicaproxy.Shutdown_Timeout.Duration = defaultSidecarShutdownTimeout
+	}
+	return nil
+}
+
+// Warns about sidecar listen addresses that aren't on the loopback
+// interface.
+func checkSidecarListeners() {
+	if !cfg.Pgreplicaproxy.Sidecar {
+		return
+	}
+	for _, listen := range cfg.Pgreplicaproxy.Listen {
+		host, _, err := net.SplitHostPort(listen)
+		if err != nil {
+			// A Unix socket, or fd://N
+			continue
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			log.Printf("sidecar: listening on %v, which isn't a loopback address", listen)
+		}
+	}
+}
+
+// Returns whether the proxy is ready to serve sessions.
+func proxyReady() bool {
+	if atomic.LoadInt32(&shuttingDown) == 1 || atomic.LoadInt32(&listenersUp) == 0 {
+		return false
+	}
+	state, err := getBalancerState()
+	return err == nil && (state.master != nil || len(state.replicas) > 0)
+}
+
+func shutdownStarted() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+func drainOnSIGTERM() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	<-signals
+
+	timeout := cfg.Pgreplicaproxy.Shutdown_Timeout.Duration
+	atomic.StoreInt32(&shuttingDown, 1)
+	sdNotify("STOPPING=1")
+	log.Printf("SIGTERM received; waiting up to %v for sessions to end", timeout)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := 0
+		for _, s := range listSessions() {
+			if cfg.Pgreplicaproxy.Protocol_Aware && atomic.LoadInt32(&s.backendIdle) == 1 && atomic.LoadInt32(&s.transactionStatus) == 'I' {
+				s.terminate(shutdownMessage)
+				continue
+			}
+			remaining++
+		}
+		if remaining == 0 {
+			log.Printf("All sessions have ended; exiting")
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Exiting with %v sessions still open", remaining)
+			break
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The proxy's own service level is tracked as three indicators, each the
+// fraction of good events:
+//
+//   routing:    new sessions for which a backend was found
+//   handshake:  sessions, once routed, that reached the backend's first
+//               ReadyForQuery (those failing authentication, with the
+//               client's credentials or the proxy's, and those whose client
+//               went away, aren't counted)
+//   master:     samples, every 10s, that found a master available
+//
+// Events are counted per minute over slo-period (default 30 days).  For each
+// indicator and window (5m, 1h, 6h and the whole period), the error ratio
+// and the burn rate, the error ratio divided by the error budget that
+// slo-target (default 0.999) leaves, are published in the metrics and at
+// /status on metrics-listen, along with the fraction of the period's error
+// budget that remains.  Alerts can then follow the burn rate, eg. a 1h burn
+// rate above 14.4 uses 2% of a 30-day budget in an hour.
+
+const defaultSLOTarget = 0.999
+const defaultSLOPeriod = 30 * 24 * time.Hour
+const sloMasterSampleInterval = 10 * time.Second
+const sloPublishInterval = 10 * time.Second
+
+var sloErrorRatioMetric = defineMetric("pgreplicaproxy_slo_error_ratio", gaugeMetric,
+	"Fraction of bad events of each service level indicator, over each window.", nil, "sli", "window")
+var sloBurnRateMetric = defineMetric("pgreplicaproxy_slo_burn_rate", gaugeMetric,
+	"Error ratio of each service level indicator over each window, relative to the error budget.", nil, "sli", "window")
+var sloBudgetRemainingMetric = defineMetric("pgreplicaproxy_slo_error_budget_remaining", gaugeMetric,
+	"Fraction of the error budget of slo-period that remains, for each service level indicator.", nil, "sli")
+
+type sloWindow struct {
+	name     string
+	duration time.Duration
+}
+
+var sloWindows = []sloWindow{{"5m", 5 * time.Minute}, {"1h", time.Hour}, {"6h", 6 * time.Hour}}
+
+// Good and bad events of an indicator in one minute.
+type sloMinute struct {
+	minute int64
+	good   int64
+	bad    int64
+}
+
+type sloIndicator struct {
+	name string
+
+	mutex   sync.Mutex
+	minutes []sloMinute // indexed by the minute modulo the period
+}
+
+var routingSLO = &sloIndicator{name: "routing"}
+var handshakeSLO = &sloIndicator{name: "handshake"}
+var masterSLO = &sloIndicator{name: "master"}
+
+var sloIndicators = []*sloIndicator{routingSLO, handshakeSLO, masterSLO}
+
+func sloTarget() float64 {
+	if target := cfg.Pgreplicaproxy.Slo_Target; target > 0 {
+		return target
+	}
+	return defaultSLOTarget
+}
+
+func sloPeriod() time.Duration {
+	if cfg.Pgreplicaproxy.Slo_Period.Duration > 0 {
+		return cfg.Pgreplicaproxy.Slo_Period.Duration
+	}
+	return defaultSLOPeriod
+}
+
+func setupSLO() {
+	if target := cfg.Pgreplicaproxy.Slo_Target; target < 0 || target >= 1 {
+		log.Fatal("slo-target must be between 0 and 1")
+	}
+	minutes := int(sloPeriod() / time.Minute)
+	if minutes < 1 {
+		log.Fatal("slo-period must be at least 1m")
+	}
+	for _, sli := range sloIndicators {
+		sli.minutes = make([]sloMinute, minutes)
+	}
+}
+
+// Records an event of the indicator; nothing is recorded before setupSLO.
+func (sli *sloIndicator) record(good bool) {
+	minute := time.Now().Unix() / 60
+	sli.mutex.Lock()
+	defer sli.mutex.Unlock()
+	if len(sli.minutes) == 0 {
+		return
+	}
+	m := &sli.minutes[minute%int64(len(sli.minutes))]
+	if m.minute != minute {
+		*m = sloMinute{minute: minute}
+	}
+	if good {
+		m.good++
+	} else {
+		m.bad++
+	}
+}
+
+// Returns the events of the last window, including the current minute.
+func (sli *sloIndicator) events(window time.Duration, now time.Time) (good, bad int64) {
+	current := now.Unix() / 60
+	since := current - int64(window/time.Minute)
+	sli.mutex.Lock()
+	defer sli.mutex.Unlock()
+	for _, m := range sli.minutes {
+		if m.minute > since && m.minute <= current {
+			good += m.good
+			bad += m.bad
+		}
+	}
+	return good, bad
+}
+
+type sloWindowStatus struct {
+	Good       int64   `json:"good"`
+	Bad        int64   `json:"bad"`
+	ErrorRatio float64 `json:"error_ratio"`
+	BurnRate   float64 `json:"burn_rate"`
+}
+
+type sloStatus struct {
+	Target          float64                     `json:"target"`
+	Windows         map[string]*sloWindowStatus `json:"windows"`
+	BudgetRemaining float64                     `json:"error_budget_remaining"`
+}
+
+func (sli *sloIndicator) status(now time.Time) *sloStatus {
+	target := sloTarget()
+	status := &sloStatus{Target: target, Windows: make(map[string]*sloWindowStatus)}
+	windows := append([]sloWindow{}, sloWindows...)
+	windows = append(windows, sloWindow{"period", sloPeriod()})
+	for _, window := range windows {
+		good, bad := sli.events(window.duration, now)
+		ws := &sloWindowStatus{Good: good, Bad: bad}
+		if good+bad > 0 {
+			ws.ErrorRatio = float64(bad) / float64(good+bad)
+		}
+		ws.BurnRate = ws.ErrorRatio / (1 - target)
+		status.Windows[window.name] = ws
+	}
+	status.BudgetRemaining = 1 - status.Windows["period"].BurnRate
+	return status
+}
+
+func sampleMasterAvailability() {
+	seen := false
+	for range time.Tick(sloMasterSampleInterval) {
+		state, err := getBalancerState()
+		available := err == nil && state.master != nil
+		// Until a master is first found, the backends are still being
+		// checked after startup
+		seen = seen || available
+		if seen {
+			masterSLO.record(available)
+		}
+	}
+}
+
+func publishSLO() {
+	for range time.Tick(sloPublishInterval) {
+		now := time.Now()
+		for _, sli := range sloIndicators {
+			status := sli.status(now)
+			for name, ws := range status.Windows {
+				setMetric(sloErrorRatioMetric, ws.ErrorRatio, sli.name, name)
+				setMetric(sloBurnRateMetric, ws.BurnRate, sli.name, name)
+			}
+			setMetric(sloBudgetRemainingMetric, status.BudgetRemaining, sli.name)
+		}
+	}
+}
+
+func writeSLOStatus(w http.ResponseWriter) {
+	now := time.Now()
+	slo := make(map[string]*sloStatus)
+	for _, sli := range sloIndicators {
+		slo[sli.name] = sli.status(now)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"slo": slo})
+}
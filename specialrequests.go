@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Before its startup message, a client may send requests identified by a
+// special protocol version code (major version 1234): SSLRequest,
+// GSSENCRequest and CancelRequest.  Each code's handling is looked up in a
+// table, which the special-request option ("<code or name> <action>") can
+// override, so that the proxy can be adapted as the protocol gains new
+// requests without code changes.  The actions are
+//
+//   default:  the built-in handling: TLS negotiation for SSLRequest, the
+//             cancellation for CancelRequest, and decline for GSSENCRequest
+//   decline:  reply N, as a server without support for the request does,
+//             and read the client's next message
+//   reject:   send an error, and close the connection
+//   close:    close the connection without replying
+//
+// Other special codes are rejected unless configured.  A client can make at
+// most two requests that are followed by another message (eg. GSSENCRequest
+// and then SSLRequest), and none once TLS has been negotiated.
+
+const specialRequestMajorVersion = 1234
+const maxSpecialRequests = 2
+
+var unsupportedSpecialRequest = errors.New("Unsupported special request code")
+
+type specialRequestHandler func(conn net.Conn, tlsConfig *tls.Config, code int32, body *bytes.Buffer, requestsLeft int) (net.Conn, *startupMessage, error)
+
+type specialRequest struct {
+	name    string
+	handler specialRequestHandler
+}
+
+// Filled in by init, as the handlers read the client's next message, which
+// looks the table up again.
+var specialRequests map[int32]specialRequest
+
+func init() {
+	specialRequests = map[int32]specialRequest{
+		80877102: {"CancelRequest", handleCancelRequest},
+		80877103: {"SSLRequest", handleSSLRequest},
+		80877104: {"GSSENCRequest", declineSpecialRequest},
+	}
+}
+
+var specialRequestActions = map[string]specialRequestHandler{
+	"decline": declineSpecialRequest,
+	"reject":  rejectSpecialRequest,
+	"close":   closeSpecialRequest,
+}
+
+// Handlers replacing the built-in handling of special request codes, from
+// the special-request option.
+var specialRequestOverrides map[int32]specialRequestHandler
+
+func setupSpecialRequests() {
+	overrides, err := compileSpecialRequests(cfg.Pgreplicaproxy.Special_Request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	specialRequestOverrides = overrides
+}
+
+func compileSpecialRequests(settings []string) (map[int32]specialRequestHandler, error) {
+	overrides := make(map[int32]specialRequestHandler)
+	for _, setting := range settings {
+		fields := strings.Fields(setting)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("special-request %q: expected a code or request name and an action", setting)
+		}
+		code, err := specialRequestCode(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("special-request %q: %v", setting, err)
+		}
+		if fields[1] == "default" {
+			request, ok := specialRequests[code]
+			if !ok {
+				return nil, fmt.Errorf("special-request %q: code %v has no built-in handling", setting, code)
+			}
+			overrides[code] = request.handler
+			continue
+		}
+		handler, ok := specialRequestActions[fields[1]]
+		if !ok {
+			return nil, fmt.Errorf("special-request %q: action must be default, decline, reject or close", setting)
+		}
+		overrides[code] = handler
+	}
+	return overrides, nil
+}
+
+// Parses a special request code given by number or by name.
+func specialRequestCode(s string) (int32, error) {
+	for code, request := range specialRequests {
+		if strings.EqualFold(request.name, s) {
+			return code, nil
+		}
+	}
+	code, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unknown request %v", s)
+	}
+	if code>>16 != specialRequestMajorVersion {
+		return 0, fmt.Errorf("%v is not a special request code", code)
+	}
+	return int32(code), nil
+}
+
+// Returns the handler for a protocol version code, or false if it isn't a
+// special request code.
+func lookupSpecialRequest(code int32) (specialRequestHandler, bool) {
+	if handler, ok := specialRequestOverrides[code]; ok {
+		return handler, true
+	}
+	if request, ok := specialRequests[code]; ok {
+		return request.handler, true
+	}
+	if code>>16 == specialRequestMajorVersion {
+		return rejectSpecialRequest, true
+	}
+	return nil, false
+}
+
+func specialRequestName(code int32) string {
+	if request, ok := specialRequests[code]; ok {
+		return request.name
+	}
+	return fmt.Sprintf("special request %v", code)
+}
+
+func handleSSLRequest(conn net.Conn, tlsConfig *tls.Config, code int32, body *bytes.Buffer, requestsLeft int) (net.Conn, *startupMessage, error) {
+	if requestsLeft == 0 {
+		return rejectSpecialRequest(conn, tlsConfig, code, body, requestsLeft)
+	}
+	if tlsConfig == nil {
+		logDebug("SSLRequest received; returning N")
+		conn.Write([]byte{'N'})
+		return readStartupMessageInternal(conn, nil, requestsLeft-1)
+	}
+
+	logDebug("SSLRequest received; returning S")
+	conn.Write([]byte{'S'})
+	tlsConn := tls.Server(conn, tlsConfig)
+	err := tlsConn.Handshake()
+	if err != nil {
+		return conn, nil, err
+	}
+	return readStartupMessageInternal(tlsConn, nil, 0)
+}
+
+func handleCancelRequest(conn net.Conn, tlsConfig *tls.Config, code int32, body *bytes.Buffer, requestsLeft int) (net.Conn, *startupMessage, error) {
+	// If possible, match the processId and secretKey to an existing
+	// connection and proxy the cancel to the correct backend.
+	key := backendKeyDataMessage{}
+	err := binary.Read(body, binary.BigEndian, &key.processId)
+	if err != nil {
+		return conn, nil, err
+	}
+	err = binary.Read(body, binary.BigEndian, &key.secretKey)
+	if err != nil {
+		return conn, nil, err
+	}
+
+	logDebug("Received CancelRequest, pid=%v", key.processId)
+
+	if !proxyCancelRequest(key) {
+		if len(cfg.Pgreplicaproxy.Peer) > 0 {
+			forwardCancelRequestToPeers(key)
+		} else if cfg.Pgreplicaproxy.Cancel_Broadcast {
+			broadcastCancelRequest(key)
+		}
+	}
+
+	return conn, nil, nil
+}
+
+func declineSpecialRequest(conn net.Conn, tlsConfig *tls.Config, code int32, body *bytes.Buffer, requestsLeft int) (net.Conn, *startupMessage, error) {
+	if requestsLeft == 0 {
+		return rejectSpecialRequest(conn, tlsConfig, code, body, requestsLeft)
+	}
+	logDebug("%v received; returning N", specialRequestName(code))
+	conn.Write([]byte{'N'})
+	return readStartupMessageInternal(conn, tlsConfig, requestsLeft-1)
+}
+
+func rejectSpecialRequest(conn net.Conn, tlsConfig *tls.Config, code int32, body *bytes.Buffer, requestsLeft int) (net.Conn, *startupMessage, error) {
+	logDebug("%v received; rejecting it", specialRequestName(code))
+	sendError(conn, "Unsupported protocol version")
+	return conn, nil, unsupportedProtocolVersion
+}
+
+func closeSpecialRequest(conn net.Conn, tlsConfig *tls.Config, code int32, body *bytes.Buffer, requestsLeft int) (net.Conn, *startupMessage, error) {
+	logDebug("%v received; closing the connection", specialRequestName(code))
+	return conn, nil, unsupportedSpecialRequest
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Limits on the startup message's parameters, beyond the size of the packet,
+// so that pathological clients can't make the proxy (or the backends) handle
+// thousands of parameters or enormous values.  Parameter names are limited
+// to 63 bytes, far longer than any of PostgreSQL's own setting names; it's
+// the proxy's limit, as PostgreSQL has none for setting names.  The packet
+// size limit defaults to PostgreSQL's own (MAX_STARTUP_PACKET_LENGTH);
+// raising it only helps if the backends accept larger packets too.
+
+const defaultStartupMaxPacketSize = 10000
+const defaultStartupMaxParameters = 64
+const defaultStartupMaxParameterLength = 4096
+const startupMaxNameLength = 63
+
+var startupRejectionsMetric = defineMetric("pgreplicaproxy_startup_rejections_total", counterMetric,
+	"Startup messages refused for exceeding the startup parameter limits, by reason.", nil, "reason")
+
+func startupMaxPacketSize() int32 {
+	if cfg.Pgreplicaproxy.Startup_Max_Packet_Size > 0 {
+		return int32(cfg.Pgreplicaproxy.Startup_Max_Packet_Size)
+	}
+	return defaultStartupMaxPacketSize
+}
+
+func startupMaxParameters() int {
+	if cfg.Pgreplicaproxy.Startup_Max_Parameters > 0 {
+		return cfg.Pgreplicaproxy.Startup_Max_Parameters
+	}
+	return defaultStartupMaxParameters
+}
+
+func startupMaxValueLength() int {
+	if cfg.Pgreplicaproxy.Startup_Max_Parameter_Length > 0 {
+		return cfg.Pgreplicaproxy.Startup_Max_Parameter_Length
+	}
+	return defaultStartupMaxParameterLength
+}
+
+func rejectStartupMessage(conn net.Conn, reason string) {
+	incMetric(startupRejectionsMetric, reason)
+	sendErrorWithCode(conn, "08P01", fmt.Sprintf("Startup message rejected: %v", reason)) // protocol violation
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// startup-parameter adds startup parameters to the connections of clients
+// that don't send them, such as a default statement_timeout.  It's a startup
+// rewriter (see rewrite.go), so it runs after the replica suffix has been
+// removed, and the other rewriters see its parameters.
+
+type defaultStartupParameter struct {
+	name  string
+	value string
+}
+
+var defaultStartupParameters []defaultStartupParameter
+
+func init() {
+	registerStartupRewriter("startup-parameter", func(r *startupRewrite) error {
+		for _, parameter := range defaultStartupParameters {
+			if _, ok := r.parameters[parameter.name]; !ok {
+				r.parameters[parameter.name] = parameter.value
+			}
+		}
+		return nil
+	})
+}
+
+func setupStartupParameters() {
+	var parameters []defaultStartupParameter
+	for _, entry := range cfg.Pgreplicaproxy.Startup_Parameter {
+		fields := strings.SplitN(strings.TrimSpace(entry), " ", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+			log.Fatalf("startup-parameter must be a parameter name followed by its value: %v", entry)
+		}
+		switch fields[0] {
+		case "user", "database", "replication":
+			log.Fatalf("startup-parameter can't set %v", fields[0])
+		}
+		parameters = append(parameters, defaultStartupParameter{fields[0], strings.TrimSpace(fields[1])})
+	}
+	defaultStartupParameters = parameters
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Per-database traffic statistics for the admin console, in the manner of
+// pgbouncer's SHOW STATS: totals since the statistics were last reset, and
+// averages over the last stats-period.  Unlike the metrics, these can be
+// reset with RESET STATS, to measure a maintenance window.
+//
+// A query is a request that the backend answered with ReadyForQuery, and a
+// transaction ends with a ReadyForQuery whose status is idle; transactions
+// are only counted in protocol-aware mode, which keeps that status.
+
+const defaultStatsPeriod = time.Minute
+
+type statsCounters struct {
+	sessions     int64
+	queries      int64
+	transactions int64
+	received     int64
+	sent         int64
+	queryTime    time.Duration
+	xactTime     time.Duration
+}
+
+func (c *statsCounters) sub(other *statsCounters) statsCounters {
+	return statsCounters{
+		sessions:     c.sessions - other.sessions,
+		queries:      c.queries - other.queries,
+		transactions: c.transactions - other.transactions,
+		received:     c.received - other.received,
+		sent:         c.sent - other.sent,
+		queryTime:    c.queryTime - other.queryTime,
+		xactTime:     c.xactTime - other.xactTime,
+	}
+}
+
+// The totals are kept per database and backend, for the stats export; SHOW
+// STATS adds up each database's backends.
+type statsKey struct {
+	database string
+	backend  string
+}
+
+// Live sessions count their own traffic, so that counting a message doesn't
+// contend with other sessions; the counters are combined when the statistics
+// are read, and folded into the totals as sessions finish.
+var stats = struct {
+	sync.Mutex
+	since time.Time
+
+	finished map[statsKey]*statsCounters
+
+	// Live sessions' counters at the last reset, which the totals leave out
+	baselines map[*session]statsCounters
+
+	// The totals at the start of the last complete period, and the change
+	// over that period.
+	periodStart  map[string]statsCounters
+	lastPeriod   map[string]statsCounters
+	periodLength time.Duration
+}{
+	since:       time.Now(),
+	finished:    make(map[statsKey]*statsCounters),
+	baselines:   make(map[*session]statsCounters),
+	periodStart: make(map[string]statsCounters),
+	lastPeriod:  make(map[string]statsCounters),
+}
+
+func statsPeriod() time.Duration {
+	if cfg.Pgreplicaproxy.Stats_Period.Duration > 0 {
+		return cfg.Pgreplicaproxy.Stats_Period.Duration
+	}
+	return defaultStatsPeriod
+}
+
+func (c *statsCounters) add(other statsCounters) {
+	c.sessions += other.sessions
+	c.queries += other.queries
+	c.transactions += other.transactions
+	c.received += other.received
+	c.sent += other.sent
+	c.queryTime += other.queryTime
+	c.xactTime += other.xactTime
+}
+
+// Reads a live session's counters, which its goroutines update atomically.
+func (c *statsCounters) load() statsCounters {
+	return statsCounters{
+		sessions:     atomic.LoadInt64(&c.sessions),
+		queries:      atomic.LoadInt64(&c.queries),
+		transactions: atomic.LoadInt64(&c.transactions),
+		received:     atomic.LoadInt64(&c.received),
+		sent:         atomic.LoadInt64(&c.sent),
+		queryTime:    time.Duration(atomic.LoadInt64((*int64)(&c.queryTime))),
+		xactTime:     time.Duration(atomic.LoadInt64((*int64)(&c.xactTime))),
+	}
+}
+
+// Called for every message in either direction.
+func (s *session) recordStats(direction int, msgType byte, length int32, body []byte) {
+	c := &s.counters
+	if direction == fromClient {
+		if msgType != 'p' && msgType != 'X' {
+			now := time.Now().UnixNano()
+			atomic.CompareAndSwapInt64(&s.queryStarted, 0, now)
+			atomic.CompareAndSwapInt64(&s.xactStarted, 0, now)
+		}
+		atomic.AddInt64(&c.received, int64(length)+1)
+		return
+	}
+
+	atomic.AddInt64(&c.sent, int64(length)+1)
+	if msgType != 'Z' || !s.ready {
+		return
+	}
+
+	now := time.Now()
+	if queryStarted := atomic.SwapInt64(&s.queryStarted, 0); queryStarted != 0 {
+		atomic.AddInt64(&c.queries, 1)
+		atomic.AddInt64((*int64)(&c.queryTime), int64(now.Sub(time.Unix(0, queryStarted))))
+	}
+	// The transaction status is only kept in protocol-aware mode
+	if len(body) >= 1 && body[0] == 'I' {
+		if xactStarted := atomic.SwapInt64(&s.xactStarted, 0); xactStarted != 0 {
+			atomic.AddInt64(&c.transactions, 1)
+			atomic.AddInt64((*int64)(&c.xactTime), int64(now.Sub(time.Unix(0, xactStarted))))
+		}
+	}
+}
+
+func (s *session) countSessionStats() {
+	atomic.AddInt64(&s.counters.sessions, 1)
+}
+
+// Folds a finished session's counters into its database's and backend's
+// totals.
+func (s *session) retireStats() {
+	counters := s.counters.load()
+	stats.Lock()
+	defer stats.Unlock()
+	baseline := stats.baselines[s]
+	delete(stats.baselines, s)
+	s.statsRetired = true
+	key := s.statsKey()
+	total, ok := stats.finished[key]
+	if !ok {
+		total = &statsCounters{}
+		stats.finished[key] = total
+	}
+	total.add(counters.sub(&baseline))
+}
+
+func (s *session) statsKey() statsKey {
+	return statsKey{s.database, backendLabel(s.backend)}
+}
+
+// Returns the totals by database and backend since the last reset.  Must be
+// called with stats locked, with a list of the live sessions.
+func combinedStats(sessions []*session) map[statsKey]statsCounters {
+	totals := make(map[statsKey]statsCounters, len(stats.finished))
+	for key, total := range stats.finished {
+		totals[key] = *total
+	}
+	for _, s := range sessions {
+		if s.statsRetired {
+			continue
+		}
+		baseline := stats.baselines[s]
+		counters := s.counters.load()
+		live := counters.sub(&baseline)
+		if live == (statsCounters{}) {
+			continue
+		}
+		key := s.statsKey()
+		total := totals[key]
+		total.add(live)
+		totals[key] = total
+	}
+	return totals
+}
+
+// Adds up the totals of each database's backends.
+func databaseStats(totals map[statsKey]statsCounters) map[string]statsCounters {
+	databases := make(map[string]statsCounters)
+	for key, total := range totals {
+		sum := databases[key.database]
+		sum.add(total)
+		databases[key.database] = sum
+	}
+	return databases
+}
+
+// Closes a stats period every stats-period, for the averages.
+func rollStatsPeriods() {
+	for range time.Tick(statsPeriod()) {
+		sessions := listSessions()
+		stats.Lock()
+		for database, total := range databaseStats(combinedStats(sessions)) {
+			start := stats.periodStart[database]
+			stats.lastPeriod[database] = total.sub(&start)
+			stats.periodStart[database] = total
+		}
+		stats.periodLength = statsPeriod()
+		stats.Unlock()
+	}
+}
+
+func resetStats() {
+	sessions := listSessions()
+	stats.Lock()
+	stats.since = time.Now()
+	stats.finished = make(map[statsKey]*statsCounters)
+	stats.baselines = make(map[*session]statsCounters)
+	for _, s := range sessions {
+		if !s.statsRetired {
+			stats.baselines[s] = s.counters.load()
+		}
+	}
+	stats.periodStart = make(map[string]statsCounters)
+	stats.lastPeriod = make(map[string]statsCounters)
+	stats.periodLength = 0
+	stats.Unlock()
+}
+
+func writeStats(out io.Writer) {
+	sessions := listSessions()
+	stats.Lock()
+	defer stats.Unlock()
+
+	totals := databaseStats(combinedStats(sessions))
+	databases := make([]string, 0, len(totals))
+	for database := range totals {
+		databases = append(databases, database)
+	}
+	sort.Strings(databases)
+
+	fmt.Fprintf(out, "since %v (%v ago)\n", stats.since.Format(time.RFC3339), time.Since(stats.since)/time.Second*time.Second)
+	for _, database := range databases {
+		total := totals[database]
+		fmt.Fprintf(out, "%v total_sessions=%v total_queries=%v total_xacts=%v total_received=%v total_sent=%v total_query_time=%.3fs total_xact_time=%.3fs",
+			database, total.sessions, total.queries, total.transactions, total.received, total.sent,
+			total.queryTime.Seconds(), total.xactTime.Seconds())
+
+		period, ok := stats.lastPeriod[database]
+		if ok && stats.periodLength > 0 {
+			seconds := stats.periodLength.Seconds()
+			fmt.Fprintf(out, " avg_queries=%.2f/s avg_xacts=%.2f/s avg_received=%.0fB/s avg_sent=%.0fB/s avg_query_time=%.3fms avg_xact_time=%.3fms",
+				float64(period.queries)/seconds, float64(period.transactions)/seconds,
+				float64(period.received)/seconds, float64(period.sent)/seconds,
+				averageMilliseconds(period.queryTime, period.queries), averageMilliseconds(period.xactTime, period.transactions))
+		}
+		fmt.Fprintln(out)
+	}
+}
+
+func averageMilliseconds(total time.Duration, count int64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return total.Seconds() * 1000 / float64(count)
+}
+
+func adminShowStats(args []string, out io.Writer) error {
+	writeStats(out)
+	return nil
+}
+
+func adminResetStats(args []string, out io.Writer) error {
+	resetStats()
+	fmt.Fprintln(out, "statistics reset")
+	return nil
+}
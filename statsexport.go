@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The per-database statistics of SHOW STATS can also be written into a table
+// on the master (stats-table), every stats-export-interval (default
+// stats-period), so that SQL-based monitoring can use them.  Each export
+// adds a row for each database and backend with traffic since the previous
+// export, connecting as the health checks do.  The table is created if it
+// doesn't exist.
+
+var statsExportsMetric = defineMetric("pgreplicaproxy_stats_exports_total", counterMetric,
+	"Exports of the per-database statistics to the master, by result.", nil, "result")
+
+func statsExportInterval() time.Duration {
+	if cfg.Pgreplicaproxy.Stats_Export_Interval.Duration > 0 {
+		return cfg.Pgreplicaproxy.Stats_Export_Interval.Duration
+	}
+	return statsPeriod()
+}
+
+func exportStatsPeriodically() {
+	proxy, err := os.Hostname()
+	if err != nil {
+		proxy = "unknown"
+	}
+
+	exported := make(map[statsKey]statsCounters)
+	since := time.Now()
+	for range time.Tick(statsExportInterval()) {
+		// Changes since the last export, or since a reset, if there was one
+		sessions := listSessions()
+		stats.Lock()
+		if stats.since.After(since) {
+			exported = make(map[statsKey]statsCounters)
+		}
+		since = time.Now()
+		totals := combinedStats(sessions)
+		changes := make(map[statsKey]statsCounters, len(totals))
+		for key, total := range totals {
+			previous := exported[key]
+			changes[key] = total.sub(&previous)
+		}
+		stats.Unlock()
+
+		if err := exportStats(proxy, changes); err != nil {
+			incMetric(statsExportsMetric, "error")
+			logLimited("stats export", "Exporting statistics to %v failed: %v", cfg.Pgreplicaproxy.Stats_Table, err)
+			continue
+		}
+		incMetric(statsExportsMetric, "ok")
+		exported = totals
+	}
+}
+
+func exportStats(proxy string, changes map[statsKey]statsCounters) error {
+	master, err := requestBackend(masterRequestChannel, databaseCluster(""), nil, false)
+	if err != nil {
+		return err
+	}
+	if master == nil {
+		return fmt.Errorf("no master is available")
+	}
+
+	db, err := sql.Open(monitorDriver(*master), monitorConnectionString(*master))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	table := cfg.Pgreplicaproxy.Stats_Table
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (
+		exported_at timestamptz NOT NULL,
+		proxy text NOT NULL,
+		database text NOT NULL,
+		backend text NOT NULL,
+		sessions bigint NOT NULL,
+		queries bigint NOT NULL,
+		transactions bigint NOT NULL,
+		received_bytes bigint NOT NULL,
+		sent_bytes bigint NOT NULL,
+		query_time interval NOT NULL,
+		xact_time interval NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	for key, c := range changes {
+		if c == (statsCounters{}) {
+			continue
+		}
+		_, err = tx.Exec(`INSERT INTO `+table+` VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10::float8 * interval '1 second', $11::float8 * interval '1 second')`,
+			now, proxy, key.database, key.backend, c.sessions, c.queries, c.transactions, c.received, c.sent,
+			c.queryTime.Seconds(), c.xactTime.Seconds())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
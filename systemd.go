@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When run as a systemd service (Type=notify), pgreplicaproxy reports READY=1
+// once its listeners are up, and if the watchdog is enabled (WatchdogSec=),
+// sends WATCHDOG=1 heartbeats for as long as its internals are responsive,
+// so that systemd restarts a wedged proxy.
+
+// The accept loops wake up at least this often, so that their heartbeats
+// show they're still running.
+const acceptHeartbeatInterval = time.Second
+
+var listenersReady sync.WaitGroup
+
+var acceptHeartbeats = struct {
+	sync.Mutex
+	lastSeen map[string]time.Time
+}{lastSeen: make(map[string]time.Time)}
+
+func acceptHeartbeat(listen string) {
+	acceptHeartbeats.Lock()
+	acceptHeartbeats.lastSeen[listen] = time.Now()
+	acceptHeartbeats.Unlock()
+}
+
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Waits for the listeners to be ready, notifies systemd, and then runs the
+// watchdog heartbeat if it's enabled.
+func notifySystemd() {
+	listenersReady.Wait()
+	atomic.StoreInt32(&listenersUp, 1)
+	err := sdNotify("READY=1")
+	if err != nil {
+		log.Printf("sd_notify failed: %v", err)
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.Printf("systemd watchdog enabled; heartbeat every %v", interval)
+	for {
+		time.Sleep(interval)
+		if proxyIsLive(interval) {
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+// Checks that the status oracle and session store respond, and that every
+// accept loop is still running.
+func proxyIsLive(timeout time.Duration) bool {
+	oracle := make(chan bool, 1)
+	go func() {
+		ping := make(chan bool, 1)
+		oraclePingChannel <- ping
+		<-ping
+		oracle <- true
+	}()
+	sessions := make(chan bool, 1)
+	go func() {
+		listSessions()
+		sessions <- true
+	}()
+
+	deadline := time.After(timeout)
+	for _, responded := range []chan bool{oracle, sessions} {
+		select {
+		case <-responded:
+		case <-deadline:
+			log.Printf("watchdog: internal components not responding")
+			return false
+		}
+	}
+
+	acceptHeartbeats.Lock()
+	defer acceptHeartbeats.Unlock()
+	for listen, lastSeen := range acceptHeartbeats.lastSeen {
+		if time.Since(lastSeen) > acceptHeartbeatInterval+timeout {
+			log.Printf("watchdog: accept loop for %v not running", listen)
+			return false
+		}
+	}
+	return true
+}
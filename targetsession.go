@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Clients can ask for the master or a replica with target_session_attrs, as
+// a startup parameter (eg. pgx's RuntimeParams) or as
+// "-c target_session_attrs=..." in options, rather than with the replica
+// suffix or prefix.  It's removed before the startup message is sent on, as
+// PostgreSQL doesn't know it.  read-write and primary go to the master;
+// read-only and standby to a replica, failing when none is available;
+// prefer-standby to a replica, or the master when none is available; any
+// changes nothing.  Routing rules still take precedence, but read-only
+// listeners refuse read-write and primary, and read-write listeners refuse
+// read-only and standby, as no server there matches.
+
+const targetSessionAttrsParameter = "target_session_attrs"
+
+// Removes target_session_attrs from a startup message, and returns its value,
+// or "" if it wasn't given.
+func takeTargetSessionAttrs(parameters startupMessage) (string, error) {
+	value, ok := takeStartupSettings(parameters, func(name string) bool {
+		return name == targetSessionAttrsParameter
+	})[targetSessionAttrsParameter]
+	if !ok {
+		return "", nil
+	}
+	switch value {
+	case "any", "read-write", "primary", "read-only", "standby", "prefer-standby":
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid target_session_attrs value: %q", value)
+}
+
+// Removes the settings whose names match from a startup message, whether
+// they're startup parameters or "-c name=value" (or "--name=value") in
+// options, and returns them; options win over parameters.
+func takeStartupSettings(parameters startupMessage, matches func(string) bool) map[string]string {
+	settings := make(map[string]string)
+	for name, value := range parameters {
+		if name != "options" && matches(name) {
+			settings[name] = value
+			delete(parameters, name)
+		}
+	}
+
+	options, found := parameters["options"]
+	if !found {
+		return settings
+	}
+	var kept []string
+	tokens := splitStartupOptions(options)
+	for i := 0; i < len(tokens); i++ {
+		setting := tokens[i]
+		switch {
+		case setting == "-c" && i+1 < len(tokens):
+			setting = tokens[i+1]
+		case strings.HasPrefix(setting, "-c"), strings.HasPrefix(setting, "--"):
+			setting = setting[2:]
+		}
+		if equals := strings.IndexByte(setting, '='); equals > 0 && matches(setting[:equals]) {
+			settings[setting[:equals]] = setting[equals+1:]
+			if tokens[i] == "-c" {
+				i++
+			}
+			continue
+		}
+		kept = append(kept, tokens[i])
+	}
+	if len(kept) == 0 {
+		delete(parameters, "options")
+	} else {
+		parameters["options"] = strings.Join(kept, " ")
+	}
+	return settings
+}
+
+// Splits the options startup parameter into its space-separated words,
+// keeping backslash escapes as they are, so that the words can be joined
+// again.
+func splitStartupOptions(options string) []string {
+	var tokens []string
+	var token []byte
+	for i := 0; i < len(options); i++ {
+		c := options[i]
+		if c == '\\' && i+1 < len(options) {
+			token = append(token, c, options[i+1])
+			i++
+		} else if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			if len(token) > 0 {
+				tokens = append(tokens, string(token))
+				token = nil
+			}
+		} else {
+			token = append(token, c)
+		}
+	}
+	if len(token) > 0 {
+		tokens = append(tokens, string(token))
+	}
+	return tokens
+}
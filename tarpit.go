@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Authentication failures are counted per client IP, whether the proxy
+// authenticates clients itself or a backend refuses them, and, with
+// auth-failure-protocol-errors, so are connections that fail before their
+// startup message is read, such as malformed packets and failed TLS
+// handshakes.  Each further connection from an IP with recent failures is
+// delayed, doubling with every failure (auth-failure-delay, up to
+// auth-failure-max-delay), and once an IP reaches auth-failure-ban-threshold
+// failures its connections are refused for auth-failure-ban-time.  Failures
+// are forgotten after auth-failure-window without any, or after a successful
+// login.
+
+const defaultMaxAuthFailureDelay = 30 * time.Second
+const defaultAuthFailureBanTime = 10 * time.Minute
+const defaultAuthFailureWindow = 10 * time.Minute
+
+var clientIPBanned = errors.New("Too many authentication failures; try again later")
+var backendAuthenticationFailed = errors.New("Backend refused the client's authentication")
+
+var authFailuresMetric = defineMetric("pgreplicaproxy_auth_failures_total", counterMetric,
+	"Client authentication failures, by where they were detected.", nil, "source")
+var tarpitRefusedMetric = defineMetric("pgreplicaproxy_tarpit_refused_connections_total", counterMetric,
+	"Connections refused from client IPs banned for repeated authentication failures.", nil)
+
+type authFailureRecord struct {
+	failures    int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+var authFailures = struct {
+	sync.Mutex
+	records map[string]*authFailureRecord
+}{records: make(map[string]*authFailureRecord)}
+
+func tarpitEnabled() bool {
+	return cfg.Pgreplicaproxy.Auth_Failure_Delay.Duration > 0 || cfg.Pgreplicaproxy.Auth_Failure_Ban_Threshold > 0
+}
+
+func authFailureWindow() time.Duration {
+	if cfg.Pgreplicaproxy.Auth_Failure_Window.Duration > 0 {
+		return cfg.Pgreplicaproxy.Auth_Failure_Window.Duration
+	}
+	return defaultAuthFailureWindow
+}
+
+func maxAuthFailureDelay() time.Duration {
+	if cfg.Pgreplicaproxy.Auth_Failure_Max_Delay.Duration > 0 {
+		return cfg.Pgreplicaproxy.Auth_Failure_Max_Delay.Duration
+	}
+	return defaultMaxAuthFailureDelay
+}
+
+// An authentication failure caused by what the client sent, with the reason
+// to log.
+type clientAuthError struct {
+	reason string
+}
+
+func (e clientAuthError) Error() string {
+	return e.reason
+}
+
+// Returns whether an error from authenticating a client counts as a failure:
+// the client sent wrong or malformed credentials, rather than disconnecting
+// or the proxy failing to check them.
+func clientAuthFailure(err error) bool {
+	if _, ok := err.(clientAuthError); ok {
+		return true
+	}
+	return err == authenticationFailed || err == malformedSCRAMMessage || err == unexpectedAuthMessage || err == invalidJWT
+}
+
+// Records a connection that failed before its startup message was read, if
+// auth-failure-protocol-errors is set.  Connections closed without sending
+// anything, such as TCP health checks, aren't counted.
+func recordProtocolError(ip string, err error) {
+	if cfg.Pgreplicaproxy.Auth_Failure_Protocol_Errors && err != io.EOF {
+		recordAuthFailure(ip, "protocol")
+	}
+}
+
+// Delays or refuses a new connection from an IP with recent authentication
+// failures.
+func tarpit(ip string) error {
+	if !tarpitEnabled() {
+		return nil
+	}
+
+	now := time.Now()
+	authFailures.Lock()
+	record, ok := authFailures.records[ip]
+	if ok && now.Sub(record.lastFailure) > authFailureWindow() && now.After(record.bannedUntil) {
+		delete(authFailures.records, ip)
+		ok = false
+	}
+	var delay time.Duration
+	banned := false
+	if ok {
+		banned = now.Before(record.bannedUntil)
+		maxDelay := maxAuthFailureDelay()
+		delay = cfg.Pgreplicaproxy.Auth_Failure_Delay.Duration
+		for i := 1; i < record.failures && delay < maxDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+	authFailures.Unlock()
+
+	if banned {
+		incMetric(tarpitRefusedMetric)
+		return clientIPBanned
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return nil
+}
+
+// Records an authentication failure from a client IP; source is "proxy",
+// "backend" or "protocol".
+func recordAuthFailure(ip string, source string) {
+	incMetric(authFailuresMetric, source)
+	if !tarpitEnabled() {
+		return
+	}
+
+	now := time.Now()
+	authFailures.Lock()
+	defer authFailures.Unlock()
+
+	record, ok := authFailures.records[ip]
+	if !ok || (now.Sub(record.lastFailure) > authFailureWindow() && now.After(record.bannedUntil)) {
+		record = &authFailureRecord{}
+		authFailures.records[ip] = record
+	}
+	record.failures++
+	record.lastFailure = now
+
+	threshold := cfg.Pgreplicaproxy.Auth_Failure_Ban_Threshold
+	if threshold > 0 && record.failures >= threshold && now.After(record.bannedUntil) {
+		banTime := cfg.Pgreplicaproxy.Auth_Failure_Ban_Time.Duration
+		if banTime <= 0 {
+			banTime = defaultAuthFailureBanTime
+		}
+		record.bannedUntil = now.Add(banTime)
+		logLimited("tarpit ban", "Banning %v for %v after %v authentication failures", ip, banTime, record.failures)
+	}
+}
+
+func recordAuthSuccess(ip string) {
+	if !tarpitEnabled() {
+		return
+	}
+	authFailures.Lock()
+	delete(authFailures.records, ip)
+	authFailures.Unlock()
+}
+
+// Forgets failures that are too old to matter, so that the table doesn't grow
+// without bound.
+func pruneAuthFailures() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		authFailures.Lock()
+		for ip, record := range authFailures.records {
+			if now.Sub(record.lastFailure) > authFailureWindow() && now.After(record.bannedUntil) {
+				delete(authFailures.records, ip)
+			}
+		}
+		authFailures.Unlock()
+	}
+}
+
+func adminShowTarpit(args []string, out io.Writer) error {
+	authFailures.Lock()
+	defer authFailures.Unlock()
+
+	ips := make([]string, 0, len(authFailures.records))
+	for ip := range authFailures.records {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	now := time.Now()
+	for _, ip := range ips {
+		record := authFailures.records[ip]
+		fmt.Fprintf(out, "%v failures=%v last_failure=%v ago", ip, record.failures, now.Sub(record.lastFailure)/time.Second*time.Second)
+		if now.Before(record.bannedUntil) {
+			fmt.Fprintf(out, " banned_for=%v", record.bannedUntil.Sub(now)/time.Second*time.Second)
+		}
+		fmt.Fprintln(out)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+)
+
+// tls-min-version, tls-ciphers and tls-curves set the TLS policy of client
+// connections, and of the links between proxies; backend-tls-min-version,
+// backend-tls-ciphers and backend-tls-curves set that of proxied backend
+// connections, and default to the client ones.  Cipher suites are given by
+// their IANA names (eg. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), and only
+// restrict TLS 1.2 and earlier, as Go doesn't allow TLS 1.3's to be chosen.
+// Curves are X25519, P-256, P-384 and P-521.  They can't be combined with
+// tls-fips, which sets the policy itself.
+
+type tlsPolicy struct {
+	minVersion uint16
+	ciphers    []uint16
+	curves     []tls.CurveID
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+var clientTLSPolicy, backendTLSPolicy *tlsPolicy
+
+func setupTLSPolicy() {
+	global := &cfg.Pgreplicaproxy
+	if global.Tls_Fips && (global.Tls_Min_Version != "" || len(global.Tls_Ciphers) > 0 || len(global.Tls_Curves) > 0 ||
+		global.Backend_Tls_Min_Version != "" || len(global.Backend_Tls_Ciphers) > 0 || len(global.Backend_Tls_Curves) > 0) {
+		log.Fatal("tls-fips can't be combined with the tls-min-version, tls-ciphers and tls-curves options")
+	}
+
+	var err error
+	clientTLSPolicy, err = compileTLSPolicy(global.Tls_Min_Version, global.Tls_Ciphers, global.Tls_Curves)
+	if err != nil {
+		log.Fatal(err)
+	}
+	backendTLSPolicy, err = compileTLSPolicy(
+		firstNonEmpty(global.Backend_Tls_Min_Version, global.Tls_Min_Version),
+		firstNonEmptyList(global.Backend_Tls_Ciphers, global.Tls_Ciphers),
+		firstNonEmptyList(global.Backend_Tls_Curves, global.Tls_Curves))
+	if err != nil {
+		log.Fatalf("backend %v", err)
+	}
+}
+
+func compileTLSPolicy(minVersion string, ciphers, curves []string) (*tlsPolicy, error) {
+	policy := &tlsPolicy{}
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("tls-min-version must be 1.0, 1.1, 1.2 or 1.3")
+		}
+		policy.minVersion = version
+	}
+
+	suites := make(map[string]*tls.CipherSuite)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite
+	}
+	for _, name := range ciphers {
+		suite, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("tls-ciphers: unknown cipher suite %v", name)
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("tls-ciphers: %v is a TLS 1.3 cipher suite, which can't be configured", name)
+		}
+		policy.ciphers = append(policy.ciphers, suite.ID)
+	}
+
+	for _, name := range curves {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("tls-curves: unknown curve %v; expected X25519, P-256, P-384 or P-521", name)
+		}
+		policy.curves = append(policy.curves, curve)
+	}
+	return policy, nil
+}
+
+func (policy *tlsPolicy) apply(config *tls.Config) {
+	if policy == nil {
+		return
+	}
+	if policy.minVersion != 0 {
+		config.MinVersion = policy.minVersion
+	}
+	if len(policy.ciphers) > 0 {
+		config.CipherSuites = policy.ciphers
+	}
+	if len(policy.curves) > 0 {
+		config.CurvePreferences = policy.curves
+	}
+}
+
+func firstNonEmptyList(lists ...[]string) []string {
+	for _, list := range lists {
+		if len(list) > 0 {
+			return list
+		}
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"compress/flate"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Backends that are far away, or that only another pgreplicaproxy can reach,
+// can be connected to through a tunnel to that proxy.  Each [tunnel] keeps a
+// single link to its remote proxy, over mutual TLS with the cluster
+// certificates, and multiplexes the connections to its backends over it (see
+// tunnelmux.go); the health checks of those backends go through the link too.
+// The link can be deflate-compressed, to save bandwidth on WAN links.  (TLS
+// compression isn't an option: it's been removed from most TLS
+// implementations because of the CRIME attack.)  Compression has to happen
+// before encryption to be of any use, so the remote proxy connects to the
+// backends with their own sslmode on behalf of proxied sessions, while the
+// health checks negotiate TLS with the backend themselves, as usual.
+//
+// The near proxy opens a link by sending tunnelMagic followed by a flags
+// byte; the remote proxy answers 'K', and from then on both sides exchange
+// frames.  The remote proxy only connects to its own backends, directly,
+// never through another tunnel.
+
+var tunnelMagic = []byte("PGRPTUNL")
+
+const (
+	tunnelCompressed = 1 << iota
+)
+
+var tunnelConnectionsMetric = defineMetric("pgreplicaproxy_tunnel_connections_total", counterMetric,
+	"Connections to backends accepted through tunnels from other proxies.", nil, "backend")
+var tunnelBytesMetric = defineMetric("pgreplicaproxy_tunnel_bytes_total", counterMetric,
+	"Bytes written to compressed tunnels, before and after compression.", nil, "stage")
+
+var unknownTunnelTarget = errors.New("Tunnel target isn't one of this proxy's backends")
+var tunnelRefused = errors.New("Tunnel refused by the remote proxy")
+
+func init() {
+	sql.Register("postgres-tunnel", tunnelDriver{})
+}
+
+// Returns the tunnel that connections to a backend go through, if any.
+func backendTunnel(backend string) (string, *tunnelConfig) {
+	label := backendLabel(backend)
+	for name, tunnel := range cfg.Tunnel {
+		for _, member := range tunnel.Backend {
+			if member == label {
+				return name, tunnel
+			}
+		}
+	}
+	return "", nil
+}
+
+func validateTunnels() {
+	for name, tunnel := range cfg.Tunnel {
+		if tunnel.Address == "" {
+			log.Fatalf("tunnel %v: an address is required", name)
+		}
+		if clusterClientTLSConfig == nil {
+			log.Fatalf("tunnel %v: tunnels require cluster-cert, cluster-key and cluster-ca", name)
+		}
+	}
+}
+
+// The database/sql driver name for health checks of a backend.  Backends
+// with dial options are checked through the tunnel driver too, since it
+// connects with dialBackendPlain.
+func monitorDriver(backend string) string {
+	if _, tunnel := backendTunnel(backend); tunnel != nil || backendDialOptions(backend) != nil {
+		return "postgres-tunnel"
+	}
+	return "postgres"
+}
+
+// Connects to a backend without negotiating TLS, through its tunnel if it has
+// one.
+func dialBackendPlain(backend string) (net.Conn, error) {
+	if name, tunnel := backendTunnel(backend); tunnel != nil {
+		return dialTunnel(name, tunnel, backendLabel(backend), true)
+	}
+	return dialBackendSocket(backend, backendConnectTimeout(backend))
+}
+
+// The links of the configured tunnels, by tunnel name.  A link that fails is
+// replaced by a new one the next time it's needed.
+var tunnelLinks = struct {
+	sync.Mutex
+	links map[string]*tunnelLink
+}{links: make(map[string]*tunnelLink)}
+
+// Opens a connection to target (a backend's network address) through a
+// tunnel.  Unless raw is set, the remote proxy negotiates TLS with the
+// backend according to its sslmode.  A new link is connected without holding
+// tunnelLinks, so that a slow remote proxy doesn't hold up the other tunnels;
+// if another connection set one up meanwhile, that one is used instead.
+func dialTunnel(name string, tunnel *tunnelConfig, target string, raw bool) (net.Conn, error) {
+	tunnelLinks.Lock()
+	link := tunnelLinks.links[name]
+	tunnelLinks.Unlock()
+	if link == nil || link.failed() {
+		newLink, err := connectTunnelLink(tunnel)
+		if err != nil {
+			return nil, err
+		}
+		tunnelLinks.Lock()
+		link = tunnelLinks.links[name]
+		if link == nil || link.failed() {
+			link = newLink
+			tunnelLinks.links[name] = link
+			newLink = nil
+		}
+		tunnelLinks.Unlock()
+		if newLink != nil {
+			newLink.fail(io.EOF)
+		}
+	}
+
+	return link.openStream(target, raw)
+}
+
+func connectTunnelLink(tunnel *tunnelConfig) (*tunnelLink, error) {
+	dialer := &net.Dialer{Timeout: peerTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", tunnel.Address, clusterClientTLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	setKeepalive(conn)
+
+	var flags byte
+	if tunnel.Compress {
+		flags |= tunnelCompressed
+	}
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+	_, err = conn.Write(append(append([]byte{}, tunnelMagic...), flags))
+	response := make([]byte, 1)
+	if err == nil {
+		_, err = io.ReadFull(conn, response)
+	}
+	if err == nil && response[0] != 'K' {
+		err = tunnelRefused
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("Tunnel link to %v established", tunnel.Address)
+
+	var linkConn net.Conn = conn
+	if tunnel.Compress {
+		linkConn = newCompressedConn(conn)
+	}
+	return newTunnelLink(linkConn, nil), nil
+}
+
+func listenTunnel(listen string) {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln = tls.NewListener(ln, clusterServerTLSConfig)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go handleTunnelConnection(conn)
+	}
+}
+
+func handleTunnelConnection(conn net.Conn) {
+	setKeepalive(conn)
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+
+	hello := make([]byte, len(tunnelMagic)+1)
+	_, err := io.ReadFull(conn, hello)
+	if err == nil && string(hello[:len(tunnelMagic)]) != string(tunnelMagic) {
+		err = incorrectlyFormattedPacket
+	}
+	if err == nil {
+		_, err = conn.Write([]byte{'K'})
+	}
+	if err != nil {
+		if err != io.EOF {
+			logLimited("tunnel read", "tunnel from %v: %v", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("Tunnel link from %v established", conn.RemoteAddr())
+
+	var linkConn net.Conn = conn
+	if hello[len(tunnelMagic)]&tunnelCompressed != 0 {
+		linkConn = newCompressedConn(conn)
+	}
+	newTunnelLink(linkConn, serveTunnelStream)
+}
+
+// Connects a stream opened by a near proxy to the backend it asked for.
+func serveTunnelStream(stream *tunnelStream, target string, raw bool) error {
+	var backend string
+	for _, candidate := range currentBackends() {
+		if backendLabel(candidate) == target {
+			backend = candidate
+		}
+	}
+	if backend == "" {
+		return unknownTunnelTarget
+	}
+
+	var upstream net.Conn
+	var err error
+	if raw {
+		network, address := network(backend)
+		upstream, err = net.DialTimeout(network, address, cfg.Pgreplicaproxy.Connect_Timeout.Duration)
+	} else {
+		upstream, err = dialBackendDirect(backend, cfg.Pgreplicaproxy.Connect_Timeout.Duration)
+	}
+	if err != nil {
+		return err
+	}
+	incMetric(tunnelConnectionsMetric, target)
+
+	go func() {
+		defer upstream.Close()
+		defer stream.Close()
+
+		done := make(chan bool, 2)
+		go func() {
+			io.Copy(upstream, stream)
+			done <- true
+		}()
+		go func() {
+			io.Copy(stream, upstream)
+			done <- true
+		}()
+		// Either side closing ends the connection
+		<-done
+	}()
+	return nil
+}
+
+// The driver for health checks of tunnelled backends: lib/pq, connecting
+// through the tunnel.
+type tunnelDriver struct{}
+
+func (tunnelDriver) Open(backend string) (driver.Conn, error) {
+	return pq.DialOpen(tunnelDialer{backend}, backend)
+}
+
+type tunnelDialer struct {
+	backend string
+}
+
+func (d tunnelDialer) Dial(network, address string) (net.Conn, error) {
+	return dialBackendPlain(d.backend)
+}
+
+func (d tunnelDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	return dialBackendPlain(d.backend)
+}
+
+// A connection whose traffic is deflate-compressed in both directions.  Each
+// write is flushed, so that protocol messages aren't held back waiting for
+// more data.
+type compressedConn struct {
+	net.Conn
+	reader io.ReadCloser
+	writer *flate.Writer
+}
+
+func newCompressedConn(conn net.Conn) *compressedConn {
+	writer, _ := flate.NewWriter(compressedBytesCounter{conn}, flate.BestSpeed)
+	return &compressedConn{Conn: conn, reader: flate.NewReader(conn), writer: writer}
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	if n > 0 {
+		addMetric(tunnelBytesMetric, float64(n), "uncompressed")
+	}
+	return n, err
+}
+
+type compressedBytesCounter struct {
+	io.Writer
+}
+
+func (c compressedBytesCounter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	addMetric(tunnelBytesMetric, float64(n), "compressed")
+	return n, err
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// A tunnel link carries many streams, each the equivalent of a TCP connection
+// to a backend, as frames of up to maxTunnelFrame bytes:
+//
+//	type (1 byte)  stream id (4 bytes)  payload length (4 bytes)  payload
+//
+// Only the near proxy opens streams.  Each side may send up to
+// tunnelStreamWindow bytes of a stream's data that the other side hasn't
+// read yet, and tells the other side as it reads, so that one slow client
+// can't hold up the link for everyone else.  A stream whose other side sends
+// more than that is closed.
+
+const (
+	tunnelFrameOpen   = 'O' // payload: raw flag byte, then target address
+	tunnelFrameOpened = 'K'
+	tunnelFrameData   = 'D'
+	tunnelFrameWindow = 'W' // payload: bytes read since the last window frame
+	tunnelFrameClose  = 'C' // payload: an error message, if any
+)
+
+const maxTunnelFrame = 32 * 1024
+const tunnelStreamWindow = 256 * 1024
+
+var tunnelLinkClosed = errors.New("Tunnel link closed")
+var tunnelStreamClosed = errors.New("Tunnel stream closed")
+var tunnelWindowExceeded = errors.New("Tunnel stream's receive window exceeded")
+
+type tunnelLink struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*tunnelStream
+	nextID  uint32
+	err     error
+
+	// On the remote proxy, connects newly opened streams to their targets
+	serve func(stream *tunnelStream, target string, raw bool) error
+}
+
+func newTunnelLink(conn net.Conn, serve func(*tunnelStream, string, bool) error) *tunnelLink {
+	link := &tunnelLink{conn: conn, streams: make(map[uint32]*tunnelStream), serve: serve}
+	go link.readFrames()
+	return link
+}
+
+func (l *tunnelLink) failed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err != nil
+}
+
+func (l *tunnelLink) writeFrame(frameType byte, id uint32, payload []byte) error {
+	frame := make([]byte, 9, 9+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint32(frame[5:], uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	_, err := l.conn.Write(frame)
+	if err != nil {
+		l.fail(err)
+	}
+	return err
+}
+
+// Closes the link and every stream on it.
+func (l *tunnelLink) fail(err error) {
+	l.mu.Lock()
+	if l.err != nil {
+		l.mu.Unlock()
+		return
+	}
+	l.err = err
+	streams := l.streams
+	l.streams = make(map[uint32]*tunnelStream)
+	l.mu.Unlock()
+
+	l.conn.Close()
+	for _, stream := range streams {
+		stream.remoteClosed(tunnelLinkClosed)
+	}
+	if err != io.EOF {
+		log.Printf("Tunnel link with %v closed: %v", l.conn.RemoteAddr(), err)
+	}
+}
+
+func (l *tunnelLink) readFrames() {
+	header := make([]byte, 9)
+	for {
+		_, err := io.ReadFull(l.conn, header)
+		if err != nil {
+			l.fail(err)
+			return
+		}
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:])
+		length := binary.BigEndian.Uint32(header[5:])
+		if length > maxTunnelFrame {
+			l.fail(incorrectlyFormattedPacket)
+			return
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(l.conn, payload)
+		if err != nil {
+			l.fail(err)
+			return
+		}
+
+		if frameType == tunnelFrameOpen {
+			l.acceptStream(id, payload)
+			continue
+		}
+
+		l.mu.Lock()
+		stream := l.streams[id]
+		l.mu.Unlock()
+		if stream == nil {
+			// Already closed on this side
+			continue
+		}
+
+		switch frameType {
+		case tunnelFrameOpened:
+			select {
+			case stream.opened <- nil:
+			default:
+			}
+		case tunnelFrameData:
+			if !stream.received(payload) {
+				logLimited("tunnel window", "tunnel from %v: stream %v: %v", l.conn.RemoteAddr(), id, tunnelWindowExceeded)
+				l.forget(id)
+				go l.writeFrame(tunnelFrameClose, id, []byte(tunnelWindowExceeded.Error()))
+			}
+		case tunnelFrameWindow:
+			if len(payload) == 4 {
+				stream.windowOpened(int(binary.BigEndian.Uint32(payload)))
+			}
+		case tunnelFrameClose:
+			var err error = io.EOF
+			if len(payload) > 0 {
+				err = errors.New(string(payload))
+			}
+			l.forget(id)
+			stream.remoteClosed(err)
+		default:
+			l.fail(incorrectlyFormattedPacket)
+			return
+		}
+	}
+}
+
+func (l *tunnelLink) register(id uint32) (*tunnelStream, error) {
+	stream := &tunnelStream{link: l, id: id, sendWindow: tunnelStreamWindow, opened: make(chan error, 1)}
+	stream.cond = sync.NewCond(&stream.mu)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return nil, l.err
+	}
+	l.streams[id] = stream
+	return stream, nil
+}
+
+func (l *tunnelLink) forget(id uint32) {
+	l.mu.Lock()
+	delete(l.streams, id)
+	l.mu.Unlock()
+}
+
+// Opens a stream to target, and waits for the remote proxy to connect it.
+func (l *tunnelLink) openStream(target string, raw bool) (*tunnelStream, error) {
+	l.mu.Lock()
+	l.nextID++
+	id := l.nextID
+	l.mu.Unlock()
+
+	stream, err := l.register(id)
+	if err != nil {
+		return nil, err
+	}
+	var flag byte
+	if raw {
+		flag = 1
+	}
+	err = l.writeFrame(tunnelFrameOpen, id, append([]byte{flag}, target...))
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case err = <-stream.opened:
+	case <-time.After(peerTimeout):
+		err = tunnelRefused
+	}
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Handles a request from the near proxy to open a stream.
+func (l *tunnelLink) acceptStream(id uint32, payload []byte) {
+	if l.serve == nil || len(payload) < 1 {
+		go l.writeFrame(tunnelFrameClose, id, []byte(tunnelRefused.Error()))
+		return
+	}
+	stream, err := l.register(id)
+	if err != nil {
+		return
+	}
+	raw, target := payload[0] == 1, string(payload[1:])
+
+	// Connecting to the backend mustn't hold up the other streams
+	go func() {
+		err := l.serve(stream, target, raw)
+		if err != nil {
+			logLimited("tunnel stream "+target, "tunnel from %v: %v: %v", l.conn.RemoteAddr(), target, err)
+			l.forget(id)
+			l.writeFrame(tunnelFrameClose, id, []byte(err.Error()))
+			return
+		}
+		l.writeFrame(tunnelFrameOpened, id, nil)
+	}()
+}
+
+// One end of a stream, which behaves as a net.Conn.
+type tunnelStream struct {
+	link   *tunnelLink
+	id     uint32
+	opened chan error
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buffer     []byte
+	unreported int // bytes read since the last window frame
+	sendWindow int
+	err        error // set once the stream is closed on either side
+	closed     bool  // whether it was closed on this side
+
+	readDeadline, writeDeadline time.Time
+}
+
+// Buffers data received for the stream.  Returns false, closing the stream,
+// if the other side has sent more than the window allows.
+func (s *tunnelStream) received(data []byte) bool {
+	s.mu.Lock()
+	exceeded := len(s.buffer)+s.unreported+len(data) > tunnelStreamWindow
+	if exceeded {
+		s.buffer = nil
+		if s.err == nil {
+			s.err = tunnelWindowExceeded
+		}
+	} else {
+		s.buffer = append(s.buffer, data...)
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	return !exceeded
+}
+
+func (s *tunnelStream) windowOpened(n int) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+func (s *tunnelStream) remoteClosed(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	select {
+	case s.opened <- err:
+	default:
+	}
+}
+
+func (s *tunnelStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.buffer) == 0 && s.err == nil && !deadlinePassed(s.readDeadline) {
+		s.cond.Wait()
+	}
+	if len(s.buffer) == 0 {
+		err := s.err
+		if err == nil {
+			err = tunnelTimeout{}
+		}
+		s.mu.Unlock()
+		return 0, err
+	}
+	n := copy(p, s.buffer)
+	s.buffer = s.buffer[n:]
+	s.unreported += n
+	var report int
+	if s.unreported >= tunnelStreamWindow/4 {
+		report, s.unreported = s.unreported, 0
+	}
+	s.mu.Unlock()
+
+	if report > 0 {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(report))
+		s.link.writeFrame(tunnelFrameWindow, s.id, payload)
+	}
+	return n, nil
+}
+
+func (s *tunnelStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.mu.Lock()
+		for s.sendWindow == 0 && s.err == nil && !deadlinePassed(s.writeDeadline) {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			if err == io.EOF {
+				err = tunnelStreamClosed
+			}
+			return written, err
+		} else if s.sendWindow == 0 {
+			s.mu.Unlock()
+			return written, tunnelTimeout{}
+		}
+		n := len(p) - written
+		if n > s.sendWindow {
+			n = s.sendWindow
+		}
+		if n > maxTunnelFrame {
+			n = maxTunnelFrame
+		}
+		s.sendWindow -= n
+		s.mu.Unlock()
+
+		err := s.link.writeFrame(tunnelFrameData, s.id, p[written:written+n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (s *tunnelStream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	alreadyClosed := s.err != nil
+	if !alreadyClosed {
+		s.err = tunnelStreamClosed
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+
+	s.link.forget(s.id)
+	if !alreadyClosed {
+		return s.link.writeFrame(tunnelFrameClose, s.id, nil)
+	}
+	return nil
+}
+
+func (s *tunnelStream) LocalAddr() net.Addr {
+	return s.link.conn.LocalAddr()
+}
+
+func (s *tunnelStream) RemoteAddr() net.Addr {
+	return s.link.conn.RemoteAddr()
+}
+
+func (s *tunnelStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *tunnelStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	s.wakeAt(t)
+	return nil
+}
+
+func (s *tunnelStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	s.wakeAt(t)
+	return nil
+}
+
+// Wakes up blocked reads and writes at a deadline, so that they notice it.
+func (s *tunnelStream) wakeAt(t time.Time) {
+	if !t.IsZero() {
+		time.AfterFunc(t.Sub(time.Now()), s.cond.Broadcast)
+	}
+	s.cond.Broadcast()
+}
+
+func deadlinePassed(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+type tunnelTimeout struct{}
+
+func (tunnelTimeout) Error() string   { return "Tunnel stream i/o timeout" }
+func (tunnelTimeout) Timeout() bool   { return true }
+func (tunnelTimeout) Temporary() bool { return true }
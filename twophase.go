@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Two-phase commit commands (PREPARE TRANSACTION, COMMIT PREPARED and
+// ROLLBACK PREPARED) only work on the master, and the prepared transaction
+// outlives the session, so the coordinator must keep talking to the same
+// server.  In protocol-aware mode, once a session has used two-phase commit,
+// its user and database are pinned to the master: their later sessions are
+// routed there even when they ask for a replica (unless they insist with
+// target_session_attrs, or come in on a read-only listener), until the proxy
+// restarts.  Sessions can't move between backends, and the commands only
+// show up once a session is under way, so a replica session's two-phase
+// commands are refused, with an error telling the client to reconnect.  The
+// refusal is made by the replica itself: the Query or Parse message is
+// replaced by one that raises the error, so that it arrives in order with
+// the backend's other responses, whether or not the backend is busy, and the
+// extended protocol's error handling (skipping to the next Sync) applies as
+// usual.  SHOW SESSIONS marks the sessions that have used two-phase commit.
+
+const twoPhasePeekLength = 256
+
+var twoPhaseCommandsMetric = defineMetric("pgreplicaproxy_two_phase_commands_total", counterMetric,
+	"Two-phase commit commands seen in protocol-aware mode, by route and whether they were refused.", nil, "route", "refused")
+var twoPhaseSessionsPinnedMetric = defineMetric("pgreplicaproxy_two_phase_pinned_sessions_total", counterMetric,
+	"Sessions asking for a replica that were routed to the master as their user has used two-phase commit, by database.", nil, "database")
+
+// The users and databases pinned to the master for having used two-phase
+// commit, keyed by user and database.
+var twoPhasePins = struct {
+	sync.Mutex
+	pinned map[string]bool
+}{pinned: make(map[string]bool)}
+
+func twoPhasePinned(user, database string) bool {
+	twoPhasePins.Lock()
+	defer twoPhasePins.Unlock()
+	return twoPhasePins.pinned[user+"\x00"+database]
+}
+
+func pinTwoPhase(sess *session) {
+	twoPhasePins.Lock()
+	defer twoPhasePins.Unlock()
+	key := sess.user + "\x00" + sess.database
+	if !twoPhasePins.pinned[key] {
+		twoPhasePins.pinned[key] = true
+		log.Printf("session %v: user %v has used two-phase commit on database %v; pinning their sessions to the master", sess.id, sess.user, sess.database)
+	}
+}
+
+// Returns the two-phase commit command a query starts with, or "".  query
+// may be truncated.
+func twoPhaseCommand(query string) string {
+	query = skipCommentsAndSpace(query)
+	words := strings.Fields(query)
+	if len(words) < 2 {
+		return ""
+	}
+	command := strings.ToUpper(words[0]) + " " + strings.ToUpper(strings.TrimRight(words[1], ";"))
+	switch command {
+	case "PREPARE TRANSACTION", "COMMIT PREPARED", "ROLLBACK PREPARED":
+		return command
+	}
+	return ""
+}
+
+func skipCommentsAndSpace(query string) string {
+	for {
+		query = strings.TrimLeft(query, " \t\r\n")
+		switch {
+		case strings.HasPrefix(query, "--"):
+			end := strings.IndexByte(query, '\n')
+			if end == -1 {
+				return ""
+			}
+			query = query[end+1:]
+		case strings.HasPrefix(query, "/*"):
+			end := strings.Index(query, "*/")
+			if end == -1 {
+				return ""
+			}
+			query = query[end+2:]
+		default:
+			return query
+		}
+	}
+}
+
+// Returns the query text at the start of a Query or Parse message body.
+func messageQuery(msgType byte, body []byte) string {
+	if msgType == 'P' {
+		// Skip the prepared statement's name
+		_, body = readCString(body)
+	}
+	query, _ := readCString(body)
+	return query
+}
+
+const twoPhaseRefusal = `DO $pgreplicaproxy$ BEGIN RAISE EXCEPTION USING ERRCODE = '25006', ` + // read only sql transaction
+	`MESSAGE = 'Two-phase commit is only possible on the master; reconnect, and new sessions will be routed there'; END $pgreplicaproxy$`
+
+// Checks a Query or Parse message for two-phase commit commands.  Returns
+// the body of the message to send to the backend instead, if the command
+// must be refused, or nil.
+func inspectTwoPhaseCommit(sess *session, msgType byte, body []byte) []byte {
+	command := twoPhaseCommand(messageQuery(msgType, body))
+	if command == "" {
+		return nil
+	}
+
+	atomic.StoreInt32(&sess.twoPhase, 1)
+	pinTwoPhase(sess)
+	if !sess.replica {
+		incMetric(twoPhaseCommandsMetric, sess.route(), "false")
+		return nil
+	}
+	incMetric(twoPhaseCommandsMetric, sess.route(), "true")
+	logLimited("two-phase "+sess.user, "session %v: %v refused on a replica", sess.id, command)
+	var replacement []byte
+	if msgType == 'P' {
+		// The same prepared statement name, and no parameter types
+		name, _ := readCString(body)
+		replacement = append(append(replacement, name...), 0)
+	}
+	replacement = append(append(replacement, twoPhaseRefusal...), 0)
+	if msgType == 'P' {
+		replacement = append(replacement, 0, 0)
+	}
+	return replacement
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// With proxy-terminated auth, a [database "name"] section can map the users
+// that connect to it to other backend roles with user-map, given as a client
+// user name, or * for any user, followed by the backend role; the first
+// matching entry wins.  Clients still authenticate as themselves, against
+// the auth-file or auth-query, and the proxy then connects to the backend as
+// the role, with its credentials from Vault (see vault.go), or its own
+// auth-file entry (a plaintext password or an md5 hash), or its password
+// from the monitoring passfile, or an RDS IAM token.  Client-side statistics
+// and limits still see the client's user name.
+
+type userMapping struct {
+	clientUser  string
+	backendRole string
+}
+
+var userMappings map[string][]userMapping
+
+func setupUserMap() {
+	mappings := make(map[string][]userMapping)
+	for database, db := range cfg.Database {
+		for _, entry := range db.User_Map {
+			fields := strings.Fields(entry)
+			if len(fields) != 2 {
+				log.Fatalf("database %v: user-map must be a user name, or *, followed by a backend role: %v", database, entry)
+			}
+			if !proxyTerminatedAuth() {
+				log.Fatalf("database %v: user-map requires auth-type md5 or scram-sha-256", database)
+			}
+			mappings[database] = append(mappings[database], userMapping{fields[0], fields[1]})
+		}
+	}
+	userMappings = mappings
+}
+
+// Returns the backend role that a user connects to a database as, or "" if
+// it isn't mapped.
+func mappedBackendRole(database, user string) string {
+	for _, mapping := range userMappings[database] {
+		if mapping.clientUser == user || mapping.clientUser == "*" {
+			return mapping.backendRole
+		}
+	}
+	return ""
+}
+
+// Returns the credentials to authenticate to a backend as a mapped role.
+func backendRoleCredentials(backend, database, role string) (*authCredentials, error) {
+	credentials := &authCredentials{user: role}
+	secret := authSecret(role)
+	switch {
+	case vaultHasRole(role):
+		credentials.user, credentials.password, _ = vaultRoleCredentials(role)
+	case strings.HasPrefix(secret, "md5") && len(secret) == 35:
+		credentials.md5Hash = secret
+	case secret != "" && !isPasswordHash(secret):
+		credentials.password = secret
+	default:
+		o := connectionOptions(backend)
+		o.Set("user", role)
+		o.Set("dbname", database)
+		credentials.password = lookupBackendPassword(o)
+	}
+	if credentials.password != "" {
+		credentials.md5Hash = md5Password(credentials.password, credentials.user)
+	}
+	if credentials.md5Hash == "" {
+		return nil, fmt.Errorf("no password or md5 hash is known for backend role %v", role)
+	}
+	return credentials, nil
+}
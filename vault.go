@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend credentials can be read from HashiCorp Vault rather than kept in
+// connection strings or password files.  vault-monitor-secret is the path of
+// a secret holding the health check credentials, and each vault-role-secret,
+// a backend role followed by a path, holds a role's credentials for user-map
+// and auth-user.  The paths can be dynamic database secrets
+// (database/creds/name), static ones (database/static-creds/name), or KV
+// secrets with username and password keys.  They're read at startup, where
+// failing is fatal, and again when two thirds of their lease or rotation
+// period has passed; renewable leases are renewed instead, until Vault
+// refuses.  The Vault token is read from vault-token-file, such as a Vault
+// Agent sink, before each request, or else from VAULT_TOKEN.
+
+const vaultTimeout = 10 * time.Second
+const vaultMinRefresh = 10 * time.Second
+const defaultVaultRefresh = 5 * time.Minute
+
+var vaultRequestsMetric = defineMetric("pgreplicaproxy_vault_requests_total", counterMetric,
+	"Vault secret reads and lease renewals, by result.", nil, "result")
+
+type vaultCredential struct {
+	user      string
+	password  string
+	leaseID   string
+	renewable bool
+	refresh   time.Duration
+}
+
+type vaultSecretConfig struct {
+	role string // "" for the monitor credentials
+	path string
+}
+
+var vaultCredentials = struct {
+	sync.Mutex
+	byRole  map[string]*vaultCredential
+	monitor *vaultCredential
+}{byRole: make(map[string]*vaultCredential)}
+
+var vaultClient *http.Client
+
+func setupVault() {
+	global := &cfg.Pgreplicaproxy
+	var secrets []vaultSecretConfig
+	if global.Vault_Monitor_Secret != "" {
+		secrets = append(secrets, vaultSecretConfig{"", global.Vault_Monitor_Secret})
+	}
+	for _, entry := range global.Vault_Role_Secret {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			log.Fatalf("vault-role-secret must be a backend role followed by a secret path: %v", entry)
+		}
+		secrets = append(secrets, vaultSecretConfig{fields[0], fields[1]})
+	}
+	if len(secrets) == 0 {
+		return
+	}
+	if global.Vault_Address == "" {
+		log.Fatal("vault-monitor-secret and vault-role-secret require vault-address")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if global.Vault_Ca != "" {
+		pem, err := ioutil.ReadFile(global.Vault_Ca)
+		if err != nil {
+			log.Fatalf("vault-ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("vault-ca: no certificates found in %v", global.Vault_Ca)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	vaultClient = &http.Client{Timeout: vaultTimeout, Transport: transport}
+
+	for _, secret := range secrets {
+		credential, err := readVaultSecret(secret.path)
+		if err != nil {
+			log.Fatalf("vault: %v: %v", secret.path, err)
+		}
+		storeVaultCredential(secret.role, credential)
+		go refreshVaultSecret(secret, credential)
+	}
+}
+
+func storeVaultCredential(role string, credential *vaultCredential) {
+	vaultCredentials.Lock()
+	defer vaultCredentials.Unlock()
+	if role == "" {
+		vaultCredentials.monitor = credential
+	} else {
+		vaultCredentials.byRole[role] = credential
+	}
+}
+
+// Returns the health check credentials from Vault, if vault-monitor-secret is
+// set.
+func vaultMonitorCredentials() (string, string, bool) {
+	vaultCredentials.Lock()
+	defer vaultCredentials.Unlock()
+	if vaultCredentials.monitor == nil {
+		return "", "", false
+	}
+	return vaultCredentials.monitor.user, vaultCredentials.monitor.password, true
+}
+
+// Returns a backend role's credentials from Vault, if it has a
+// vault-role-secret.  Dynamic secrets have their own user name.
+func vaultRoleCredentials(role string) (string, string, bool) {
+	vaultCredentials.Lock()
+	defer vaultCredentials.Unlock()
+	credential := vaultCredentials.byRole[role]
+	if credential == nil {
+		return "", "", false
+	}
+	return credential.user, credential.password, true
+}
+
+// Keeps a secret's credentials current: renews its lease while Vault allows,
+// and reads it again otherwise.
+func refreshVaultSecret(secret vaultSecretConfig, credential *vaultCredential) {
+	for {
+		time.Sleep(credential.refresh)
+		if credential.renewable {
+			refresh, err := renewVaultLease(credential.leaseID, credential.refresh*3/2)
+			if err == nil {
+				credential.refresh = refresh
+				continue
+			}
+			log.Printf("vault: renewing the lease of %v failed; reading it again: %v", secret.path, err)
+		}
+		latest, err := readVaultSecret(secret.path)
+		if err != nil {
+			log.Printf("vault: %v: %v", secret.path, err)
+			credential.renewable = false
+			credential.refresh = vaultMinRefresh
+			continue
+		}
+		storeVaultCredential(secret.role, latest)
+		credential = latest
+	}
+}
+
+type vaultResponse struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Errors        []string               `json:"errors"`
+}
+
+func readVaultSecret(path string) (*vaultCredential, error) {
+	response, err := vaultRequest("GET", strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	data := response.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		// A KV version 2 secret
+		data = nested
+	}
+	user, _ := data["username"].(string)
+	password, _ := data["password"].(string)
+	if user == "" || password == "" {
+		return nil, fmt.Errorf("the secret has no username and password")
+	}
+
+	credential := &vaultCredential{user: user, password: password, leaseID: response.LeaseID, renewable: response.Renewable && response.LeaseID != ""}
+	period := time.Duration(response.LeaseDuration) * time.Second
+	if ttl, ok := data["ttl"].(float64); ok && period == 0 {
+		// A static secret's time until its next rotation
+		period = time.Duration(ttl) * time.Second
+	}
+	credential.refresh = vaultRefresh(period)
+	return credential, nil
+}
+
+// Renews a lease, returning when it should next be renewed.
+func renewVaultLease(leaseID string, increment time.Duration) (time.Duration, error) {
+	body, _ := json.Marshal(map[string]interface{}{"lease_id": leaseID, "increment": int(increment.Seconds())})
+	response, err := vaultRequest("PUT", "sys/leases/renew", body)
+	if err != nil {
+		return 0, err
+	}
+	if response.LeaseDuration <= 0 {
+		return 0, fmt.Errorf("the lease can't be extended any further")
+	}
+	return vaultRefresh(time.Duration(response.LeaseDuration) * time.Second), nil
+}
+
+func vaultRefresh(period time.Duration) time.Duration {
+	refresh := period * 2 / 3
+	if period <= 0 {
+		refresh = defaultVaultRefresh
+	}
+	if refresh < vaultMinRefresh {
+		refresh = vaultMinRefresh
+	}
+	return refresh
+}
+
+func vaultRequest(method, path string, body []byte) (*vaultResponse, error) {
+	token, err := vaultToken()
+	if err != nil {
+		incMetric(vaultRequestsMetric, "error")
+		return nil, err
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(cfg.Pgreplicaproxy.Vault_Address, "/")+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		incMetric(vaultRequestsMetric, "error")
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		incMetric(vaultRequestsMetric, "error")
+		return nil, err
+	}
+	defer resp.Body.Close()
+	response := &vaultResponse{}
+	err = json.NewDecoder(resp.Body).Decode(response)
+	if resp.StatusCode != http.StatusOK {
+		incMetric(vaultRequestsMetric, "error")
+		if err == nil && len(response.Errors) > 0 {
+			return nil, fmt.Errorf("Vault returned %v: %v", resp.Status, strings.Join(response.Errors, "; "))
+		}
+		return nil, fmt.Errorf("Vault returned %v", resp.Status)
+	}
+	if err != nil {
+		incMetric(vaultRequestsMetric, "error")
+		return nil, err
+	}
+	incMetric(vaultRequestsMetric, "ok")
+	return response, nil
+}
+
+func vaultToken() (string, error) {
+	if file := cfg.Pgreplicaproxy.Vault_Token_File; file != "" {
+		token, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	return "", fmt.Errorf("no Vault token: set vault-token-file or VAULT_TOKEN")
+}
+
+func vaultHasRole(role string) bool {
+	_, _, ok := vaultRoleCredentials(role)
+	return ok
+}
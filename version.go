@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A database's [database] section can restrict its sessions to backends
+// whose server version is within min-server-version and max-server-version,
+// eg. "14" or "9.6", so that during a mixed-version upgrade an application
+// never silently lands on a version it doesn't support.  A maximum that only
+// gives the major version includes all of its minor versions.  The backends'
+// versions (server_version_num) are found by the health checks; a backend
+// whose version isn't known yet is treated as outside any window.
+
+type serverVersionWindow struct {
+	min, max int
+
+	// As configured, for error messages
+	minText, maxText string
+}
+
+var serverVersionWindows = make(map[string]serverVersionWindow)
+
+var backendVersions = struct {
+	sync.Mutex
+	versions map[string]int
+}{versions: make(map[string]int)}
+
+func setupServerVersionWindows() {
+	for database, db := range cfg.Database {
+		if db.Min_Server_Version == "" && db.Max_Server_Version == "" {
+			continue
+		}
+		window := serverVersionWindow{minText: db.Min_Server_Version, maxText: db.Max_Server_Version}
+		var err error
+		if db.Min_Server_Version != "" {
+			window.min, err = parseServerVersion(db.Min_Server_Version, false)
+			if err != nil {
+				log.Fatalf("database %v: min-server-version: %v", database, err)
+			}
+		}
+		if db.Max_Server_Version != "" {
+			window.max, err = parseServerVersion(db.Max_Server_Version, true)
+			if err != nil {
+				log.Fatalf("database %v: max-server-version: %v", database, err)
+			}
+		}
+		serverVersionWindows[database] = window
+	}
+}
+
+// Converts a version such as "9.6", "9.6.3", "14" or "14.5" to the
+// server_version_num format.  With upper, the unspecified minor version is
+// the last one rather than the first.
+func parseServerVersion(version string, upper bool) (int, error) {
+	var parts []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 99 {
+			return 0, fmt.Errorf("invalid version %q", version)
+		}
+		parts = append(parts, n)
+	}
+
+	// Before 10, the major version has two parts
+	majorParts := 1
+	if parts[0] < 10 {
+		majorParts = 2
+	}
+	if len(parts) < majorParts || len(parts) > majorParts+1 {
+		return 0, fmt.Errorf("invalid version %q", version)
+	}
+	minor := 0
+	if len(parts) > majorParts {
+		minor = parts[majorParts]
+	} else if upper {
+		minor = 99
+	}
+	if majorParts == 2 {
+		return parts[0]*10000 + parts[1]*100 + minor, nil
+	}
+	return parts[0]*10000 + minor, nil
+}
+
+// Records a backend's server version, from its health check connection.
+func recordServerVersion(db *sql.DB, backend string) {
+	var versionNum string
+	err := db.QueryRow("SHOW server_version_num").Scan(&versionNum)
+	if err == nil {
+		var num int
+		num, err = strconv.Atoi(versionNum)
+		if err == nil {
+			backendVersions.Lock()
+			backendVersions.versions[backend] = num
+			backendVersions.Unlock()
+			return
+		}
+	}
+	logLimited("version "+backend, "%v: server version unknown: %v", backendLabel(backend), err)
+}
+
+// Narrows the backends allowed for a database's sessions (nil for any) to
+// those within its server version window.  Returns allowed unchanged if
+// the database has no window.
+func serverVersionAllowed(database string, allowed map[string]bool) map[string]bool {
+	window, ok := serverVersionWindows[database]
+	if !ok {
+		return allowed
+	}
+
+	backendVersions.Lock()
+	defer backendVersions.Unlock()
+	narrowed := make(map[string]bool)
+	for _, backend := range currentBackends() {
+		label := backendLabel(backend)
+		if allowed != nil && !allowed[label] {
+			continue
+		}
+		version, known := backendVersions.versions[backend]
+		if known && version >= window.min && (window.max == 0 || version <= window.max) {
+			narrowed[label] = true
+		}
+	}
+	return narrowed
+}
+
+// Describes a database's server version window for error messages, or ""
+// if it has none.
+func serverVersionWindowDescription(database string) string {
+	window, ok := serverVersionWindows[database]
+	if !ok {
+		return ""
+	}
+	switch {
+	case window.maxText == "":
+		return fmt.Sprintf("server version %v or later", window.minText)
+	case window.minText == "":
+		return fmt.Sprintf("server version %v or earlier", window.maxText)
+	}
+	return fmt.Sprintf("server version between %v and %v", window.minText, window.maxText)
+}
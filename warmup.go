@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// When a backend is promoted, or comes back after being down, the proxy can
+// warm its cache before routing clients to it, so that the first clients
+// don't all hit a cold cache at once.  The warmup-query statements are run
+// over the monitoring connection, and then the warmup-script is run, with
+// the backend's connection string in PGREPLICAPROXY_BACKEND and its new role
+// (master or replica) in PGREPLICAPROXY_ROLE.  Warm-up is bounded by
+// warmup-timeout, after which the backend is used regardless.
+
+const defaultWarmupTimeout = 30 * time.Second
+
+var warmupDurationMetric = defineMetric("pgreplicaproxy_backend_warmup_duration_seconds", histogramMetric,
+	"Time spent warming backends before routing clients to them.", latencyBuckets, "backend", "result")
+
+func warmupConfigured() bool {
+	return len(cfg.Pgreplicaproxy.Warmup_Query) > 0 || cfg.Pgreplicaproxy.Warmup_Script != ""
+}
+
+func warmupTimeout() time.Duration {
+	if cfg.Pgreplicaproxy.Warmup_Timeout.Duration > 0 {
+		return cfg.Pgreplicaproxy.Warmup_Timeout.Duration
+	}
+	return defaultWarmupTimeout
+}
+
+// Runs the warm-up queries and script against a backend that's about to
+// become eligible for traffic in the given role.
+func warmBackend(db *sql.DB, backend string, status int) {
+	if !warmupConfigured() {
+		return
+	}
+
+	role := "replica"
+	if status == StatusMaster {
+		role = "master"
+	}
+	label := backendLabel(backend)
+	log.Printf("%v Warming up before routing %v connections", label, role)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), warmupTimeout())
+	defer cancel()
+
+	result := "ok"
+	for _, query := range cfg.Pgreplicaproxy.Warmup_Query {
+		_, err := db.ExecContext(ctx, query)
+		if err != nil {
+			log.Printf("%v Warm-up query failed: %v", label, err)
+			result = "error"
+			if ctx.Err() != nil {
+				break
+			}
+		}
+	}
+
+	if cfg.Pgreplicaproxy.Warmup_Script != "" && ctx.Err() == nil {
+		cmd := exec.CommandContext(ctx, cfg.Pgreplicaproxy.Warmup_Script)
+		cmd.Env = append(os.Environ(), "PGREPLICAPROXY_BACKEND="+backend, "PGREPLICAPROXY_ROLE="+role)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Printf("%v Warm-up script failed: %v: %s", label, err, output)
+			result = "error"
+		}
+	}
+
+	if ctx.Err() != nil {
+		result = "timeout"
+	}
+	observeMetric(warmupDurationMetric, time.Since(start).Seconds(), label, result)
+	log.Printf("%v Warm-up finished after %v (%v)", label, time.Since(start), result)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"container/ring"
+	"log"
+)
+
+// A [backend "address"] section's weight (default 1) sets the replica's share
+// of the sessions handed out in rotation, so that a large replica can take
+// more than a small reporting one: a replica of weight 3 gets three sessions
+// for each one of a replica of weight 1.  The rotation is smooth, as nginx's
+// is, interleaving the replicas rather than sending each its sessions in a
+// burst.  With response-time-weighting, the weights multiply those derived
+// from response times.  A weight of 0 can't be told from an unset one, so it
+// means the default too; a replica can't be weighted out of the rotation.
+
+// Returns a backend's configured weight.
+func backendWeight(backend string) int {
+	if options := backendDialOptions(backend); options != nil && options.Weight > 0 {
+		return options.Weight
+	}
+	return 1
+}
+
+func replicaWeightsConfigured() bool {
+	for _, options := range cfg.Backend {
+		if options.Weight > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func validateBackendWeights() {
+	for address, options := range cfg.Backend {
+		if options.Weight < 0 {
+			log.Fatalf("backend %v: weight must be positive, or 0 for the default", address)
+		}
+	}
+}
+
+// Picks the next replica from the ring by smooth weighted round-robin, among
+// those in allowed unless it's nil.  credits holds each replica's running
+// credit between calls.  Returns the ring positioned at the chosen replica,
+// or nil if none is allowed.
+func nextWeightedMember(replicas *ring.Ring, allowed map[string]bool, credits map[string]int) *ring.Ring {
+	var best *ring.Ring
+	total := 0
+	for i, r := 0, replicas; i < replicas.Len(); i, r = i+1, r.Next() {
+		backend := r.Value.(string)
+		if allowed != nil && !allowed[backendLabel(backend)] {
+			continue
+		}
+		weight := backendWeight(backend)
+		credits[backend] += weight
+		total += weight
+		if best == nil || credits[backend] > credits[best.Value.(string)] {
+			best = r
+		}
+	}
+	if best != nil {
+		credits[best.Value.(string)] -= total
+	}
+	return best
+}
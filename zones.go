@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+)
+
+// Backends can be labelled with the zone (or region) they run in, by a
+// [backend "address"] section's zone, and replica sessions then prefer the
+// replicas in their client's zone: the zone of the first client-zone entry,
+// a client network followed by a zone, that matches the client's address,
+// or else the proxy's own zone.  Remote replicas are only used when none in
+// the zone is available.  The preference applies within replica groups and
+// routing rules' replicas, which are preferences too.
+
+type clientZone struct {
+	network *net.IPNet
+	zone    string
+}
+
+var clientZones []clientZone
+
+func setupZones() {
+	var zones []clientZone
+	for _, entry := range cfg.Pgreplicaproxy.Client_Zone {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			log.Fatalf("client-zone must be a client network followed by a zone: %v", entry)
+		}
+		client := fields[0]
+		if !strings.Contains(client, "/") {
+			if strings.Contains(client, ":") {
+				client += "/128"
+			} else {
+				client += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			log.Fatalf("client-zone: %v", err)
+		}
+		zones = append(zones, clientZone{network, fields[1]})
+	}
+	clientZones = zones
+}
+
+// Returns the zone whose replicas a client's sessions prefer, or "" if none.
+func clientZoneOf(addr net.Addr) string {
+	if ip := net.ParseIP(clientIP(addr)); ip != nil {
+		for _, zone := range clientZones {
+			if zone.network.Contains(ip) {
+				return zone.zone
+			}
+		}
+	}
+	return cfg.Pgreplicaproxy.Zone
+}
+
+// Returns the network addresses of the backends in a zone, narrowed to
+// members unless it's nil, or nil if the zone has none.
+func zoneMembers(zone string, members map[string]bool) map[string]bool {
+	var local map[string]bool
+	for address, options := range cfg.Backend {
+		if options.Zone != zone || (members != nil && !members[address]) {
+			continue
+		}
+		if local == nil {
+			local = make(map[string]bool)
+		}
+		local[address] = true
+	}
+	return local
+}
+
+// Requests a replica in the client's zone, among members unless it's nil.
+// Returns nil if zones aren't configured or none there is available.
+func requestLocalReplica(requestChannel chan<- serverRequest, cluster, members map[string]bool, addr net.Addr, affinity string) (*string, error) {
+	zone := clientZoneOf(addr)
+	if zone == "" {
+		return nil, nil
+	}
+	local := zoneMembers(zone, members)
+	if local == nil {
+		return nil, nil
+	}
+	backend, err := requestBackendWithAffinity(requestChannel, cluster, local, true, affinity)
+	if err == nil && backend == nil {
+		logDebug("%v: no replica in zone %v is available", addr, zone)
+	}
+	return backend, err
+}